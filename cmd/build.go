@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+type buildCmd struct {
+	output   string
+	strip    bool
+	optimize int
+	flagSet  *pflag.FlagSet
+}
+
+func (cmd *buildCmd) flags() error {
+	cmd.flagSet = pflag.NewFlagSet("build", pflag.ExitOnError)
+	cmd.flagSet.StringVarP(&cmd.output, "output", "o", "out.luafc", "file to write the compiled chunk to")
+	cmd.flagSet.BoolVarP(&cmd.strip, "strip", "s", false, "strip debug information like line numbers and local names")
+	cmd.flagSet.IntVarP(&cmd.optimize, "optimize", "O", 0, "optimization level of the compiled bytecode 0-2")
+	cmd.flagSet.Usage = cmd.usage
+	return cmd.flagSet.Parse(os.Args[2:])
+}
+
+func (cmd *buildCmd) usage() {
+	fmt.Fprint(os.Stderr, "usage: luaf build [options] <main.lua> [modules.lua...]\n")
+	fmt.Fprint(os.Stderr, "\nThe first file is the entrypoint, any other files are bundled in as modules\n")
+	fmt.Fprint(os.Stderr, "that can be required by their module name. mod/init.lua is required as mod.\n\n")
+	cmd.flagSet.PrintDefaults()
+}
+
+func (cmd *buildCmd) run() error {
+	paths := cmd.flagSet.Args()
+	if len(paths) == 0 {
+		cmd.usage()
+		return errors.New("no input files")
+	}
+	fn, err := compileFiles(paths, parse.OptLevel(cmd.optimize))
+	if err != nil {
+		return err
+	}
+	data, err := fn.Dump(cmd.strip)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cmd.output, data, 0o644)
+}
+
+// compileFiles parses all of the paths at the optimization level and combines
+// them into a single chunk where the first path is the main chunk and the rest
+// are modules.
+func compileFiles(paths []string, level parse.OptLevel) (*parse.FnProto, error) {
+	mode := parse.ModeText | parse.ModeBinary | level.Mode()
+	main, err := parse.File(paths[0], mode)
+	if err != nil {
+		return nil, err
+	} else if len(paths) == 1 {
+		return main, nil
+	}
+	modules := map[string]*parse.FnProto{}
+	for _, path := range paths[1:] {
+		name := moduleName(path)
+		if _, found := modules[name]; found {
+			return nil, fmt.Errorf("module %q defined more than once", name)
+		}
+		fn, err := parse.File(path, mode)
+		if err != nil {
+			return nil, err
+		}
+		modules[name] = fn
+	}
+	return parse.Combine(main, modules)
+}
+
+// moduleName converts a file path into the name it would be required with, so
+// ./lib/util.lua is lib.util and lib/util/init.lua is also lib.util.
+func moduleName(path string) string {
+	name := strings.TrimSuffix(filepath.ToSlash(filepath.Clean(path)), filepath.Ext(path))
+	name = strings.TrimSuffix(name, "/init")
+	return strings.ReplaceAll(name, "/", ".")
+}
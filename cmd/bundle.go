@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/tanema/luaf/internal/parse"
+	"github.com/tanema/luaf/internal/runtime"
+)
+
+// bundleMagic marks the end of an executable that has a compiled chunk appended
+// to it. The trailer is the magic followed by the length of the chunk.
+const (
+	bundleMagic       = "\x1bLuafBun"
+	bundleTrailerSize = len(bundleMagic) + 8
+)
+
+type bundleCmd struct {
+	output  string
+	strip   bool
+	flagSet *pflag.FlagSet
+}
+
+func (cmd *bundleCmd) flags() error {
+	cmd.flagSet = pflag.NewFlagSet("bundle", pflag.ExitOnError)
+	cmd.flagSet.StringVarP(&cmd.output, "output", "o", "", "executable to write, defaults to the name of the main script")
+	cmd.flagSet.BoolVarP(&cmd.strip, "strip", "s", false, "strip debug information like line numbers and local names")
+	cmd.flagSet.Usage = cmd.usage
+	return cmd.flagSet.Parse(os.Args[2:])
+}
+
+func (cmd *bundleCmd) usage() {
+	fmt.Fprint(os.Stderr, "usage: luaf bundle [options] <main.lua>\n")
+	fmt.Fprint(os.Stderr, "\nCreates a single executable with the runtime, main script and every module it\n")
+	fmt.Fprint(os.Stderr, "requires with a string literal. All arguments are passed through to the script.\n\n")
+	cmd.flagSet.PrintDefaults()
+}
+
+func (cmd *bundleCmd) run() error {
+	args := cmd.flagSet.Args()
+	if len(args) != 1 {
+		cmd.usage()
+		return errors.New("expected a single main script")
+	}
+	mainPath := args[0]
+	if cmd.output == "" {
+		cmd.output = strings.TrimSuffix(filepath.Base(mainPath), filepath.Ext(mainPath))
+	}
+
+	main, err := parse.File(mainPath, parse.ModeText|parse.ModeBinary)
+	if err != nil {
+		return err
+	}
+	modules, err := resolveRequires(main, []string{".", filepath.Dir(mainPath)})
+	if err != nil {
+		return err
+	}
+	fn := main
+	if len(modules) > 0 {
+		if fn, err = parse.Combine(main, modules); err != nil {
+			return err
+		}
+	}
+	chunk, err := fn.Dump(cmd.strip)
+	if err != nil {
+		return err
+	}
+
+	exe, err := currentExecutable()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cmd.output, appendBundle(exe, chunk), 0o755)
+}
+
+// appendBundle appends the chunk and the trailer that points at it to exe.
+func appendBundle(exe, chunk []byte) []byte {
+	out := append(exe, chunk...)
+	out = append(out, bundleMagic...)
+	return binary.LittleEndian.AppendUint64(out, uint64(len(chunk)))
+}
+
+// resolveRequires follows every require with a string literal, through all of the
+// required modules, to find the files that need to be bundled. Modules that are
+// built into the runtime are skipped and modules that cannot be found are warned
+// about because they may still be available on the machine that runs the bundle.
+func resolveRequires(main *parse.FnProto, dirs []string) (map[string]*parse.FnProto, error) {
+	modules := map[string]*parse.FnProto{}
+	queue := main.Requires()
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if _, found := modules[name]; found || runtime.IsBuiltinModule(name) {
+			continue
+		}
+		path, found := findModule(name, dirs)
+		if !found {
+			fmt.Fprintf(os.Stderr, "warning: could not find module %q to bundle\n", name)
+			continue
+		}
+		fn, err := parse.File(path, parse.ModeText|parse.ModeBinary)
+		if err != nil {
+			return nil, err
+		}
+		modules[name] = fn
+		queue = append(queue, fn.Requires()...)
+	}
+	return modules, nil
+}
+
+func findModule(name string, dirs []string) (string, bool) {
+	modPath := filepath.FromSlash(strings.ReplaceAll(name, ".", "/"))
+	for _, dir := range dirs {
+		for _, candidate := range []string{modPath + ".lua", filepath.Join(modPath, "init.lua")} {
+			path := filepath.Join(dir, candidate)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				return path, true
+			}
+		}
+	}
+	return "", false
+}
+
+// currentExecutable returns the running luaf binary without any bundled chunk so
+// that bundling from a bundle does not stack chunks.
+func currentExecutable() ([]byte, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	exe, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return stripBundle(exe), nil
+}
+
+// stripBundle removes the bundled chunk and trailer from exe if it has them.
+func stripBundle(exe []byte) []byte {
+	if len(exe) >= bundleTrailerSize {
+		end := int64(len(exe) - bundleTrailerSize)
+		if size, found := bundleSize(exe[end:], end); found {
+			return exe[:end-size]
+		}
+	}
+	return exe
+}
+
+// openBundle checks if the running executable has a chunk bundled into it and
+// returns it, or nil if there is none. Only the trailer is read when there is no
+// bundle so that this stays cheap for the plain luaf binary.
+func openBundle() ([]byte, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	exe, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = exe.Close() }()
+	info, err := exe.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return readBundle(exe, info.Size())
+}
+
+// readBundle reads the chunk bundled at the end of an executable of size bytes,
+// or returns nil if it has no trailer.
+func readBundle(exe io.ReaderAt, size int64) ([]byte, error) {
+	if size < int64(bundleTrailerSize) {
+		return nil, nil
+	}
+	end := size - int64(bundleTrailerSize)
+	trailer := make([]byte, bundleTrailerSize)
+	if _, err := exe.ReadAt(trailer, end); err != nil {
+		return nil, err
+	}
+	chunkSize, found := bundleSize(trailer, end)
+	if !found {
+		return nil, nil
+	}
+	chunk := make([]byte, chunkSize)
+	if _, err := exe.ReadAt(chunk, end-chunkSize); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// bundleSize reads the size of the bundled chunk from the trailer, limit is the
+// space available before the trailer so a corrupt size is never trusted.
+func bundleSize(trailer []byte, limit int64) (int64, bool) {
+	if !bytes.HasPrefix(trailer, []byte(bundleMagic)) {
+		return 0, false
+	}
+	size := binary.LittleEndian.Uint64(trailer[len(bundleMagic):])
+	if size > uint64(limit) {
+		return 0, false
+	}
+	return int64(size), true
+}
+
+// runBundle runs a bundled chunk, all command line arguments are passed to the
+// script as they would be after -- with luaf.
+func runBundle(chunk []byte, args []string) error {
+	fn, err := parse.Parse(os.Args[0], bytes.NewReader(chunk), parse.ModeBinary)
+	if err != nil {
+		return err
+	}
+	vm, err := runtime.New(context.Background(), nil, append([]string{os.Args[0], "--"}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = vm.Close() }()
+	_, err = vm.Eval(fn)
+	return err
+}
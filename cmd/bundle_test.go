@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tanema/luaf/internal/parse"
+	"github.com/tanema/luaf/internal/runtime"
+)
+
+func TestBundle(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeFile := func(name, src string) string {
+		t.Helper()
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(src), 0o600))
+		return path
+	}
+	mainPath := writeFile("main.lua", `
+		local greet = require("bundled.greet")
+		local str = require("string")
+		return str.upper(greet("bundle"))
+	`)
+	writeFile("bundled/greet/init.lua", `
+		local fmt = require("bundled.fmt")
+		return function(name) return fmt("hello %s", name) end
+	`)
+	writeFile("bundled/fmt.lua", `return string.format`)
+
+	t.Run("resolves requires through modules", func(t *testing.T) {
+		t.Parallel()
+		main, err := parse.File(mainPath, parse.ModeText)
+		require.NoError(t, err)
+		modules, err := resolveRequires(main, []string{dir})
+		require.NoError(t, err)
+		assert.Len(t, modules, 2)
+		assert.Contains(t, modules, "bundled.greet")
+		assert.Contains(t, modules, "bundled.fmt")
+	})
+
+	t.Run("round trips a bundled chunk", func(t *testing.T) {
+		t.Parallel()
+		main, err := parse.File(mainPath, parse.ModeText)
+		require.NoError(t, err)
+		modules, err := resolveRequires(main, []string{dir})
+		require.NoError(t, err)
+		fn, err := parse.Combine(main, modules)
+		require.NoError(t, err)
+		chunk, err := fn.Dump(true)
+		require.NoError(t, err)
+
+		exe := []byte("not really an executable")
+		bundled := appendBundle(bytes.Clone(exe), chunk)
+		read, err := readBundle(bytes.NewReader(bundled), int64(len(bundled)))
+		require.NoError(t, err)
+		assert.Equal(t, chunk, read)
+		assert.Equal(t, exe, stripBundle(bundled))
+
+		loaded, err := parse.Parse("bundle", bytes.NewReader(read), parse.ModeBinary)
+		require.NoError(t, err)
+		vm, err := runtime.New(context.Background(), nil)
+		require.NoError(t, err)
+		res, err := vm.Eval(loaded)
+		require.NoError(t, err)
+		assert.Equal(t, []any{"HELLO BUNDLE"}, res)
+	})
+
+	t.Run("rebundling replaces the chunk", func(t *testing.T) {
+		t.Parallel()
+		exe := []byte("exe")
+		bundled := appendBundle(stripBundle(appendBundle(bytes.Clone(exe), []byte("first"))), []byte("second"))
+		read, err := readBundle(bytes.NewReader(bundled), int64(len(bundled)))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("second"), read)
+		assert.Equal(t, exe, stripBundle(bundled))
+	})
+
+	t.Run("ignores executables without a bundle", func(t *testing.T) {
+		t.Parallel()
+		for _, exe := range [][]byte{
+			{},
+			[]byte("a plain executable that is long enough for a trailer"),
+			binary.LittleEndian.AppendUint64([]byte("x"+bundleMagic), 100),
+		} {
+			read, err := readBundle(bytes.NewReader(exe), int64(len(exe)))
+			require.NoError(t, err)
+			assert.Nil(t, read)
+			assert.Equal(t, exe, stripBundle(exe))
+		}
+	})
+
+	t.Run("current executable has no bundle", func(t *testing.T) {
+		t.Parallel()
+		exe, err := currentExecutable()
+		require.NoError(t, err)
+		path, err := os.Executable()
+		require.NoError(t, err)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Len(t, exe, int(info.Size()))
+		chunk, err := openBundle()
+		require.NoError(t, err)
+		assert.Nil(t, chunk)
+	})
+}
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/tanema/luaf/internal/conf"
+	"github.com/tanema/luaf/internal/parse"
+)
+
+type disasmCmd struct {
+	json     bool
+	optimize int
+	flagSet  *pflag.FlagSet
+	sources  map[string][]string
+}
+
+func (cmd *disasmCmd) flags() error {
+	cmd.flagSet = pflag.NewFlagSet("disasm", pflag.ExitOnError)
+	cmd.flagSet.BoolVar(&cmd.json, "json", false, "output the disassembly as json")
+	cmd.flagSet.IntVarP(&cmd.optimize, "optimize", "O", 0, "optimization level of the disassembled bytecode 0-2")
+	cmd.flagSet.Usage = cmd.usage
+	return cmd.flagSet.Parse(os.Args[2:])
+}
+
+func (cmd *disasmCmd) usage() {
+	fmt.Fprint(os.Stderr, "usage: luaf disasm [options] <file.lua|file.luafc>\n")
+	fmt.Fprint(os.Stderr, "\nSource lines are shown alongside the instructions when the source file can be found.\n\n")
+	cmd.flagSet.PrintDefaults()
+}
+
+func (cmd *disasmCmd) run() error {
+	paths := cmd.flagSet.Args()
+	if len(paths) != 1 {
+		cmd.usage()
+		return errors.New("expected a single input file")
+	}
+	fn, err := parse.File(paths[0], parse.ModeText|parse.ModeBinary|parse.OptLevel(cmd.optimize).Mode())
+	if err != nil {
+		return err
+	}
+	dis := fn.Disassemble()
+	if cmd.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(dis)
+	}
+	cmd.sources = map[string][]string{}
+	out := bufio.NewWriter(os.Stdout)
+	cmd.printTree(out, dis, 0)
+	cmd.printFn(out, dis)
+	return out.Flush()
+}
+
+// printTree lists the function and all of its nested functions by depth.
+func (cmd *disasmCmd) printTree(out io.Writer, dis *parse.Disassembly, depth int) {
+	fmt.Fprintf(out, "%v%v <%v:%v>\n", strings.Repeat("  ", depth), dis.Name, dis.Filename, dis.Line)
+	for _, child := range dis.Functions {
+		cmd.printTree(out, child, depth+1)
+	}
+}
+
+func (cmd *disasmCmd) printFn(out io.Writer, dis *parse.Disassembly) {
+	vararg := ""
+	if dis.Varargs {
+		vararg = "+"
+	}
+	fmt.Fprintf(out, "\nfunction %v <%v:%v> (%v instructions)\n", dis.Name, dis.Filename, dis.Line, len(dis.Code))
+	fmt.Fprintf(out, "%v%v params, %v upvalues, %v locals, %v constants, %v functions\n",
+		dis.Params, vararg, len(dis.Upvalues), len(dis.Locals), len(dis.Constants), len(dis.Functions))
+	for i, konst := range dis.Constants {
+		fmt.Fprintf(out, "  K%-4v %v\n", i, konst)
+	}
+	for i, name := range dis.Upvalues {
+		fmt.Fprintf(out, "  U%-4v %v\n", i, name)
+	}
+	for _, lcl := range dis.Locals {
+		fmt.Fprintf(out, "  R%-4v %v\t[%v, %v)\n", lcl.Register, lcl.Name, lcl.StartPC, lcl.EndPC)
+	}
+
+	lines := cmd.sourceLines(dis.Filename)
+	lastLine := int64(-1)
+	for _, inst := range dis.Code {
+		if inst.Line > 0 && inst.Line != lastLine {
+			if inst.Line <= int64(len(lines)) && strings.TrimSpace(lines[inst.Line-1]) != "" {
+				fmt.Fprintf(out, "%6v | %v\n", inst.Line, lines[inst.Line-1])
+			}
+			lastLine = inst.Line
+		}
+		if inst.Label != "" {
+			fmt.Fprintf(out, "%v:\n", inst.Label)
+		}
+		args := make([]string, len(inst.Args))
+		for i, arg := range inst.Args {
+			args[i] = strconv.FormatInt(arg, 10)
+		}
+		if inst.K {
+			args = append(args, "k")
+		}
+		comment := inst.Notes
+		if inst.Target != "" {
+			comment = append(comment, "to "+inst.Target)
+		}
+		line := fmt.Sprintf("\t%-4v [%v]\t%-10v %-16v", inst.PC, inst.Line, inst.Op, strings.Join(args, " "))
+		if len(comment) > 0 {
+			line += "; " + strings.Join(comment, " ")
+		}
+		fmt.Fprintln(out, strings.TrimRight(line, " "))
+	}
+	for _, child := range dis.Functions {
+		cmd.printFn(out, child)
+	}
+}
+
+// sourceLines reads the source of a function if it is still available. The
+// filename of a precompiled chunk is where it was compiled from so the source
+// may not exist, or may itself be a compiled chunk, in which case it is skipped.
+// Both luaf and lua binary chunks start with the escape character.
+func (cmd *disasmCmd) sourceLines(filename string) []string {
+	if lines, found := cmd.sources[filename]; found {
+		return lines
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil || bytes.HasPrefix(data, []byte(conf.LUASIGNATURE[:1])) {
+		data = nil
+	}
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	}
+	cmd.sources[filename] = lines
+	return lines
+}
@@ -29,18 +29,32 @@ type (
 		executeStat string
 		interactive bool
 		warningsOn  bool
+		ordered     bool
+		memProfile  string
+		memTop      int
+		traceFile   string
+		optimize    int
 		flagSet     *pflag.FlagSet
 	}
 )
 
 var subcommands = map[string]command{
-	"test": &testCmd{},
-	"doc":  &docCmd{},
+	"test":   &testCmd{},
+	"doc":    &docCmd{},
+	"build":  &buildCmd{},
+	"bundle": &bundleCmd{},
+	"disasm": &disasmCmd{},
 }
 
 // Exec is the main entrypoint that parses the command line args to decide how
 // the application should react.
 func Exec(args []string) error {
+	if chunk, err := openBundle(); err != nil {
+		return err
+	} else if chunk != nil {
+		return runBundle(chunk, args)
+	}
+
 	var cmd command = &rootCmd{}
 	if len(args) > 0 {
 		if sub, found := subcommands[args[0]]; found {
@@ -61,6 +75,11 @@ func (cmd *rootCmd) flags() error {
 	cmd.flagSet.StringVarP(&cmd.executeStat, "execute", "e", "", "execute string 'stat'")
 	cmd.flagSet.BoolVarP(&cmd.interactive, "interactive", "i", false, "enter interactive mode after executing a script")
 	cmd.flagSet.BoolVarP(&cmd.warningsOn, "warnings-on", "W", false, "turn warnings on")
+	cmd.flagSet.BoolVar(&cmd.ordered, "ordered-pairs", false, "iterate tables in the order that keys were inserted")
+	cmd.flagSet.StringVar(&cmd.memProfile, "memprofile", "", "write a pprof profile of lua allocations to file")
+	cmd.flagSet.IntVar(&cmd.memTop, "memprofile-top", 0, "print the top n lua allocation sites to stderr on exit")
+	cmd.flagSet.StringVar(&cmd.traceFile, "trace", "", "write a chrome trace event json file of the execution")
+	cmd.flagSet.IntVarP(&cmd.optimize, "optimize", "O", 0, "optimization level of the parsed bytecode 0-2")
 	cmd.flagSet.Usage = cmd.usage
 	return cmd.flagSet.Parse(os.Args[1:])
 }
@@ -72,20 +91,43 @@ func (cmd *rootCmd) usage() {
 	fmt.Fprint(os.Stderr, "\nSubcommands:\n")
 	fmt.Fprint(os.Stderr, "  test\tRun automated tests at specified paths\n")
 	fmt.Fprint(os.Stderr, "  doc \tGenerate documentation for project\n")
+	fmt.Fprint(os.Stderr, "  build\tCompile lua files into a precompiled chunk\n")
+	fmt.Fprint(os.Stderr, "  bundle\tCreate a standalone executable from a lua script\n")
+	fmt.Fprint(os.Stderr, "  disasm\tDisassemble a lua file or precompiled chunk\n")
 	fmt.Fprint(os.Stderr, "\n")
 }
 
 func (cmd *rootCmd) run() error {
 	var err error
 	runtime.WarnEnabled = cmd.warningsOn
+	runtime.OrderedPairs = cmd.ordered
 
 	cmd.vm, err = runtime.New(context.Background(), nil, fmtCLIArgs(cmd.flagSet)...)
 	if err != nil {
 		return err
 	}
+	cmd.vm.SetOptimizeLevel(parse.OptLevel(cmd.optimize))
 
 	defer func() { _ = cmd.vm.Close() }()
 
+	if cmd.memProfile != "" || cmd.memTop > 0 {
+		cmd.vm.EnableMemProfile()
+		defer func() {
+			if err := cmd.writeMemProfile(); err != nil {
+				fmt.Fprintf(os.Stderr, "error writing memory profile: %v\n", err)
+			}
+		}()
+	}
+
+	if cmd.traceFile != "" {
+		cmd.vm.EnableTrace()
+		defer func() {
+			if err := cmd.writeTrace(); err != nil {
+				fmt.Fprintf(os.Stderr, "error writing trace: %v\n", err)
+			}
+		}()
+	}
+
 	args := cmd.flagSet.Args()
 	if cmd.showVersion {
 		cmd.printVersion()
@@ -120,7 +162,7 @@ func (cmd *rootCmd) printVersion() {
 }
 
 func (cmd *rootCmd) parseSrc(path string, src io.ReadSeeker) error {
-	fn, err := parse.Parse(path, src, parse.ModeText)
+	fn, err := parse.Parse(path, src, parse.ModeText|parse.ModeBinary|parse.OptLevel(cmd.optimize).Mode())
 	if err != nil {
 		return err
 	}
@@ -139,6 +181,33 @@ func (cmd *rootCmd) parseSrc(path string, src io.ReadSeeker) error {
 	return nil
 }
 
+func (cmd *rootCmd) writeMemProfile() error {
+	profile := cmd.vm.MemProfile()
+	if cmd.memTop > 0 {
+		if err := profile.WriteTop(os.Stderr, cmd.memTop); err != nil {
+			return err
+		}
+	}
+	if cmd.memProfile == "" {
+		return nil
+	}
+	out, err := os.Create(cmd.memProfile)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = out.Close() }()
+	return profile.WritePprof(out)
+}
+
+func (cmd *rootCmd) writeTrace() error {
+	out, err := os.Create(cmd.traceFile)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = out.Close() }()
+	return cmd.vm.Tracer().WriteJSON(out)
+}
+
 func (cmd *rootCmd) runREPL() error {
 	cmd.printVersion()
 	fmt.Fprint(os.Stderr, "Press ctrl-c to quit or clear current buffer.\n")
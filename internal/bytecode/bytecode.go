@@ -87,6 +87,11 @@ func IABsC(op Op, a, b uint8, c int8, hasConst bool) uint32 {
 	return IABC(op, a, b, uint8(c), hasConst)
 }
 
+// IAsBC is an easy way of making a IABC operation with a signed B value.
+func IAsBC(op Op, a uint8, b int8, c uint8, hasConst bool) uint32 {
+	return IABC(op, a, uint8(b), c, hasConst)
+}
+
 // IvABC will generate a ivABC bytecode which is the extended version of iABC.
 // See virtual machine documentation for deeper definition of how the bytecode is formatted.
 func IvABC(op Op, a, b uint8, c uint16, hasConst bool) uint32 {
@@ -176,6 +181,12 @@ func GetB(bc uint32) int64 {
 	return int64(bc >> posB & maskByte)
 }
 
+// GetsB gets the b param but signed.
+func GetsB(bc uint32) int64 {
+	assertCodeOpType(bc, TypeABC)
+	return int64(int8(bc >> posB & maskByte))
+}
+
 // GetvB gets the b param in IvABC instructions.
 func GetvB(bc uint32) int64 {
 	assertCodeOpType(bc, TypevABC)
@@ -212,6 +223,23 @@ func GetvC(bc uint32) int64 {
 	return int64(bc >> posvC & mask10bits)
 }
 
+// SetA replaces the a param in any instruction that has one.
+func SetA(bc uint32, a uint8) uint32 {
+	return bc&^(maskByte<<posA) | uint32(a)<<posA
+}
+
+// SetB replaces the b param in IABC instructions.
+func SetB(bc uint32, b uint8) uint32 {
+	assertCodeOpType(bc, TypeABC)
+	return bc&^(maskByte<<posB) | uint32(b)<<posB
+}
+
+// SetC replaces the c param in IABC instructions.
+func SetC(bc uint32, c uint8) uint32 {
+	assertCodeOpType(bc, TypeABC)
+	return bc&^(maskByte<<posC) | uint32(c)<<posC
+}
+
 // GetK gets the K param in IABC instructions with an indicator if there is a const
 // value in the instruction or not. This has a different meaning per instruction.
 func GetK(bc uint32) bool { return (bc & (1 << posk)) > 0 }
@@ -69,6 +69,17 @@ func TestBytecodeABC(t *testing.T) {
 		assert.Equal(t, TypeABC, Kind(code))
 	})
 
+	t.Run("iAsBC", func(t *testing.T) {
+		t.Parallel()
+		code := IAsBC(MMBINI, 12, -22, 33, true)
+		assert.Equal(t, MMBINI, GetOp(code))
+		assert.Equal(t, int64(12), GetA(code))
+		assert.Equal(t, int64(-22), GetsB(code))
+		assert.Equal(t, int64(33), GetC(code))
+		assert.True(t, GetK(code))
+		assert.Equal(t, TypeABC, Kind(code))
+	})
+
 	t.Run("ivABC", func(t *testing.T) {
 		t.Parallel()
 		code := IvABC(NEWTABLE, 12, 22, 33, true)
@@ -115,6 +126,15 @@ func TestBytecodeABC(t *testing.T) {
 		assert.Equal(t, TypesJ, Kind(code))
 	})
 
+	t.Run("set params", func(t *testing.T) {
+		t.Parallel()
+		code := SetC(SetB(SetA(IABC(ADD, 1, 2, 3, true), 12), 22), 33)
+		assert.Equal(t, IABC(ADD, 12, 22, 33, true), code)
+		assert.Equal(t, IABx(LOADK, 7, 300), SetA(IABx(LOADK, 1, 300), 7))
+		assert.Equal(t, IAsBx(LOADI, 7, -3), SetA(IAsBx(LOADI, 1, -3), 7))
+		assert.Equal(t, IvABC(NEWTABLE, 7, 22, 33, true), SetA(IvABC(NEWTABLE, 1, 22, 33, true), 7))
+	})
+
 	t.Run("IsReturn", func(t *testing.T) {
 		t.Parallel()
 		code := IAB(RETURN, 0, 1)
@@ -103,44 +103,45 @@ const (
 	// SELF Prepare an object method for calling.
 	// A B C	R[A+1] := R[B]; R[A] := R[B][K[C]:shortstring
 	SELF
-	// ADDI Add specifically a positive int number.
-	// A B sC	R[A] := R[B] + sC
+	// ADDI Add a small integer. For all of the immediate and constant arithmetic
+	// below, k means the operands were flipped (the constant is the first operand).
+	// A B sC k	R[A] := R[B] + sC
 	ADDI
 	// ADDK Add a specific const.
-	// A B C	R[A] := R[B] + K[C]:number
+	// A B C k	R[A] := R[B] + K[C]:number
 	ADDK
 	// SUBK subtracts a constant K instead of loading K.
-	// A B C	R[A] := R[B] - K[C]:number
+	// A B C k	R[A] := R[B] - K[C]:number
 	SUBK
 	// MULK multiplies a constant K instead of loading K.
-	// A B C	R[A] := R[B] * K[C]:numbe
+	// A B C k	R[A] := R[B] * K[C]:number
 	MULK
 	// MODK modulus a constant K instead of loading K.
-	// A B C	R[A] := R[B] % K[C]:number
+	// A B C k	R[A] := R[B] % K[C]:number
 	MODK
 	// POWK exponent of a constant K instead of loading K.
-	// A B C	R[A] := R[B] ^ K[C]:number
+	// A B C k	R[A] := R[B] ^ K[C]:number
 	POWK
 	// DIVK divides a constant K instead of loading K.
-	// A B C	R[A] := R[B] / K[C]:number
+	// A B C k	R[A] := R[B] / K[C]:number
 	DIVK
 	// IDIVK int divides a constant K instead of loading K.
-	// A B C	R[A] := R[B] // K[C]:number
+	// A B C k	R[A] := R[B] // K[C]:number
 	IDIVK
 	// BANDK boolean and a constant K instead of loading K.
-	// A B C	R[A] := R[B] & K[C]:integer
+	// A B C k	R[A] := R[B] & K[C]:integer
 	BANDK
 	// BORK boolean or a constant K instead of loading K.
-	// A B C	R[A] := R[B] | K[C]:integer
+	// A B C k	R[A] := R[B] | K[C]:integer
 	BORK
 	// BXORK boolean xor a constant K instead of loading K.
-	// A B C	R[A] := R[B] ~ K[C]:integer
+	// A B C k	R[A] := R[B] ~ K[C]:integer
 	BXORK
-	// SHLI shift left a constant K instead of loading K.
-	// A B sC	R[A] := sC << R[B]
+	// SHLI shift left by a small integer instead of loading it.
+	// A B sC k	R[A] := R[B] << sC
 	SHLI
-	// SHRI shift right a constant K instead of loading K.
-	// A B sC	R[A] := R[B] >> sC
+	// SHRI shift right by a small integer instead of loading it.
+	// A B sC k	R[A] := R[B] >> sC
 	SHRI
 	// ADD Addition operator.
 	// A B C	R[A] := R[B] + R[C]
@@ -185,6 +186,8 @@ const (
 	// A B C	call C metamethod over R[A] and R[B]
 	// MMBIN and variants follow each arithmetic and bitwise opcode. If the operation
 	// succeeds, it skips this next opcode. Otherwise, this opcode calls the corresponding metamethod.
+	// C is the register form of the arithmetic opcode, such as ADD, and the result is stored in
+	// the destination register of the preceding instruction.
 	MMBIN
 	// MMBINI call metamethod. k means the arguments were flipped (the constant is the first operand).
 	// A sB C k	call C metamethod over R[A] and sB
@@ -235,23 +238,23 @@ const (
 	// A B k	if ((R[A] <= R[B]) ~= k) then pc++
 	LE
 	// EQK compare a value with a constant.
-	// A B k	if ((R[A] == K[B]) ~= k) then pc++
+	// A B C	if ((R[B] == K[C]) ~= A) then pc++
 	EQK
 	// EQI compare a value with an int.
-	// A sB k	if ((R[A] == sB) ~= k) then pc++
+	// A B sC	if ((R[B] == sC) ~= A) then pc++
 	EQI
-	// LTI less than compare size with int.
-	// A sB k	if ((R[A] < sB) ~= k) then pc++
+	// LTI less than compare with an int. k means the operands were flipped (sC < R[B]).
+	// A B sC k	if ((R[B] < sC) ~= A) then pc++
 	LTI
-	// LEI less than equal with int.
-	// A sB k	if ((R[A] <= sB) ~= k) then pc++
+	// LEI less than equal with an int. k means the operands were flipped (sC <= R[B]).
+	// A B sC k	if ((R[B] <= sC) ~= A) then pc++
 	LEI
 	// TEST Boolean test, with conditional jump.
 	// A k	if (not R[A] == k) then pc++
 	TEST
 	// TESTSET test against a value but then save it into a register. Used in short-circuit expressions
 	// that need both to jump and to produce a value, such as (a = b or c).
-	// A B k	if (not R[B] == k) then pc++ else R[A] := R[B]
+	// A B C	if (not R[B] == C) then pc++ else R[A] := R[B]
 	TESTSET
 	// CALL Call a closure. if (B == 0) then B = top - A. If (C == 0), then 'top' is set
 	// to last_result+1, so next open instruction (CALL, RETURN*, SETLIST) may use 'top'.
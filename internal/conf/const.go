@@ -20,13 +20,18 @@ const (
 	// LUAVERSIONPATCHN is the patch version.
 	LUAVERSIONPATCHN = 0
 	// LUAFORMAT dump/undump format incase it ever changes.
-	LUAFORMAT = 0
+	LUAFORMAT = 2
 	// INITIALSTACKSIZE  stack size at vm startup.
 	INITIALSTACKSIZE = 128
+	// THREADSTACKSIZE stack size a coroutine starts with, it grows as needed.
+	THREADSTACKSIZE = 16
 	// MAXSTACKSIZE  max stack size.
 	MAXSTACKSIZE = math.MaxInt64
-	// MAXCALLDEPTH max nested (non-tail) call depth before erroring with a stack overflow.
-	MAXCALLDEPTH = 200
+	// MAXCALLDEPTH default max nested (non-tail) lua call depth before erroring with a stack overflow.
+	MAXCALLDEPTH = 200_000
+	// MAXCCALLDEPTH max nested go calls back into lua, like metamethods, pcall or
+	// resume, before erroring with a C stack overflow.
+	MAXCCALLDEPTH = 200
 	// MAXCALLCHAIN max number of "__call" metamethod hops resolved for a single call.
 	MAXCALLCHAIN = 15
 	// MAXUPVALUES max allowed upvals referred in a fn scope.
@@ -37,6 +42,9 @@ const (
 	MAXCONST = 64_536
 	// MAXINLINECONST max index that we can index constants with iABC.
 	MAXINLINECONST = 255
+	// MAXSHORTLEN max length of a string key that GETFIELD and SETFIELD are used for,
+	// longer keys use GETTABLE and SETTABLE like lua does for long strings.
+	MAXSHORTLEN = 40
 	// MAXRESULTS max amount of return values.
 	MAXRESULTS = 254
 	// MAXREGS max number of registers usable in a single fn scope.
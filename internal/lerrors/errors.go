@@ -35,6 +35,8 @@ const (
 	LexerErr
 	// UserErr is an error raised from user code by the user.
 	UserErr
+	// BytecodeErr is an error found while verifying a precompiled chunk.
+	BytecodeErr
 )
 
 func (err *Error) Error() string {
@@ -54,6 +56,8 @@ func (err *Error) Error() string {
 		return fmt.Sprintf(`TypeError: %s:%v:%v %v`, err.Filename, err.Line, err.Column, err.Err)
 	case LexerErr:
 		return fmt.Sprintf(`LexError: %s:%v:%v %v`, err.Filename, err.Line, err.Column, err.Err)
+	case BytecodeErr:
+		return fmt.Sprintf(`BytecodeError: %s:%v:%v %v`, err.Filename, err.Line, err.Column, err.Err)
 	default:
 		return err.Err.Error()
 	}
@@ -0,0 +1,101 @@
+package parse
+
+import (
+	"errors"
+	"maps"
+	"slices"
+
+	"github.com/tanema/luaf/internal/bytecode"
+	"github.com/tanema/luaf/internal/conf"
+)
+
+// Combine links several parsed chunks into a single chunk. The generated code is
+// equivalent to:
+//
+//	local preload = package.preload
+//	preload["mod.a"] = function(...) --[[ mod/a.lua ]] end
+//	preload["mod.b"] = function(...) --[[ mod/b.lua ]] end
+//	return (function(...) --[[ main.lua ]] end)(...)
+//
+// So each of the modules is registered under its module name, and require will
+// load it without searching or parsing, then main is called with the arguments.
+func Combine(main *FnProto, modules map[string]*FnProto) (*FnProto, error) {
+	fn := NewEmptyFnProto(main.Filename, nil)
+	fn.UpIndexes = []Upindex{{Name: _ENVName, FromStack: true, Index: 0}}
+	names := slices.Sorted(maps.Keys(modules))
+	if len(names)+2 > conf.MAXINLINECONST {
+		return nil, errors.New("too many modules to combine into a single chunk")
+	}
+
+	pkgIdx, _ := fn.addConst("package")
+	preloadIdx, _ := fn.addConst("preload")
+	fn.code(bytecode.IABC(bytecode.GETTABUP, 0, 0, uint8(pkgIdx), true), main.LineInfo)
+	fn.code(bytecode.IABC(bytecode.GETFIELD, 0, 0, uint8(preloadIdx), false), main.LineInfo)
+	for _, name := range names {
+		nameIdx, _ := fn.addConst(name)
+		fnIdx := fn.addFn(asChildChunk(modules[name]))
+		fn.code(bytecode.IABx(bytecode.CLOSURE, 1, fnIdx), main.LineInfo)
+		if len(name) > conf.MAXSHORTLEN {
+			fn.code(bytecode.IABx(bytecode.LOADK, 2, nameIdx), main.LineInfo)
+			fn.code(bytecode.IABC(bytecode.SETTABLE, 0, 2, 1, false), main.LineInfo)
+		} else {
+			fn.code(bytecode.IABC(bytecode.SETFIELD, 0, uint8(nameIdx), 1, false), main.LineInfo)
+		}
+	}
+	fn.code(bytecode.IABx(bytecode.CLOSURE, 1, fn.addFn(asChildChunk(main))), main.LineInfo)
+	fn.code(bytecode.IAB(bytecode.VARARG, 2, 0), main.LineInfo)
+	fn.code(bytecode.IABC(bytecode.CALL, 1, 0, 0, false), main.LineInfo)
+	fn.code(bytecode.Return(1, -1), main.LineInfo)
+	return fn, nil
+}
+
+// asChildChunk copies a main chunk so that it can be used as a closure inside of
+// another chunk. A main chunk gets _ENV from the stack of the root scope, a child
+// has to get it from the upvalues of its parent instead.
+func asChildChunk(chunk *FnProto) *FnProto {
+	child := *chunk
+	child.UpIndexes = slices.Clone(chunk.UpIndexes)
+	for i, idx := range child.UpIndexes {
+		if idx.FromStack && idx.Name == _ENVName {
+			child.UpIndexes[i].FromStack = false
+			child.UpIndexes[i].Index = 0
+		}
+	}
+	return &child
+}
+
+// Requires returns the names of all the modules that are required with a string
+// literal, like require("mod.name"), in this function and all of its children.
+// Dynamic requires cannot be resolved without running the code so they are not
+// included.
+func (fn *FnProto) Requires() []string {
+	names := []string{}
+	for i, code := range fn.ByteCodes {
+		op := bytecode.GetOp(code)
+		if i < 2 || (op != bytecode.CALL && op != bytecode.TAILCALL) || bytecode.GetB(code) != 2 {
+			continue
+		}
+		fnReg := bytecode.GetA(code)
+		getFn, loadName := fn.ByteCodes[i-2], fn.ByteCodes[i-1]
+		if bytecode.GetOp(getFn) != bytecode.GETTABUP ||
+			bytecode.GetA(getFn) != fnReg ||
+			!bytecode.GetK(getFn) ||
+			int(bytecode.GetB(getFn)) >= len(fn.UpIndexes) ||
+			fn.UpIndexes[bytecode.GetB(getFn)].Name != _ENVName ||
+			fn.GetConst(bytecode.GetC(getFn)) != "require" {
+			continue
+		} else if bytecode.GetOp(loadName) != bytecode.LOADK || bytecode.GetA(loadName) != fnReg+1 {
+			continue
+		} else if name, isStr := fn.GetConst(bytecode.GetBx(loadName)).(string); isStr && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	for _, child := range fn.FnTable {
+		for _, name := range child.Requires() {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
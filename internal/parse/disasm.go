@@ -0,0 +1,302 @@
+package parse
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tanema/luaf/internal/bytecode"
+)
+
+type (
+	// Disassembly is a readable breakdown of a function's bytecode with operands
+	// resolved to the constants, locals and upvalues they refer to. It is built
+	// to be printed or marshalled to json so compiler output can be compared.
+	Disassembly struct {
+		Name      string              `json:"name"`
+		Filename  string              `json:"filename"`
+		Line      int64               `json:"line"`
+		Params    int64               `json:"params"`
+		Varargs   bool                `json:"varargs"`
+		Constants []string            `json:"constants"`
+		Upvalues  []string            `json:"upvalues"`
+		Locals    []DisasmLocal       `json:"locals"`
+		Code      []DisasmInstruction `json:"code"`
+		Functions []*Disassembly      `json:"functions"`
+	}
+	// DisasmLocal is a local variable and the range of pcs it is live for.
+	DisasmLocal struct {
+		Name     string `json:"name"`
+		Register uint8  `json:"register"`
+		StartPC  int    `json:"startpc"`
+		EndPC    int    `json:"endpc"`
+	}
+	// DisasmInstruction is a single decoded instruction. Args are the raw operands
+	// in the order of the instruction format and Notes are what those operands
+	// resolve to, in the same order.
+	DisasmInstruction struct {
+		PC     int      `json:"pc"`
+		Line   int64    `json:"line,omitempty"`
+		Label  string   `json:"label,omitempty"`
+		Op     string   `json:"op"`
+		Args   []int64  `json:"args"`
+		K      bool     `json:"k,omitempty"`
+		Target string   `json:"target,omitempty"`
+		Notes  []string `json:"notes,omitempty"`
+	}
+)
+
+// Disassemble decodes the bytecode of fn and all of its nested functions. Jump
+// destinations are given labels in the order they appear in the function.
+func (fn *FnProto) Disassemble() *Disassembly {
+	dis := &Disassembly{
+		Name:      fn.Name,
+		Filename:  fn.Filename,
+		Line:      fn.Line,
+		Params:    fn.Arity,
+		Varargs:   fn.Varargs,
+		Constants: make([]string, len(fn.Constants)),
+		Upvalues:  make([]string, len(fn.UpIndexes)),
+		Locals:    make([]DisasmLocal, 0, len(fn.AllLocals)),
+		Code:      make([]DisasmInstruction, len(fn.ByteCodes)),
+		Functions: make([]*Disassembly, len(fn.FnTable)),
+	}
+	for i, val := range fn.Constants {
+		dis.Constants[i] = disasmConst(val)
+	}
+	for i, upval := range fn.UpIndexes {
+		dis.Upvalues[i] = upval.Name
+	}
+	for _, lcl := range fn.AllLocals {
+		if lcl.name != "" {
+			dis.Locals = append(dis.Locals, DisasmLocal{
+				Name:     lcl.name,
+				Register: lcl.register,
+				StartPC:  lcl.startPC,
+				EndPC:    lcl.endPC,
+			})
+		}
+	}
+
+	labels := map[int]string{}
+	for _, target := range fn.jumpTargets() {
+		labels[target] = "L" + strconv.Itoa(len(labels)+1)
+	}
+	for pc, code := range fn.ByteCodes {
+		inst := DisasmInstruction{
+			PC:    pc,
+			Label: labels[pc],
+			Op:    opName(code),
+			Args:  disasmArgs(code),
+			Notes: fn.disasmNotes(pc, code),
+		}
+		if kind := bytecode.Kind(code); kind == bytecode.TypeABC || kind == bytecode.TypevABC {
+			inst.K = bytecode.GetK(code)
+		}
+		if pc < len(fn.LineTrace) {
+			inst.Line = fn.LineTrace[pc].Line
+		}
+		if target, ok := jumpTarget(pc, code); ok {
+			inst.Target = labels[target]
+		}
+		dis.Code[pc] = inst
+	}
+	for i, child := range fn.FnTable {
+		dis.Functions[i] = child.Disassemble()
+	}
+	return dis
+}
+
+// jumpTargets returns the sorted unique pcs that are jumped to within the function.
+func (fn *FnProto) jumpTargets() []int {
+	targets := []int{}
+	for pc, code := range fn.ByteCodes {
+		if target, ok := jumpTarget(pc, code); ok && target >= 0 && target <= len(fn.ByteCodes) {
+			targets = append(targets, target)
+		}
+	}
+	slices.Sort(targets)
+	return slices.Compact(targets)
+}
+
+// jumpTarget returns the pc that an instruction explicitly jumps to. Tests that
+// skip the next instruction are not considered jumps.
+func jumpTarget(pc int, code uint32) (int, bool) {
+	switch bytecode.GetOp(code) {
+	case bytecode.JMP:
+		return pc + 1 + int(bytecode.GetJump(code)), true
+	case bytecode.FORPREP:
+		return pc + 1 + int(bytecode.GetBx(code)), true
+	case bytecode.FORLOOP, bytecode.TFORLOOP:
+		return pc + 1 - int(bytecode.GetBx(code)), true
+	default:
+		return 0, false
+	}
+}
+
+func opName(code uint32) string {
+	op := bytecode.GetOp(code)
+	if name := op.ToString(); name != "" {
+		return name
+	}
+	return fmt.Sprintf("OP(%v)", uint8(op))
+}
+
+func disasmArgs(code uint32) []int64 {
+	switch bytecode.Kind(code) {
+	case bytecode.TypeABC:
+		return []int64{bytecode.GetA(code), bytecode.GetB(code), bytecode.GetC(code)}
+	case bytecode.TypevABC:
+		return []int64{bytecode.GetA(code), bytecode.GetvB(code), bytecode.GetvC(code)}
+	case bytecode.TypeABx:
+		return []int64{bytecode.GetA(code), bytecode.GetBx(code)}
+	case bytecode.TypeAsBx:
+		return []int64{bytecode.GetA(code), bytecode.GetsBx(code)}
+	case bytecode.TypesJ:
+		return []int64{bytecode.GetJump(code)}
+	case bytecode.TypeAx:
+		return []int64{int64(bytecode.GetAx(code))}
+	default:
+		return []int64{int64(code >> 7)}
+	}
+}
+
+// disasmNotes resolves the operands of an instruction to the names of locals,
+// upvalues, functions and the values of constants that they refer to.
+func (fn *FnProto) disasmNotes(pc int, code uint32) []string {
+	notes := []string{}
+	reg := func(idx int64) {
+		if idx >= 0 && idx <= math.MaxUint8 {
+			if name, ok := fn.LocalNameAt(uint8(idx), pc); ok {
+				notes = append(notes, name)
+			}
+		}
+	}
+	regs := func(first, last int64) {
+		for idx := first; idx <= last; idx++ {
+			reg(idx)
+		}
+	}
+	konst := func(idx int64) {
+		if idx >= 0 && idx < int64(len(fn.Constants)) {
+			notes = append(notes, disasmConst(fn.Constants[idx]))
+		}
+	}
+	rk := func(idx int64) {
+		if bytecode.GetK(code) {
+			konst(idx)
+		} else {
+			reg(idx)
+		}
+	}
+	event := func() {
+		mmop := bytecode.Op(bytecode.GetC(code))
+		notes = append(notes, mmop.ToString())
+	}
+	upval := func(idx int64) {
+		if idx >= 0 && idx < int64(len(fn.UpIndexes)) {
+			notes = append(notes, fn.UpIndexes[idx].Name)
+		}
+	}
+
+	a := bytecode.GetA(code)
+	switch bytecode.GetOp(code) {
+	case bytecode.MOVE, bytecode.UNM, bytecode.BNOT, bytecode.ADDI, bytecode.SHLI, bytecode.SHRI, bytecode.TESTSET:
+		reg(a)
+		reg(bytecode.GetB(code))
+	case bytecode.LOADK:
+		reg(a)
+		konst(bytecode.GetBx(code))
+	case bytecode.LOADNIL:
+		regs(a, a+bytecode.GetBx(code))
+	case bytecode.GETUPVAL, bytecode.SETUPVAL:
+		reg(a)
+		upval(bytecode.GetB(code))
+	case bytecode.GETTABUP:
+		reg(a)
+		upval(bytecode.GetB(code))
+		rk(bytecode.GetC(code))
+	case bytecode.SETTABUP:
+		upval(a)
+		reg(bytecode.GetB(code))
+		rk(bytecode.GetC(code))
+	case bytecode.GETTABLE, bytecode.SETTABLE:
+		reg(a)
+		reg(bytecode.GetB(code))
+		rk(bytecode.GetC(code))
+	case bytecode.GETFIELD, bytecode.SELF, bytecode.ADDK, bytecode.SUBK, bytecode.MULK, bytecode.MODK, bytecode.POWK,
+		bytecode.DIVK, bytecode.IDIVK, bytecode.BANDK, bytecode.BORK, bytecode.BXORK:
+		reg(a)
+		reg(bytecode.GetB(code))
+		konst(bytecode.GetC(code))
+	case bytecode.GETI:
+		reg(a)
+		reg(bytecode.GetB(code))
+	case bytecode.SETI:
+		reg(a)
+		rk(bytecode.GetC(code))
+	case bytecode.SETFIELD:
+		reg(a)
+		konst(bytecode.GetB(code))
+		rk(bytecode.GetC(code))
+	case bytecode.ADD, bytecode.SUB, bytecode.MUL, bytecode.DIV, bytecode.MOD, bytecode.POW, bytecode.IDIV,
+		bytecode.BAND, bytecode.BOR, bytecode.BXOR, bytecode.SHL, bytecode.SHR, bytecode.SAR:
+		reg(a)
+		reg(bytecode.GetB(code))
+		reg(bytecode.GetC(code))
+	case bytecode.MMBIN:
+		reg(a)
+		reg(bytecode.GetB(code))
+		event()
+	case bytecode.MMBINI:
+		reg(a)
+		event()
+	case bytecode.MMBINK:
+		reg(a)
+		konst(bytecode.GetB(code))
+		event()
+	case bytecode.NOT, bytecode.LEN:
+		reg(a)
+		rk(bytecode.GetB(code))
+	case bytecode.CONCAT:
+		reg(a)
+		regs(bytecode.GetB(code), bytecode.GetC(code))
+	case bytecode.EQ, bytecode.LT, bytecode.LE:
+		reg(bytecode.GetB(code))
+		reg(bytecode.GetC(code))
+	case bytecode.EQK:
+		reg(bytecode.GetB(code))
+		konst(bytecode.GetC(code))
+	case bytecode.EQI, bytecode.LTI, bytecode.LEI:
+		reg(bytecode.GetB(code))
+	case bytecode.CLOSURE:
+		reg(a)
+		if idx := bytecode.GetBx(code); idx < int64(len(fn.FnTable)) {
+			notes = append(notes, "function "+fn.FnTable[idx].Name)
+		}
+	case bytecode.LOADI, bytecode.LOADF, bytecode.LOADFALSE, bytecode.LOADTRUE, bytecode.LFALSESKIP,
+		bytecode.TEST, bytecode.CALL, bytecode.TAILCALL, bytecode.RETURN, bytecode.RETURN1, bytecode.VARARG,
+		bytecode.TBC, bytecode.CLOSE, bytecode.NEWTABLE, bytecode.SETLIST, bytecode.FORPREP, bytecode.FORLOOP,
+		bytecode.TFORCALL, bytecode.TFORLOOP:
+		reg(a)
+	}
+	return notes
+}
+
+// disasmConst formats a constant so that its type can be told from its text.
+func disasmConst(val any) string {
+	switch tval := val.(type) {
+	case string:
+		return strconv.Quote(tval)
+	case float64:
+		str := strconv.FormatFloat(tval, 'g', -1, 64)
+		if !strings.ContainsAny(str, ".eIN") {
+			str += ".0"
+		}
+		return str
+	default:
+		return toString(val)
+	}
+}
@@ -0,0 +1,57 @@
+package parse
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisassemble(t *testing.T) {
+	t.Parallel()
+
+	src := `local a = "one"
+local function add(b)
+  for i = 1, 3 do b = b .. i end
+  return a .. b
+end
+return add(2.0)`
+	fn, err := Parse("disasm.lua", strings.NewReader(src), ModeText)
+	require.NoError(t, err)
+	dis := fn.Disassemble()
+
+	assert.Equal(t, "main", dis.Name)
+	assert.Equal(t, []string{`"one"`, "2.0"}, dis.Constants)
+	assert.Empty(t, dis.Upvalues)
+	require.Len(t, dis.Code, len(fn.ByteCodes))
+	assert.Equal(t, DisasmInstruction{
+		PC:    0,
+		Line:  1,
+		Op:    "LOADK",
+		Args:  []int64{0, 0},
+		Notes: []string{`"one"`},
+	}, dis.Code[0])
+	assert.Equal(t, []string{"add", "function add"}, dis.Code[1].Notes)
+
+	require.Len(t, dis.Functions, 1)
+	add := dis.Functions[0]
+	assert.Equal(t, "add", add.Name)
+	assert.Equal(t, []string{"a"}, add.Upvalues)
+	assert.Contains(t, add.Locals, DisasmLocal{Name: "b", Register: 0, StartPC: 0, EndPC: len(add.Code)})
+
+	var forprep, forloop DisasmInstruction
+	for _, inst := range add.Code {
+		switch inst.Op {
+		case "FORPREP":
+			forprep = inst
+		case "FORLOOP":
+			forloop = inst
+		}
+	}
+	assert.Equal(t, "L2", forprep.Target)
+	assert.Equal(t, "L2", forloop.Label)
+	assert.Equal(t, "L1", forloop.Target)
+	assert.Equal(t, "L1", add.Code[forprep.PC+1].Label)
+	assert.Contains(t, add.Code[forprep.PC+1].Notes, "i")
+}
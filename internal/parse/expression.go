@@ -53,8 +53,9 @@ type (
 		paren bool
 	}
 	exVariable struct { // upvalue or local
-		lvar *Local
-		name string
+		lvar  *Local
+		name  string
+		konst expression // inlined value of a const local from a parent function
 		LineInfo
 		typeDefn  types.Definition
 		local     bool
@@ -266,7 +267,9 @@ func (ex *exBool) discharge(fn *FnProto, dst uint8) error {
 func (ex *exBool) inferType() types.Definition { return types.Bool }
 
 func (ex *exVariable) discharge(fn *FnProto, dst uint8) error {
-	if !ex.local {
+	if ex.konst != nil {
+		return ex.konst.discharge(fn, dst)
+	} else if !ex.local {
 		fn.code(bytecode.IAB(bytecode.GETUPVAL, dst, ex.address), ex.LineInfo)
 	} else if dst != ex.address { // already there
 		fn.code(bytecode.IAB(bytecode.MOVE, dst, ex.address), ex.LineInfo)
@@ -336,6 +339,21 @@ func (ex *exTable) discharge(fn *FnProto, dst uint8) error {
 	}
 
 	for i, key := range ex.keys {
+		idx, isField, ok, err := specializedKey(fn, key)
+		if err != nil {
+			return err
+		} else if ok {
+			ival, valIsConst, err := dischargeMaybeConst(fn, ex.vals[i], dst+1)
+			if err != nil {
+				return err
+			}
+			op := bytecode.SETI
+			if isField {
+				op = bytecode.SETFIELD
+			}
+			fn.code(bytecode.IABC(op, dst, idx, ival, valIsConst), ex.LineInfo)
+			continue
+		}
 		if err := key.discharge(fn, dst+1); err != nil {
 			return err
 		}
@@ -364,22 +382,48 @@ func (ex *exTable) inferType() types.Definition {
 }
 
 func (ex *exIndex) discharge(fn *FnProto, dst uint8) error {
-	ikey, keyIsConst, err := dischargeMaybeConst(fn, ex.key, dst+1)
-	if err != nil {
-		return err
+	if val, isVal := ex.table.(*exVariable); !isVal || val.local {
+		idx, isField, ok, err := specializedKey(fn, ex.key)
+		if err != nil {
+			return err
+		} else if ok {
+			itable := dst
+			if isVal {
+				itable = val.address
+			} else if err := ex.table.discharge(fn, dst); err != nil {
+				return err
+			}
+			op := bytecode.GETI
+			if isField {
+				op = bytecode.GETFIELD
+			}
+			fn.code(bytecode.IABC(op, dst, itable, idx, false), ex.LineInfo)
+			return nil
+		}
 	}
 	if val, isVal := ex.table.(*exVariable); isVal {
-		if val.local {
+		ikey, keyIsConst, err := dischargeMaybeConst(fn, ex.key, dst+1)
+		if err != nil {
+			return err
+		} else if val.local {
 			fn.code(bytecode.IABC(bytecode.GETTABLE, dst, val.address, ikey, keyIsConst), ex.LineInfo)
 		} else {
 			fn.code(bytecode.IABC(bytecode.GETTABUP, dst, val.address, ikey, keyIsConst), ex.LineInfo)
 		}
 		return nil
 	}
-	// if the table is not a value, it is a value that will be colocated in the stack after discharging.
-	err = ex.table.discharge(fn, dst)
+	// if the table is not a value, it is a value that will be colocated in the
+	// stack after discharging. It is discharged before the key so that the
+	// registers it uses, like the arguments of a call, do not overwrite the key.
+	if err := ex.table.discharge(fn, dst); err != nil {
+		return err
+	}
+	ikey, keyIsConst, err := dischargeMaybeConst(fn, ex.key, dst+1)
+	if err != nil {
+		return err
+	}
 	fn.code(bytecode.IABC(bytecode.GETTABLE, dst, dst, ikey, keyIsConst), ex.LineInfo)
-	return err
+	return nil
 }
 
 func (ex *exIndex) inferType() types.Definition { return ex.typeDefn }
@@ -387,74 +431,34 @@ func (ex *exIndex) inferType() types.Definition { return ex.typeDefn }
 func (ex *exInfixOp) discharge(fn *FnProto, dst uint8) error {
 	switch ex.operand {
 	case tokenBitwiseOrUnion, tokenBitwiseNotOrXOr, tokenBitwiseAnd, tokenShiftLeft, tokenShiftRight, tokenArithShiftRight,
-		tokenModulo, tokenDivide, tokenFloorDivide, tokenExponent, tokenMinus, tokenMultiply:
-		if err := ex.dischargeBoth(fn, dst); err != nil {
+		tokenModulo, tokenDivide, tokenFloorDivide, tokenExponent, tokenMinus, tokenMultiply, tokenAdd:
+		if done, err := ex.dischargeConstArith(fn, dst); err != nil || done {
 			return err
-		}
-		fn.code(bytecode.IABC(tokenToBytecodeOp[ex.operand], dst, dst, dst+1, false), ex.LineInfo)
-	case tokenAdd:
-		// only one should be a constant int or float otherwise this op would have already been folded
-		// try to optimize to ADDI or ADDK
-		if exIsNum(ex.exprs[0]) || exIsNum(ex.exprs[1]) {
-			num, other := ex.exprs[0], ex.exprs[1]
-			if !exIsNum(ex.exprs[0]) && exIsNum(ex.exprs[1]) {
-				num, other = ex.exprs[1], ex.exprs[0]
-			}
-
-			if nval, ok := num.(*exInteger); ok && nval.val >= math.MinInt8 && nval.val <= math.MaxInt8 {
-				if err := other.discharge(fn, dst); err != nil {
-					return err
-				}
-				fn.code(bytecode.IABsC(bytecode.ADDI, dst, dst, int8(nval.val), false), ex.LineInfo)
-				return nil
-			} else if len(fn.Constants) < math.MaxUint8-1 {
-				if err := other.discharge(fn, dst); err != nil {
-					return err
-				}
-
-				kval, _ := exIsConst(num)
-				kaddr, err := fn.addConst(kval)
-				if err != nil {
-					return err
-				}
-				fn.code(bytecode.IABC(bytecode.ADDK, dst, dst, uint8(kaddr), true), ex.LineInfo)
-				return nil
-			}
-		}
-
-		if err := ex.dischargeBoth(fn, dst); err != nil {
+		} else if err := ex.dischargeBoth(fn, dst); err != nil {
 			return err
 		}
-		fn.code(bytecode.IABC(bytecode.ADD, dst, dst, dst+1, false), ex.LineInfo)
-	case tokenLt, tokenLe, tokenEq:
-		if err := ex.dischargeBoth(fn, dst); err != nil {
+		op := tokenToBytecodeOp[ex.operand]
+		fn.code(bytecode.IABC(op, dst, dst, dst+1, false), ex.LineInfo)
+		fn.code(bytecode.IABC(bytecode.MMBIN, dst, dst+1, uint8(op), false), ex.LineInfo)
+	case tokenLt, tokenLe, tokenEq, tokenNe:
+		if err := ex.dischargeCompare(fn, dst); err != nil { // if true skip next
 			return err
 		}
-		fn.code(bytecode.IABC(tokenToBytecodeOp[ex.operand], 0, dst, dst+1, false), ex.LineInfo) // if false skip next
-		fn.code(bytecode.IAB(bytecode.LFALSESKIP, dst, 0), ex.LineInfo)                          // set false don't skip next
-		fn.code(bytecode.True(dst), ex.LineInfo)                                                 // set true then skip next
-	case tokenNe:
-		if err := ex.dischargeBoth(fn, dst); err != nil {
-			return err
-		}
-		fn.code(bytecode.IABC(bytecode.EQ, 1, dst, dst+1, false), ex.LineInfo) // if not eq skip next
-		fn.code(bytecode.IAB(bytecode.LFALSESKIP, dst, 0), ex.LineInfo)        // set false don't skip next
-		fn.code(bytecode.True(dst), ex.LineInfo)                               // set true then skip next
-	case tokenAnd:
-		if err := ex.exprs[0].discharge(fn, dst); err != nil {
-			return err
-		}
-		fn.code(bytecode.IAB(bytecode.TEST, dst, 0), ex.LineInfo)
-		ijmp := fn.code(bytecode.Jump(0), ex.LineInfo)
-		if err := ex.exprs[1].discharge(fn, dst); err != nil {
-			return err
-		}
-		fn.ByteCodes[ijmp] = bytecode.Jump(int32(len(fn.ByteCodes) - ijmp - 1))
-	case tokenOr:
-		if err := ex.exprs[0].discharge(fn, dst); err != nil {
+		fn.code(bytecode.IAB(bytecode.LFALSESKIP, dst, 0), ex.LineInfo) // set false don't skip next
+		fn.code(bytecode.True(dst), ex.LineInfo)                        // set true then skip next
+	case tokenAnd, tokenOr:
+		var expected uint8
+		if ex.operand == tokenOr {
+			expected = 1
+		}
+		// a local can be tested where it is and only copied if it is the result
+		if val, isVal := ex.exprs[0].(*exVariable); isVal && val.local && val.address != dst {
+			fn.code(bytecode.IABC(bytecode.TESTSET, dst, val.address, expected, false), ex.LineInfo)
+		} else if err := ex.exprs[0].discharge(fn, dst); err != nil {
 			return err
+		} else {
+			fn.code(bytecode.IAB(bytecode.TEST, dst, expected), ex.LineInfo)
 		}
-		fn.code(bytecode.IAB(bytecode.TEST, dst, 1), ex.LineInfo)
 		ijmp := fn.code(bytecode.Jump(0), ex.LineInfo)
 		if err := ex.exprs[1].discharge(fn, dst); err != nil {
 			return err
@@ -480,6 +484,92 @@ func (ex *exInfixOp) dischargeBoth(fn *FnProto, dst uint8) error {
 	return ex.exprs[1].discharge(fn, dst+1)
 }
 
+// dischargeConstArith encodes a constant operand directly into the arithmetic
+// instruction, as an immediate for ADDI, SHLI and SHRI or as a constant for the
+// K variants, followed by the matching MMBINI or MMBINK. Only one operand is ever
+// constant otherwise the expression would have been folded, if that is the left
+// operand the instructions are flagged as flipped. It returns false if nothing
+// was emitted.
+func (ex *exInfixOp) dischargeConstArith(fn *FnProto, dst uint8) (bool, error) {
+	num, other, flipped := ex.exprs[1], ex.exprs[0], false
+	if !exIsNum(num) {
+		num, other, flipped = ex.exprs[0], ex.exprs[1], true
+	}
+	if !exIsNum(num) {
+		return false, nil
+	}
+	op := tokenToBytecodeOp[ex.operand]
+	if iop, hasImm := tokenToBytecodeOpI[ex.operand]; hasImm {
+		if ival, isInt := num.(*exInteger); isInt && ival.val >= math.MinInt8 && ival.val <= math.MaxInt8 {
+			src, err := dischargeOperand(fn, other, dst)
+			if err != nil {
+				return false, err
+			}
+			fn.code(bytecode.IABsC(iop, dst, src, int8(ival.val), flipped), ex.LineInfo)
+			fn.code(bytecode.IAsBC(bytecode.MMBINI, src, int8(ival.val), uint8(op), flipped), ex.LineInfo)
+			return true, nil
+		}
+	}
+	kop, hasConst := tokenToBytecodeOpK[ex.operand]
+	if !hasConst {
+		return false, nil
+	}
+	kval, _ := exIsConst(num)
+	kaddr, err := fn.addConst(kval)
+	if err != nil {
+		return false, err
+	} else if kaddr > conf.MAXINLINECONST {
+		return false, nil
+	}
+	src, err := dischargeOperand(fn, other, dst)
+	if err != nil {
+		return false, err
+	}
+	fn.code(bytecode.IABC(kop, dst, src, uint8(kaddr), flipped), ex.LineInfo)
+	fn.code(bytecode.IABC(bytecode.MMBINK, src, uint8(kaddr), uint8(op), flipped), ex.LineInfo)
+	return true, nil
+}
+
+// dischargeCompare emits the comparison instruction that skips the next instruction
+// if the comparison holds. Small integers are compared with EQI, LTI and LEI and
+// other constants are compared for equality with EQK.
+func (ex *exInfixOp) dischargeCompare(fn *FnProto, dst uint8) error {
+	var expected uint8
+	op := ex.operand
+	if op == tokenNe {
+		expected, op = 1, tokenEq
+	}
+	konst, other, flipped := ex.exprs[1], ex.exprs[0], false
+	if _, isConst := exIsEqConst(konst); !isConst {
+		konst, other, flipped = ex.exprs[0], ex.exprs[1], true
+	}
+	if ival, isInt := konst.(*exInteger); isInt && ival.val >= math.MinInt8 && ival.val <= math.MaxInt8 {
+		src, err := dischargeOperand(fn, other, dst)
+		if err != nil {
+			return err
+		}
+		fn.code(bytecode.IABsC(tokenToBytecodeOpI[op], expected, src, int8(ival.val), flipped && op != tokenEq), ex.LineInfo)
+		return nil
+	} else if kval, isConst := exIsEqConst(konst); isConst && op == tokenEq {
+		kaddr, err := fn.addConst(kval)
+		if err != nil {
+			return err
+		} else if kaddr <= conf.MAXINLINECONST {
+			src, err := dischargeOperand(fn, other, dst)
+			if err != nil {
+				return err
+			}
+			fn.code(bytecode.IABC(bytecode.EQK, expected, src, uint8(kaddr), false), ex.LineInfo)
+			return nil
+		}
+	}
+	if err := ex.dischargeBoth(fn, dst); err != nil {
+		return err
+	}
+	fn.code(bytecode.IABC(tokenToBytecodeOp[op], expected, dst, dst+1, false), ex.LineInfo)
+	return nil
+}
+
 func (ex *exInfixOp) inferType() types.Definition {
 	switch ex.operand {
 	case tokenConcat:
@@ -812,6 +902,30 @@ func dischargeMaybeConst(fn *FnProto, ex expression, dst uint8) (uint8, bool, er
 	return dst, false, ex.discharge(fn, dst)
 }
 
+// specializedKey checks if a table key can be encoded directly into the table
+// access instructions. Small positive integers are used as the index itself by
+// GETI and SETI and short string constants are referenced by GETFIELD and
+// SETFIELD, which is signaled by isField.
+func specializedKey(fn *FnProto, key expression) (uint8, bool, bool, error) {
+	switch ex := key.(type) {
+	case *exInteger:
+		if ex.val >= 0 && ex.val <= math.MaxUint8 {
+			return uint8(ex.val), false, true, nil
+		}
+	case *exString:
+		if len(ex.val) > conf.MAXSHORTLEN {
+			return 0, false, false, nil
+		}
+		kaddr, err := fn.addConst(ex.val)
+		if err != nil {
+			return 0, false, false, err
+		} else if kaddr <= conf.MAXINLINECONST {
+			return uint8(kaddr), true, true, nil
+		}
+	}
+	return 0, false, false, nil
+}
+
 func exIsConst(expr expression) (any, bool) {
 	switch ex := expr.(type) {
 	case *exString:
@@ -825,6 +939,43 @@ func exIsConst(expr expression) (any, bool) {
 	}
 }
 
+// dischargeOperand returns the register that holds the value of ex. Locals are
+// used where they are rather than being copied into dst first.
+func dischargeOperand(fn *FnProto, ex expression, dst uint8) (uint8, error) {
+	if val, isVal := ex.(*exVariable); isVal && val.local {
+		return val.address, nil
+	}
+	return dst, ex.discharge(fn, dst)
+}
+
+// exIsEqConst extends exIsConst with the values that can only be compared for
+// equality as constants.
+func exIsEqConst(expr expression) (any, bool) {
+	switch ex := expr.(type) {
+	case *exNil:
+		return nil, true
+	case *exBool:
+		return ex.val, true
+	default:
+		return exIsConst(expr)
+	}
+}
+
+// inlineConst copies the value of a const local so that it can be used in place
+// of the variable where it is referenced.
+func inlineConst(expr expression, linfo LineInfo) expression {
+	switch ex := expr.(type) {
+	case *exInteger:
+		return &exInteger{val: ex.val, LineInfo: linfo}
+	case *exFloat:
+		return &exFloat{val: ex.val, LineInfo: linfo}
+	case *exBool:
+		return &exBool{val: ex.val, LineInfo: linfo}
+	default:
+		return &exNil{LineInfo: linfo}
+	}
+}
+
 func inferTypeArray(exprs []expression) []types.Definition {
 	defns := make([]types.Definition, len(exprs))
 	for i, ex := range exprs {
@@ -1,6 +1,7 @@
 package parse
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
@@ -17,7 +18,11 @@ import (
 	"github.com/tanema/luaf/internal/types"
 )
 
-const _ENVName = "_ENV"
+const (
+	_ENVName = "_ENV"
+	// undumpPrealloc is the most items that are allocated up front while undumping.
+	undumpPrealloc = 1024
+)
 
 type (
 	// Upindex captures an upvalue position for fetching them during runtime.
@@ -36,6 +41,7 @@ type (
 		attrConst bool
 		attrClose bool
 		typeDefn  types.Definition
+		constVal  expression // compile time value of a const local that closures inline
 		register  uint8
 		startPC   int
 		endPC     int
@@ -295,12 +301,7 @@ func (fn *FnProto) checkGotos(p *Parser) error {
 // finalize is the final step that does the following:
 // - ensures that the function ends with a return statement (simplifies VM).
 // - validates that all gotos have a destination.
-// future:
-// - optimizes the generated bytecode.
-//   - JMP threading: unconditional jumps are folded.
-//   - Null op: usesless loads and/or math operations that do nothing like multiplication by 1
-//   - Specialize Ops Add -> AddI
-//   - Duplicate load values, LoadI 0, 1, LOADI 1, 1, ADD 0, 0, 1 => LoadI 0, 1, ADD 0, 0, 0
+// - optimizes the generated bytecode at the configured level.
 func (fn *FnProto) finalize(p *Parser) error {
 	if len(fn.ByteCodes) == 0 || !bytecode.IsReturn(fn.ByteCodes[len(fn.ByteCodes)-1]) {
 		p.code(fn, bytecode.Return(0, 0))
@@ -312,7 +313,11 @@ func (fn *FnProto) finalize(p *Parser) error {
 		}
 	}
 
-	return fn.checkGotos(p)
+	if err := fn.checkGotos(p); err != nil {
+		return err
+	}
+	fn.optimize(p.config.Optimize)
+	return nil
 }
 
 func (fn *FnProto) code(op uint32, linfo LineInfo) int {
@@ -350,13 +355,24 @@ func (fn *FnProto) String() string {
 				return fmt.Sprintf("\t%s values", optionVariable(bytecode.GetB(op)))
 			case bytecode.SETLIST:
 				return fmt.Sprintf("\t%s values in from stack index %v", optionVariable(bytecode.GetvB(op)), bytecode.GetvC(op))
+			case bytecode.MMBIN, bytecode.MMBINI, bytecode.MMBINK:
+				mmop := bytecode.Op(bytecode.GetC(op))
+				return "\t" + mmop.ToString()
 			}
 			if bytecode.Kind(op) == bytecode.TypeABC {
 				b := bytecode.GetB(op)
 				c := bytecode.GetC(op)
 				out := []string{}
-				if inst := bytecode.GetOp(op); (inst == bytecode.GETTABUP || inst == bytecode.SETTABUP) && b == 0 {
-					out = append(out, _ENVName)
+				switch inst := bytecode.GetOp(op); inst {
+				case bytecode.GETTABUP, bytecode.SETTABUP:
+					if b == 0 {
+						out = append(out, _ENVName)
+					}
+				case bytecode.GETFIELD, bytecode.EQK, bytecode.ADDK, bytecode.SUBK, bytecode.MULK, bytecode.MODK,
+					bytecode.POWK, bytecode.DIVK, bytecode.IDIVK, bytecode.BANDK, bytecode.BORK, bytecode.BXORK:
+					out = append(out, fmt.Sprintf(`"%v"`, toString(fn.GetConst(c))))
+				case bytecode.SETFIELD:
+					out = append(out, fmt.Sprintf(`"%v"`, toString(fn.GetConst(b))))
 				}
 				if bytecode.GetK(op) {
 					switch bytecode.GetOp(op) {
@@ -396,12 +412,14 @@ func optionVariable(param int64) string {
 }
 
 // Dump will serialize fnproto data into a byte array for writing out to a file.
-func (fn *FnProto) Dump(_ bool) ([]byte, error) {
+// If strip is true, debug information like line traces, local variable names
+// and comments are left out of the output.
+func (fn *FnProto) Dump(strip bool) ([]byte, error) {
 	var end binary.ByteOrder = binary.NativeEndian
 	buf := []byte{}
 	return buf, anyerr([]error{
 		dumpHeader(&buf, end),
-		dumpFn(&buf, end, fn),
+		dumpFn(&buf, end, fn, strip),
 	})
 }
 
@@ -413,38 +431,55 @@ func hasLuaBinPrefix(src io.ReadSeeker) bool {
 	} else if err != nil && !errors.Is(err, io.EOF) {
 		return false
 	}
-	return strings.HasPrefix(string(prefix[:n]), conf.LUASIGNATURE)
+	return strings.HasPrefix(string(prefix[:n]), conf.LUASIGNATURE) || hasLua54Prefix(prefix[:n])
 }
 
 // UndumpFnProto will deserialize fnproto data into a new fnproto ready for interpreting.
-func UndumpFnProto(buf io.Reader) (*FnProto, error) {
-	var end binary.ByteOrder = binary.NativeEndian
-	fn := &FnProto{}
-	return fn, anyerr([]error{
-		undumpHeader(buf, end),
-		undumpFn(buf, end, fn),
-	})
+// Chunks dumped by Lua 5.4 are also accepted and translated into luaf bytecode.
+// The bytecode is verified before it is returned so that a corrupt chunk cannot
+// crash the vm.
+func UndumpFnProto(src io.Reader) (*FnProto, error) {
+	buf := bufio.NewReader(src)
+	var fn *FnProto
+	var err error
+	if prefix, _ := buf.Peek(len(lua54Signature) + 1); hasLua54Prefix(prefix) {
+		fn, err = undumpLua54(buf)
+	} else {
+		var end binary.ByteOrder = binary.NativeEndian
+		fn = &FnProto{}
+		err = anyerr([]error{
+			undumpHeader(buf, end),
+			undumpFn(buf, end, fn),
+		})
+	}
+	if err != nil {
+		return nil, err
+	} else if err := fn.verify(); err != nil {
+		return nil, err
+	}
+	return fn, nil
 }
 
 func dumpHeader(buf *[]byte, end binary.ByteOrder) error {
 	return anyerr([]error{
-		dump(buf, end, conf.LUASIGNATURE),
+		dump(buf, end, []byte(conf.LUASIGNATURE)),
 		dump(buf, end, conf.LUAVERSION),
 		dump(buf, end, int8(conf.LUAFORMAT)),
 	})
 }
 
 func undumpHeader(buf io.Reader, end binary.ByteOrder) error {
-	var signature, version string
+	var version string
 	var format int8
+	signature := make([]byte, len(conf.LUASIGNATURE))
 	if err := anyerr([]error{
-		undump(buf, end, &signature),
+		undump(buf, end, signature),
 		undump(buf, end, &version),
 		undump(buf, end, &format),
 	}); err != nil {
 		return err
 	}
-	if signature != conf.LUASIGNATURE {
+	if string(signature) != conf.LUASIGNATURE {
 		return errors.New("invalid signature")
 	} else if version != conf.LUAVERSION {
 		return fmt.Errorf("unsupported version, current %v, found %v", conf.LUAVERSION, version)
@@ -454,25 +489,35 @@ func undumpHeader(buf io.Reader, end binary.ByteOrder) error {
 	return nil
 }
 
-func dumpFn(buf *[]byte, end binary.ByteOrder, fn *FnProto) error {
+func dumpFn(buf *[]byte, end binary.ByteOrder, fn *FnProto, strip bool) error {
 	return anyerr([]error{
+		dump(buf, end, fn.Name),
+		dump(buf, end, fn.Filename),
 		dump(buf, end, fn.Line),
+		dump(buf, end, fn.Column),
 		dump(buf, end, fn.Arity),
+		dump(buf, end, fn.Varargs),
 		dumpByteCodes(buf, end, fn),
 		dumpConstants(buf, end, fn),
 		dumpUpvals(buf, end, fn),
-		dumpFnTable(buf, end, fn),
+		dumpFnTable(buf, end, fn, strip),
+		dumpDebug(buf, end, fn, strip),
 	})
 }
 
 func undumpFn(buf io.Reader, end binary.ByteOrder, fn *FnProto) error {
 	return anyerr([]error{
+		undump(buf, end, &fn.Name),
+		undump(buf, end, &fn.Filename),
 		undump(buf, end, &fn.Line),
+		undump(buf, end, &fn.Column),
 		undump(buf, end, &fn.Arity),
+		undump(buf, end, &fn.Varargs),
 		undumpByteCodes(buf, end, fn),
 		undumpConstants(buf, end, fn),
 		undumpUpvals(buf, end, fn),
 		undumpFnTable(buf, end, fn),
+		undumpDebug(buf, end, fn),
 	})
 }
 
@@ -489,17 +534,17 @@ func dumpByteCodes(buf *[]byte, end binary.ByteOrder, fn *FnProto) error {
 }
 
 func undumpByteCodes(buf io.Reader, end binary.ByteOrder, fn *FnProto) error {
-	var size int64
-	if err := undump(buf, end, &size); err != nil {
-		return fmt.Errorf("undumpFnTable: %w", err)
+	size, err := undumpLen(buf, end)
+	if err != nil {
+		return fmt.Errorf("undumpByteCodes: %w", err)
 	}
-	fn.ByteCodes = make([]uint32, size)
-	for i := range size {
+	fn.ByteCodes = make([]uint32, 0, min(size, undumpPrealloc))
+	for range size {
 		var code uint32
 		if err := undump(buf, end, &code); err != nil {
 			return err
 		}
-		fn.ByteCodes[i] = code
+		fn.ByteCodes = append(fn.ByteCodes, code)
 	}
 	return nil
 }
@@ -522,6 +567,15 @@ func dumpConstants(buf *[]byte, end binary.ByteOrder, fn *FnProto) error {
 			if err := dump(buf, end, 'i'); err != nil {
 				return err
 			}
+		case bool:
+			if err := dump(buf, end, 'b'); err != nil {
+				return err
+			}
+		case nil:
+			if err := dump(buf, end, 'n'); err != nil {
+				return err
+			}
+			continue
 		}
 		if err := dump(buf, end, konst); err != nil {
 			return err
@@ -531,36 +585,42 @@ func dumpConstants(buf *[]byte, end binary.ByteOrder, fn *FnProto) error {
 }
 
 func undumpConstants(buf io.Reader, end binary.ByteOrder, fn *FnProto) error {
-	var size int64
-	if err := undump(buf, end, &size); err != nil {
+	size, err := undumpLen(buf, end)
+	if err != nil {
 		return fmt.Errorf("undumpConstants: %w", err)
 	}
-	fn.Constants = make([]any, size)
-	for i := range size {
+	fn.Constants = make([]any, 0, min(size, undumpPrealloc))
+	for range size {
 		var kind rune
 		if err := undump(buf, end, &kind); err != nil {
 			return err
 		}
+		var val any
 		switch kind {
 		case 's':
-			var val string
-			if err := undump(buf, end, &val); err != nil {
-				return err
-			}
-			fn.Constants[i] = val
+			var str string
+			err = undump(buf, end, &str)
+			val = str
 		case 'f':
-			var val float64
-			if err := undump(buf, end, &val); err != nil {
-				return err
-			}
-			fn.Constants[i] = val
+			var num float64
+			err = undump(buf, end, &num)
+			val = num
 		case 'i':
-			var val int64
-			if err := undump(buf, end, &val); err != nil {
-				return err
-			}
-			fn.Constants[i] = val
+			var num int64
+			err = undump(buf, end, &num)
+			val = num
+		case 'b':
+			var b bool
+			err = undump(buf, end, &b)
+			val = b
+		case 'n':
+		default:
+			return fmt.Errorf("undumpConstants: unknown constant type %q", kind)
 		}
+		if err != nil {
+			return err
+		}
+		fn.Constants = append(fn.Constants, val)
 	}
 	return nil
 }
@@ -582,12 +642,12 @@ func dumpUpvals(buf *[]byte, end binary.ByteOrder, fn *FnProto) error {
 }
 
 func undumpUpvals(buf io.Reader, end binary.ByteOrder, fn *FnProto) error {
-	var size int64
-	if err := undump(buf, end, &size); err != nil {
+	size, err := undumpLen(buf, end)
+	if err != nil {
 		return fmt.Errorf("undumpUpvals: %w", err)
 	}
-	fn.UpIndexes = make([]Upindex, size)
-	for i := range size {
+	fn.UpIndexes = make([]Upindex, 0, min(size, undumpPrealloc))
+	for range size {
 		index := Upindex{}
 		if err := anyerr([]error{
 			undump(buf, end, &index.FromStack),
@@ -596,17 +656,17 @@ func undumpUpvals(buf io.Reader, end binary.ByteOrder, fn *FnProto) error {
 		}); err != nil {
 			return err
 		}
-		fn.UpIndexes[i] = index
+		fn.UpIndexes = append(fn.UpIndexes, index)
 	}
 	return nil
 }
 
-func dumpFnTable(buf *[]byte, end binary.ByteOrder, fn *FnProto) error {
+func dumpFnTable(buf *[]byte, end binary.ByteOrder, fn *FnProto, strip bool) error {
 	if err := dump(buf, end, int64(len(fn.FnTable))); err != nil {
 		return fmt.Errorf("dumpFnTable: %w", err)
 	}
 	for _, proto := range fn.FnTable {
-		if err := dumpFn(buf, end, proto); err != nil {
+		if err := dumpFn(buf, end, proto, strip); err != nil {
 			return err
 		}
 	}
@@ -614,21 +674,93 @@ func dumpFnTable(buf *[]byte, end binary.ByteOrder, fn *FnProto) error {
 }
 
 func undumpFnTable(buf io.Reader, end binary.ByteOrder, fn *FnProto) error {
-	var size int64
-	if err := undump(buf, end, &size); err != nil {
+	size, err := undumpLen(buf, end)
+	if err != nil {
 		return fmt.Errorf("undumpFnTable: %w", err)
 	}
-	fn.FnTable = make([]*FnProto, size)
-	for i := range size {
+	fn.FnTable = make([]*FnProto, 0, min(size, undumpPrealloc))
+	for range size {
 		proto := &FnProto{}
 		if err := undumpFn(buf, end, proto); err != nil {
 			return err
 		}
-		fn.FnTable[i] = proto
+		fn.FnTable = append(fn.FnTable, proto)
 	}
 	return nil
 }
 
+// dumpDebug writes the information only needed for error messages and
+// debugging. When stripped, empty sections are written so that the format
+// stays the same.
+func dumpDebug(buf *[]byte, end binary.ByteOrder, fn *FnProto, strip bool) error {
+	lineTrace, locals, comment := fn.LineTrace, fn.AllLocals, fn.Comment
+	if strip {
+		lineTrace, locals, comment = nil, nil, ""
+	}
+	if err := dump(buf, end, int64(len(lineTrace))); err != nil {
+		return fmt.Errorf("dumpDebug: %w", err)
+	}
+	for _, li := range lineTrace {
+		if err := anyerr([]error{
+			dump(buf, end, li.Line),
+			dump(buf, end, li.Column),
+		}); err != nil {
+			return err
+		}
+	}
+	if err := dump(buf, end, int64(len(locals))); err != nil {
+		return fmt.Errorf("dumpDebug: %w", err)
+	}
+	for _, lcl := range locals {
+		if err := anyerr([]error{
+			dump(buf, end, lcl.name),
+			dump(buf, end, lcl.register),
+			dump(buf, end, int64(lcl.startPC)),
+			dump(buf, end, int64(lcl.endPC)),
+		}); err != nil {
+			return err
+		}
+	}
+	return dump(buf, end, comment)
+}
+
+func undumpDebug(buf io.Reader, end binary.ByteOrder, fn *FnProto) error {
+	size, err := undumpLen(buf, end)
+	if err != nil {
+		return fmt.Errorf("undumpDebug: %w", err)
+	}
+	fn.LineTrace = make([]LineInfo, 0, min(size, undumpPrealloc))
+	for range size {
+		var li LineInfo
+		if err := anyerr([]error{
+			undump(buf, end, &li.Line),
+			undump(buf, end, &li.Column),
+		}); err != nil {
+			return err
+		}
+		fn.LineTrace = append(fn.LineTrace, li)
+	}
+	if size, err = undumpLen(buf, end); err != nil {
+		return fmt.Errorf("undumpDebug: %w", err)
+	}
+	fn.AllLocals = make([]*Local, 0, min(size, undumpPrealloc))
+	for range size {
+		var startPC, endPC int64
+		lcl := &Local{}
+		if err := anyerr([]error{
+			undump(buf, end, &lcl.name),
+			undump(buf, end, &lcl.register),
+			undump(buf, end, &startPC),
+			undump(buf, end, &endPC),
+		}); err != nil {
+			return err
+		}
+		lcl.startPC, lcl.endPC = int(startPC), int(endPC)
+		fn.AllLocals = append(fn.AllLocals, lcl)
+	}
+	return undump(buf, end, &fn.Comment)
+}
+
 func dump(buf *[]byte, end binary.ByteOrder, val any) error {
 	var err error
 	switch tval := val.(type) {
@@ -636,7 +768,9 @@ func dump(buf *[]byte, end binary.ByteOrder, val any) error {
 		float32, float64, []byte:
 		*buf, err = binary.Append(*buf, end, tval)
 	case string:
-		*buf, err = binary.Append(*buf, end, fmt.Appendf(nil, "%s\000", val))
+		if *buf, err = binary.Append(*buf, end, int64(len(tval))); err == nil {
+			*buf = append(*buf, tval...)
+		}
 	default:
 		return fmt.Errorf("dump: unsupported type %T", val)
 	}
@@ -649,17 +783,15 @@ func dump(buf *[]byte, end binary.ByteOrder, val any) error {
 func undump(buf io.Reader, end binary.ByteOrder, val any) error {
 	switch tval := val.(type) {
 	case *string:
-		strBuf := []byte{}
-		for {
-			var b byte
-			if err := binary.Read(buf, end, &b); err != nil {
-				return fmt.Errorf("undump string: %w", err)
-			} else if b == '\000' {
-				break
-			}
-			strBuf = append(strBuf, b)
+		size, err := undumpLen(buf, end)
+		if err != nil {
+			return fmt.Errorf("undump string: %w", err)
+		}
+		var str strings.Builder
+		if _, err := io.CopyN(&str, buf, size); err != nil {
+			return fmt.Errorf("undump string: %w", err)
 		}
-		*tval = string(strBuf)
+		*tval = str.String()
 		return nil
 	default:
 		if err := binary.Read(buf, end, val); err != nil {
@@ -669,6 +801,18 @@ func undump(buf io.Reader, end binary.ByteOrder, val any) error {
 	}
 }
 
+// undumpLen reads the length of a list or string. Lengths are not trusted to
+// preallocate with as a corrupt chunk could ask for any amount of memory.
+func undumpLen(buf io.Reader, end binary.ByteOrder) (int64, error) {
+	var size int64
+	if err := binary.Read(buf, end, &size); err != nil {
+		return 0, err
+	} else if size < 0 {
+		return 0, fmt.Errorf("invalid length %v", size)
+	}
+	return size, nil
+}
+
 func anyerr(errs []error) error {
 	for _, err := range errs {
 		if err != nil {
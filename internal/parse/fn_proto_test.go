@@ -0,0 +1,128 @@
+package parse
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tanema/luaf/internal/bytecode"
+	"github.com/tanema/luaf/internal/conf"
+)
+
+func TestDumpUndump(t *testing.T) {
+	t.Parallel()
+
+	src := `local a = "one"
+---adds a to b
+local function add(b, ...)
+  return a .. b
+end
+return add(2)`
+	fn, err := Parse("dump.lua", strings.NewReader(src), ModeText)
+	require.NoError(t, err)
+
+	t.Run("keeps debug information", func(t *testing.T) {
+		t.Parallel()
+		data, err := fn.Dump(false)
+		require.NoError(t, err)
+		undumped, err := Parse("ignored", bytes.NewReader(data), ModeBinary)
+		require.NoError(t, err)
+		assert.Equal(t, fn.ByteCodes, undumped.ByteCodes)
+		assert.Equal(t, fn.Constants, undumped.Constants)
+		assert.Equal(t, fn.LineTrace, undumped.LineTrace)
+		assert.Equal(t, "dump.lua", undumped.Filename)
+		require.Len(t, undumped.FnTable, 1)
+		child := undumped.FnTable[0]
+		assert.Equal(t, "add", child.Name)
+		assert.True(t, child.Varargs)
+		assert.Equal(t, fn.FnTable[0].Comment, child.Comment)
+		assert.Equal(t, fn.FnTable[0].LineTrace, child.LineTrace)
+		name, ok := child.LocalNameAt(0, 0)
+		assert.True(t, ok)
+		assert.Equal(t, "b", name)
+	})
+
+	t.Run("strip drops debug information", func(t *testing.T) {
+		t.Parallel()
+		full, err := fn.Dump(false)
+		require.NoError(t, err)
+		data, err := fn.Dump(true)
+		require.NoError(t, err)
+		assert.Less(t, len(data), len(full))
+		undumped, err := Parse("ignored", bytes.NewReader(data), ModeBinary)
+		require.NoError(t, err)
+		assert.Equal(t, fn.ByteCodes, undumped.ByteCodes)
+		assert.Empty(t, undumped.LineTrace)
+		assert.Empty(t, undumped.AllLocals)
+		child := undumped.FnTable[0]
+		assert.Empty(t, child.LineTrace)
+		assert.Empty(t, child.Comment)
+		_, ok := child.LocalNameAt(0, 0)
+		assert.False(t, ok)
+	})
+}
+
+func TestCombine(t *testing.T) {
+	t.Parallel()
+
+	main, err := Parse("main.lua", strings.NewReader(`return require("lib.a")`), ModeText)
+	require.NoError(t, err)
+	mod, err := Parse("lib/a.lua", strings.NewReader(`return x`), ModeText)
+	require.NoError(t, err)
+
+	fn, err := Combine(main, map[string]*FnProto{"lib.a": mod})
+	require.NoError(t, err)
+	assert.Equal(t, []any{"package", "preload", "lib.a"}, fn.Constants)
+	assert.Equal(t, []uint32{
+		bytecode.IABC(bytecode.GETTABUP, 0, 0, 0, true),
+		bytecode.IABC(bytecode.GETFIELD, 0, 0, 1, false),
+		bytecode.IABx(bytecode.CLOSURE, 1, 0),
+		bytecode.IABC(bytecode.SETFIELD, 0, 2, 1, false),
+		bytecode.IABx(bytecode.CLOSURE, 1, 1),
+		bytecode.IAB(bytecode.VARARG, 2, 0),
+		bytecode.IABC(bytecode.CALL, 1, 0, 0, false),
+		bytecode.IAB(bytecode.RETURN, 1, 0),
+	}, fn.ByteCodes, fmtBytecodeDiff(nil, fn.ByteCodes))
+	require.Len(t, fn.FnTable, 2)
+	assert.Equal(t, mod.ByteCodes, fn.FnTable[0].ByteCodes)
+	require.Len(t, fn.FnTable[0].UpIndexes, 1)
+	assert.False(t, fn.FnTable[0].UpIndexes[0].FromStack)
+	assert.Equal(t, uint8(0), fn.FnTable[0].UpIndexes[0].Index)
+	assert.True(t, mod.UpIndexes[0].FromStack, "original chunk should not be modified")
+}
+
+func TestCombineLongModuleName(t *testing.T) {
+	t.Parallel()
+
+	name := "lib." + strings.Repeat("a", conf.MAXSHORTLEN)
+	main, err := Parse("main.lua", strings.NewReader(`return 1`), ModeText)
+	require.NoError(t, err)
+	mod, err := Parse("lib/a.lua", strings.NewReader(`return 2`), ModeText)
+	require.NoError(t, err)
+
+	fn, err := Combine(main, map[string]*FnProto{name: mod})
+	require.NoError(t, err)
+	assert.Equal(t, []any{"package", "preload", name}, fn.Constants)
+	assert.Equal(t, []uint32{
+		bytecode.IABx(bytecode.CLOSURE, 1, 0),
+		bytecode.IABx(bytecode.LOADK, 2, 2),
+		bytecode.IABC(bytecode.SETTABLE, 0, 2, 1, false),
+	}, fn.ByteCodes[2:5], fmtBytecodeDiff(nil, fn.ByteCodes))
+}
+
+func TestRequires(t *testing.T) {
+	t.Parallel()
+
+	src := `local a = require("lib.a")
+require "lib.b"
+local name = "dynamic"
+local c = require(name)
+local function f() return require("lib.c") end
+local d = require("lib.a")`
+	fn, err := Parse("requires.lua", strings.NewReader(src), ModeText)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lib.a", "lib.b", "lib.c"}, fn.Requires())
+}
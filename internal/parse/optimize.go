@@ -0,0 +1,942 @@
+package parse
+
+import (
+	"math"
+	"slices"
+
+	"github.com/tanema/luaf/internal/bytecode"
+)
+
+// OptLevel is how much work the optimizer does on each function after it is parsed.
+type OptLevel uint8
+
+const (
+	// OptNone leaves the generated bytecode as it is.
+	OptNone OptLevel = iota
+	// OptBasic threads jumps and removes code that can never be reached.
+	OptBasic
+	// OptFull also folds constants through registers and removes redundant moves
+	// and loads of values that are never read.
+	OptFull
+)
+
+// Mode returns the load mode flag that parses text at the level. It is combined
+// with ModeText so that each parse picks its own level.
+func (level OptLevel) Mode() LoadMode { return LoadMode(level) << optModeShift }
+
+// maxOptPasses limits how many times the passes are repeated while they still find
+// something to change.
+const maxOptPasses = 8
+
+// regSet is a set of registers, one bit for each of the 256 that a function can address.
+type regSet [4]uint64
+
+func (set *regSet) add(reg int64) {
+	if reg >= 0 && reg <= math.MaxUint8 {
+		set[reg/64] |= 1 << (reg % 64)
+	}
+}
+
+// addRange adds all registers from first to last inclusive.
+func (set *regSet) addRange(first, last int64) {
+	for reg := first; reg <= min(last, math.MaxUint8); reg++ {
+		set.add(reg)
+	}
+}
+
+func (set regSet) has(reg int64) bool {
+	return reg >= 0 && reg <= math.MaxUint8 && set[reg/64]&(1<<(reg%64)) != 0
+}
+
+func (set regSet) union(other regSet) regSet {
+	for i := range set {
+		set[i] |= other[i]
+	}
+	return set
+}
+
+func (set regSet) minus(other regSet) regSet {
+	for i := range set {
+		set[i] &^= other[i]
+	}
+	return set
+}
+
+// arithRegOp maps the immediate and constant forms of the arithmetic instructions
+// to the register form of the same operation.
+var arithRegOp = map[bytecode.Op]bytecode.Op{
+	bytecode.ADDI:  bytecode.ADD,
+	bytecode.SHLI:  bytecode.SHL,
+	bytecode.SHRI:  bytecode.SHR,
+	bytecode.ADDK:  bytecode.ADD,
+	bytecode.SUBK:  bytecode.SUB,
+	bytecode.MULK:  bytecode.MUL,
+	bytecode.MODK:  bytecode.MOD,
+	bytecode.POWK:  bytecode.POW,
+	bytecode.DIVK:  bytecode.DIV,
+	bytecode.IDIVK: bytecode.IDIV,
+	bytecode.BANDK: bytecode.BAND,
+	bytecode.BORK:  bytecode.BOR,
+	bytecode.BXORK: bytecode.BXOR,
+}
+
+func isRegArith(op bytecode.Op) bool {
+	switch op {
+	case bytecode.ADD, bytecode.SUB, bytecode.MUL, bytecode.DIV, bytecode.MOD, bytecode.POW, bytecode.IDIV,
+		bytecode.BAND, bytecode.BOR, bytecode.BXOR, bytecode.SHL, bytecode.SHR, bytecode.SAR:
+		return true
+	}
+	return false
+}
+
+// isArith reports if the instruction is one that is followed by an MMBIN which
+// it skips when the operation succeeds on numbers.
+func isArith(op bytecode.Op) bool {
+	_, isConstArith := arithRegOp[op]
+	return isConstArith || isRegArith(op)
+}
+
+// isSkip reports if the instruction can skip the instruction after it. That next
+// instruction is only ever reached in relation to this one so it cannot be removed.
+func isSkip(op bytecode.Op) bool {
+	switch op {
+	case bytecode.EQ, bytecode.LT, bytecode.LE, bytecode.EQK, bytecode.EQI, bytecode.LTI, bytecode.LEI,
+		bytecode.TEST, bytecode.TESTSET, bytecode.LFALSESKIP:
+		return true
+	}
+	return false
+}
+
+// hasExtraArg reports if an EXARG follows the instruction.
+func hasExtraArg(code uint32) bool {
+	switch bytecode.GetOp(code) {
+	case bytecode.NEWTABLE, bytecode.SETLIST:
+		return bytecode.GetK(code)
+	case bytecode.LOADKX:
+		return true
+	}
+	return false
+}
+
+// writesOnlyA reports if the instruction always sets R[A] and no other register,
+// so it can write to a different register instead.
+func writesOnlyA(op bytecode.Op) bool {
+	switch op {
+	case bytecode.MOVE, bytecode.LOADI, bytecode.LOADF, bytecode.LOADK, bytecode.LOADFALSE, bytecode.LOADTRUE,
+		bytecode.GETUPVAL, bytecode.GETTABUP, bytecode.GETTABLE, bytecode.GETI, bytecode.GETFIELD,
+		bytecode.CLOSURE, bytecode.UNM, bytecode.BNOT, bytecode.NOT, bytecode.LEN, bytecode.CONCAT:
+		return true
+	}
+	return isArith(op)
+}
+
+// optimize rewrites the bytecode of the function and all of its children. The
+// passes are repeated while they keep finding changes because each one exposes
+// more work for the others, like dead code after a folded jump.
+func (fn *FnProto) optimize(level OptLevel) {
+	if level == OptNone {
+		return
+	}
+	for _, child := range fn.FnTable {
+		child.optimize(level)
+	}
+	captured := fn.capturedRegs()
+	for range maxOptPasses {
+		changed := fn.threadJumps()
+		if level >= OptFull {
+			changed = fn.foldConstants(captured) || changed
+			changed = fn.removeRedundantMoves(captured) || changed
+		}
+		changed = fn.removeDeadCode() || changed
+		if !changed {
+			return
+		}
+	}
+}
+
+// successors returns the pcs that execution can continue at after pc.
+func (fn *FnProto) successors(pc int) []int {
+	code := fn.ByteCodes[pc]
+	var succ []int
+	switch op := bytecode.GetOp(code); {
+	case op == bytecode.RETURN, op == bytecode.RETURN0, op == bytecode.RETURN1:
+	case op == bytecode.JMP, op == bytecode.FORPREP:
+		target, _ := jumpTarget(pc, code)
+		succ = []int{target}
+	case op == bytecode.FORLOOP, op == bytecode.TFORLOOP:
+		target, _ := jumpTarget(pc, code)
+		succ = []int{pc + 1, target}
+	case op == bytecode.LFALSESKIP, hasExtraArg(code):
+		succ = []int{pc + 2}
+	case isSkip(op), isArith(op):
+		succ = []int{pc + 1, pc + 2}
+	default:
+		succ = []int{pc + 1}
+	}
+	return slices.DeleteFunc(succ, func(next int) bool { return next < 0 || next >= len(fn.ByteCodes) })
+}
+
+// blockStarts marks the instructions that can be arrived at from somewhere other
+// than the instruction before them, so nothing can be assumed about registers there.
+func (fn *FnProto) blockStarts() []bool {
+	starts := make([]bool, len(fn.ByteCodes))
+	if len(starts) > 0 {
+		starts[0] = true
+	}
+	for pc, code := range fn.ByteCodes {
+		succ := fn.successors(pc)
+		if !slices.Contains(succ, pc+1) && pc+1 < len(starts) {
+			starts[pc+1] = true
+		}
+		for _, next := range succ {
+			// the success path of arithmetic only steps over its own MMBIN
+			if next != pc+1 && (next != pc+2 || !isArith(bytecode.GetOp(code))) {
+				starts[next] = true
+			}
+		}
+	}
+	return starts
+}
+
+// isSlot reports if the instruction at pc belongs to the skip of the instruction
+// before it and must stay in place.
+func (fn *FnProto) isSlot(pc int) bool {
+	return pc > 0 && (isSkip(bytecode.GetOp(fn.ByteCodes[pc-1])) || hasExtraArg(fn.ByteCodes[pc-1]))
+}
+
+// regEffects returns the registers that an instruction may read and the ones that
+// it always writes. prev is the instruction before it, which MMBIN stores the result
+// of. ok is false if the instruction is not understood.
+func (fn *FnProto) regEffects(code, prev uint32) (reads, writes regSet, ok bool) {
+	op := bytecode.GetOp(code)
+	a := bytecode.GetA(code)
+	switch {
+	case isRegArith(op):
+		reads.add(bytecode.GetB(code))
+		reads.add(bytecode.GetC(code))
+		return reads, writes, true
+	case isArith(op):
+		reads.add(bytecode.GetB(code))
+		return reads, writes, true
+	}
+
+	switch op {
+	case bytecode.MOVE, bytecode.UNM, bytecode.BNOT, bytecode.GETI, bytecode.GETFIELD:
+		reads.add(bytecode.GetB(code))
+		writes.add(a)
+	case bytecode.NOT, bytecode.LEN:
+		if !bytecode.GetK(code) {
+			reads.add(bytecode.GetB(code))
+		}
+		writes.add(a)
+	case bytecode.LOADI, bytecode.LOADF, bytecode.LOADK, bytecode.LOADFALSE, bytecode.LOADTRUE,
+		bytecode.LFALSESKIP, bytecode.GETUPVAL, bytecode.NEWTABLE:
+		writes.add(a)
+	case bytecode.CLOSURE:
+		if idx := bytecode.GetBx(code); idx < int64(len(fn.FnTable)) {
+			for _, upindex := range fn.FnTable[idx].UpIndexes {
+				if upindex.FromStack {
+					reads.add(int64(upindex.Index))
+				}
+			}
+		}
+		writes.add(a)
+	case bytecode.LOADNIL:
+		writes.addRange(a, a+bytecode.GetBx(code))
+	case bytecode.MMBIN:
+		reads.add(a)
+		reads.add(bytecode.GetB(code))
+		writes.add(bytecode.GetA(prev))
+	case bytecode.MMBINI, bytecode.MMBINK:
+		reads.add(a)
+		writes.add(bytecode.GetA(prev))
+	case bytecode.CONCAT:
+		b, c := concatRange(code)
+		reads.addRange(b, c)
+		writes.add(a)
+	case bytecode.GETTABLE, bytecode.GETTABUP:
+		if op == bytecode.GETTABLE {
+			reads.add(bytecode.GetB(code))
+		}
+		if !bytecode.GetK(code) {
+			reads.add(bytecode.GetC(code))
+		}
+		writes.add(a)
+	case bytecode.SELF:
+		reads.add(bytecode.GetB(code))
+		writes.addRange(a, a+1)
+	case bytecode.SETTABLE, bytecode.SETI, bytecode.SETFIELD, bytecode.SETTABUP:
+		if op == bytecode.SETTABUP || op == bytecode.SETTABLE {
+			reads.add(bytecode.GetB(code))
+		}
+		if op != bytecode.SETTABUP {
+			reads.add(a)
+		}
+		if !bytecode.GetK(code) {
+			reads.add(bytecode.GetC(code))
+		}
+	case bytecode.SETUPVAL, bytecode.TEST, bytecode.RETURN1:
+		reads.add(a)
+	case bytecode.TESTSET, bytecode.EQK, bytecode.EQI, bytecode.LTI, bytecode.LEI:
+		reads.add(bytecode.GetB(code))
+	case bytecode.EQ, bytecode.LT, bytecode.LE:
+		reads.add(bytecode.GetB(code))
+		reads.add(bytecode.GetC(code))
+	case bytecode.SETLIST:
+		if nvals := bytecode.GetvB(code); nvals == 0 {
+			reads.addRange(a, math.MaxUint8)
+		} else {
+			reads.addRange(a, a+nvals-1)
+		}
+	case bytecode.CALL, bytecode.TAILCALL:
+		if nargs := bytecode.GetB(code); nargs == 0 {
+			reads.addRange(a, math.MaxUint8)
+		} else {
+			reads.addRange(a, a+nargs-1)
+		}
+		if nret := bytecode.GetC(code); nret >= 2 {
+			writes.addRange(a, a+nret-2)
+		}
+	case bytecode.RETURN:
+		if nret := bytecode.GetB(code); nret == 0 {
+			reads.addRange(a, math.MaxUint8)
+		} else {
+			reads.addRange(a, a+nret-2)
+		}
+	case bytecode.VARARG:
+		if nret := bytecode.GetB(code); nret >= 2 {
+			writes.addRange(a, a+nret-2)
+		}
+	case bytecode.FORPREP, bytecode.FORLOOP, bytecode.TFORCALL:
+		reads.addRange(a, a+2)
+		if op == bytecode.TFORCALL {
+			writes.addRange(a+3, a+2+bytecode.GetsBx(code))
+		}
+	case bytecode.TFORLOOP:
+		reads.addRange(a, a+3)
+	case bytecode.JMP, bytecode.RETURN0, bytecode.EXARG, bytecode.CLOSE, bytecode.TBC:
+	default:
+		return reads, writes, false
+	}
+	return reads, writes, true
+}
+
+// liveness returns the registers that may still be read after each instruction.
+// It returns false if the function has instructions that it does not understand.
+func (fn *FnProto) liveness() ([]regSet, bool) {
+	size := len(fn.ByteCodes)
+	reads := make([]regSet, size)
+	writes := make([]regSet, size)
+	succs := make([][]int, size)
+	for pc, code := range fn.ByteCodes {
+		var prev uint32
+		if pc > 0 {
+			prev = fn.ByteCodes[pc-1]
+		}
+		var ok bool
+		if reads[pc], writes[pc], ok = fn.regEffects(code, prev); !ok {
+			return nil, false
+		}
+		succs[pc] = fn.successors(pc)
+	}
+
+	liveIn := make([]regSet, size)
+	liveOut := make([]regSet, size)
+	for changed := true; changed; {
+		changed = false
+		for pc := size - 1; pc >= 0; pc-- {
+			var out regSet
+			for _, next := range succs[pc] {
+				out = out.union(liveIn[next])
+			}
+			in := reads[pc].union(out.minus(writes[pc]))
+			if in != liveIn[pc] || out != liveOut[pc] {
+				liveIn[pc], liveOut[pc] = in, out
+				changed = true
+			}
+		}
+	}
+	return liveOut, true
+}
+
+// capturedRegs returns the registers that are captured by closures or closed when
+// they go out of scope. Their values are used outside of the instructions that
+// read them so they are never rewritten.
+func (fn *FnProto) capturedRegs() regSet {
+	var regs regSet
+	for _, code := range fn.ByteCodes {
+		switch bytecode.GetOp(code) {
+		case bytecode.CLOSURE:
+			if idx := bytecode.GetBx(code); idx < int64(len(fn.FnTable)) {
+				for _, upindex := range fn.FnTable[idx].UpIndexes {
+					if upindex.FromStack {
+						regs.add(int64(upindex.Index))
+					}
+				}
+			}
+		case bytecode.TBC:
+			regs.add(bytecode.GetA(code))
+		}
+	}
+	for _, lcl := range fn.AllLocals {
+		if lcl.upvalRef || lcl.attrClose {
+			regs.add(int64(lcl.register))
+		}
+	}
+	return regs
+}
+
+// removeInstructions deletes the marked instructions and moves jump offsets, line
+// information and local scopes to match. Jumps to a removed instruction go to the
+// next instruction that is kept. Locals whose value never reaches their register
+// anymore are dropped.
+func (fn *FnProto) removeInstructions(removed []bool) bool {
+	if !slices.Contains(removed, true) {
+		return false
+	}
+	localStarts := make([]int, len(fn.AllLocals))
+	for i, lcl := range fn.AllLocals {
+		localStarts[i] = fn.localStart(lcl, removed)
+	}
+	newPC := make([]int, len(fn.ByteCodes)+1)
+	kept := 0
+	for pc := range fn.ByteCodes {
+		newPC[pc] = kept
+		if !removed[pc] {
+			kept++
+		}
+	}
+	newPC[len(fn.ByteCodes)] = kept
+
+	codes := make([]uint32, 0, kept)
+	lines := make([]LineInfo, 0, kept)
+	for pc, code := range fn.ByteCodes {
+		if removed[pc] {
+			continue
+		}
+		if target, isJump := jumpTarget(pc, code); isJump {
+			from, to := newPC[pc], newPC[target]
+			switch op := bytecode.GetOp(code); op {
+			case bytecode.JMP:
+				code = bytecode.Jump(int32(to - from - 1))
+			case bytecode.FORPREP:
+				code = bytecode.IABx(op, uint8(bytecode.GetA(code)), uint16(to-from-1))
+			default:
+				code = bytecode.IABx(op, uint8(bytecode.GetA(code)), uint16(from+1-to))
+			}
+		}
+		codes = append(codes, code)
+		lines = append(lines, fn.LineTrace[pc])
+	}
+	fn.ByteCodes, fn.LineTrace = codes, lines
+
+	locals := fn.AllLocals[:0]
+	for i, lcl := range fn.AllLocals {
+		if localStarts[i] < 0 {
+			continue
+		}
+		lcl.startPC = newPC[localStarts[i]]
+		if lcl.endPC >= 0 {
+			lcl.endPC = newPC[lcl.endPC]
+		}
+		locals = append(locals, lcl)
+	}
+	clear(fn.AllLocals[len(locals):])
+	fn.AllLocals = locals
+	return true
+}
+
+// localStart returns the pc that the value of a local is in its register from
+// once the marked instructions are removed, or -1 if it never gets there. A local
+// starts after the instruction that stores it, so if that store is removed the
+// local starts after the next instruction in its scope that writes its register.
+func (fn *FnProto) localStart(lcl *Local, removed []bool) int {
+	if lcl.startPC == 0 || !removed[lcl.startPC-1] {
+		return lcl.startPC
+	}
+	writesLocal := func(pc int) bool {
+		var prev uint32
+		if pc > 0 {
+			prev = fn.ByteCodes[pc-1]
+		}
+		_, writes, ok := fn.regEffects(fn.ByteCodes[pc], prev)
+		return !ok || writes.has(int64(lcl.register))
+	}
+	// a folded arithmetic instruction stores the local without its MMBIN, and a
+	// removed move may have had the instruction before it changed to store it.
+	for store := lcl.startPC - 1; store >= 0; store-- {
+		code := fn.ByteCodes[store]
+		if !removed[store] {
+			if writesLocal(store) {
+				return lcl.startPC
+			}
+			break
+		}
+		op := bytecode.GetOp(code)
+		isMMBIN := op == bytecode.MMBIN || op == bytecode.MMBINI || op == bytecode.MMBINK
+		if !isMMBIN && (op != bytecode.MOVE || bytecode.GetA(code) != int64(lcl.register)) {
+			break
+		}
+	}
+	end := len(fn.ByteCodes)
+	if lcl.endPC >= 0 {
+		end = min(lcl.endPC, end)
+	}
+	for pc := lcl.startPC; pc < end; pc++ {
+		if !removed[pc] && writesLocal(pc) {
+			return pc + 1
+		}
+	}
+	return -1
+}
+
+// threadJumps points jumps that land on another unconditional jump straight at
+// the final destination.
+func (fn *FnProto) threadJumps() bool {
+	changed := false
+	for pc, code := range fn.ByteCodes {
+		if bytecode.GetOp(code) != bytecode.JMP {
+			continue
+		}
+		target, _ := jumpTarget(pc, code)
+		final := target
+		for range len(fn.ByteCodes) {
+			if final < 0 || final >= len(fn.ByteCodes) || bytecode.GetOp(fn.ByteCodes[final]) != bytecode.JMP {
+				break
+			}
+			nextTarget, _ := jumpTarget(final, fn.ByteCodes[final])
+			if nextTarget == final {
+				break
+			}
+			final = nextTarget
+		}
+		if final != target {
+			fn.ByteCodes[pc] = bytecode.Jump(int32(final - pc - 1))
+			changed = true
+		}
+	}
+	return changed
+}
+
+// removeDeadCode removes instructions that can never be reached and jumps to the
+// instruction right after them.
+func (fn *FnProto) removeDeadCode() bool {
+	size := len(fn.ByteCodes)
+	if size == 0 {
+		return false
+	}
+	reached := make([]bool, size)
+	queue := []int{0}
+	reached[0] = true
+	for len(queue) > 0 {
+		pc := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		next := fn.successors(pc)
+		if code := fn.ByteCodes[pc]; (isSkip(bytecode.GetOp(code)) || hasExtraArg(code)) && pc+1 < size {
+			next = append(next, pc+1)
+		}
+		for _, succ := range next {
+			if !reached[succ] {
+				reached[succ] = true
+				queue = append(queue, succ)
+			}
+		}
+	}
+
+	removed := make([]bool, size)
+	for pc, code := range fn.ByteCodes {
+		if pc == size-1 {
+			break // the function always ends with the return added in finalize
+		}
+		isNop := bytecode.GetOp(code) == bytecode.JMP && bytecode.GetJump(code) == 0
+		removed[pc] = !reached[pc] || (isNop && !fn.isSlot(pc))
+	}
+	return fn.removeInstructions(removed)
+}
+
+// concatRange returns the first and last register that CONCAT joins.
+func concatRange(code uint32) (int64, int64) {
+	b, c := bytecode.GetB(code), bytecode.GetC(code)
+	if c < b {
+		c = b + 1
+	}
+	return b, c
+}
+
+// constExpr converts a constant value to the expression that it would have been
+// parsed from, so that the folding of the parser can be used on it.
+func constExpr(val any) (expression, bool) {
+	switch tval := val.(type) {
+	case int64:
+		return &exInteger{val: tval}, true
+	case float64:
+		return &exFloat{val: tval}, true
+	case string:
+		return &exString{val: tval}, true
+	case bool:
+		return &exBool{val: tval}, true
+	}
+	return nil, false
+}
+
+// foldConstants tracks the values that registers are loaded with inside of each
+// block and replaces operations on known values with a load of the result.
+func (fn *FnProto) foldConstants(captured regSet) bool {
+	starts := fn.blockStarts()
+	removed := make([]bool, len(fn.ByteCodes))
+	known := map[int64]expression{}
+	changed := false
+	for pc := 0; pc < len(fn.ByteCodes); pc++ {
+		if starts[pc] {
+			clear(known)
+		}
+		code := fn.ByteCodes[pc]
+		op := bytecode.GetOp(code)
+		if result, ok := fn.foldInstruction(code, known); ok && !fn.isSlot(pc) {
+			if load, ok := fn.loadConst(uint8(bytecode.GetA(code)), result); ok {
+				fn.ByteCodes[pc] = load
+				if isArith(op) {
+					removed[pc+1] = true
+				}
+				changed = true
+				code = load
+			}
+		}
+		fn.trackConstants(code, known, captured)
+		if isArith(op) {
+			pc++ // the MMBIN stores to the same register as the arithmetic
+		}
+	}
+	return fn.removeInstructions(removed) || changed
+}
+
+// foldInstruction returns the result of an instruction if all of its operands are known.
+func (fn *FnProto) foldInstruction(code uint32, known map[int64]expression) (expression, bool) {
+	op := bytecode.GetOp(code)
+	switch {
+	case isArith(op):
+		lval, lok := known[bytecode.GetB(code)]
+		var rval expression
+		rok := true
+		switch {
+		case isRegArith(op):
+			rval, rok = known[bytecode.GetC(code)]
+		case op == bytecode.ADDI, op == bytecode.SHLI, op == bytecode.SHRI:
+			rval = &exInteger{val: bytecode.GetsC(code)}
+		default:
+			rval, rok = constExpr(fn.GetConst(bytecode.GetC(code)))
+		}
+		if !lok || !rok || !exIsNum(lval) || !exIsNum(rval) {
+			return nil, false
+		}
+		if bytecode.GetK(code) {
+			lval, rval = rval, lval
+		}
+		regOp := op
+		if rop, isConstArith := arithRegOp[op]; isConstArith {
+			regOp = rop
+		}
+		for tk, tkOp := range tokenToBytecodeOp {
+			if tkOp == regOp {
+				result := constFold(&exInfixOp{operand: tk, exprs: []expression{lval, rval}})
+				return result, exIsNum(result)
+			}
+		}
+	case op == bytecode.CONCAT:
+		b, c := concatRange(code)
+		if c == b {
+			return nil, false
+		}
+		var result expression = &exString{}
+		for reg := b; reg <= c; reg++ {
+			// floats are left to the vm which formats them differently from the parser
+			switch val := known[reg].(type) {
+			case *exString, *exInteger:
+				result = constFold(&exInfixOp{operand: tokenConcat, exprs: []expression{result, val}})
+			default:
+				return nil, false
+			}
+		}
+		return result, true
+	case op == bytecode.UNM, op == bytecode.BNOT, op == bytecode.NOT, op == bytecode.LEN:
+		val, ok := known[bytecode.GetB(code)]
+		if (op == bytecode.NOT || op == bytecode.LEN) && bytecode.GetK(code) {
+			val, ok = constExpr(fn.GetConst(bytecode.GetB(code)))
+		}
+		if !ok {
+			return nil, false
+		}
+		tk := map[bytecode.Op]tokenType{
+			bytecode.UNM:  tokenMinus,
+			bytecode.BNOT: tokenBitwiseNotOrXOr,
+			bytecode.NOT:  tokenNot,
+			bytecode.LEN:  tokenLength,
+		}[op]
+		switch result := unaryExpression(&token{Kind: tk}, val).(type) {
+		case *exInteger, *exFloat, *exBool:
+			return result, true
+		}
+	}
+	return nil, false
+}
+
+// loadConst creates the instruction that loads a folded value into dst.
+func (fn *FnProto) loadConst(dst uint8, val expression) (uint32, bool) {
+	switch tval := val.(type) {
+	case *exBool:
+		return bytecode.Bool(tval.val, dst), true
+	case *exInteger:
+		if tval.val >= math.MinInt16 && tval.val <= math.MaxInt16 {
+			return bytecode.IAsBx(bytecode.LOADI, dst, int16(tval.val)), true
+		}
+	case *exFloat:
+		isSmall := tval.val >= math.MinInt16 && tval.val <= math.MaxInt16 && tval.val == math.Trunc(tval.val)
+		if isSmall && (tval.val != 0 || !math.Signbit(tval.val)) {
+			return bytecode.IAsBx(bytecode.LOADF, dst, int16(tval.val)), true
+		}
+	}
+	kval, isConst := exIsConst(val)
+	if !isConst {
+		return 0, false
+	}
+	kaddr, err := fn.addConst(kval)
+	if err != nil {
+		return 0, false
+	}
+	return bytecode.IABx(bytecode.LOADK, dst, kaddr), true
+}
+
+// trackConstants updates the known values of registers after code runs.
+func (fn *FnProto) trackConstants(code uint32, known map[int64]expression, captured regSet) {
+	a := bytecode.GetA(code)
+	set := func(reg int64, val expression, ok bool) {
+		if ok && !captured.has(reg) {
+			known[reg] = val
+		} else {
+			delete(known, reg)
+		}
+	}
+	switch op := bytecode.GetOp(code); op {
+	case bytecode.LOADI:
+		set(a, &exInteger{val: bytecode.GetsBx(code)}, true)
+	case bytecode.LOADF:
+		set(a, &exFloat{val: float64(bytecode.GetsBx(code))}, true)
+	case bytecode.LOADK:
+		val, ok := constExpr(fn.GetConst(bytecode.GetBx(code)))
+		set(a, val, ok)
+	case bytecode.LOADTRUE, bytecode.LOADFALSE, bytecode.LFALSESKIP:
+		set(a, &exBool{val: op == bytecode.LOADTRUE}, true)
+	case bytecode.LOADNIL:
+		for reg := a; reg <= a+bytecode.GetBx(code); reg++ {
+			set(reg, &exNil{}, true)
+		}
+	case bytecode.MOVE:
+		val, ok := known[bytecode.GetB(code)]
+		set(a, val, ok)
+	case bytecode.SELF:
+		delete(known, a)
+		delete(known, a+1)
+	case bytecode.SETTABLE, bytecode.SETI, bytecode.SETFIELD:
+		// the value and key registers are cleared once they are stored
+		if op == bytecode.SETTABLE {
+			delete(known, bytecode.GetB(code))
+		}
+		if !bytecode.GetK(code) {
+			delete(known, bytecode.GetC(code))
+		}
+	case bytecode.TESTSET:
+		delete(known, a)
+	case bytecode.EQ, bytecode.LT, bytecode.LE, bytecode.EQK, bytecode.EQI, bytecode.LTI, bytecode.LEI,
+		bytecode.TEST, bytecode.JMP, bytecode.SETTABUP, bytecode.SETUPVAL, bytecode.TBC, bytecode.EXARG,
+		bytecode.RETURN, bytecode.RETURN0, bytecode.RETURN1:
+	default:
+		if writesOnlyA(op) || op == bytecode.NEWTABLE {
+			delete(known, a)
+		} else {
+			for reg := range known {
+				if reg >= a {
+					delete(known, reg)
+				}
+			}
+		}
+	}
+}
+
+// removeRedundantMoves uses register liveness to remove moves and loads that are
+// never read, and to write values straight to where they are moved to. For example
+// a temporary that is computed and then moved into a local is computed into the
+// local instead.
+func (fn *FnProto) removeRedundantMoves(captured regSet) bool {
+	changed := false
+	for range maxOptPasses {
+		liveOut, ok := fn.liveness()
+		if !ok {
+			return changed
+		}
+		starts := fn.blockStarts()
+		removed := make([]bool, len(fn.ByteCodes))
+		touched := make([]bool, len(fn.ByteCodes))
+		for pc, code := range fn.ByteCodes {
+			if touched[pc] || fn.isSlot(pc) {
+				continue
+			}
+			op, dst := bytecode.GetOp(code), bytecode.GetA(code)
+			switch op {
+			case bytecode.LOADI, bytecode.LOADF, bytecode.LOADK, bytecode.LOADFALSE, bytecode.LOADTRUE,
+				bytecode.GETUPVAL:
+				removed[pc] = !captured.has(dst) && !liveOut[pc].has(dst)
+			case bytecode.LOADNIL:
+				removed[pc] = bytecode.GetBx(code) == 0 && !captured.has(dst) && !liveOut[pc].has(dst)
+			case bytecode.MOVE:
+				src := bytecode.GetB(code)
+				switch {
+				case src == dst, !captured.has(dst) && !liveOut[pc].has(dst):
+					removed[pc] = true
+				case captured.has(src) || captured.has(dst):
+				case fn.isReverseMove(pc, removed, starts):
+					removed[pc] = true
+				case fn.moveResult(pc, liveOut, starts, removed, touched):
+					removed[pc] = true
+				case fn.forwardMove(pc, liveOut, starts, removed, touched):
+					removed[pc] = true
+				}
+			}
+		}
+		if !fn.removeInstructions(removed) {
+			return changed
+		}
+		changed = true
+	}
+	return changed
+}
+
+// isReverseMove reports if the move at pc copies back the register that the move
+// just before it copied from.
+func (fn *FnProto) isReverseMove(pc int, removed, starts []bool) bool {
+	if pc == 0 || starts[pc] || removed[pc-1] {
+		return false
+	}
+	code, prev := fn.ByteCodes[pc], fn.ByteCodes[pc-1]
+	return bytecode.GetOp(prev) == bytecode.MOVE &&
+		bytecode.GetA(prev) == bytecode.GetB(code) && bytecode.GetB(prev) == bytecode.GetA(code)
+}
+
+// moveResult changes the instruction that computes the temporary moved at pc to
+// write to the move destination instead. It reports false if the temporary is
+// still needed or the instruction cannot be changed. Locals are left so that
+// errors can still name them.
+func (fn *FnProto) moveResult(pc int, liveOut []regSet, starts, removed, touched []bool) bool {
+	code := fn.ByteCodes[pc]
+	dst, src := bytecode.GetA(code), bytecode.GetB(code)
+	if _, isLocal := fn.LocalNameAt(uint8(src), pc); isLocal {
+		return false
+	}
+	producer := pc - 1
+	if producer >= 0 {
+		switch bytecode.GetOp(fn.ByteCodes[producer]) {
+		case bytecode.MMBIN, bytecode.MMBINI, bytecode.MMBINK:
+			if starts[producer] {
+				return false
+			}
+			producer--
+		}
+	}
+	if producer < 0 || starts[pc] || liveOut[pc].has(src) || removed[producer] || touched[producer] {
+		return false
+	}
+	prodCode := fn.ByteCodes[producer]
+	if !writesOnlyA(bytecode.GetOp(prodCode)) || bytecode.GetA(prodCode) != src {
+		return false
+	} else if producer != pc-1 && !isArith(bytecode.GetOp(prodCode)) {
+		return false
+	}
+	fn.ByteCodes[producer] = bytecode.SetA(prodCode, uint8(dst))
+	for i := producer; i <= pc; i++ {
+		touched[i] = true
+	}
+	return true
+}
+
+// forwardMove changes the instruction after the move at pc to read the source of
+// the move directly. It reports false if the destination is still needed after.
+func (fn *FnProto) forwardMove(pc int, liveOut []regSet, starts, removed, touched []bool) bool {
+	code := fn.ByteCodes[pc]
+	tmp, src := bytecode.GetA(code), uint8(bytecode.GetB(code))
+	user := pc + 1
+	if user >= len(fn.ByteCodes) || starts[user] || removed[user] || touched[user] {
+		return false
+	}
+	last := user
+	if isArith(bytecode.GetOp(fn.ByteCodes[user])) {
+		last = user + 1
+	}
+	userCode := fn.ByteCodes[user]
+	overwritten := writesOnlyA(bytecode.GetOp(userCode)) && bytecode.GetA(userCode) == tmp
+	if last >= len(fn.ByteCodes) || (liveOut[last].has(tmp) && !overwritten) {
+		return false
+	}
+
+	rewritten := slices.Clone(fn.ByteCodes[user : last+1])
+	for i := range rewritten {
+		rewritten[i] = forwardOperand(rewritten[i], uint8(tmp), src)
+	}
+	for i, next := range rewritten {
+		prev := code
+		if i > 0 {
+			prev = rewritten[i-1]
+		}
+		if reads, _, ok := fn.regEffects(next, prev); !ok || reads.has(tmp) {
+			return false
+		}
+	}
+	copy(fn.ByteCodes[user:], rewritten)
+	for i := pc; i <= last; i++ {
+		touched[i] = true
+	}
+	return true
+}
+
+// forwardOperand replaces the register operands of an instruction that are only
+// read. Operands that the instruction clears or writes to are left as they are.
+func forwardOperand(code uint32, from, to uint8) uint32 {
+	replace := func(get func(uint32) int64, set func(uint32, uint8) uint32) {
+		if get(code) == int64(from) {
+			code = set(code, to)
+		}
+	}
+	op := bytecode.GetOp(code)
+	isConst := bytecode.GetK(code)
+	switch {
+	case isRegArith(op):
+		replace(bytecode.GetB, bytecode.SetB)
+		replace(bytecode.GetC, bytecode.SetC)
+		return code
+	case isArith(op):
+		replace(bytecode.GetB, bytecode.SetB)
+		return code
+	}
+	switch op {
+	case bytecode.EQ, bytecode.LT, bytecode.LE:
+		replace(bytecode.GetB, bytecode.SetB)
+		replace(bytecode.GetC, bytecode.SetC)
+	case bytecode.MOVE, bytecode.UNM, bytecode.BNOT, bytecode.GETI, bytecode.GETFIELD, bytecode.SELF,
+		bytecode.EQK, bytecode.EQI, bytecode.LTI, bytecode.LEI, bytecode.TESTSET, bytecode.SETTABUP:
+		replace(bytecode.GetB, bytecode.SetB)
+	case bytecode.NOT, bytecode.LEN:
+		if !isConst {
+			replace(bytecode.GetB, bytecode.SetB)
+		}
+	case bytecode.GETTABLE:
+		replace(bytecode.GetB, bytecode.SetB)
+		if !isConst {
+			replace(bytecode.GetC, bytecode.SetC)
+		}
+	case bytecode.SETTABLE, bytecode.SETI, bytecode.SETFIELD, bytecode.TEST, bytecode.RETURN1,
+		bytecode.SETUPVAL, bytecode.MMBINI, bytecode.MMBINK:
+		replace(bytecode.GetA, bytecode.SetA)
+	case bytecode.MMBIN:
+		replace(bytecode.GetA, bytecode.SetA)
+		replace(bytecode.GetB, bytecode.SetB)
+	}
+	return code
+}
@@ -0,0 +1,175 @@
+package parse
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tanema/luaf/internal/bytecode"
+)
+
+func TestOptimize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		description string
+		src         string
+		level       OptLevel
+		expected    []uint32
+	}{
+		{
+			description: "no optimization",
+			src:         "local a = 2\nlocal b = a * 3\nreturn b + 1",
+			level:       OptNone,
+			expected: []uint32{
+				bytecode.IAsBx(bytecode.LOADI, 0, 2),
+				bytecode.IABC(bytecode.MULK, 1, 0, 0, false),
+				bytecode.IABC(bytecode.MMBINK, 0, 0, uint8(bytecode.MUL), false),
+				bytecode.IABC(bytecode.ADDI, 2, 1, 1, false),
+				bytecode.IAsBC(bytecode.MMBINI, 1, 1, uint8(bytecode.ADD), false),
+				bytecode.IAB(bytecode.RETURN1, 2, 0),
+			},
+		},
+		{
+			description: "folds constants through registers",
+			src:         "local a = 2\nlocal b = a * 3\nreturn b + 1",
+			level:       OptFull,
+			expected: []uint32{
+				bytecode.IAsBx(bytecode.LOADI, 2, 7),
+				bytecode.IAB(bytecode.RETURN1, 2, 0),
+			},
+		},
+		{
+			description: "removes moves into and out of temporaries",
+			src:         "local t = {}\nlocal n = #t\nn = t.x + n\nreturn n",
+			level:       OptFull,
+			expected: []uint32{
+				bytecode.IvABC(bytecode.NEWTABLE, 0, 0, 0, false),
+				bytecode.IAB(bytecode.LEN, 1, 0),
+				bytecode.IABC(bytecode.GETFIELD, 2, 0, 0, false),
+				bytecode.IABC(bytecode.ADD, 2, 2, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 1, uint8(bytecode.ADD), false),
+				bytecode.IAB(bytecode.RETURN1, 2, 0),
+			},
+		},
+		{
+			description: "leaves loops without jump chains alone",
+			src:         "local x = 1\nwhile true do\n  if x > 10 then break end\n  x = x + 1\nend\nreturn x",
+			level:       OptBasic,
+			expected: []uint32{
+				bytecode.IAsBx(bytecode.LOADI, 0, 1),
+				bytecode.True(1),
+				bytecode.IAB(bytecode.TEST, 1, 0),
+				bytecode.Jump(10),
+				bytecode.IABsC(bytecode.LTI, 0, 0, 10, true),
+				bytecode.IAB(bytecode.LFALSESKIP, 1, 0),
+				bytecode.True(1),
+				bytecode.IAB(bytecode.TEST, 1, 0),
+				bytecode.Jump(1),
+				bytecode.Jump(4),
+				bytecode.IABC(bytecode.ADDI, 1, 0, 1, false),
+				bytecode.IAsBC(bytecode.MMBINI, 0, 1, uint8(bytecode.ADD), false),
+				bytecode.IAB(bytecode.MOVE, 0, 1),
+				bytecode.Jump(-13),
+				bytecode.IAB(bytecode.MOVE, 1, 0),
+				bytecode.IAB(bytecode.RETURN1, 1, 0),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+			p := newParser(tc.level)
+			fn, err := p.Parse("opt.lua", strings.NewReader(tc.src))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, fn.ByteCodes, fn.String())
+			assert.Len(t, fn.LineTrace, len(fn.ByteCodes))
+			require.NoError(t, fn.verify())
+		})
+	}
+
+	t.Run("removes unreachable code and keeps line trace in sync", func(t *testing.T) {
+		t.Parallel()
+		fn := &FnProto{
+			ByteCodes: []uint32{
+				bytecode.IAB(bytecode.TEST, 0, 0),
+				bytecode.Jump(2),
+				bytecode.IAsBx(bytecode.LOADI, 1, 1),
+				bytecode.IAB(bytecode.RETURN1, 1, 0),
+				bytecode.Jump(1),
+				bytecode.IAsBx(bytecode.LOADI, 1, 2),
+				bytecode.IAB(bytecode.RETURN0, 0, 0),
+			},
+			LineTrace: []LineInfo{{Line: 1}, {Line: 2}, {Line: 3}, {Line: 4}, {Line: 5}, {Line: 6}, {Line: 7}},
+			AllLocals: []*Local{{name: "a", register: 1, startPC: 3, endPC: 7}},
+		}
+		fn.optimize(OptBasic)
+		assert.Equal(t, []uint32{
+			bytecode.IAB(bytecode.TEST, 0, 0),
+			bytecode.Jump(2),
+			bytecode.IAsBx(bytecode.LOADI, 1, 1),
+			bytecode.IAB(bytecode.RETURN1, 1, 0),
+			bytecode.IAB(bytecode.RETURN0, 0, 0),
+		}, fn.ByteCodes)
+		assert.Equal(t, []LineInfo{{Line: 1}, {Line: 2}, {Line: 3}, {Line: 4}, {Line: 7}}, fn.LineTrace)
+		assert.Equal(t, 3, fn.AllLocals[0].startPC)
+		assert.Equal(t, 5, fn.AllLocals[0].endPC)
+	})
+
+	t.Run("optimizes at the level of the load mode", func(t *testing.T) {
+		t.Parallel()
+		src := "local a = 1\nlocal b = a + 2\nreturn b"
+		fn, err := Parse("opt.lua", strings.NewReader(src), ModeText|OptFull.Mode())
+		require.NoError(t, err)
+		assert.Equal(t, []uint32{
+			bytecode.IAsBx(bytecode.LOADI, 1, 3),
+			bytecode.IAB(bytecode.RETURN1, 1, 0),
+		}, fn.ByteCodes)
+		fn, err = Parse("opt.lua", strings.NewReader(src), ModeText)
+		require.NoError(t, err)
+		assert.Len(t, fn.ByteCodes, 5)
+	})
+
+	t.Run("moves or drops locals whose store was removed", func(t *testing.T) {
+		t.Parallel()
+		p := newParser(OptFull)
+		fn, err := p.Parse("opt.lua", strings.NewReader(`local n = 5
+local m = n * 2
+print(m)
+local s = "a"
+s = s .. "b"
+return s`))
+		require.NoError(t, err)
+		assert.Equal(t, []uint32{
+			bytecode.IAsBx(bytecode.LOADI, 1, 10),
+			bytecode.IABC(bytecode.GETTABUP, 2, 0, 1, true),
+			bytecode.IAB(bytecode.MOVE, 3, 1),
+			bytecode.IABC(bytecode.CALL, 2, 2, 2, false),
+			bytecode.IABx(bytecode.LOADK, 2, 4),
+			bytecode.IAB(bytecode.RETURN1, 2, 0),
+		}, fn.ByteCodes)
+		var locals []string
+		for _, lcl := range fn.AllLocals {
+			locals = append(locals, fmt.Sprintf("%v R%v [%v, %v)", lcl.name, lcl.register, lcl.startPC, lcl.endPC))
+		}
+		assert.Equal(t, []string{"m R1 [1, 6)", "s R2 [5, 6)"}, locals)
+	})
+
+	t.Run("keeps values captured by closures", func(t *testing.T) {
+		t.Parallel()
+		p := newParser(OptFull)
+		fn, err := p.Parse("opt.lua", strings.NewReader("local a = 1\nlocal f = function() return a end\na = 2\nreturn f"))
+		require.NoError(t, err)
+		assert.Equal(t, []uint32{
+			bytecode.IAsBx(bytecode.LOADI, 0, 1),
+			bytecode.IABx(bytecode.CLOSURE, 1, 0),
+			bytecode.IAsBx(bytecode.LOADI, 2, 2),
+			bytecode.IAB(bytecode.MOVE, 0, 2),
+			bytecode.IAB(bytecode.RETURN1, 1, 0),
+		}, fn.ByteCodes)
+	})
+}
@@ -30,6 +30,7 @@ type (
 		Globals     bool         // not allowed to define globals only locals
 		Strict      bool         // type checking and throw parsing errors if types are bad
 		Locale      *i18n.Locale // change locale for just this file.
+		Optimize    OptLevel     // how much to optimize the bytecode of each function
 	}
 	// Parser is the object that will parse a file an be able to return bytecode
 	// ready for the VM.
@@ -52,11 +53,15 @@ const (
 	ModeText LoadMode = 0b01
 	// ModeBinary implies that the chunk of data being loaded is pre parsed binary.
 	ModeBinary LoadMode = 0b10
+
+	// optModeShift is where the optimization level of text chunks is kept in the
+	// load mode, above the text and binary flags.
+	optModeShift = 2
 )
 
-func newParser() *Parser {
+func newParser(level OptLevel) *Parser {
 	return &Parser{
-		config:         Config{Locale: i18n.GetLocale(i18n.CategoryALL)},
+		config:         Config{Locale: i18n.GetLocale(i18n.CategoryALL), Optimize: level},
 		rootfn:         newRootFn(),
 		breakBlocks:    [][]int{},
 		continueBlocks: [][]int{},
@@ -77,6 +82,8 @@ func File(path string, mode LoadMode) (*FnProto, error) {
 // Parse will, depending on the LoadMode, parse a text file and return bytecode
 // or if the load mode is binary, it will undump an already parsed fnproto. If
 // both modes are passed, it will try to figure out which kind of file it is parsing.
+// Text is optimized at the level added to the mode with OptLevel.Mode, binary
+// chunks are loaded as they were compiled.
 func Parse(filename string, src io.ReadSeeker, mode LoadMode) (*FnProto, error) {
 	isBinary := hasLuaBinPrefix(src)
 	if isBinary && mode&ModeBinary != ModeBinary {
@@ -86,14 +93,14 @@ func Parse(filename string, src io.ReadSeeker, mode LoadMode) (*FnProto, error)
 	} else if isBinary {
 		return UndumpFnProto(src)
 	}
-	return newParser().Parse(filename, src)
+	return newParser(OptLevel(mode>>optModeShift)).Parse(filename, src)
 }
 
 // TryStat allows for trying a single statement. This is primarily for repl.
 func TryStat(src string, parentFn *FnProto) (*FnProto, error) {
 	filename := "<source>"
 	fn := NewEmptyFnProto(filename, parentFn)
-	p := newParser()
+	p := newParser(OptNone)
 	p.filename = filename
 	p.lex = newLexer(filename, strings.NewReader(src))
 	if firsterr := p.stat(fn); firsterr != nil {
@@ -354,6 +361,19 @@ func (p *Parser) stat(fn *FnProto) error {
 	tk, err := p.peek()
 	if err != nil {
 		return err
+	} else if isAsync, err := p.contextual(asyncName, tokenFunction); err != nil {
+		return err
+	} else if isAsync {
+		return p.funcstat(fn, true)
+	} else if isAwait, err := p.contextual(awaitName, awaitOperand...); err != nil {
+		return err
+	} else if isAwait {
+		expr, err := p.awaitexp(fn)
+		if err != nil {
+			return err
+		}
+		_, err = p.discharge(fn, tk, expr)
+		return err
 	}
 	switch tk.Kind {
 	case tokenSemiColon:
@@ -365,7 +385,7 @@ func (p *Parser) stat(fn *FnProto) error {
 	case tokenConst:
 		return p.localstat(fn, true)
 	case tokenFunction:
-		return p.funcstat(fn)
+		return p.funcstat(fn, false)
 	case tokenReturn:
 		return p.retstat(fn)
 	case tokenDo:
@@ -389,7 +409,7 @@ func (p *Parser) stat(fn *FnProto) error {
 	case tokenTypeDef:
 		return p.typedefstat(fn, false)
 	default:
-		tk, err := p.lex.Peek()
+		first, err := p.lex.Peek()
 		if err != nil {
 			return err
 		}
@@ -397,11 +417,14 @@ func (p *Parser) stat(fn *FnProto) error {
 		if err != nil {
 			return err
 		} else if call, isCall := expr.(*exCall); isCall {
-			_, err := p.discharge(fn, tk, call)
+			_, err := p.discharge(fn, first, call)
 			return err
 		} else if tk, err := p.peek(); err != nil {
 			return err
 		} else if tk.Kind == tokenAssign || tk.Kind == tokenComma {
+			if err := p.assignable(first, expr); err != nil {
+				return err
+			}
 			return p.assignment(fn, expr)
 		}
 		return p.parseErr(tk, fmt.Errorf("unexpected expression %v", reflect.TypeOf(expr)))
@@ -508,7 +531,7 @@ func (p *Parser) parseDocTag(doc string) {
 	}
 }
 
-// localstat -> local [localfunc | localassign | typedef ].
+// localstat -> local [[ASYNC] localfunc | localassign | typedef ].
 func (p *Parser) localstat(fn *FnProto, isConst bool) error {
 	var tk *token
 	if isConst {
@@ -520,16 +543,24 @@ func (p *Parser) localstat(fn *FnProto, isConst bool) error {
 	if err != nil {
 		return err
 	} else if ptk.Kind == tokenFunction {
-		return p.localfunc(fn, isConst)
+		return p.localfunc(fn, isConst, false)
 	} else if ptk.Kind == tokenTypeDef {
 		return p.typedefstat(fn, true)
+	} else if isAsync, err := p.contextual(asyncName, tokenFunction); err != nil {
+		return err
+	} else if isAsync {
+		p.mustnext(tokenIdentifier)
+		return p.localfunc(fn, isConst, true)
 	}
 	return p.localassign(fn, tk, isConst)
 }
 
 // localfunc -> FUNCTION NAME funcbody.
-func (p *Parser) localfunc(fn *FnProto, isConst bool) error {
-	tk := p.mustnext(tokenFunction)
+func (p *Parser) localfunc(fn *FnProto, isConst, isAsync bool) error {
+	tk, err := p.consumeToken(tokenFunction)
+	if err != nil {
+		return err
+	}
 	ifn := uint8(len(fn.Locals))
 	name, err := p.consumeToken(tokenIdentifier)
 	if err != nil {
@@ -547,19 +578,30 @@ func (p *Parser) localfunc(fn *FnProto, isConst bool) error {
 		return err
 	}
 
-	expr := &exClosure{
+	var expr expression = &exClosure{
 		fn:       fn.addFn(newFn),
 		fnproto:  newFn,
 		LineInfo: name.LineInfo,
 	}
+	if isAsync {
+		if expr, err = p.async(fn, expr, name.LineInfo); err != nil {
+			return err
+		}
+	}
 
 	_, err = p.dischargeTo(fn, tk, expr, ifn)
 	return err
 }
 
-// funcstat -> FUNCTION funcname funcbody.
-func (p *Parser) funcstat(fn *FnProto) error {
-	tk := p.mustnext(tokenFunction)
+// funcstat -> [ASYNC] FUNCTION funcname funcbody.
+func (p *Parser) funcstat(fn *FnProto, isAsync bool) error {
+	if isAsync {
+		p.mustnext(tokenIdentifier)
+	}
+	tk, err := p.consumeToken(tokenFunction)
+	if err != nil {
+		return err
+	}
 	name, hasSelf, fullname, err := p.funcname(fn)
 	if err != nil {
 		return err
@@ -568,11 +610,16 @@ func (p *Parser) funcstat(fn *FnProto) error {
 	if err != nil {
 		return err
 	}
-	closure := &exClosure{
+	var closure expression = &exClosure{
 		fn:       fn.addFn(newFn),
 		fnproto:  newFn,
 		LineInfo: tk.LineInfo,
 	}
+	if isAsync {
+		if closure, err = p.async(fn, closure, tk.LineInfo); err != nil {
+			return err
+		}
+	}
 	icls, err := p.discharge(fn, tk, closure)
 	if err != nil {
 		return p.parseErr(tk, err)
@@ -580,6 +627,87 @@ func (p *Parser) funcstat(fn *FnProto) error {
 	return p.assignTo(fn, tk, name, icls, closure)
 }
 
+// async wraps a closure with coroutine.async so that calling it runs it on a
+// coroutine and returns a future of its results.
+func (p *Parser) async(fn *FnProto, closure expression, li LineInfo) (expression, error) {
+	wrap, err := p.coroutineFn(fn, "async", li)
+	if err != nil {
+		return nil, err
+	}
+	return newCallExpr(wrap, []expression{closure}, false, li), nil
+}
+
+// awaitexp -> AWAIT expr, which calls coroutine.await with the value of expr
+// to wait for it if it is a future.
+func (p *Parser) awaitexp(fn *FnProto) (expression, error) {
+	tk := p.mustnext(tokenIdentifier)
+	val, err := p.expr(fn, unaryPriority)
+	if err != nil {
+		return nil, err
+	}
+	await, err := p.coroutineFn(fn, "await", tk.LineInfo)
+	if err != nil {
+		return nil, err
+	}
+	return newCallExpr(await, []expression{val}, false, tk.LineInfo), nil
+}
+
+// contextual reports if the next token is the identifier name and the token
+// after it is one of after, on the same line so that a name at the end of a
+// line is never joined with the next statement. This is how async and await are
+// keywords only where they could not be names.
+func (p *Parser) contextual(name string, after ...tokenType) (bool, error) {
+	tk, err := p.peek()
+	if err != nil || tk.Kind != tokenIdentifier || tk.StringVal != name {
+		return false, err
+	}
+	tk, err = p.lex.Next()
+	if err != nil {
+		return false, err
+	}
+	next, err := p.peek()
+	p.lex.back(tk)
+	if err != nil {
+		return false, err
+	}
+	return next.Line == tk.Line && slices.Contains(after, next.Kind), nil
+}
+
+// coroutineFn references a function of the coroutine library through _ENV so
+// that a local named coroutine does not change what async and await call.
+func (p *Parser) coroutineFn(fn *FnProto, name string, li LineInfo) (expression, error) {
+	env, err := p.name(fn, &token{StringVal: _ENVName, LineInfo: li})
+	if err != nil {
+		return nil, err
+	}
+	lib := &exIndex{
+		table:    env,
+		key:      &exString{val: "coroutine", LineInfo: li},
+		typeDefn: types.NewTable(),
+		LineInfo: li,
+	}
+	return &exIndex{
+		table:    lib,
+		key:      &exString{val: name, LineInfo: li},
+		typeDefn: &types.Function{},
+		LineInfo: li,
+	}, nil
+}
+
+// assignable checks that an expression parsed from tk can be assigned to. Const
+// locals of parent functions have been replaced by their value by this point so
+// the name of the variable is taken from the token.
+func (p *Parser) assignable(tk *token, expr expression) error {
+	switch expr.(type) {
+	case *exVariable, *exIndex:
+		return nil
+	}
+	if tk.Kind == tokenIdentifier {
+		return p.parseErr(tk, fmt.Errorf("attempt to assign to const variable '%v'", tk.StringVal))
+	}
+	return p.parseErr(tk, fmt.Errorf("unexpected expression %v", reflect.TypeOf(expr)))
+}
+
 func (p *Parser) assignTo(fn *FnProto, tk *token, dst expression, from uint8, value expression) error {
 	valKind := value.inferType()
 	switch ex := dst.(type) {
@@ -595,21 +723,34 @@ func (p *Parser) assignTo(fn *FnProto, tk *token, dst expression, from uint8, va
 		}
 		return nil
 	case *exIndex:
-		if val, isVal := ex.table.(*exVariable); isVal {
+		val, isVal := ex.table.(*exVariable)
+		if isVal && !val.local {
 			ikey, err := p.discharge(fn, tk, ex.key)
 			if err != nil {
 				return err
 			}
-			if val.local {
-				fn.code(bytecode.IABC(bytecode.SETTABLE, val.address, ikey, from, false), ex.LineInfo)
-			} else {
-				fn.code(bytecode.IABC(bytecode.SETTABUP, val.address, ikey, from, false), ex.LineInfo)
-			}
+			fn.code(bytecode.IABC(bytecode.SETTABUP, val.address, ikey, from, false), ex.LineInfo)
 			return nil
 		}
-		itable, err := p.discharge(fn, tk, ex.table)
-		if err != nil {
-			return err
+		var itable uint8
+		if isVal {
+			itable = val.address
+		} else {
+			reg, err := p.discharge(fn, tk, ex.table)
+			if err != nil {
+				return err
+			}
+			itable = reg
+		}
+		if idx, isField, ok, err := specializedKey(fn, ex.key); err != nil {
+			return p.parseErr(tk, err)
+		} else if ok {
+			op := bytecode.SETI
+			if isField {
+				op = bytecode.SETFIELD
+			}
+			fn.code(bytecode.IABC(op, itable, idx, from, false), ex.LineInfo)
+			return nil
 		}
 		ikey, err := p.discharge(fn, tk, ex.key)
 		if err != nil {
@@ -1536,6 +1677,14 @@ func (p *Parser) localassign(fn *FnProto, decl *token, isConst bool) error {
 			}
 			lcl.typeDefn = defn
 		}
+		if lcl.attrConst && i < len(exprs) {
+			// strings stay captured so that a dump stores them once.
+			if _, isStr := exprs[i].(*exString); !isStr {
+				if _, isConst := exIsEqConst(exprs[i]); isConst {
+					lcl.constVal = exprs[i]
+				}
+			}
+		}
 		if err := fn.addLocal(lcl); err != nil {
 			return err
 		} else if lcl.attrClose {
@@ -1638,9 +1787,15 @@ func (p *Parser) assignment(fn *FnProto, first expression) error {
 		if len(names) >= conf.MAXCCALLS {
 			return p.parseErr(ptk, errors.New("too many names in assignment"))
 		}
+		first, err := p.peek()
+		if err != nil {
+			return err
+		}
 		expr, err := p.suffixedexp(fn)
 		if err != nil {
 			return err
+		} else if err := p.assignable(first, expr); err != nil {
+			return err
 		}
 		names = append(names, expr)
 	}
@@ -1713,6 +1868,12 @@ func (p *Parser) expr(fn *FnProto, limit int) (expression, error) {
 	var desc expression
 	if tk, err := p.peek(); err != nil {
 		return nil, err
+	} else if isAwait, err := p.contextual(awaitName, awaitOperand...); err != nil {
+		return nil, err
+	} else if isAwait {
+		if desc, err = p.awaitexp(fn); err != nil {
+			return nil, err
+		}
 	} else if tk.isUnary() {
 		if err = p.next(tk.Kind); err != nil {
 			return nil, err
@@ -1768,11 +1929,22 @@ func (p *Parser) code(fn *FnProto, inst uint32) int {
 	return fn.code(inst, p.lastTokenInfo)
 }
 
-// simpleexp -> Float | Integer | String | nil | true | false | ... | constructor | FUNCTION body | suffixedexp.
+// simpleexp -> Float | Integer | String | nil | true | false | ... | constructor | [ASYNC] FUNCTION body |
+// suffixedexp.
 func (p *Parser) simpleexp(fn *FnProto) (expression, error) {
 	ptk, err := p.peek()
 	if err != nil {
 		return nil, err
+	} else if isAsync, err := p.contextual(asyncName, tokenFunction); err != nil {
+		return nil, err
+	} else if isAsync {
+		tk := p.mustnext(tokenIdentifier)
+		p.mustnext(tokenFunction)
+		newFn, err := p.funcbody(fn, "", false, tk.LineInfo)
+		if err != nil {
+			return nil, err
+		}
+		return p.async(fn, &exClosure{fn: fn.addFn(newFn), fnproto: newFn, LineInfo: tk.LineInfo}, tk.LineInfo)
 	}
 	switch ptk.Kind {
 	case tokenFloat:
@@ -1836,7 +2008,14 @@ func (p *Parser) primaryexp(fn *FnProto) (expression, error) {
 		}
 		return desc, p.next(tokenCloseParen)
 	case tokenIdentifier:
-		return p.name(fn, p.mustnext(tokenIdentifier))
+		expr, err := p.name(fn, p.mustnext(tokenIdentifier))
+		if err != nil {
+			return nil, err
+		}
+		if val, isVar := expr.(*exVariable); isVar && val.konst != nil {
+			return val.konst, nil
+		}
+		return expr, nil
 	default:
 		return nil, p.parseErr(tk, fmt.Errorf("unexpected symbol near %s", tk.near()))
 	}
@@ -1969,7 +2148,19 @@ func (p *Parser) resolveVar(fn *FnProto, name *token) (*exVariable, error) {
 	} else if value, err := p.resolveVar(fn.prev, name); err != nil {
 		return nil, err
 	} else if value != nil {
-		if value.local {
+		if value.local && value.lvar.constVal != nil {
+			value = &exVariable{
+				name:      name.StringVal,
+				konst:     inlineConst(value.lvar.constVal, name.LineInfo),
+				typeDefn:  value.typeDefn,
+				attrConst: true,
+			}
+		}
+		if value.konst != nil {
+			// constants are copied into the closure instead of being captured.
+			value.LineInfo = name.LineInfo
+			return value, nil
+		} else if value.local {
 			value.lvar.upvalRef = true
 		}
 		err := fn.addUpindex(
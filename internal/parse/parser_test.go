@@ -2,6 +2,8 @@ package parse
 
 import (
 	"bytes"
+	"fmt"
+	"slices"
 	"strings"
 	"testing"
 
@@ -9,6 +11,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/tanema/luaf/internal/bytecode"
+	"github.com/tanema/luaf/internal/conf"
 	"github.com/tanema/luaf/internal/types"
 )
 
@@ -69,13 +72,42 @@ func TestParser(t *testing.T) {
 			upindexes:   []Upindex{_envUpIndex},
 			bytecodes: []uint32{
 				bytecode.IABC(bytecode.GETTABUP, 0, 0, 1, true),
-				bytecode.IABC(bytecode.GETTABLE, 0, 0, 0, true),
+				bytecode.IABC(bytecode.GETFIELD, 0, 0, 0, false),
 				bytecode.IABC(bytecode.SELF, 0, 0, 2, true),
 				bytecode.IABC(bytecode.GETTABUP, 2, 0, 3, true),
 				bytecode.IABC(bytecode.CALL, 0, 3, 2, false),
 			},
 			stackpointer: 1,
 		},
+		{
+			description: "await expression",
+			input:       `local x = await y`,
+			constants:   []any{"await", "coroutine", "y"},
+			upindexes:   []Upindex{_envUpIndex},
+			locals:      []*Local{{name: "x", typeDefn: types.Any, startPC: 4, endPC: -1}},
+			bytecodes: []uint32{
+				bytecode.IABC(bytecode.GETTABUP, 0, 0, 1, true),
+				bytecode.IABC(bytecode.GETFIELD, 0, 0, 0, false),
+				bytecode.IABC(bytecode.GETTABUP, 1, 0, 2, true),
+				bytecode.IABC(bytecode.CALL, 0, 2, 2, false),
+			},
+			stackpointer: 1,
+		},
+		{
+			description: "async function",
+			input:       `async function f() end`,
+			constants:   []any{"async", "coroutine", "f"},
+			upindexes:   []Upindex{_envUpIndex},
+			bytecodes: []uint32{
+				bytecode.IABC(bytecode.GETTABUP, 0, 0, 1, true),
+				bytecode.IABC(bytecode.GETFIELD, 0, 0, 0, false),
+				bytecode.IABx(bytecode.CLOSURE, 1, 0),
+				bytecode.IABC(bytecode.CALL, 0, 2, 2, false),
+				bytecode.IABx(bytecode.LOADK, 1, 2),
+				bytecode.IABC(bytecode.SETTABUP, 0, 1, 0, false),
+			},
+			stackpointer: 2,
+		},
 		{
 			description: "index assign",
 			input:       `table.window = 23`,
@@ -84,25 +116,86 @@ func TestParser(t *testing.T) {
 			bytecodes: []uint32{
 				bytecode.IAsBx(bytecode.LOADI, 0, 23),
 				bytecode.IABC(bytecode.GETTABUP, 1, 0, 0, true),
-				bytecode.IABx(bytecode.LOADK, 2, 1),
-				bytecode.IABC(bytecode.SETTABLE, 1, 2, 0, false),
+				bytecode.IABC(bytecode.SETFIELD, 1, 1, 0, false),
 			},
-			stackpointer: 3,
+			stackpointer: 2,
 		},
 		{
-			description:  "assignment attributes",
-			input:        `local a <const> = 42`,
-			locals:       []*Local{{name: "a", attrConst: true, typeDefn: types.Number, startPC: 1, endPC: -1}},
+			description: "assignment attributes",
+			input:       `local a <const> = 42`,
+			locals: []*Local{{
+				name: "a", attrConst: true, typeDefn: types.Number, startPC: 1, endPC: -1,
+				constVal: &exInteger{val: 42, LineInfo: LineInfo{Line: 1, Column: 19}},
+			}},
 			bytecodes:    []uint32{bytecode.IAsBx(bytecode.LOADI, 0, 42)},
 			stackpointer: 1,
 		},
 		{
-			description:  "const assignment",
-			input:        `const a = 42`,
-			locals:       []*Local{{name: "a", attrConst: true, typeDefn: types.Number, startPC: 1, endPC: -1}},
+			description: "const assignment",
+			input:       `const a = 42`,
+			locals: []*Local{{
+				name: "a", attrConst: true, typeDefn: types.Number, startPC: 1, endPC: -1,
+				constVal: &exInteger{val: 42, LineInfo: LineInfo{Line: 1, Column: 11}},
+			}},
 			bytecodes:    []uint32{bytecode.IAsBx(bytecode.LOADI, 0, 42)},
 			stackpointer: 1,
 		},
+		{
+			description: "constant operand arithmetic",
+			input:       `local a = 5; local b, c, d = a - 1.5, 2 << a, a + 300`,
+			locals: []*Local{
+				{name: "a", typeDefn: types.Number, startPC: 1, endPC: -1},
+				{name: "b", typeDefn: types.Number, register: 1, startPC: 3, endPC: -1},
+				{name: "c", typeDefn: types.Number, register: 2, startPC: 5, endPC: -1},
+				{name: "d", typeDefn: types.Number, register: 3, startPC: 7, endPC: -1},
+			},
+			constants: []any{1.5, int64(300)},
+			bytecodes: []uint32{
+				bytecode.IAsBx(bytecode.LOADI, 0, 5),
+				bytecode.IABC(bytecode.SUBK, 1, 0, 0, false),
+				bytecode.IABC(bytecode.MMBINK, 0, 0, uint8(bytecode.SUB), false),
+				bytecode.IABsC(bytecode.SHLI, 2, 0, 2, true),
+				bytecode.IAsBC(bytecode.MMBINI, 0, 2, uint8(bytecode.SHL), true),
+				bytecode.IABC(bytecode.ADDK, 3, 0, 1, false),
+				bytecode.IABC(bytecode.MMBINK, 0, 1, uint8(bytecode.ADD), false),
+			},
+			stackpointer: 4,
+		},
+		{
+			description: "constant operand comparison",
+			input:       `local a = 5; local b, c = a > 3, "x" ~= a`,
+			locals: []*Local{
+				{name: "a", typeDefn: types.Number, startPC: 1, endPC: -1},
+				{name: "b", typeDefn: types.Bool, register: 1, startPC: 4, endPC: -1},
+				{name: "c", typeDefn: types.Bool, register: 2, startPC: 7, endPC: -1},
+			},
+			constants: []any{"x"},
+			bytecodes: []uint32{
+				bytecode.IAsBx(bytecode.LOADI, 0, 5),
+				bytecode.IABsC(bytecode.LTI, 0, 0, 3, true),
+				bytecode.IAB(bytecode.LFALSESKIP, 1, 0),
+				bytecode.True(1),
+				bytecode.IABC(bytecode.EQK, 1, 0, 0, false),
+				bytecode.IAB(bytecode.LFALSESKIP, 2, 0),
+				bytecode.True(2),
+			},
+			stackpointer: 3,
+		},
+		{
+			description: "test set local",
+			input:       `local a = 5; local b = a or 2`,
+			locals: []*Local{
+				{name: "a", typeDefn: types.Number, startPC: 1, endPC: -1},
+				{name: "b", typeDefn: types.Any, register: 1, startPC: 4, endPC: -1},
+			},
+			bytecodes: []uint32{
+				bytecode.IAsBx(bytecode.LOADI, 0, 5),
+				bytecode.IABC(bytecode.TESTSET, 1, 0, 1, false),
+				bytecode.Jump(1),
+				bytecode.IAsBx(bytecode.LOADI, 1, 2),
+			},
+			stackpointer: 2,
+		},
 		{
 			description: "local multiple assignment",
 			input:       `local a, b, c = 1, true, "abcd"`,
@@ -131,14 +224,11 @@ func TestParser(t *testing.T) {
 				bytecode.IABC(bytecode.GETUPVAL, 3, 0, 0, false), // ENV
 				bytecode.IABC(bytecode.GETUPVAL, 4, 0, 0, false), // ENV
 				bytecode.IABC(bytecode.GETUPVAL, 5, 0, 0, false), // ENV
-				bytecode.IABx(bytecode.LOADK, 6, 1),              // a
-				bytecode.IABC(bytecode.SETTABLE, 3, 6, 0, false), // ENV[a] = 1
-				bytecode.IABx(bytecode.LOADK, 7, 2),              // b
-				bytecode.IABC(bytecode.SETTABLE, 4, 7, 1, false), // ENV[b] = true
-				bytecode.IABx(bytecode.LOADK, 8, 3),              // c
-				bytecode.IABC(bytecode.SETTABLE, 5, 8, 2, false), // ENV[c] = "defg"
+				bytecode.IABC(bytecode.SETFIELD, 3, 1, 0, false), // ENV[a] = 1
+				bytecode.IABC(bytecode.SETFIELD, 4, 2, 1, false), // ENV[b] = true
+				bytecode.IABC(bytecode.SETFIELD, 5, 3, 2, false), // ENV[c] = "defg"
 			},
-			stackpointer: 9,
+			stackpointer: 6,
 		},
 		{
 			description: "local function assignment",
@@ -215,9 +305,8 @@ testFn()
 				bytecode.IABx(bytecode.LOADK, 0, 0),              // "hello world"
 				bytecode.IABx(bytecode.CLOSURE, 1, 0),            // function
 				bytecode.IABC(bytecode.GETTABUP, 2, 0, 2, true),  // ENV[tbl]
-				bytecode.IABC(bytecode.GETTABLE, 2, 2, 1, true),  // tbl["robot"]
-				bytecode.IABx(bytecode.LOADK, 3, 3),              // testFn
-				bytecode.IABC(bytecode.SETTABLE, 2, 3, 1, false), // tbl["robot"]["testFn"] = function
+				bytecode.IABC(bytecode.GETFIELD, 2, 2, 1, false), // tbl["robot"]
+				bytecode.IABC(bytecode.SETFIELD, 2, 3, 1, false), // tbl["robot"]["testFn"] = function
 				bytecode.IABC(bytecode.GETTABUP, 1, 0, 3, true),  // ENV["testFn"] # this is bad lua but accurate bytecode
 				bytecode.IABC(bytecode.CALL, 1, 1, 2, false),     // ENV["testFn"]()
 			},
@@ -368,7 +457,7 @@ testFn()
 				othertable,
 			}`,
 			locals: []*Local{
-				{name: "a", typeDefn: types.NewTable(), startPC: 12, endPC: -1},
+				{name: "a", typeDefn: types.NewTable(), startPC: 10, endPC: -1},
 			},
 			constants: []any{"othertable", "settings", "tim", int64(42)},
 			upindexes: []Upindex{_envUpIndex},
@@ -380,11 +469,9 @@ testFn()
 				bytecode.IAsBx(bytecode.LOADI, 4, 54),
 				bytecode.IABC(bytecode.GETTABUP, 5, 0, 0, true),
 				bytecode.IvABC(bytecode.SETLIST, 0, 6, 1, false),
-				bytecode.IABx(bytecode.LOADK, 1, 1),
-				bytecode.IAB(bytecode.LOADTRUE, 2, 0),
-				bytecode.IABC(bytecode.SETTABLE, 0, 1, 2, false),
-				bytecode.IABx(bytecode.LOADK, 1, 2),
-				bytecode.IABC(bytecode.SETTABLE, 0, 1, 3, true),
+				bytecode.IAB(bytecode.LOADTRUE, 1, 0),
+				bytecode.IABC(bytecode.SETFIELD, 0, 1, 1, false),
+				bytecode.IABC(bytecode.SETFIELD, 0, 2, 3, true),
 			},
 			stackpointer: 1,
 		},
@@ -444,17 +531,18 @@ testFn()
 				{name: "forNumSum", typeDefn: types.Number, startPC: 1, endPC: -1},
 			},
 			bytecodes: []uint32{
-				bytecode.IAsBx(bytecode.LOADI, 0, 0),        // 0 [forNumSum]
-				bytecode.IAsBx(bytecode.LOADI, 1, 10),       // 1
-				bytecode.IAsBx(bytecode.LOADI, 2, 1),        // 10
-				bytecode.IAsBx(bytecode.LOADI, 3, -1),       // 2
-				bytecode.IABx(bytecode.FORPREP, 1, 5),       // Start for loop jump 5
-				bytecode.IAB(bytecode.MOVE, 4, 1),           // Copy counter into loop var i
-				bytecode.IAB(bytecode.MOVE, 5, 0),           // Move forNumSum to 5
-				bytecode.IAB(bytecode.MOVE, 6, 4),           // Move i to 6
-				bytecode.IABC(bytecode.ADD, 5, 5, 6, false), // forNumSum + i
-				bytecode.IAB(bytecode.MOVE, 0, 5),           // forNumSum = (forNumSum + i)
-				bytecode.IABx(bytecode.FORLOOP, 1, 6),       // Jump back 4
+				bytecode.IAsBx(bytecode.LOADI, 0, 0),                            // 0 [forNumSum]
+				bytecode.IAsBx(bytecode.LOADI, 1, 10),                           // 1
+				bytecode.IAsBx(bytecode.LOADI, 2, 1),                            // 10
+				bytecode.IAsBx(bytecode.LOADI, 3, -1),                           // 2
+				bytecode.IABx(bytecode.FORPREP, 1, 6),                           // Start for loop jump 6
+				bytecode.IAB(bytecode.MOVE, 4, 1),                               // Copy counter into loop var i
+				bytecode.IAB(bytecode.MOVE, 5, 0),                               // Move forNumSum to 5
+				bytecode.IAB(bytecode.MOVE, 6, 4),                               // Move i to 6
+				bytecode.IABC(bytecode.ADD, 5, 5, 6, false),                     // forNumSum + i
+				bytecode.IABC(bytecode.MMBIN, 5, 6, uint8(bytecode.ADD), false), // Metamethod fallback for ADD
+				bytecode.IAB(bytecode.MOVE, 0, 5),                               // forNumSum = (forNumSum + i)
+				bytecode.IABx(bytecode.FORLOOP, 1, 7),                           // Jump back 6
 			},
 			stackpointer: 1,
 		},
@@ -687,3 +775,125 @@ func fmtBytecodeDiff(expected, actual []uint32) string {
 Bytcodes are not equal.
 ` + strings.Join(parts, "\n")
 }
+
+func TestConstUpvalueInlining(t *testing.T) {
+	t.Parallel()
+
+	src := `local a <const> = 1.5
+const b = 2
+local c = 3
+local s <const> = "x"
+local function f() return a, b + c end
+local function g() return function() return a, s end end`
+	fn, err := Parse("inline.lua", strings.NewReader(src), ModeText)
+	require.NoError(t, err)
+	assert.False(t, fn.Locals[0].upvalRef)
+	assert.False(t, fn.Locals[1].upvalRef)
+	assert.True(t, fn.Locals[2].upvalRef)
+	assert.True(t, fn.Locals[3].upvalRef, "strings are captured")
+
+	f := fn.FnTable[0]
+	assert.Equal(t, []Upindex{{FromStack: true, Name: "c", Index: 2, typeDefn: types.Number}}, f.UpIndexes)
+	assert.Equal(t, []any{1.5}, f.Constants)
+	assert.Equal(t, []uint32{
+		bytecode.IABx(bytecode.LOADK, 0, 0),
+		bytecode.IAB(bytecode.GETUPVAL, 1, 0),
+		bytecode.IABsC(bytecode.ADDI, 1, 1, 2, true),
+		bytecode.IAsBC(bytecode.MMBINI, 1, 2, uint8(bytecode.ADD), true),
+		bytecode.IAB(bytecode.RETURN, 0, 3),
+	}, f.ByteCodes, fmtBytecodeDiff(nil, f.ByteCodes))
+
+	g := fn.FnTable[1]
+	assert.Equal(t, []string{"s"}, upindexNames(g.UpIndexes))
+	assert.Equal(t, []string{"s"}, upindexNames(g.FnTable[0].UpIndexes))
+	assert.Equal(t, []any{1.5}, g.FnTable[0].Constants)
+
+	_, err = Parse("assign.lua", strings.NewReader("const a = 1\nlocal function f() a = 2 end"), ModeText)
+	require.ErrorContains(t, err, "attempt to assign to const variable 'a'")
+}
+
+func upindexNames(upindexes []Upindex) []string {
+	names := make([]string, len(upindexes))
+	for i, up := range upindexes {
+		names[i] = up.Name
+	}
+	return names
+}
+
+func TestIndexCallResultKeepsKey(t *testing.T) {
+	t.Parallel()
+
+	// the call is discharged before the key so that its arguments do not
+	// overwrite the register holding the key.
+	fn, err := Parse("index.lua", strings.NewReader("local f, a, k = ...\nreturn f(a)[k]"), ModeText)
+	require.NoError(t, err)
+	expected := []uint32{
+		bytecode.IAB(bytecode.VARARG, 0, 4),
+		bytecode.IAB(bytecode.MOVE, 3, 0),
+		bytecode.IAB(bytecode.MOVE, 4, 1),
+		bytecode.IABC(bytecode.CALL, 3, 2, 2, false),
+		bytecode.IAB(bytecode.MOVE, 4, 2),
+		bytecode.IABC(bytecode.GETTABLE, 3, 3, 4, false),
+		bytecode.IAB(bytecode.RETURN1, 3, 0),
+	}
+	assert.Equal(t, expected, fn.ByteCodes, fmtBytecodeDiff(expected, fn.ByteCodes))
+}
+
+func TestAsyncAwaitAreContextual(t *testing.T) {
+	t.Parallel()
+
+	testcases := []struct {
+		description string
+		input       string
+		wraps       bool
+	}{
+		{description: "fields", input: "local t = {} return t.async, t.await"},
+		{description: "constructor keys", input: "local t = {await = 1, async = 2} return t"},
+		{description: "locals", input: "local async, await = 1, 2 return async + await"},
+		{description: "globals", input: "await = 1 async = 2"},
+		{description: "function names", input: "function async() end function await() end"},
+		{description: "calls", input: "await(x) async(y)"},
+		{description: "name at the end of a line", input: "local x = await\ny = 2"},
+		{description: "library function", input: "local f = coroutine.async(function() end)", wraps: true},
+		{description: "await expression", input: "local x = await y", wraps: true},
+		{description: "await statement", input: "await y", wraps: true},
+		{description: "async function", input: "async function f() end", wraps: true},
+		{description: "local async function", input: "local async function f() end", wraps: true},
+		{description: "async function expression", input: "local f = async function() end", wraps: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+			fn, err := Parse("contextual.lua", strings.NewReader(tc.input), ModeText)
+			require.NoError(t, err)
+			assert.Equal(t, tc.wraps, slices.Contains(fn.Constants, any("coroutine")))
+		})
+	}
+}
+
+func TestLongFieldNamesUseTableOps(t *testing.T) {
+	t.Parallel()
+
+	// like lua, only keys up to the short string length are used as fields.
+	short, long := strings.Repeat("s", conf.MAXSHORTLEN), strings.Repeat("l", conf.MAXSHORTLEN+1)
+	src := fmt.Sprintf("local t, v = ...\nt.%v = v\nt.%v = v\nreturn t.%v, {%v = v}", short, long, long, long)
+	fn, err := Parse("fields.lua", strings.NewReader(src), ModeText)
+	require.NoError(t, err)
+	assert.Equal(t, []any{short, long}, fn.Constants)
+	expected := []uint32{
+		bytecode.IAB(bytecode.VARARG, 0, 3),
+		bytecode.IAB(bytecode.MOVE, 2, 1),
+		bytecode.IABC(bytecode.SETFIELD, 0, 0, 2, false),
+		bytecode.IAB(bytecode.MOVE, 2, 1),
+		bytecode.IABx(bytecode.LOADK, 3, 1),
+		bytecode.IABC(bytecode.SETTABLE, 0, 3, 2, false),
+		bytecode.IABC(bytecode.GETTABLE, 2, 0, 1, true),
+		bytecode.IvABC(bytecode.NEWTABLE, 3, 0, 1, false),
+		bytecode.IABx(bytecode.LOADK, 4, 1),
+		bytecode.IAB(bytecode.MOVE, 5, 1),
+		bytecode.IABC(bytecode.SETTABLE, 3, 4, 5, false),
+		bytecode.IAB(bytecode.RETURN, 2, 3),
+	}
+	assert.Equal(t, expected, fn.ByteCodes, fmtBytecodeDiff(expected, fn.ByteCodes))
+}
@@ -145,10 +145,20 @@ const (
 	MetaMeta MetaMethod = "__metatable"
 	// MetaGC is the __gc methamethod.
 	MetaGC MetaMethod = "__gc"
+	// MetaMode is the __mode metafield that makes a table weak.
+	MetaMode MetaMethod = "__mode"
 )
 
 const unaryPriority = 12
 
+// async and await are not reserved words so that they can still be used as
+// names. They are only keywords where a name could not be followed by the next
+// token, see Parser.contextual.
+const (
+	asyncName = "async"
+	awaitName = "await"
+)
+
 // left, right priority for binary ops.
 var (
 	binaryPriority = map[tokenType][2]int{
@@ -175,6 +185,13 @@ var (
 		tokenFloorDivide:     {11, 11},
 		tokenExponent:        {14, 13},
 	}
+	// awaitOperand are the tokens that make await the operator when they follow
+	// it. They can start an expression but cannot continue one that uses await as
+	// a name, unlike a call or an operator would.
+	awaitOperand = []tokenType{
+		tokenIdentifier, tokenInteger, tokenFloat, tokenNil, tokenTrue, tokenFalse,
+		tokenDots, tokenFunction, tokenNot, tokenLength,
+	}
 	keywords = map[string]tokenType{
 		string(tokenAnd):      tokenAnd,
 		string(tokenTrue):     tokenTrue,
@@ -221,6 +238,26 @@ var (
 		tokenFloorDivide:     bytecode.IDIV,
 		tokenExponent:        bytecode.POW,
 	}
+	tokenToBytecodeOpI = map[tokenType]bytecode.Op{
+		tokenAdd:        bytecode.ADDI,
+		tokenShiftLeft:  bytecode.SHLI,
+		tokenShiftRight: bytecode.SHRI,
+		tokenEq:         bytecode.EQI,
+		tokenLt:         bytecode.LTI,
+		tokenLe:         bytecode.LEI,
+	}
+	tokenToBytecodeOpK = map[tokenType]bytecode.Op{
+		tokenAdd:             bytecode.ADDK,
+		tokenMinus:           bytecode.SUBK,
+		tokenMultiply:        bytecode.MULK,
+		tokenModulo:          bytecode.MODK,
+		tokenDivide:          bytecode.DIVK,
+		tokenFloorDivide:     bytecode.IDIVK,
+		tokenExponent:        bytecode.POWK,
+		tokenBitwiseAnd:      bytecode.BANDK,
+		tokenBitwiseOrUnion:  bytecode.BORK,
+		tokenBitwiseNotOrXOr: bytecode.BXORK,
+	}
 	tokenToMetaMethod = map[tokenType]MetaMethod{
 		tokenAdd:             MetaAdd,
 		tokenMinus:           MetaSub,
@@ -0,0 +1,909 @@
+package parse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/tanema/luaf/internal/bytecode"
+	"github.com/tanema/luaf/internal/conf"
+)
+
+// Lua 5.4 binary chunks, as written by luac 5.4 or string.dump, can be loaded by
+// translating them into luaf prototypes. The instruction sets are close enough
+// that most instructions map directly. The ones that do not are expanded into a
+// few luaf instructions using scratch registers above the frame of the function,
+// and all jumps are patched afterwards to account for the expansion.
+const (
+	lua54Signature = "\x1bLua"
+	lua54Version   = 0x54
+	lua54Format    = 0
+	lua54Data      = "\x19\x93\r\n\x1a\n"
+	lua54Int       = 0x5678
+	lua54Num       = 370.5
+
+	lua54VNil    = 0x00
+	lua54VFalse  = 0x01
+	lua54VTrue   = 0x11
+	lua54VNumInt = 0x03
+	lua54VNumFlt = 0x13
+	lua54VShrStr = 0x04
+	lua54VLngStr = 0x14
+
+	lua54AbsLineInfo = -0x80
+	lua54OffsetsBx   = 0xFFFF
+	lua54OffsetsJ    = 0xFFFFFF
+	lua54OffsetsC    = 0x7F
+	lua54MaxArgC     = 0xFF
+)
+
+type lua54Op uint8
+
+// opcodes in the order that they are numbered by Lua 5.4.
+const (
+	lua54MOVE lua54Op = iota
+	lua54LOADI
+	lua54LOADF
+	lua54LOADK
+	lua54LOADKX
+	lua54LOADFALSE
+	lua54LFALSESKIP
+	lua54LOADTRUE
+	lua54LOADNIL
+	lua54GETUPVAL
+	lua54SETUPVAL
+	lua54GETTABUP
+	lua54GETTABLE
+	lua54GETI
+	lua54GETFIELD
+	lua54SETTABUP
+	lua54SETTABLE
+	lua54SETI
+	lua54SETFIELD
+	lua54NEWTABLE
+	lua54SELF
+	lua54ADDI
+	lua54ADDK
+	lua54SUBK
+	lua54MULK
+	lua54MODK
+	lua54POWK
+	lua54DIVK
+	lua54IDIVK
+	lua54BANDK
+	lua54BORK
+	lua54BXORK
+	lua54SHRI
+	lua54SHLI
+	lua54ADD
+	lua54SUB
+	lua54MUL
+	lua54MOD
+	lua54POW
+	lua54DIV
+	lua54IDIV
+	lua54BAND
+	lua54BOR
+	lua54BXOR
+	lua54SHL
+	lua54SHR
+	lua54MMBIN
+	lua54MMBINI
+	lua54MMBINK
+	lua54UNM
+	lua54BNOT
+	lua54NOT
+	lua54LEN
+	lua54CONCAT
+	lua54CLOSE
+	lua54TBC
+	lua54JMP
+	lua54EQ
+	lua54LT
+	lua54LE
+	lua54EQK
+	lua54EQI
+	lua54LTI
+	lua54LEI
+	lua54GTI
+	lua54GEI
+	lua54TEST
+	lua54TESTSET
+	lua54CALL
+	lua54TAILCALL
+	lua54RETURN
+	lua54RETURN0
+	lua54RETURN1
+	lua54FORLOOP
+	lua54FORPREP
+	lua54TFORPREP
+	lua54TFORCALL
+	lua54TFORLOOP
+	lua54SETLIST
+	lua54CLOSURE
+	lua54VARARG
+	lua54VARARGPREP
+	lua54EXTRAARG
+)
+
+// arithmetic operations that map onto a luaf operation of the same name.
+var lua54Arith = map[lua54Op]bytecode.Op{
+	lua54ADD: bytecode.ADD, lua54SUB: bytecode.SUB, lua54MUL: bytecode.MUL, lua54MOD: bytecode.MOD,
+	lua54POW: bytecode.POW, lua54DIV: bytecode.DIV, lua54IDIV: bytecode.IDIV, lua54BAND: bytecode.BAND,
+	lua54BOR: bytecode.BOR, lua54BXOR: bytecode.BXOR, lua54SHL: bytecode.SHL, lua54SHR: bytecode.SHR,
+}
+
+// constant operand arithmetic that maps onto a luaf operation of the same name.
+var lua54ArithK = map[lua54Op]bytecode.Op{
+	lua54ADDK: bytecode.ADDK, lua54SUBK: bytecode.SUBK, lua54MULK: bytecode.MULK, lua54MODK: bytecode.MODK,
+	lua54POWK: bytecode.POWK, lua54DIVK: bytecode.DIVK, lua54IDIVK: bytecode.IDIVK, lua54BANDK: bytecode.BANDK,
+	lua54BORK: bytecode.BORK, lua54BXORK: bytecode.BXORK,
+}
+
+// lua54TagMethods maps the metamethod events used by MMBIN to the luaf register
+// form arithmetic operation that MMBIN dispatches on.
+var lua54TagMethods = map[uint8]bytecode.Op{
+	6: bytecode.ADD, 7: bytecode.SUB, 8: bytecode.MUL, 9: bytecode.MOD, 10: bytecode.POW, 11: bytecode.DIV,
+	12: bytecode.IDIV, 13: bytecode.BAND, 14: bytecode.BOR, 15: bytecode.BXOR, 16: bytecode.SHL, 17: bytecode.SHR,
+}
+
+var lua54Direct = map[lua54Op]bytecode.Op{
+	lua54MOVE: bytecode.MOVE, lua54LOADFALSE: bytecode.LOADFALSE, lua54LFALSESKIP: bytecode.LFALSESKIP,
+	lua54LOADTRUE: bytecode.LOADTRUE, lua54GETUPVAL: bytecode.GETUPVAL, lua54SETUPVAL: bytecode.SETUPVAL,
+	lua54UNM: bytecode.UNM, lua54BNOT: bytecode.BNOT, lua54NOT: bytecode.NOT, lua54LEN: bytecode.LEN,
+	lua54CLOSE: bytecode.CLOSE, lua54TBC: bytecode.TBC, lua54RETURN: bytecode.RETURN,
+	lua54RETURN0: bytecode.RETURN0, lua54RETURN1: bytecode.RETURN1,
+}
+
+type (
+	lua54Reader struct {
+		src *bufio.Reader
+		end binary.ByteOrder
+	}
+	lua54Proto struct {
+		source       string
+		lineDefined  int64
+		numParams    uint8
+		isVararg     bool
+		maxStackSize uint8
+		code         []uint32
+		lineInfo     []int8
+		absLineInfo  map[int]int64
+		locals       []lua54Local
+	}
+	lua54Local struct {
+		name           string
+		startPC, endPC int
+	}
+	// lua54Jump is a jump that needs to be patched once the position of every
+	// translated instruction is known. The target is the sub'th instruction of
+	// the translation of the original instruction at pc target.
+	lua54Jump struct {
+		pc     int
+		target int
+		sub    int
+	}
+	lua54Translator struct {
+		src     *lua54Proto
+		fn      *FnProto
+		oldPC   int
+		starts  []int
+		jumps   []lua54Jump
+		scratch uint8
+		line    LineInfo
+	}
+)
+
+func hasLua54Prefix(prefix []byte) bool {
+	return len(prefix) > len(lua54Signature) &&
+		bytes.HasPrefix(prefix, []byte(lua54Signature)) &&
+		prefix[len(lua54Signature)] == lua54Version
+}
+
+// undumpLua54 reads a Lua 5.4 binary chunk and translates it into a luaf FnProto.
+func undumpLua54(src *bufio.Reader) (*FnProto, error) {
+	rdr := &lua54Reader{src: src}
+	if err := rdr.header(); err != nil {
+		return nil, fmt.Errorf("lua 5.4 chunk: %w", err)
+	} else if _, err := rdr.byte(); err != nil { // number of upvalues in the main closure
+		return nil, fmt.Errorf("lua 5.4 chunk: %w", err)
+	}
+	fn, err := rdr.function("")
+	if err != nil {
+		return nil, fmt.Errorf("lua 5.4 chunk: %w", err)
+	}
+	fn.Name = "main"
+	return fn, nil
+}
+
+func (rdr *lua54Reader) header() error {
+	head := make([]byte, len(lua54Signature)+2+len(lua54Data)+3)
+	if _, err := io.ReadFull(rdr.src, head); err != nil {
+		return err
+	}
+	version, format := head[len(lua54Signature)], head[len(lua54Signature)+1]
+	data := string(head[len(lua54Signature)+2 : len(lua54Signature)+2+len(lua54Data)])
+	sizes := head[len(head)-3:]
+	if version != lua54Version {
+		return fmt.Errorf("unsupported version %x", version)
+	} else if format != lua54Format {
+		return fmt.Errorf("unsupported format %v", format)
+	} else if data != lua54Data {
+		return errors.New("corrupted chunk")
+	} else if sizes[0] != 4 || sizes[1] != 8 || sizes[2] != 8 {
+		return fmt.Errorf("unsupported sizes, instruction: %v, integer: %v, number: %v", sizes[0], sizes[1], sizes[2])
+	}
+
+	check := make([]byte, 8)
+	if _, err := io.ReadFull(rdr.src, check); err != nil {
+		return err
+	}
+	switch {
+	case binary.LittleEndian.Uint64(check) == lua54Int:
+		rdr.end = binary.LittleEndian
+	case binary.BigEndian.Uint64(check) == lua54Int:
+		rdr.end = binary.BigEndian
+	default:
+		return errors.New("integer format mismatch")
+	}
+	if num, err := rdr.float(); err != nil {
+		return err
+	} else if num != lua54Num {
+		return errors.New("float format mismatch")
+	}
+	return nil
+}
+
+func (rdr *lua54Reader) byte() (byte, error) { return rdr.src.ReadByte() }
+
+// size reads a variable length size where each byte holds 7 bits and the last
+// byte is marked with the high bit.
+func (rdr *lua54Reader) size() (int64, error) {
+	var size int64
+	for {
+		b, err := rdr.src.ReadByte()
+		if err != nil {
+			return 0, err
+		} else if size > math.MaxInt64>>7 {
+			return 0, errors.New("integer overflow")
+		}
+		size = size<<7 | int64(b&0x7f)
+		if b&0x80 != 0 {
+			return size, nil
+		}
+	}
+}
+
+func (rdr *lua54Reader) integer() (int64, error) {
+	var val int64
+	err := binary.Read(rdr.src, rdr.end, &val)
+	return val, err
+}
+
+func (rdr *lua54Reader) float() (float64, error) {
+	var val float64
+	err := binary.Read(rdr.src, rdr.end, &val)
+	return val, err
+}
+
+// string reads a string, the bool is false if the string was NULL.
+func (rdr *lua54Reader) string() (string, bool, error) {
+	size, err := rdr.size()
+	if err != nil || size == 0 {
+		return "", false, err
+	}
+	var buf strings.Builder
+	if _, err := io.CopyN(&buf, rdr.src, size-1); err != nil {
+		return "", false, err
+	}
+	return buf.String(), true, nil
+}
+
+// count reads the length of a list in the chunk, sanity checked so that a corrupt
+// chunk cannot make us allocate huge slices.
+func (rdr *lua54Reader) count() (int, error) {
+	size, err := rdr.size()
+	if err != nil {
+		return 0, err
+	} else if size > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid list size %v", size)
+	}
+	return int(size), nil
+}
+
+func (rdr *lua54Reader) function(parentSource string) (*FnProto, error) {
+	src := &lua54Proto{source: parentSource, absLineInfo: map[int]int64{}}
+	fn := &FnProto{}
+	if source, found, err := rdr.string(); err != nil {
+		return nil, err
+	} else if found {
+		src.source = source
+	}
+	if err := rdr.signature(src); err != nil {
+		return nil, err
+	} else if err := rdr.code(src); err != nil {
+		return nil, err
+	} else if err := rdr.constants(fn); err != nil {
+		return nil, err
+	} else if err := rdr.upvalues(fn); err != nil {
+		return nil, err
+	}
+
+	nprotos, err := rdr.count()
+	if err != nil {
+		return nil, err
+	}
+	fn.FnTable = make([]*FnProto, 0, min(nprotos, undumpPrealloc))
+	for range nprotos {
+		child, err := rdr.function(src.source)
+		if err != nil {
+			return nil, err
+		}
+		fn.FnTable = append(fn.FnTable, child)
+	}
+	if err := rdr.debug(src, fn); err != nil {
+		return nil, err
+	}
+
+	fn.Filename = src.source
+	if strings.HasPrefix(fn.Filename, "@") || strings.HasPrefix(fn.Filename, "=") {
+		fn.Filename = fn.Filename[1:]
+	}
+	fn.LineInfo = LineInfo{Line: src.lineDefined}
+	fn.Arity = int64(src.numParams)
+	fn.Varargs = src.isVararg
+	if err := translateLua54(src, fn); err != nil {
+		return nil, fmt.Errorf("%s:%v: %w", fn.Filename, src.lineDefined, err)
+	}
+	return fn, nil
+}
+
+func (rdr *lua54Reader) signature(src *lua54Proto) error {
+	var err error
+	if src.lineDefined, err = rdr.size(); err != nil {
+		return err
+	} else if _, err = rdr.size(); err != nil { // last line defined
+		return err
+	} else if src.numParams, err = rdr.byte(); err != nil {
+		return err
+	}
+	isVararg, err := rdr.byte()
+	if err != nil {
+		return err
+	}
+	src.isVararg = isVararg != 0
+	src.maxStackSize, err = rdr.byte()
+	return err
+}
+
+func (rdr *lua54Reader) code(src *lua54Proto) error {
+	size, err := rdr.count()
+	if err != nil {
+		return err
+	}
+	// the code is buffered first so that a corrupt size fails at the end of the
+	// chunk rather than allocating for instructions that are not there.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, rdr.src, int64(size)*4); err != nil {
+		return err
+	}
+	src.code = make([]uint32, size)
+	return binary.Read(&buf, rdr.end, src.code)
+}
+
+func (rdr *lua54Reader) constants(fn *FnProto) error {
+	size, err := rdr.count()
+	if err != nil {
+		return err
+	}
+	fn.Constants = make([]any, 0, min(size, undumpPrealloc))
+	for range size {
+		kind, err := rdr.byte()
+		if err != nil {
+			return err
+		}
+		var konst any
+		switch kind {
+		case lua54VNil:
+		case lua54VFalse:
+			konst = false
+		case lua54VTrue:
+			konst = true
+		case lua54VNumInt:
+			konst, err = rdr.integer()
+		case lua54VNumFlt:
+			konst, err = rdr.float()
+		case lua54VShrStr, lua54VLngStr:
+			konst, _, err = rdr.string()
+		default:
+			return fmt.Errorf("unknown constant type %v", kind)
+		}
+		if err != nil {
+			return err
+		}
+		fn.Constants = append(fn.Constants, konst)
+	}
+	return nil
+}
+
+func (rdr *lua54Reader) upvalues(fn *FnProto) error {
+	size, err := rdr.count()
+	if err != nil {
+		return err
+	}
+	fn.UpIndexes = make([]Upindex, 0, min(size, undumpPrealloc))
+	desc := make([]byte, 3) // instack, index, kind
+	for range size {
+		if _, err := io.ReadFull(rdr.src, desc); err != nil {
+			return err
+		}
+		fn.UpIndexes = append(fn.UpIndexes, Upindex{FromStack: desc[0] != 0, Index: desc[1]})
+	}
+	return nil
+}
+
+func (rdr *lua54Reader) debug(src *lua54Proto, fn *FnProto) error {
+	size, err := rdr.count()
+	if err != nil {
+		return err
+	}
+	var lineInfo bytes.Buffer
+	if _, err := io.CopyN(&lineInfo, rdr.src, int64(size)); err != nil {
+		return err
+	}
+	src.lineInfo = make([]int8, size)
+	for i, delta := range lineInfo.Bytes() {
+		src.lineInfo[i] = int8(delta)
+	}
+
+	if size, err = rdr.count(); err != nil {
+		return err
+	}
+	for range size {
+		pc, err := rdr.size()
+		if err != nil {
+			return err
+		}
+		line, err := rdr.size()
+		if err != nil {
+			return err
+		}
+		src.absLineInfo[int(pc)] = line
+	}
+
+	if size, err = rdr.count(); err != nil {
+		return err
+	}
+	src.locals = make([]lua54Local, 0, min(size, undumpPrealloc))
+	for range size {
+		name, _, err := rdr.string()
+		if err != nil {
+			return err
+		}
+		startPC, err := rdr.size()
+		if err != nil {
+			return err
+		}
+		endPC, err := rdr.size()
+		if err != nil {
+			return err
+		}
+		src.locals = append(src.locals, lua54Local{name: name, startPC: int(startPC), endPC: int(endPC)})
+	}
+
+	if size, err = rdr.count(); err != nil {
+		return err
+	}
+	for i := range size {
+		name, _, err := rdr.string()
+		if err != nil {
+			return err
+		} else if i < len(fn.UpIndexes) {
+			fn.UpIndexes[i].Name = name
+		}
+	}
+	return nil
+}
+
+// translateLua54 converts the instructions of a Lua 5.4 function into luaf
+// bytecode along with the line trace and locals that refer to instruction
+// positions. The closing value of a generic for loop is not supported and is
+// ignored.
+func translateLua54(src *lua54Proto, fn *FnProto) error {
+	if int(src.maxStackSize)+2 > conf.MAXREGS {
+		return errors.New("function uses too many registers to be translated")
+	}
+	t := &lua54Translator{
+		src:     src,
+		fn:      fn,
+		starts:  make([]int, len(src.code)+1),
+		scratch: src.maxStackSize,
+		line:    LineInfo{Line: src.lineDefined},
+	}
+	for pc, code := range src.code {
+		t.oldPC = pc
+		t.starts[pc] = len(fn.ByteCodes)
+		t.advanceLine(pc)
+		if err := t.translate(code); err != nil {
+			return fmt.Errorf("instruction %v: %w", pc, err)
+		}
+	}
+	t.starts[len(src.code)] = len(fn.ByteCodes)
+	if err := t.patchJumps(); err != nil {
+		return err
+	}
+
+	fn.AllLocals = make([]*Local, len(src.locals))
+	for i, lcl := range src.locals {
+		// registers are not stored, a local is in the register after every other
+		// local that is active when it starts.
+		var register uint8
+		for _, prev := range src.locals[:i] {
+			if prev.startPC <= lcl.startPC && lcl.startPC < prev.endPC {
+				register++
+			}
+		}
+		fn.AllLocals[i] = &Local{
+			name:     lcl.name,
+			register: register,
+			startPC:  t.starts[min(lcl.startPC, len(src.code))],
+			endPC:    t.starts[min(lcl.endPC, len(src.code))],
+		}
+	}
+	return nil
+}
+
+func (t *lua54Translator) advanceLine(pc int) {
+	if pc >= len(t.src.lineInfo) {
+		return
+	} else if delta := t.src.lineInfo[pc]; delta != lua54AbsLineInfo {
+		t.line.Line += int64(delta)
+	} else if line, found := t.src.absLineInfo[pc]; found {
+		t.line.Line = line
+	}
+}
+
+func (t *lua54Translator) emit(codes ...uint32) {
+	for _, code := range codes {
+		t.fn.ByteCodes = append(t.fn.ByteCodes, code)
+		t.fn.LineTrace = append(t.fn.LineTrace, t.line)
+	}
+}
+
+// jump emits a placeholder instruction that is patched to jump to the sub'th
+// instruction translated from target.
+func (t *lua54Translator) jump(code uint32, target, sub int) error {
+	if target < 0 || target > len(t.src.code) {
+		return fmt.Errorf("jump out of bounds to %v", target)
+	}
+	t.jumps = append(t.jumps, lua54Jump{pc: len(t.fn.ByteCodes), target: target, sub: sub})
+	t.emit(code)
+	return nil
+}
+
+func (t *lua54Translator) patchJumps() error {
+	for _, jmp := range t.jumps {
+		code := t.fn.ByteCodes[jmp.pc]
+		dest := t.starts[jmp.target] + jmp.sub
+		var offset int
+		switch bytecode.GetOp(code) {
+		case bytecode.JMP:
+			offset = dest - jmp.pc - 1
+			if offset < math.MinInt16 || offset > math.MaxInt16 {
+				return fmt.Errorf("jump at %v too far", jmp.pc)
+			}
+			t.fn.ByteCodes[jmp.pc] = bytecode.Jump(int32(offset))
+			continue
+		case bytecode.FORPREP:
+			offset = dest - jmp.pc - 1
+		default: // backward loops: FORLOOP, TFORLOOP
+			offset = jmp.pc + 1 - dest
+		}
+		if offset < 0 || offset > math.MaxUint16 {
+			return fmt.Errorf("loop at %v too long", jmp.pc)
+		}
+		t.fn.ByteCodes[jmp.pc] = bytecode.IABx(bytecode.GetOp(code), uint8(bytecode.GetA(code)), uint16(offset))
+	}
+	return nil
+}
+
+// extraArg returns the argument of the EXTRAARG instruction following the current one.
+func (t *lua54Translator) extraArg() (uint32, error) {
+	if next := t.oldPC + 1; next < len(t.src.code) && lua54Op(t.src.code[next]&0x7f) == lua54EXTRAARG {
+		return t.src.code[next] >> 7, nil
+	}
+	return 0, errors.New("expected EXTRAARG instruction")
+}
+
+// loadInt loads an integer into a register, using a constant if it does not fit
+// into a LOADI instruction.
+func (t *lua54Translator) loadInt(dst uint8, val int64, float bool) error {
+	if val >= math.MinInt16 && val <= math.MaxInt16 {
+		if float {
+			t.emit(bytecode.IAsBx(bytecode.LOADF, dst, int16(val)))
+		} else {
+			t.emit(bytecode.IAsBx(bytecode.LOADI, dst, int16(val)))
+		}
+		return nil
+	}
+	var konst any = val
+	if float {
+		konst = float64(val)
+	}
+	idx, err := t.fn.addConst(konst)
+	if err != nil {
+		return err
+	}
+	t.emit(bytecode.IABx(bytecode.LOADK, dst, idx))
+	return nil
+}
+
+func (t *lua54Translator) translate(code uint32) error {
+	op := lua54Op(code & 0x7f)
+	a := uint8(code >> 7)
+	k := code>>15&1 == 1
+	b := uint8(code >> 16)
+	c := uint8(code >> 24)
+	bx := int64(code >> 15)
+	sB := int64(b) - lua54OffsetsC
+	sC := int64(c) - lua54OffsetsC
+	tmp, tmp2 := t.scratch, t.scratch+1
+
+	if dst, found := lua54Direct[op]; found {
+		t.emit(bytecode.IAB(dst, a, b))
+		return nil
+	} else if dst, found := lua54Arith[op]; found {
+		t.emit(bytecode.IABC(dst, a, b, c, false))
+		return nil
+	} else if dst, found := lua54ArithK[op]; found {
+		t.emit(bytecode.IABC(dst, a, b, c, false))
+		return nil
+	}
+
+	switch op {
+	case lua54LOADI, lua54LOADF:
+		return t.loadInt(a, bx-lua54OffsetsBx, op == lua54LOADF)
+	case lua54LOADK:
+		if bx > math.MaxUint16 {
+			return fmt.Errorf("constant index %v too large", bx)
+		}
+		t.emit(bytecode.IABx(bytecode.LOADK, a, uint16(bx)))
+	case lua54LOADKX:
+		idx, err := t.extraArg()
+		if err != nil {
+			return err
+		} else if idx > math.MaxUint16 {
+			return fmt.Errorf("constant index %v too large", idx)
+		}
+		t.emit(bytecode.IABx(bytecode.LOADK, a, uint16(idx)))
+	case lua54LOADNIL:
+		t.emit(bytecode.IABx(bytecode.LOADNIL, a, uint16(b)))
+	case lua54GETTABUP:
+		t.emit(bytecode.IABC(bytecode.GETTABUP, a, b, c, true))
+	case lua54GETTABLE:
+		t.emit(bytecode.IABC(bytecode.GETTABLE, a, b, c, false))
+	case lua54GETI:
+		t.emit(bytecode.IABC(bytecode.GETI, a, b, c, false))
+	case lua54GETFIELD:
+		t.emit(bytecode.IABC(bytecode.GETFIELD, a, b, c, false))
+	case lua54SETTABUP:
+		// the luaf key is a register rather than a constant
+		t.emit(bytecode.IABx(bytecode.LOADK, tmp, uint16(b)), bytecode.IABC(bytecode.SETTABUP, a, tmp, c, k))
+	case lua54SETTABLE, lua54SETI, lua54SETFIELD:
+		// luaf clears the value register after a store, and the key register of
+		// SETTABLE, as they are always temporaries in luaf code. In Lua they may be
+		// locals so they are copied to the scratch registers first.
+		val := c
+		if !k {
+			t.emit(bytecode.IAB(bytecode.MOVE, tmp2, c))
+			val = tmp2
+		}
+		switch op {
+		case lua54SETTABLE:
+			t.emit(bytecode.IAB(bytecode.MOVE, tmp, b), bytecode.IABC(bytecode.SETTABLE, a, tmp, val, k))
+		case lua54SETI:
+			t.emit(bytecode.IABC(bytecode.SETI, a, b, val, k))
+		default:
+			t.emit(bytecode.IABC(bytecode.SETFIELD, a, b, val, k))
+		}
+	case lua54NEWTABLE:
+		extra, err := t.extraArg()
+		if err != nil {
+			return err
+		}
+		var hashSize uint16
+		if b > 10 {
+			hashSize = 0x3FF
+		} else if b > 0 {
+			hashSize = 1 << (b - 1)
+		}
+		arraySize := uint32(c)
+		if k {
+			arraySize += extra * (lua54MaxArgC + 1)
+		}
+		if arraySize <= 0x3F {
+			t.emit(bytecode.IvABC(bytecode.NEWTABLE, a, uint8(arraySize), hashSize, false))
+		} else {
+			t.emit(bytecode.IvABC(bytecode.NEWTABLE, a, 0, hashSize, true), bytecode.ExArg(arraySize+1))
+		}
+	case lua54SELF:
+		if k {
+			t.emit(bytecode.IABC(bytecode.SELF, a, b, c, false))
+		} else {
+			t.emit(
+				bytecode.IAB(bytecode.MOVE, tmp, b),
+				bytecode.IABC(bytecode.GETTABLE, a, tmp, c, false),
+				bytecode.IAB(bytecode.MOVE, a+1, tmp),
+			)
+		}
+	case lua54ADDI:
+		if sC <= math.MaxInt8 {
+			t.emit(bytecode.IABsC(bytecode.ADDI, a, b, int8(sC), false))
+		} else if err := t.loadInt(tmp, sC, false); err != nil {
+			return err
+		} else {
+			t.emit(bytecode.IABC(bytecode.ADD, a, b, tmp, false))
+		}
+	case lua54SHRI:
+		if sC <= math.MaxInt8 {
+			t.emit(bytecode.IABsC(bytecode.SHRI, a, b, int8(sC), false))
+		} else if err := t.loadInt(tmp, sC, false); err != nil {
+			return err
+		} else {
+			t.emit(bytecode.IABC(bytecode.SHR, a, b, tmp, false))
+		}
+	case lua54SHLI:
+		// lua shifts the immediate by the register, which luaf marks as flipped.
+		if sC <= math.MaxInt8 {
+			t.emit(bytecode.IABsC(bytecode.SHLI, a, b, int8(sC), true))
+		} else if err := t.loadInt(tmp, sC, false); err != nil {
+			return err
+		} else {
+			t.emit(bytecode.IABC(bytecode.SHL, a, tmp, b, false))
+		}
+	case lua54MMBIN, lua54MMBINI, lua54MMBINK:
+		mmop, found := lua54TagMethods[c]
+		if !found {
+			return fmt.Errorf("invalid metamethod event %v", c)
+		}
+		switch op {
+		case lua54MMBIN:
+			t.emit(bytecode.IABC(bytecode.MMBIN, a, b, uint8(mmop), false))
+		case lua54MMBINK:
+			t.emit(bytecode.IABC(bytecode.MMBINK, a, b, uint8(mmop), k))
+		default:
+			if sB >= math.MinInt8 && sB <= math.MaxInt8 {
+				t.emit(bytecode.IAsBC(bytecode.MMBINI, a, int8(sB), uint8(mmop), k))
+				break
+			}
+			// nothing may come between the arithmetic and its fallback so an immediate
+			// that does not fit is passed as a constant instead.
+			idx, err := t.fn.addConst(sB)
+			if err != nil {
+				return err
+			} else if idx > conf.MAXINLINECONST {
+				return fmt.Errorf("constant index %v too large", idx)
+			}
+			t.emit(bytecode.IABC(bytecode.MMBINK, a, uint8(idx), uint8(mmop), k))
+		}
+	case lua54VARARGPREP, lua54EXTRAARG:
+		// varargs need no preparation and extra args are consumed by the instruction
+		// before them.
+	case lua54CONCAT:
+		t.emit(bytecode.IABC(bytecode.CONCAT, a, a, a+b-1, false))
+	case lua54JMP:
+		return t.jump(bytecode.Jump(0), t.oldPC+1+int(code>>7)-lua54OffsetsJ, 0)
+	case lua54EQ, lua54LT, lua54LE:
+		dst := map[lua54Op]bytecode.Op{lua54EQ: bytecode.EQ, lua54LT: bytecode.LT, lua54LE: bytecode.LE}[op]
+		t.emit(bytecode.IABC(dst, lua54Bool(k), a, b, false))
+	case lua54EQK:
+		t.emit(bytecode.IABC(bytecode.EQK, lua54Bool(k), a, b, false))
+	case lua54EQI, lua54LTI, lua54LEI, lua54GTI, lua54GEI:
+		// C is set when the immediate was a float, luaf immediates are only integers.
+		if c == 0 && sB <= math.MaxInt8 {
+			imm := int8(sB)
+			switch op {
+			case lua54EQI:
+				t.emit(bytecode.IABsC(bytecode.EQI, lua54Bool(k), a, imm, false))
+			case lua54LTI:
+				t.emit(bytecode.IABsC(bytecode.LTI, lua54Bool(k), a, imm, false))
+			case lua54LEI:
+				t.emit(bytecode.IABsC(bytecode.LEI, lua54Bool(k), a, imm, false))
+			case lua54GTI:
+				t.emit(bytecode.IABsC(bytecode.LTI, lua54Bool(k), a, imm, true))
+			default:
+				t.emit(bytecode.IABsC(bytecode.LEI, lua54Bool(k), a, imm, true))
+			}
+			return nil
+		}
+		if err := t.loadInt(tmp, sB, c != 0); err != nil {
+			return err
+		}
+		switch op {
+		case lua54EQI:
+			t.emit(bytecode.IABC(bytecode.EQ, lua54Bool(k), a, tmp, false))
+		case lua54LTI:
+			t.emit(bytecode.IABC(bytecode.LT, lua54Bool(k), a, tmp, false))
+		case lua54LEI:
+			t.emit(bytecode.IABC(bytecode.LE, lua54Bool(k), a, tmp, false))
+		case lua54GTI:
+			t.emit(bytecode.IABC(bytecode.LT, lua54Bool(k), tmp, a, false))
+		default:
+			t.emit(bytecode.IABC(bytecode.LE, lua54Bool(k), tmp, a, false))
+		}
+	case lua54TEST:
+		t.emit(bytecode.IAB(bytecode.TEST, a, lua54Bool(k)))
+	case lua54TESTSET:
+		t.emit(bytecode.IABC(bytecode.TESTSET, a, b, lua54Bool(k), false))
+	case lua54VARARG:
+		t.emit(bytecode.IAB(bytecode.VARARG, a, c))
+	case lua54CALL:
+		t.emit(bytecode.IABC(bytecode.CALL, a, b, c, false))
+	case lua54TAILCALL:
+		t.emit(bytecode.IABC(bytecode.TAILCALL, a, b, 0, false))
+	case lua54FORPREP:
+		// luaf jumps straight to the FORLOOP, and the visible loop variable is
+		// copied at the start of the body rather than by the loop instructions.
+		if err := t.jump(bytecode.IABx(bytecode.FORPREP, a, 0), t.oldPC+int(bx)+1, 0); err != nil {
+			return err
+		}
+		t.emit(bytecode.IAB(bytecode.MOVE, a+3, a))
+	case lua54FORLOOP:
+		return t.jump(bytecode.IABx(bytecode.FORLOOP, a, 0), t.oldPC-int(bx), 1)
+	case lua54TFORPREP:
+		return t.jump(bytecode.Jump(0), t.oldPC+int(bx)+1, 0)
+	case lua54TFORCALL:
+		// luaf puts the results one register lower than Lua, over the closing
+		// value, so the results are shifted up and the closing value restored.
+		t.emit(bytecode.IAB(bytecode.MOVE, tmp, a+3), bytecode.IAsBx(bytecode.TFORCALL, a, int16(c)))
+		for i := int(c) - 1; i >= 0; i-- {
+			t.emit(bytecode.IAB(bytecode.MOVE, a+4+uint8(i), a+3+uint8(i)))
+		}
+		t.emit(bytecode.IAB(bytecode.MOVE, a+3, tmp))
+	case lua54TFORLOOP:
+		// TFORCALL already set the control variable to the first result so luaf
+		// can check the control variable instead of the first loop variable.
+		return t.jump(bytecode.IABx(bytecode.TFORLOOP, a+1, 0), t.oldPC+1-int(bx), 0)
+	case lua54SETLIST:
+		start := uint32(c)
+		if k {
+			extra, err := t.extraArg()
+			if err != nil {
+				return err
+			}
+			start += extra * (lua54MaxArgC + 1)
+		}
+		var count uint8
+		if b > 0 {
+			if b >= 0x3F {
+				return fmt.Errorf("SETLIST of %v values is too large", b)
+			}
+			count = b + 1
+		}
+		if start+1 <= 0x3FF {
+			t.emit(bytecode.IvABC(bytecode.SETLIST, a, count, uint16(start+1), false))
+		} else {
+			t.emit(bytecode.IvABC(bytecode.SETLIST, a, count, 0, true), bytecode.ExArg(start+1))
+		}
+	case lua54CLOSURE:
+		if bx >= int64(len(t.fn.FnTable)) {
+			return fmt.Errorf("closure index %v out of range", bx)
+		}
+		t.emit(bytecode.IABx(bytecode.CLOSURE, a, uint16(bx)))
+	default:
+		return fmt.Errorf("unsupported opcode %v", op)
+	}
+	return nil
+}
+
+func lua54Bool(val bool) uint8 {
+	if val {
+		return 1
+	}
+	return 0
+}
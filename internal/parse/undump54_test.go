@@ -0,0 +1,315 @@
+package parse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tanema/luaf/internal/bytecode"
+)
+
+// lua54TestFn describes a function to be written in the Lua 5.4 dump format so
+// that tests can target specific instructions. Real luac output is tested with
+// the fixture in runtime/testdata.
+type lua54TestFn struct {
+	source  string
+	line    int64
+	params  uint8
+	vararg  bool
+	stack   uint8
+	code    []uint32
+	consts  []any
+	upvals  [][3]byte
+	protos  []lua54TestFn
+	lines   []int8
+	locals  []lua54Local
+	upnames []string
+}
+
+func lua54Chunk(main lua54TestFn) []byte {
+	buf := []byte(lua54Signature)
+	buf = append(buf, lua54Version, lua54Format)
+	buf = append(buf, lua54Data...)
+	buf = append(buf, 4, 8, 8)
+	buf = binary.LittleEndian.AppendUint64(buf, lua54Int)
+	buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(lua54Num))
+	buf = append(buf, byte(len(main.upvals)))
+	return main.dump(buf)
+}
+
+func lua54Size(buf []byte, size int) []byte {
+	groups := []byte{byte(size&0x7f) | 0x80}
+	for size >>= 7; size > 0; size >>= 7 {
+		groups = append([]byte{byte(size & 0x7f)}, groups...)
+	}
+	return append(buf, groups...)
+}
+
+func lua54String(buf []byte, str string) []byte {
+	return append(lua54Size(buf, len(str)+1), str...)
+}
+
+func (fn lua54TestFn) dump(buf []byte) []byte {
+	if fn.source == "" {
+		buf = lua54Size(buf, 0)
+	} else {
+		buf = lua54String(buf, fn.source)
+	}
+	buf = lua54Size(buf, int(fn.line))
+	buf = lua54Size(buf, int(fn.line))
+	var vararg byte
+	if fn.vararg {
+		vararg = 1
+	}
+	buf = append(buf, fn.params, vararg, fn.stack)
+	buf = lua54Size(buf, len(fn.code))
+	for _, code := range fn.code {
+		buf = binary.LittleEndian.AppendUint32(buf, code)
+	}
+	buf = lua54Size(buf, len(fn.consts))
+	for _, konst := range fn.consts {
+		switch val := konst.(type) {
+		case nil:
+			buf = append(buf, lua54VNil)
+		case bool:
+			buf = append(buf, map[bool]byte{true: lua54VTrue, false: lua54VFalse}[val])
+		case int64:
+			buf = binary.LittleEndian.AppendUint64(append(buf, lua54VNumInt), uint64(val))
+		case float64:
+			buf = binary.LittleEndian.AppendUint64(append(buf, lua54VNumFlt), math.Float64bits(val))
+		case string:
+			buf = lua54String(append(buf, lua54VShrStr), val)
+		}
+	}
+	buf = lua54Size(buf, len(fn.upvals))
+	for _, upval := range fn.upvals {
+		buf = append(buf, upval[:]...)
+	}
+	buf = lua54Size(buf, len(fn.protos))
+	for _, proto := range fn.protos {
+		buf = proto.dump(buf)
+	}
+	buf = lua54Size(buf, len(fn.lines))
+	for _, delta := range fn.lines {
+		buf = append(buf, byte(delta))
+	}
+	buf = lua54Size(buf, 0) // abslineinfo
+	buf = lua54Size(buf, len(fn.locals))
+	for _, lcl := range fn.locals {
+		buf = lua54String(buf, lcl.name)
+		buf = lua54Size(buf, lcl.startPC)
+		buf = lua54Size(buf, lcl.endPC)
+	}
+	buf = lua54Size(buf, len(fn.upnames))
+	for _, name := range fn.upnames {
+		buf = lua54String(buf, name)
+	}
+	return buf
+}
+
+func lua54ABC(op lua54Op, a, b, c uint8, k bool) uint32 {
+	return uint32(c)<<24 | uint32(b)<<16 | uint32(lua54Bool(k))<<15 | uint32(a)<<7 | uint32(op)
+}
+
+func lua54ABx(op lua54Op, a uint8, bx int) uint32 { return uint32(bx)<<15 | uint32(a)<<7 | uint32(op) }
+
+func lua54AsBx(op lua54Op, a uint8, sbx int) uint32 { return lua54ABx(op, a, sbx+lua54OffsetsBx) }
+
+func lua54sJ(sj int) uint32 { return uint32(sj+lua54OffsetsJ)<<7 | uint32(lua54JMP) }
+
+func TestUndumpLua54(t *testing.T) {
+	t.Parallel()
+
+	// local t = {}
+	// for i = 1, 3 do t[i] = i * 2 end
+	// return t[3]
+	main := lua54TestFn{
+		source: "@loop.lua",
+		vararg: true,
+		stack:  6,
+		code: []uint32{
+			lua54ABC(lua54VARARGPREP, 0, 0, 0, false),
+			lua54ABC(lua54NEWTABLE, 0, 0, 0, false),
+			lua54ABx(lua54EXTRAARG, 0, 0),
+			lua54AsBx(lua54LOADI, 1, 1),
+			lua54AsBx(lua54LOADI, 2, 3),
+			lua54AsBx(lua54LOADI, 3, 1),
+			lua54ABx(lua54FORPREP, 1, 3),
+			lua54ABC(lua54MULK, 5, 4, 0, false),
+			lua54ABC(lua54MMBINK, 4, 0, 8, false),
+			lua54ABC(lua54SETTABLE, 0, 4, 5, false),
+			lua54ABx(lua54FORLOOP, 1, 4),
+			lua54ABC(lua54GETI, 1, 0, 3, false),
+			lua54ABC(lua54RETURN, 1, 2, 1, false),
+			lua54ABC(lua54RETURN, 1, 1, 1, false),
+		},
+		consts: []any{int64(2)},
+		upvals: [][3]byte{{1, 0, 0}},
+		lines:  []int8{1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0},
+		locals: []lua54Local{
+			{"t", 3, 14}, {"(for state)", 6, 11}, {"(for state)", 6, 11}, {"(for state)", 6, 11}, {"i", 7, 10},
+		},
+		upnames: []string{"_ENV"},
+	}
+
+	t.Run("translates instructions", func(t *testing.T) {
+		t.Parallel()
+		fn, err := Parse("ignored", bytes.NewReader(lua54Chunk(main)), ModeBinary)
+		require.NoError(t, err)
+		assert.Equal(t, "main", fn.Name)
+		assert.Equal(t, "loop.lua", fn.Filename)
+		assert.True(t, fn.Varargs)
+		assert.Equal(t, []any{int64(2)}, fn.Constants)
+		assert.Equal(t, []Upindex{{Name: _ENVName, FromStack: true, Index: 0}}, fn.UpIndexes)
+		expected := []uint32{
+			bytecode.IvABC(bytecode.NEWTABLE, 0, 0, 0, false),
+			bytecode.IAsBx(bytecode.LOADI, 1, 1),
+			bytecode.IAsBx(bytecode.LOADI, 2, 3),
+			bytecode.IAsBx(bytecode.LOADI, 3, 1),
+			bytecode.IABx(bytecode.FORPREP, 1, 6),
+			bytecode.IAB(bytecode.MOVE, 4, 1),
+			bytecode.IABC(bytecode.MULK, 5, 4, 0, false),
+			bytecode.IABC(bytecode.MMBINK, 4, 0, uint8(bytecode.MUL), false),
+			bytecode.IAB(bytecode.MOVE, 7, 5),
+			bytecode.IAB(bytecode.MOVE, 6, 4),
+			bytecode.IABC(bytecode.SETTABLE, 0, 6, 7, false),
+			bytecode.IABx(bytecode.FORLOOP, 1, 7),
+			bytecode.IABC(bytecode.GETI, 1, 0, 3, false),
+			bytecode.IAB(bytecode.RETURN, 1, 2),
+			bytecode.IAB(bytecode.RETURN, 1, 1),
+		}
+		assert.Equal(t, expected, fn.ByteCodes, fmtBytecodeDiff(expected, fn.ByteCodes))
+		require.Len(t, fn.LineTrace, len(expected))
+		assert.Equal(t, int64(1), fn.LineTrace[0].Line)
+		assert.Equal(t, int64(2), fn.LineTrace[4].Line)
+		assert.Equal(t, int64(3), fn.LineTrace[12].Line)
+
+		name, ok := fn.LocalNameAt(0, 12)
+		assert.True(t, ok)
+		assert.Equal(t, "t", name)
+		name, ok = fn.LocalNameAt(4, 6)
+		assert.True(t, ok)
+		assert.Equal(t, "i", name)
+	})
+
+	t.Run("dumps translated chunk", func(t *testing.T) {
+		t.Parallel()
+		fn, err := Parse("ignored", bytes.NewReader(lua54Chunk(main)), ModeBinary)
+		require.NoError(t, err)
+		fn.Constants = append(fn.Constants, nil, true)
+		data, err := fn.Dump(false)
+		require.NoError(t, err)
+		undumped, err := Parse("ignored", bytes.NewReader(data), ModeBinary)
+		require.NoError(t, err)
+		assert.Equal(t, fn.ByteCodes, undumped.ByteCodes)
+		assert.Equal(t, fn.Constants, undumped.Constants)
+	})
+
+	t.Run("translates conditional moves", func(t *testing.T) {
+		t.Parallel()
+		// local a, b = ...; return a or b
+		fn, err := Parse("ignored", bytes.NewReader(lua54Chunk(lua54TestFn{
+			vararg: true,
+			stack:  3,
+			code: []uint32{
+				lua54ABC(lua54TESTSET, 2, 0, 0, true),
+				lua54sJ(1),
+				lua54ABC(lua54MOVE, 2, 1, 0, false),
+				lua54ABC(lua54RETURN1, 2, 0, 0, false),
+			},
+		})), ModeBinary)
+		require.NoError(t, err)
+		expected := []uint32{
+			bytecode.IABC(bytecode.TESTSET, 2, 0, 1, false),
+			bytecode.Jump(1),
+			bytecode.IAB(bytecode.MOVE, 2, 1),
+			bytecode.IAB(bytecode.RETURN1, 2, 0),
+		}
+		assert.Equal(t, expected, fn.ByteCodes, fmtBytecodeDiff(expected, fn.ByteCodes))
+	})
+
+	t.Run("copies stored locals to scratch registers", func(t *testing.T) {
+		t.Parallel()
+		// local t, v = ...; t.x = v; t[1] = v; t[v] = 2
+		fn, err := Parse("ignored", bytes.NewReader(lua54Chunk(lua54TestFn{
+			params: 2,
+			stack:  2,
+			code: []uint32{
+				lua54ABC(lua54SETFIELD, 0, 0, 1, false),
+				lua54ABC(lua54SETI, 0, 1, 1, false),
+				lua54ABC(lua54SETTABLE, 0, 1, 1, true),
+				lua54ABC(lua54RETURN0, 0, 1, 0, false),
+			},
+			consts: []any{"x", int64(2)},
+		})), ModeBinary)
+		require.NoError(t, err)
+		expected := []uint32{
+			bytecode.IAB(bytecode.MOVE, 3, 1),
+			bytecode.IABC(bytecode.SETFIELD, 0, 0, 3, false),
+			bytecode.IAB(bytecode.MOVE, 3, 1),
+			bytecode.IABC(bytecode.SETI, 0, 1, 3, false),
+			bytecode.IAB(bytecode.MOVE, 2, 1),
+			bytecode.IABC(bytecode.SETTABLE, 0, 2, 1, true),
+			bytecode.IAB(bytecode.RETURN0, 0, 1),
+		}
+		assert.Equal(t, expected, fn.ByteCodes, fmtBytecodeDiff(expected, fn.ByteCodes))
+	})
+
+	t.Run("translates metamethod fallbacks", func(t *testing.T) {
+		t.Parallel()
+		// local a = ...; return a + 128, a - 127
+		fn, err := Parse("ignored", bytes.NewReader(lua54Chunk(lua54TestFn{
+			params: 1,
+			stack:  3,
+			code: []uint32{
+				lua54ABC(lua54ADDI, 1, 0, 255, false),
+				lua54ABC(lua54MMBINI, 0, 255, 6, false),
+				lua54ABC(lua54ADDI, 2, 0, 0, false),
+				lua54ABC(lua54MMBINI, 0, 254, 7, false),
+				lua54ABC(lua54RETURN, 1, 3, 0, false),
+			},
+		})), ModeBinary)
+		require.NoError(t, err)
+		expected := []uint32{
+			bytecode.IAsBx(bytecode.LOADI, 3, 128),
+			bytecode.IABC(bytecode.ADD, 1, 0, 3, false),
+			bytecode.IABC(bytecode.MMBINK, 0, 0, uint8(bytecode.ADD), false),
+			bytecode.IABsC(bytecode.ADDI, 2, 0, -127, false),
+			bytecode.IAsBC(bytecode.MMBINI, 0, 127, uint8(bytecode.SUB), false),
+			bytecode.IAB(bytecode.RETURN, 1, 3),
+		}
+		assert.Equal(t, expected, fn.ByteCodes, fmtBytecodeDiff(expected, fn.ByteCodes))
+		assert.Equal(t, []any{int64(128)}, fn.Constants)
+	})
+
+	t.Run("rejects unsupported chunks", func(t *testing.T) {
+		t.Parallel()
+		chunk := lua54Chunk(main)
+		chunk[len(lua54Signature)+1] = 1
+		_, err := Parse("ignored", bytes.NewReader(chunk), ModeBinary)
+		require.ErrorContains(t, err, "unsupported format")
+
+		_, err = Parse("ignored", bytes.NewReader(lua54Chunk(lua54TestFn{
+			code: []uint32{uint32(lua54EXTRAARG) + 1},
+		})), ModeBinary)
+		require.ErrorContains(t, err, "unsupported opcode")
+
+		_, err = Parse("ignored", bytes.NewReader(lua54Chunk(lua54TestFn{
+			code: []uint32{lua54ABC(lua54LOADKX, 0, 0, 0, false)},
+		})), ModeBinary)
+		require.ErrorContains(t, err, "expected EXTRAARG")
+
+		_, err = Parse("ignored", bytes.NewReader(lua54Chunk(lua54TestFn{
+			stack: 2,
+			code: []uint32{
+				lua54ABC(lua54ADD, 0, 0, 1, false),
+				lua54ABC(lua54MMBIN, 0, 1, 22, false),
+			},
+		})), ModeBinary)
+		require.ErrorContains(t, err, "invalid metamethod event")
+	})
+}
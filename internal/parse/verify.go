@@ -0,0 +1,375 @@
+package parse
+
+import (
+	"fmt"
+
+	"github.com/tanema/luaf/internal/bytecode"
+	"github.com/tanema/luaf/internal/conf"
+	"github.com/tanema/luaf/internal/lerrors"
+)
+
+// verifier walks the bytecode of a loaded chunk before it is run. The vm trusts
+// its bytecode and indexes into the stack, constants, upvalues and function table
+// directly, so a corrupt or hand crafted chunk could otherwise panic the process.
+type verifier struct {
+	fn   *FnProto
+	pc   int
+	code uint32
+}
+
+// verify checks fn and all of its children.
+func (fn *FnProto) verify() error {
+	vfy := &verifier{fn: fn}
+	if fn.Arity < 0 || fn.Arity > conf.MAXREGS {
+		return vfy.errorf("invalid number of parameters %v", fn.Arity)
+	}
+	for pc, code := range fn.ByteCodes {
+		vfy.pc, vfy.code = pc, code
+		if err := vfy.instruction(); err != nil {
+			return err
+		}
+	}
+	for _, child := range fn.FnTable {
+		for _, idx := range child.UpIndexes {
+			if !idx.FromStack && int(idx.Index) >= len(fn.UpIndexes) {
+				return vfy.errorf("closure %q captures upvalue %v that does not exist", child.Name, idx.Index)
+			}
+		}
+		if err := child.verify(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vfy *verifier) errorf(format string, args ...any) error {
+	err := &lerrors.Error{
+		Kind:     lerrors.BytecodeErr,
+		Filename: vfy.fn.Filename,
+		Err:      fmt.Errorf(format, args...),
+	}
+	if vfy.pc < len(vfy.fn.ByteCodes) {
+		op := bytecode.GetOp(vfy.code)
+		err.Err = fmt.Errorf("%v at pc %v: %w", op.ToString(), vfy.pc, err.Err)
+	}
+	if vfy.pc < len(vfy.fn.LineTrace) {
+		err.Line = vfy.fn.LineTrace[vfy.pc].Line
+		err.Column = vfy.fn.LineTrace[vfy.pc].Column
+	}
+	return err
+}
+
+// regs checks that n registers starting at first are within the frame.
+func (vfy *verifier) regs(first, n int64) error {
+	if first < 0 || n < 0 || first+n > conf.MAXREGS {
+		return vfy.errorf("registers %v to %v out of range", first, first+n-1)
+	}
+	return nil
+}
+
+func (vfy *verifier) konst(idx int64) error {
+	if idx < 0 || idx >= int64(len(vfy.fn.Constants)) {
+		return vfy.errorf("constant %v out of range", idx)
+	}
+	return nil
+}
+
+// field checks a constant used as a key by GETFIELD and SETFIELD, which are only
+// ever string constants.
+func (vfy *verifier) field(idx int64) error {
+	if err := vfy.konst(idx); err != nil {
+		return err
+	} else if _, isStr := vfy.fn.Constants[idx].(string); !isStr {
+		return vfy.errorf("constant %v is not a string field name", idx)
+	}
+	return nil
+}
+
+// rk checks an operand that is a constant if k is set, or a register otherwise.
+func (vfy *verifier) rk(idx int64, isConst bool) error {
+	if isConst {
+		return vfy.konst(idx)
+	}
+	return vfy.regs(idx, 1)
+}
+
+func (vfy *verifier) upval(idx int64) error {
+	if idx >= int64(len(vfy.fn.UpIndexes)) {
+		return vfy.errorf("upvalue %v out of range", idx)
+	}
+	return nil
+}
+
+// target checks a pc that execution will continue at. Landing right after the
+// last instruction is allowed as that ends the function. Jumps cannot land on
+// EXARG or on an instruction that uses the top of the stack left open by the one
+// before it.
+func (vfy *verifier) target(pc int64) error {
+	if pc < 0 || pc > int64(len(vfy.fn.ByteCodes)) {
+		return vfy.errorf("jump to %v out of range", pc)
+	} else if pc == int64(len(vfy.fn.ByteCodes)) {
+		return nil
+	} else if code := vfy.fn.ByteCodes[pc]; bytecode.GetOp(code) == bytecode.EXARG {
+		return vfy.errorf("jump to %v lands on EXARG", pc)
+	} else if usesOpenTop(code) {
+		return vfy.errorf("jump to %v lands on an instruction using the open top", pc)
+	}
+	return nil
+}
+
+// usesOpenTop reports if an instruction takes all the values up to the top of the
+// stack rather than a fixed number of registers.
+func usesOpenTop(code uint32) bool {
+	switch bytecode.GetOp(code) {
+	case bytecode.CALL, bytecode.TAILCALL, bytecode.RETURN:
+		return bytecode.GetB(code) == 0
+	case bytecode.SETLIST:
+		return bytecode.GetvB(code) == 0
+	default:
+		return false
+	}
+}
+
+// openTop checks that an instruction using the values up to the top of the stack
+// from first on follows a call or vararg that left the top open at or above first.
+// Otherwise the top is wherever the last instruction that moved it left it.
+func (vfy *verifier) openTop(first int64) error {
+	if vfy.pc > 0 {
+		prev := vfy.fn.ByteCodes[vfy.pc-1]
+		switch bytecode.GetOp(prev) {
+		case bytecode.CALL, bytecode.TAILCALL:
+			if bytecode.GetC(prev) == 0 && bytecode.GetA(prev) >= first {
+				return nil
+			}
+		case bytecode.VARARG:
+			if bytecode.GetB(prev) == 0 && bytecode.GetA(prev) >= first {
+				return nil
+			}
+		}
+	}
+	return vfy.errorf("does not follow an instruction that leaves the top open")
+}
+
+// extraArg checks that an instruction with extra arguments is followed by them.
+func (vfy *verifier) extraArg() error {
+	next := vfy.pc + 1
+	if next >= len(vfy.fn.ByteCodes) || bytecode.GetOp(vfy.fn.ByteCodes[next]) != bytecode.EXARG {
+		return vfy.errorf("expected EXARG to follow")
+	}
+	return nil
+}
+
+// metamethodFallback checks that an arithmetic instruction is followed by the
+// MMBIN that it skips when both operands are numbers.
+func (vfy *verifier) metamethodFallback() error {
+	next := vfy.pc + 1
+	if next < len(vfy.fn.ByteCodes) {
+		switch bytecode.GetOp(vfy.fn.ByteCodes[next]) {
+		case bytecode.MMBIN, bytecode.MMBINI, bytecode.MMBINK:
+			return nil
+		}
+	}
+	return vfy.errorf("expected MMBIN to follow")
+}
+
+// metamethodEvent checks that an MMBIN names a register form arithmetic operation
+// in C and follows an arithmetic instruction to store its result.
+func (vfy *verifier) metamethodEvent() error {
+	switch bytecode.Op(bytecode.GetC(vfy.code)) {
+	case bytecode.ADD, bytecode.SUB, bytecode.MUL, bytecode.DIV, bytecode.MOD, bytecode.POW, bytecode.IDIV,
+		bytecode.BAND, bytecode.BOR, bytecode.BXOR, bytecode.SHL, bytecode.SHR, bytecode.SAR:
+	default:
+		return vfy.errorf("invalid metamethod operation %v", bytecode.GetC(vfy.code))
+	}
+	if vfy.pc > 0 {
+		switch bytecode.GetOp(vfy.fn.ByteCodes[vfy.pc-1]) {
+		case bytecode.ADD, bytecode.SUB, bytecode.MUL, bytecode.DIV, bytecode.MOD, bytecode.POW, bytecode.IDIV,
+			bytecode.BAND, bytecode.BOR, bytecode.BXOR, bytecode.SHL, bytecode.SHR, bytecode.SAR,
+			bytecode.ADDI, bytecode.SHLI, bytecode.SHRI, bytecode.ADDK, bytecode.SUBK, bytecode.MULK,
+			bytecode.MODK, bytecode.POWK, bytecode.DIVK, bytecode.IDIVK, bytecode.BANDK, bytecode.BORK,
+			bytecode.BXORK:
+			return nil
+		}
+	}
+	return vfy.errorf("does not follow an arithmetic instruction")
+}
+
+// genericLoop checks that the body of a generic for loop, which TFORLOOP jumps
+// back to, is entered by a jump to the TFORCALL that calls the iterator for it.
+func (vfy *verifier) genericLoop(body int64) error {
+	a := bytecode.GetA(vfy.code)
+	if body > 0 {
+		if jmp := vfy.fn.ByteCodes[body-1]; bytecode.GetOp(jmp) == bytecode.JMP {
+			for call := body + bytecode.GetJump(jmp); call >= body && call < int64(vfy.pc); call++ {
+				if code := vfy.fn.ByteCodes[call]; bytecode.GetOp(code) == bytecode.TFORCALL {
+					if bytecode.GetA(code)+1 == a {
+						return nil
+					}
+					break
+				}
+			}
+		}
+	}
+	return vfy.errorf("does not loop back to a generic for loop")
+}
+
+func (vfy *verifier) all(errs ...error) error { return anyerr(errs) }
+
+func (vfy *verifier) instruction() error {
+	code := vfy.code
+	op := bytecode.GetOp(code)
+	a := bytecode.GetA(code)
+	k := bytecode.GetK(code)
+	pc := int64(vfy.pc)
+
+	switch op {
+	case bytecode.MOVE, bytecode.UNM, bytecode.BNOT:
+		return vfy.all(vfy.regs(a, 1), vfy.regs(bytecode.GetB(code), 1))
+	case bytecode.LOADK:
+		return vfy.all(vfy.regs(a, 1), vfy.konst(bytecode.GetBx(code)))
+	case bytecode.LOADI, bytecode.LOADF, bytecode.LOADFALSE, bytecode.LOADTRUE, bytecode.TBC, bytecode.CLOSE,
+		bytecode.RETURN1:
+		return vfy.regs(a, 1)
+	case bytecode.LFALSESKIP:
+		return vfy.all(vfy.regs(a, 1), vfy.target(pc+2))
+	case bytecode.LOADNIL:
+		return vfy.regs(a, bytecode.GetBx(code)+1)
+	case bytecode.NEWTABLE:
+		if k {
+			return vfy.all(vfy.regs(a, 1), vfy.extraArg())
+		}
+		return vfy.regs(a, 1)
+	case bytecode.ADD, bytecode.SUB, bytecode.MUL, bytecode.DIV, bytecode.MOD, bytecode.POW, bytecode.IDIV,
+		bytecode.BAND, bytecode.BOR, bytecode.BXOR, bytecode.SHL, bytecode.SHR, bytecode.SAR:
+		return vfy.all(
+			vfy.regs(a, 1),
+			vfy.regs(bytecode.GetB(code), 1),
+			vfy.regs(bytecode.GetC(code), 1),
+			vfy.metamethodFallback(),
+		)
+	case bytecode.ADDI, bytecode.SHLI, bytecode.SHRI:
+		return vfy.all(vfy.regs(a, 1), vfy.regs(bytecode.GetB(code), 1), vfy.metamethodFallback())
+	case bytecode.ADDK, bytecode.SUBK, bytecode.MULK, bytecode.MODK, bytecode.POWK, bytecode.DIVK, bytecode.IDIVK,
+		bytecode.BANDK, bytecode.BORK, bytecode.BXORK:
+		return vfy.all(
+			vfy.regs(a, 1),
+			vfy.regs(bytecode.GetB(code), 1),
+			vfy.konst(bytecode.GetC(code)),
+			vfy.metamethodFallback(),
+		)
+	case bytecode.MMBIN:
+		return vfy.all(vfy.regs(a, 1), vfy.regs(bytecode.GetB(code), 1), vfy.metamethodEvent())
+	case bytecode.MMBINI:
+		return vfy.all(vfy.regs(a, 1), vfy.metamethodEvent())
+	case bytecode.MMBINK:
+		return vfy.all(vfy.regs(a, 1), vfy.konst(bytecode.GetB(code)), vfy.metamethodEvent())
+	case bytecode.NOT, bytecode.LEN:
+		return vfy.all(vfy.regs(a, 1), vfy.rk(bytecode.GetB(code), k))
+	case bytecode.CONCAT:
+		b, c := bytecode.GetB(code), bytecode.GetC(code)
+		return vfy.all(vfy.regs(a, 1), vfy.regs(b, max(c-b+1, 2)))
+	case bytecode.JMP:
+		return vfy.target(pc + 1 + bytecode.GetJump(code))
+	case bytecode.EQ, bytecode.LT, bytecode.LE:
+		return vfy.all(vfy.regs(bytecode.GetB(code), 1), vfy.regs(bytecode.GetC(code), 1), vfy.target(pc+2))
+	case bytecode.EQK:
+		return vfy.all(vfy.regs(bytecode.GetB(code), 1), vfy.konst(bytecode.GetC(code)), vfy.target(pc+2))
+	case bytecode.EQI, bytecode.LTI, bytecode.LEI:
+		return vfy.all(vfy.regs(bytecode.GetB(code), 1), vfy.target(pc+2))
+	case bytecode.TEST:
+		return vfy.all(vfy.regs(a, 1), vfy.target(pc+2))
+	case bytecode.TESTSET:
+		return vfy.all(vfy.regs(a, 1), vfy.regs(bytecode.GetB(code), 1), vfy.target(pc+2))
+	case bytecode.GETTABLE:
+		return vfy.all(vfy.regs(a, 1), vfy.regs(bytecode.GetB(code), 1), vfy.rk(bytecode.GetC(code), k))
+	case bytecode.GETI:
+		return vfy.all(vfy.regs(a, 1), vfy.regs(bytecode.GetB(code), 1))
+	case bytecode.GETFIELD:
+		return vfy.all(vfy.regs(a, 1), vfy.regs(bytecode.GetB(code), 1), vfy.field(bytecode.GetC(code)))
+	case bytecode.SETTABLE:
+		return vfy.all(vfy.regs(a, 1), vfy.regs(bytecode.GetB(code), 1), vfy.rk(bytecode.GetC(code), k))
+	case bytecode.SETI:
+		return vfy.all(vfy.regs(a, 1), vfy.rk(bytecode.GetC(code), k))
+	case bytecode.SETFIELD:
+		return vfy.all(vfy.regs(a, 1), vfy.field(bytecode.GetB(code)), vfy.rk(bytecode.GetC(code), k))
+	case bytecode.SETLIST:
+		errs := []error{vfy.regs(a, 1)}
+		if count := bytecode.GetvB(code) - 1; count > 0 {
+			errs = append(errs, vfy.regs(a+1, count))
+		} else if count < 0 {
+			errs = append(errs, vfy.openTop(a+1))
+		}
+		if k {
+			errs = append(errs, vfy.extraArg())
+		}
+		return anyerr(errs)
+	case bytecode.GETUPVAL, bytecode.SETUPVAL:
+		return vfy.all(vfy.regs(a, 1), vfy.upval(bytecode.GetB(code)))
+	case bytecode.GETTABUP:
+		return vfy.all(vfy.regs(a, 1), vfy.upval(bytecode.GetB(code)), vfy.rk(bytecode.GetC(code), k))
+	case bytecode.SETTABUP:
+		return vfy.all(vfy.upval(a), vfy.regs(bytecode.GetB(code), 1), vfy.rk(bytecode.GetC(code), k))
+	case bytecode.SELF:
+		return vfy.all(vfy.regs(a, 2), vfy.regs(bytecode.GetB(code), 1), vfy.konst(bytecode.GetC(code)))
+	case bytecode.CALL, bytecode.TAILCALL:
+		b, c := bytecode.GetB(code), bytecode.GetC(code)
+		if b == 0 {
+			return vfy.all(vfy.regs(a, 1), vfy.openTop(a+1), vfy.regs(a, max(c-1, 0)))
+		}
+		return vfy.all(vfy.regs(a, b), vfy.regs(a, max(c-1, 0)))
+	case bytecode.RETURN:
+		if bytecode.GetB(code) == 0 {
+			return vfy.all(vfy.regs(a, 1), vfy.openTop(a))
+		}
+		return vfy.regs(a, max(bytecode.GetB(code)-1, 1))
+	case bytecode.VARARG:
+		return vfy.regs(a, max(bytecode.GetB(code)-1, 1))
+	case bytecode.RETURN0:
+		return nil
+	case bytecode.CLOSURE:
+		if idx := bytecode.GetBx(code); idx >= int64(len(vfy.fn.FnTable)) {
+			return vfy.errorf("function %v out of range", idx)
+		}
+		return vfy.regs(a, 1)
+	case bytecode.FORPREP:
+		loop := pc + 1 + bytecode.GetBx(code)
+		if err := vfy.all(vfy.regs(a, 3), vfy.target(loop)); err != nil {
+			return err
+		} else if loop == int64(len(vfy.fn.ByteCodes)) ||
+			bytecode.GetOp(vfy.fn.ByteCodes[loop]) != bytecode.FORLOOP ||
+			bytecode.GetA(vfy.fn.ByteCodes[loop]) != a {
+			return vfy.errorf("does not jump to a matching FORLOOP")
+		}
+		return nil
+	case bytecode.FORLOOP:
+		body := pc + 1 - bytecode.GetBx(code)
+		if err := vfy.all(vfy.regs(a, 3), vfy.target(body)); err != nil {
+			return err
+		} else if prep := body - 1; prep < 0 ||
+			bytecode.GetOp(vfy.fn.ByteCodes[prep]) != bytecode.FORPREP ||
+			bytecode.GetA(vfy.fn.ByteCodes[prep]) != a ||
+			prep+1+bytecode.GetBx(vfy.fn.ByteCodes[prep]) != pc {
+			return vfy.errorf("does not loop back to a matching FORPREP")
+		}
+		return nil
+	case bytecode.TFORCALL:
+		return vfy.regs(a, 3+max(bytecode.GetsBx(code), 0))
+	case bytecode.TFORLOOP:
+		body := pc + 1 - bytecode.GetBx(code)
+		if err := vfy.all(vfy.regs(a, 2), vfy.target(body)); err != nil {
+			return err
+		}
+		return vfy.genericLoop(body)
+	case bytecode.EXARG:
+		if vfy.pc > 0 {
+			prev := vfy.fn.ByteCodes[vfy.pc-1]
+			prevOp := bytecode.GetOp(prev)
+			if (prevOp == bytecode.NEWTABLE || prevOp == bytecode.SETLIST) && bytecode.GetK(prev) {
+				return nil
+			}
+		}
+		return vfy.errorf("does not follow an instruction that takes extra arguments")
+	default:
+		return vfy.errorf("unsupported instruction")
+	}
+}
@@ -0,0 +1,162 @@
+package parse
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tanema/luaf/internal/bytecode"
+	"github.com/tanema/luaf/internal/lerrors"
+)
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	src := `local a = "one"
+local function add(b)
+  return a .. b
+end
+return add("two")`
+
+	load := func(t *testing.T, corrupt func(fn *FnProto)) (*FnProto, error) {
+		t.Helper()
+		fn, err := Parse("verify.lua", strings.NewReader(src), ModeText)
+		require.NoError(t, err)
+		corrupt(fn)
+		data, err := fn.Dump(false)
+		require.NoError(t, err)
+		return Parse("ignored", bytes.NewReader(data), ModeBinary)
+	}
+
+	t.Run("accepts valid chunk", func(t *testing.T) {
+		t.Parallel()
+		_, err := load(t, func(*FnProto) {})
+		require.NoError(t, err)
+	})
+
+	tests := map[string]struct {
+		corrupt func(fn *FnProto)
+		msg     string
+	}{
+		"constant out of range": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[0] = bytecode.IABx(bytecode.LOADK, 0, 42) },
+			msg:     "LOADK at pc 0: constant 42 out of range",
+		},
+		"register out of range": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[0] = bytecode.IABx(bytecode.LOADNIL, 250, 10) },
+			msg:     "registers 250 to 260 out of range",
+		},
+		"jump out of range": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[0] = bytecode.Jump(100) },
+			msg:     "jump to 101 out of range",
+		},
+		"function out of range": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[0] = bytecode.IABx(bytecode.CLOSURE, 0, 3) },
+			msg:     "function 3 out of range",
+		},
+		"upvalue out of range": {
+			corrupt: func(fn *FnProto) { fn.FnTable[0].ByteCodes[0] = bytecode.IAB(bytecode.GETUPVAL, 1, 5) },
+			msg:     "upvalue 5 out of range",
+		},
+		"captured upvalue out of range": {
+			corrupt: func(fn *FnProto) { fn.FnTable[0].UpIndexes[0] = Upindex{Name: "a", Index: 7} },
+			msg:     `closure "add" captures upvalue 7 that does not exist`,
+		},
+		"missing extra argument": {
+			corrupt: func(fn *FnProto) {
+				fn.ByteCodes = append(fn.ByteCodes, bytecode.IvABC(bytecode.NEWTABLE, 0, 0, 0, true))
+			},
+			msg: "expected EXARG to follow",
+		},
+		"stray extra argument": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[0] = bytecode.ExArg(1) },
+			msg:     "does not follow an instruction that takes extra arguments",
+		},
+		"field that is not a string": {
+			corrupt: func(fn *FnProto) {
+				fn.Constants = append(fn.Constants, int64(1))
+				fn.ByteCodes[0] = bytecode.IABC(bytecode.GETFIELD, 0, 0, uint8(len(fn.Constants)-1), false)
+			},
+			msg: "is not a string field name",
+		},
+		"arithmetic without fallback": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[0] = bytecode.IABC(bytecode.ADD, 0, 0, 0, false) },
+			msg:     "ADD at pc 0: expected MMBIN to follow",
+		},
+		"stray metamethod fallback": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[1] = bytecode.IABC(bytecode.MMBIN, 0, 0, uint8(bytecode.ADD), false) },
+			msg:     "does not follow an arithmetic instruction",
+		},
+		"invalid metamethod operation": {
+			corrupt: func(fn *FnProto) {
+				fn.ByteCodes[0] = bytecode.IABsC(bytecode.ADDI, 0, 0, 1, false)
+				fn.ByteCodes[1] = bytecode.IAsBC(bytecode.MMBINI, 0, 1, uint8(bytecode.CALL), false)
+			},
+			msg: "invalid metamethod operation",
+		},
+		"open top without a call": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[0] = bytecode.IAB(bytecode.RETURN, 0, 0) },
+			msg:     "RETURN at pc 0: does not follow an instruction that leaves the top open",
+		},
+		"open top below the call": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[5] = bytecode.IAB(bytecode.RETURN, 3, 0) },
+			msg:     "RETURN at pc 5: does not follow an instruction that leaves the top open",
+		},
+		"call with open top after a fixed value": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[4] = bytecode.IABC(bytecode.CALL, 2, 0, 1, false) },
+			msg:     "CALL at pc 4: does not follow an instruction that leaves the top open",
+		},
+		"jump onto open top": {
+			corrupt: func(fn *FnProto) {
+				fn.ByteCodes[0] = bytecode.Jump(4)
+				fn.ByteCodes[5] = bytecode.IAB(bytecode.RETURN, 2, 0)
+			},
+			msg: "jump to 5 lands on an instruction using the open top",
+		},
+		"loop without prep": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[2] = bytecode.IABx(bytecode.FORLOOP, 0, 2) },
+			msg:     "FORLOOP at pc 2: does not loop back to a matching FORPREP",
+		},
+		"generic loop without iterator call": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[3] = bytecode.IABx(bytecode.TFORLOOP, 1, 2) },
+			msg:     "TFORLOOP at pc 3: does not loop back to a generic for loop",
+		},
+		"unsupported instruction": {
+			corrupt: func(fn *FnProto) { fn.ByteCodes[0] = bytecode.IABx(bytecode.LOADKX, 0, 0) },
+			msg:     "unsupported instruction",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			fn, err := load(t, tc.corrupt)
+			assert.Nil(t, fn)
+			var luaErr *lerrors.Error
+			require.ErrorAs(t, err, &luaErr)
+			assert.Equal(t, lerrors.BytecodeErr, luaErr.Kind)
+			assert.ErrorContains(t, err, tc.msg)
+		})
+	}
+
+	t.Run("accepts open top after a call", func(t *testing.T) {
+		t.Parallel()
+		_, err := load(t, func(fn *FnProto) { fn.ByteCodes[5] = bytecode.IAB(bytecode.RETURN, 2, 0) })
+		require.NoError(t, err)
+	})
+
+	t.Run("rejects truncated chunk", func(t *testing.T) {
+		t.Parallel()
+		fn, err := Parse("verify.lua", strings.NewReader(src), ModeText)
+		require.NoError(t, err)
+		data, err := fn.Dump(false)
+		require.NoError(t, err)
+		for size := len(data) - 1; size > 0; size -= 7 {
+			_, err := Parse("ignored", bytes.NewReader(data[:size]), ModeBinary)
+			require.Error(t, err)
+		}
+	})
+}
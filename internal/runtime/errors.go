@@ -125,6 +125,11 @@ func isEnvReg(f *frame, pc, reg int64) bool {
 }
 
 func (vm *VM) annotate(f *frame, reg int64, err error) error {
+	return vm.annotateAt(f, f.pc, reg, err)
+}
+
+// annotateAt names the value held by reg at pc if the error message describes it.
+func (vm *VM) annotateAt(f *frame, pc, reg int64, err error) error {
 	if err == nil {
 		return nil
 	}
@@ -132,7 +137,7 @@ func (vm *VM) annotate(f *frame, reg int64, err error) error {
 	if strings.HasSuffix(msg, "')") {
 		return err
 	}
-	kind, name, ok := describeRegister(f, f.pc, reg)
+	kind, name, ok := describeRegister(f, pc, reg)
 	if !ok {
 		return err
 	}
@@ -177,25 +182,26 @@ func (vm *VM) annotateUpvalue(f *frame, upIdx int64, err error) error {
 	return fmt.Errorf("%s (upvalue '%s')", msg, name)
 }
 
-func (vm *VM) annotateArithErr(f *frame, op parse.MetaMethod, bVal any, bReg, cReg int64, err error) error {
+// annotateArithErr names the operand of a failed arithmetic metamethod call. The
+// registers are those of the left and right operands, or -1 for a constant which
+// can not be named. Registers are described as they were before the arithmetic
+// instruction preceding the metamethod instruction.
+func (vm *VM) annotateArithErr(f *frame, lVal Value, lReg, rReg int64, err error) error {
 	if err == nil {
 		return nil
 	}
-	msg := err.Error()
-	reg := bReg
-	switch {
-	case strings.Contains(msg, "has no integer representation"):
-		if _, ok := toIntExact(bVal); ok {
-			reg = cReg
-		}
-	case op == parse.MetaUNM || op == parse.MetaBNot:
-		reg = bReg
-	default:
-		if isNumber(bVal) {
-			reg = cReg
+	reg := lReg
+	if strings.Contains(err.Error(), "has no integer representation") {
+		if _, ok := lVal.toIntExact(); ok {
+			reg = rReg
 		}
+	} else if lVal.isNumber() {
+		reg = rReg
 	}
-	return vm.annotate(f, reg, err)
+	if reg < 0 {
+		return err
+	}
+	return vm.annotateAt(f, f.pc-1, reg, err)
 }
 
 func newUserErr(vm *VM, level int, val any) error {
@@ -230,6 +236,16 @@ func newUserErr(vm *VM, level int, val any) error {
 }
 
 func newRuntimeErr(vm *VM, li parse.LineInfo, err error) error {
+	var filename string
+	if vm.callDepth >= 0 {
+		filename = vm.callStack[vm.callDepth].filename
+	}
+	return newRuntimeErrIn(vm, filename, li, err)
+}
+
+// newRuntimeErrIn is newRuntimeErr for when the file the error happened in is
+// no longer on the call stack, like after a tail call from the root frame.
+func newRuntimeErrIn(vm *VM, filename string, li parse.LineInfo, err error) error {
 	var luaErr *lerrors.Error
 	if errors.As(err, &luaErr) {
 		if luaErr.Line != 0 {
@@ -237,28 +253,29 @@ func newRuntimeErr(vm *VM, li parse.LineInfo, err error) error {
 		}
 		luaErr.Line = li.Line
 		luaErr.Column = li.Column
-		if len(vm.callStack) > 0 {
-			luaErr.Filename = vm.callStack[vm.callDepth].filename
-		}
+		luaErr.Filename = filename
 		return luaErr
 	}
-	ci := callInfo{LineInfo: li}
-	if len(vm.callStack) > 0 {
-		ci.filename = vm.callStack[vm.callDepth].filename
-	}
 	return &lerrors.Error{
 		Kind:      lerrors.RuntimeErr,
-		Filename:  ci.filename,
-		Line:      ci.Line,
-		Column:    ci.Column,
+		Filename:  filename,
+		Line:      li.Line,
+		Column:    li.Column,
 		Err:       err,
 		Traceback: vm.formatCallstack(),
 	}
 }
 
 func (vm *VM) formatCallstack() []string {
+	// like lua, only the outermost and innermost calls of a deep stack are shown.
+	const levels1, levels2 = 11, 10
 	parts := []string{}
-	for i := range vm.callDepth {
+	for i := int64(0); i < vm.callDepth; i++ {
+		if skip := vm.callDepth - levels1 - levels2; i == levels1 && skip > 1 {
+			parts = append(parts, fmt.Sprintf("\t...\t(skipping %d levels)", skip))
+			i += skip - 1
+			continue
+		}
 		info := vm.callStack[i]
 		if strings.HasPrefix(info.filename, "<") && strings.HasSuffix(info.filename, ">") {
 			parts = append(parts, fmt.Sprintf("\t%v %v", info.filename, info.name))
@@ -0,0 +1,147 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+type (
+	// Future is the eventual result of an async function, or of anything else that
+	// go code completes later. It can be settled from any goroutine, the threads
+	// awaiting it are resumed by the event loop of their vm once it is.
+	Future struct {
+		mu      sync.Mutex
+		state   futureState
+		res     []any
+		err     error
+		waiting []func(res []any, err error)
+	}
+	futureState string
+)
+
+const (
+	futurePending  futureState = "pending"
+	futureResolved futureState = "resolved"
+	futureRejected futureState = "rejected"
+)
+
+var futureMetatable *Table
+
+func init() {
+	futureMetatable = sharedMetatable(map[any]any{
+		string(parse.MetaName): "FUTURE",
+		string(parse.MetaIndex): NewTable(nil, map[any]any{
+			"status": builtinFn("future:status", stdFutureStatus),
+		}),
+	})
+}
+
+// NewFuture creates a pending future that go code can return to lua and settle
+// later with Resolve or Reject.
+func NewFuture() *Future {
+	return &Future{state: futurePending}
+}
+
+func (f *Future) String() string { return fmt.Sprintf("future: %p", f) }
+
+// Resolve settles the future with the values that awaiting it returns. Only the
+// first call to Resolve or Reject settles the future.
+func (f *Future) Resolve(vals ...any) { f.settle(futureResolved, vals, nil) }
+
+// Reject settles the future with the error that awaiting it raises.
+func (f *Future) Reject(err error) { f.settle(futureRejected, nil, err) }
+
+func (f *Future) settle(state futureState, res []any, err error) {
+	f.mu.Lock()
+	if f.state != futurePending {
+		f.mu.Unlock()
+		return
+	}
+	f.state, f.res, f.err = state, res, err
+	waiting := f.waiting
+	f.waiting = nil
+	f.mu.Unlock()
+	for _, done := range waiting {
+		done(res, err)
+	}
+}
+
+// complete settles the future with the results of the function of an async
+// call. It is the continuation of that call.
+func (f *Future) complete(_ *VM, res []any, err error) ([]any, error) {
+	if err != nil {
+		f.Reject(err)
+	} else {
+		f.Resolve(res...)
+	}
+	return []any{}, nil
+}
+
+// then calls done once the future is settled, right away if it already is.
+func (f *Future) then(done func(res []any, err error)) {
+	f.mu.Lock()
+	if f.state == futurePending {
+		f.waiting = append(f.waiting, done)
+		f.mu.Unlock()
+		return
+	}
+	f.mu.Unlock()
+	done(f.res, f.err)
+}
+
+func (f *Future) status() futureState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+func (f *Future) settled() bool { return f.status() != futurePending }
+
+// async calls fn on a new thread of the event loop and returns a future of its
+// results. fn runs right away until it first has to wait, the loop runs the
+// rest of it.
+func (vm *VM) async(fn any, args []any) (*Future, error) {
+	future := NewFuture()
+	body := Fn("async", func(vm *VM, args []any) ([]any, error) {
+		res, err := vm.PCallK(fn, args, future.complete)
+		if IsYield(err) {
+			return nil, err
+		}
+		return future.complete(vm, res, err)
+	})
+	thread, err := vm.newThread(body)
+	if err != nil {
+		return nil, err
+	}
+	thread.scheduled = true
+	return future, vm.loop.resume(vm, thread, args)
+}
+
+// await returns the results of the future or raises its error. A pending future
+// yields the thread to the event loop if it can, otherwise the loop is run
+// until the future is settled.
+func (vm *VM) await(future *Future) ([]any, error) {
+	if future.settled() {
+		return future.res, future.err
+	} else if vm.canAwait() {
+		return vm.CallK(awaitYield, []any{&awaitOp{future: future}}, awaitContinue)
+	} else if vm.loop.running {
+		return nil, errors.New("cannot wait for a pending future while the loop is running")
+	}
+	vm.loop.waiting++
+	future.then(func([]any, error) { vm.loop.post(loopEvent{}) })
+	if err := vm.loop.run(vm, future.settled); err != nil {
+		return nil, err
+	}
+	return future.res, future.err
+}
+
+func stdFutureStatus(_ *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "future:status", "future"); err != nil {
+		return nil, err
+	}
+	return []any{string(args[0].(*Future).status())}, nil
+}
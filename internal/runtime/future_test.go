@@ -0,0 +1,76 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+func TestFuture(t *testing.T) {
+	t.Parallel()
+
+	run := func(t *testing.T, src string) []any {
+		t.Helper()
+		vm, err := New(context.Background(), nil)
+		require.NoError(t, err)
+		// fetch returns a future that is settled from another goroutine.
+		require.NoError(t, vm.env.Set("fetch", Fn("fetch", func(_ *VM, args []any) ([]any, error) {
+			future := NewFuture()
+			go func() {
+				if msg, isStr := args[0].(string); isStr {
+					future.Resolve("got " + msg)
+				} else {
+					future.Reject(errors.New("fetch failed"))
+				}
+			}()
+			return []any{future}, nil
+		})))
+		fn, err := parse.Parse("test", strings.NewReader(src), parse.ModeText)
+		require.NoError(t, err)
+		result, err := vm.Eval(fn)
+		require.NoError(t, err)
+		return result
+	}
+
+	t.Run("resolved from go on the loop", func(t *testing.T) {
+		t.Parallel()
+		result := run(t, `
+			local async function get(msg) return await fetch(msg) end
+			local res = {}
+			require("loop").run(function()
+				local a, b = get("a"), get("b")
+				res = { await a, await b }
+			end)
+			return res[1], res[2]
+		`)
+		assert.Equal(t, []any{"got a", "got b"}, result)
+	})
+
+	t.Run("awaited outside of a coroutine", func(t *testing.T) {
+		t.Parallel()
+		result := run(t, `
+			local future = fetch("msg")
+			return await future, future:status()
+		`)
+		assert.Equal(t, []any{"got msg", "resolved"}, result)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		t.Parallel()
+		result := run(t, `
+			local async function get() return await fetch(false) end
+			local future = get()
+			local ok, err = pcall(function() return await future end)
+			return ok, future:status(), err
+		`)
+		require.Len(t, result, 3)
+		assert.Equal(t, []any{false, "rejected"}, result[:2])
+		assert.Contains(t, result[2], "fetch failed")
+	})
+}
@@ -0,0 +1,305 @@
+package runtime
+
+import (
+	"cmp"
+	"fmt"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+	"weak"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+type (
+	// gcState is the garbage collection state that a vm shares with its
+	// coroutines.
+	//
+	// Tables are marked for finalization when setmetatable sets a metatable with
+	// a __gc field. They are given a go finalizer, which resurrects them once they
+	// are unreachable, but that only queues them since go runs finalizers on
+	// their own goroutine. The vm runs their __gc metamethods at its next safe
+	// point, in the reverse order that they were marked like lua. Like any go
+	// finalizer, a table that can reach itself through its own values is never
+	// collected so its __gc only runs when the vm is closed. Putting the finalizer
+	// on a sentinel that the table owns does not get around it, the sentinel has
+	// to hold the table to hand it to __gc which makes it part of the same cycle.
+	//
+	// Memory is left to the go collector, which cannot be stopped for one vm, so
+	// stopping the collector only stops finalizers from running at safe points.
+	//
+	// allocated is what collectgarbage("count") reports. Allocations add to it as
+	// they happen and every collection resets it to what a walk of the reachable
+	// values found, so like lua it only goes down when a collection runs.
+	gcState struct {
+		mu        sync.Mutex
+		delivered *sync.Cond
+		signal    *atomic.Bool
+		marked    map[weak.Pointer[Table]]uint64
+		pending   []finalizer
+		seq       uint64
+		running   bool
+		closed    bool
+		// main is the thread that created the state, the values on its stack are
+		// counted no matter which coroutine asks.
+		main      weak.Pointer[VM]
+		stopped   bool
+		mode      string
+		allocated atomic.Int64
+	}
+	finalizer struct {
+		tbl *Table
+		seq uint64
+	}
+	// MemStats is an estimate of the memory held by the values that a vm can
+	// still reach, in bytes. It is what collectgarbage("count") reports.
+	MemStats struct {
+		Tables   int64
+		Strings  int64
+		Closures int64
+		Stack    int64
+	}
+	// memWalker visits every value reachable from a vm once to add up MemStats.
+	memWalker struct {
+		stats MemStats
+		seen  map[any]bool
+		work  []any
+	}
+)
+
+const (
+	gcModeIncremental  = "incremental"
+	gcModeGenerational = "generational"
+
+	callInfoSize = int64(unsafe.Sizeof(callInfo{}))
+)
+
+func newGCState(main *VM) *gcState {
+	gc := &gcState{
+		signal: main.interrupted,
+		marked: map[weak.Pointer[Table]]uint64{},
+		main:   weak.Make(main),
+		mode:   gcModeIncremental,
+	}
+	gc.delivered = sync.NewCond(&gc.mu)
+	return gc
+}
+
+// mark marks tbl for finalization unless it already is.
+func (gc *gcState) mark(tbl *Table) {
+	ref := weak.Make(tbl)
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if _, isMarked := gc.marked[ref]; isMarked || gc.closed {
+		return
+	}
+	gc.seq++
+	gc.marked[ref] = gc.seq
+	runtime.SetFinalizer(tbl, func(tbl *Table) { gc.queue(ref, tbl) })
+}
+
+// queue is called on the go finalizer goroutine once tbl is unreachable.
+func (gc *gcState) queue(ref weak.Pointer[Table], tbl *Table) {
+	gc.mu.Lock()
+	if seq, isMarked := gc.marked[ref]; isMarked {
+		delete(gc.marked, ref)
+		gc.pending = append(gc.pending, finalizer{tbl: tbl, seq: seq})
+	}
+	gc.mu.Unlock()
+	gc.delivered.Broadcast()
+	gc.signal.Store(true)
+}
+
+// collect runs a full collection and waits for every table that it found
+// unreachable to be queued for finalization.
+func (gc *gcState) collect() {
+	runtime.GC()
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	// the weak pointers of tables with a finalizer are cleared as soon as the
+	// finalizer is queued on the go finalizer goroutine.
+	var waiting []weak.Pointer[Table]
+	for ref := range gc.marked {
+		if ref.Value() == nil {
+			waiting = append(waiting, ref)
+		}
+	}
+	for len(waiting) > 0 {
+		gc.delivered.Wait()
+		waiting = slices.DeleteFunc(waiting, func(ref weak.Pointer[Table]) bool {
+			_, isMarked := gc.marked[ref]
+			return !isMarked
+		})
+	}
+}
+
+// take removes the queued tables, along with every marked table if all is set,
+// in the order that their finalizers should run.
+func (gc *gcState) take(all bool) []finalizer {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	pending := gc.pending
+	gc.pending = nil
+	if all {
+		for ref, seq := range gc.marked {
+			if tbl := ref.Value(); tbl != nil {
+				runtime.SetFinalizer(tbl, nil)
+				pending = append(pending, finalizer{tbl: tbl, seq: seq})
+			}
+		}
+		clear(gc.marked)
+		gc.closed = true
+	}
+	slices.SortFunc(pending, func(a, b finalizer) int { return cmp.Compare(b.seq, a.seq) })
+	return pending
+}
+
+// runFinalizers calls the __gc metamethods of the tables that are queued, or of
+// every table marked for finalization if all is set. Errors raised by them are
+// only warned about.
+func (vm *VM) runFinalizers(all bool) {
+	if vm.gc.running {
+		return
+	}
+	vm.gc.running = true
+	defer func() { vm.gc.running = false }()
+	// finalizers can make more tables unreachable so keep going until none are
+	// left.
+	for pending := vm.gc.take(all); len(pending) > 0; pending = vm.gc.take(false) {
+		for _, fin := range pending {
+			method := vm.findMetavalue(parse.MetaGC, fin.tbl)
+			if method == nil {
+				continue
+			}
+			vm.nny++
+			_, err := vm.call(method, []any{fin.tbl})
+			vm.nny--
+			if err != nil {
+				_, _ = warn(vm, fmt.Sprintf("error in __gc metamethod (%v)", ToString(getErrVal(err))))
+			}
+		}
+	}
+}
+
+// collectGarbage runs a full collection and then the finalizers of the tables
+// that it found unreachable. It runs even if the collector is stopped.
+func (vm *VM) collectGarbage() {
+	// stale values above the top of the stack would keep objects alive.
+	clear(vm.Stack[vm.top:])
+	vm.gc.collect()
+	vm.runFinalizers(false)
+	vm.gc.allocated.Store(vm.MemStats().Total())
+}
+
+// StopGC stops finalizers from running on this vm and its coroutines until
+// RestartGC is called. Explicit collections still run them.
+func (vm *VM) StopGC() { vm.gc.stopped = true }
+
+// RestartGC runs finalizers at safe points again, including those queued while
+// the collector was stopped.
+func (vm *VM) RestartGC() {
+	vm.gc.stopped = false
+	vm.gc.signal.Store(true)
+}
+
+// MemStats adds up the memory held by the tables, strings, closures and stacks
+// that the vm, and any of its coroutines, can still reach. Values are only
+// counted once, no matter how many times they are referenced, and values only
+// held by weak references are not counted. Every value is visited so it costs as
+// much as a full collection, use MemCount for the running estimate.
+func (vm *VM) MemStats() MemStats {
+	w := &memWalker{seen: map[any]bool{}}
+	w.push(vm.env)
+	if main := vm.gc.main.Value(); main != nil {
+		w.push(main)
+	}
+	w.push(vm)
+	for len(w.work) > 0 {
+		ref := w.work[len(w.work)-1]
+		w.work = w.work[:len(w.work)-1]
+		w.walk(ref)
+	}
+	return w.stats
+}
+
+// MemCount is the estimate of the bytes in use that collectgarbage("count")
+// reports. It is the total of MemStats at the last collection plus everything
+// allocated since, so it is cheap to call but values dropped since the last
+// collection are still counted.
+func (vm *VM) MemCount() int64 { return vm.gc.allocated.Load() }
+
+// Total is the sum of all of the stats.
+func (m MemStats) Total() int64 { return m.Tables + m.Strings + m.Closures + m.Stack }
+
+func (w *memWalker) visit(v Value) {
+	if v.kind == kindString {
+		// strings are immutable so copies share their bytes.
+		if str := v.str(); len(str) > 0 && !w.seen[unsafe.StringData(str)] {
+			w.seen[unsafe.StringData(str)] = true
+			w.stats.Strings += int64(len(str))
+		}
+		return
+	}
+	switch ref := v.ref().(type) {
+	case *Table, *Closure, *VM:
+		w.push(ref)
+	}
+}
+
+func (w *memWalker) push(ref any) {
+	if !w.seen[ref] {
+		w.seen[ref] = true
+		w.work = append(w.work, ref)
+	}
+}
+
+func (w *memWalker) walk(ref any) {
+	switch obj := ref.(type) {
+	case *Table:
+		w.stats.Tables += tableSize + obj.footprint()
+		for _, val := range obj.val {
+			w.visit(val)
+		}
+		for _, node := range obj.nodes {
+			w.visit(node.key)
+			w.visit(node.val)
+		}
+		if obj.metatable != nil {
+			w.push(obj.metatable)
+		}
+		w.ephemerons(obj.ephemerons)
+	case *Closure:
+		w.stats.Closures += closureSize + int64(len(obj.upvalues))*pointerSize
+		for _, broker := range obj.upvalues {
+			w.push(broker)
+		}
+		w.ephemerons(obj.ephemerons)
+	case *upvalueBroker:
+		w.stats.Closures += brokerSize
+		// open upvalues are still on the stack of their thread.
+		if !obj.open {
+			w.visit(obj.val)
+		}
+	case *VM:
+		w.stats.Stack += int64(cap(obj.Stack))*valueSize + int64(cap(obj.callStack))*callInfoSize
+		for _, val := range obj.Stack[:obj.top] {
+			w.visit(val)
+		}
+		if obj.body != nil {
+			w.visit(ValueOf(obj.body))
+		}
+		w.ephemerons(obj.ephemerons)
+	}
+}
+
+// ephemerons visits the values a key holds in the weak keyed tables that are
+// still alive.
+func (w *memWalker) ephemerons(e ephemerons) {
+	for tbl, eph := range e {
+		if tbl.Value() != nil {
+			w.visit(eph.val)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 )
 
 // File is a lua file handle.
@@ -17,6 +18,7 @@ type File struct {
 	Path      string
 	Closed    bool
 	process   *os.Process
+	readMu    sync.Mutex // serializes reads and seeks, loop.read reads off the vm goroutine
 	reader    *bufio.Reader
 	handle    osFile
 	isstdpipe bool
@@ -172,6 +174,8 @@ func (f *File) Seek(from string, offset int64) (int64, error) {
 	} else if f.process != nil {
 		return 0, errors.New("cannot seek process")
 	}
+	f.readMu.Lock()
+	defer f.readMu.Unlock()
 	whence := 1
 	switch from {
 	case "set":
@@ -190,6 +194,8 @@ func (f *File) Read(formats []any) ([]any, error) {
 	} else if f.writeOnly {
 		return nil, errors.New("file writeonly")
 	}
+	f.readMu.Lock()
+	defer f.readMu.Unlock()
 
 	results := []any{}
 	for _, mode := range formats {
@@ -8,69 +8,66 @@ import (
 
 var threadMetatable *Table
 
+func init() {
+	threadMetatable = sharedMetatable(map[any]any{
+		string(parse.MetaName):     "THREAD",
+		string(parse.MetaClose):    builtinFn("coroutine.close", stdThreadClose),
+		string(parse.MetaToString): builtinFn("thread:__tostring", stdThreadToString),
+		"RUNNING":                  string(threadStateRunning),
+		"SUSPENDED":                string(threadStateSuspended),
+		"NORMAL":                   string(threadStateNormal),
+		"DEAD":                     string(threadStateDead),
+		string(parse.MetaIndex): NewTable(nil, map[any]any{
+			"close":   builtinFn("coroutine.close", stdThreadClose),
+			"running": builtinFn("coroutine.running", stdThreadRunning),
+			"status":  builtinFn("coroutine.status", stdThreadStatus),
+		}),
+	})
+}
+
 func createCoroutineLib() *Table {
-	threadMetatable = &Table{
-		hashtable: map[any]any{
-			string(parse.MetaName):     "THREAD",
-			string(parse.MetaClose):    Fn("coroutine.close", stdThreadClose),
-			string(parse.MetaToString): Fn("thread:__tostring", stdThreadToString),
-			"RUNNING":                  threadStateRunning,
-			"SUSPENDED":                threadStateSuspended,
-			"DEAD":                     threadStateDead,
-			string(parse.MetaIndex): &Table{
-				hashtable: map[any]any{
-					"close":   Fn("coroutine.close", stdThreadClose),
-					"running": Fn("coroutine.running", stdThreadRunning),
-					"status":  Fn("coroutine.status", stdThreadStatus),
-				},
-			},
-		},
-	}
-
-	return &Table{
-		hashtable: map[any]any{
-			"close":       Fn("coroutine.close", stdThreadClose),
-			"create":      Fn("coroutine.create", stdThreadCreate),
-			"isyieldable": Fn("coroutine.isyeildable", stdThreadIsYieldable),
-			"running":     Fn("coroutine.running", stdThreadRunning),
-			"status":      Fn("coroutine.status", stdThreadStatus),
-			"resume":      Fn("coroutine.resume", stdThreadResume),
-			"yield":       Fn("coroutine.yield", stdThreadYield),
-			"wrap":        Fn("coroutine.wrap", stdThreadWrap),
-		},
-	}
+	return NewTable(nil, map[any]any{
+		"async":       builtinFn("coroutine.async", stdThreadAsync),
+		"await":       builtinFn("coroutine.await", stdThreadAwait),
+		"close":       builtinFn("coroutine.close", stdThreadClose),
+		"create":      builtinFn("coroutine.create", stdThreadCreate),
+		"isyieldable": builtinFn("coroutine.isyieldable", stdThreadIsYieldable),
+		"running":     builtinFn("coroutine.running", stdThreadRunning),
+		"status":      builtinFn("coroutine.status", stdThreadStatus),
+		"resume":      builtinFn("coroutine.resume", stdThreadResume),
+		"yield":       builtinFn("coroutine.yield", stdThreadYield),
+		"wrap":        builtinFn("coroutine.wrap", stdThreadWrap),
+	})
 }
 
 func stdThreadCreate(vm *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "coroutine.create", "function"); err != nil {
 		return nil, err
 	}
-	newVM, err := vm.newYieldable(args[0])
+	thread, err := vm.newThread(args[0])
 	if err != nil {
 		return nil, err
 	}
-	return []any{newVM}, err
+	return []any{thread}, nil
 }
 
 func stdThreadIsYieldable(vm *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "coroutine.isyieldable", "~thread"); err != nil {
 		return nil, err
 	}
+	thread := vm
 	if len(args) > 0 {
-		return []any{args[0].(*VM).yieldable}, nil
+		thread = args[0].(*VM)
 	}
-	return []any{vm.yieldable}, nil
+	nny := thread.nny
+	if thread == vm {
+		nny-- // this call does not block yielding
+	}
+	return []any{thread.yieldable && nny == 0}, nil
 }
 
-func stdThreadRunning(vm *VM, args []any) ([]any, error) {
-	if err := assertArguments(args, "coroutine.running", "~thread"); err != nil {
-		return nil, err
-	}
-	status := vm.status
-	if len(args) > 0 {
-		status = args[0].(*VM).status
-	}
-	return []any{vm, status == threadStateRunning}, nil
+func stdThreadRunning(vm *VM, _ []any) ([]any, error) {
+	return []any{vm, !vm.yieldable}, nil
 }
 
 func stdThreadStatus(_ *VM, args []any) ([]any, error) {
@@ -84,41 +81,77 @@ func stdThreadClose(vm *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "coroutine.close", "thread"); err != nil {
 		return nil, err
 	}
-	thread := vm
-	if len(args) > 0 {
-		thread = args[0].(*VM)
-	}
-
-	if !thread.yieldable {
-		return nil, errors.New("cannot close main thread")
-	}
-
-	thread.cancel()
-	return []any{}, nil
+	thread := args[0].(*VM)
+	switch thread.status {
+	case threadStateRunning:
+		return nil, errors.New("cannot close a running coroutine")
+	case threadStateNormal:
+		return nil, errors.New("cannot close a normal coroutine")
+	}
+
+	// unwind the frames that were suspended so that open upvalues are closed
+	// and any pending to-be-closed variables are closed. The thread counts as
+	// running while its variables are closed so it cannot be closed again.
+	thread.status = threadStateRunning
+	closeErr := thread.resumeErr
+	for f := thread.yieldFrame; f != nil; f = f.prev {
+		thread.popCallstack()
+		closeErr = thread.closeUpvalues(f, closeErr)
+	}
+	clear(thread.Stack[:thread.top])
+	thread.top = 0
+	thread.yieldFrame = nil
+	thread.body = nil
+	thread.resumeErr = nil
+	thread.status = threadStateDead
+	if closeErr != nil {
+		return []any{false, getErrVal(closeErr)}, nil
+	}
+	return []any{true}, nil
 }
 
-func stdThreadResume(_ *VM, args []any) ([]any, error) {
+func stdThreadResume(vm *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "coroutine.resume", "thread"); err != nil {
 		return nil, err
 	}
-	return args[0].(*VM).resume(args[1:])
+	res, err := resumeThread(vm, args[0].(*VM), args[1:])
+	if err != nil {
+		return []any{false, getErrVal(err)}, nil
+	}
+	return append([]any{true}, res...), nil
+}
+
+func resumeThread(vm, thread *VM, args []any) ([]any, error) {
+	if vm.tracer == nil || thread.status != threadStateSuspended {
+		return thread.resume(vm, args)
+	}
+	vm.tracer.switchThread(vm, thread, "coroutine.resume")
+	res, err := thread.resume(vm, args)
+	if thread.status == threadStateSuspended {
+		vm.tracer.switchThread(thread, vm, "coroutine.yield")
+	} else {
+		vm.tracer.switchThread(thread, vm, "coroutine.dead")
+	}
+	return res, err
 }
 
 func stdThreadYield(vm *VM, args []any) ([]any, error) {
 	if !vm.yieldable {
 		return nil, errors.New("cannot yield from outside a coroutine")
 	}
-	return args, &Interrupt{kind: InterruptYield}
+	return nil, &Interrupt{kind: InterruptYield, values: args}
 }
 
 func stdThreadWrap(vm *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "coroutine.wrap", "function"); err != nil {
 		return nil, err
 	}
-
-	newVM, err := vm.newYieldable(args[0])
-	resume := func(_ *VM, args []any) ([]any, error) { return newVM.resume(args) }
-	return []any{Fn("coroutine.resume", resume)}, err
+	thread, err := vm.newThread(args[0])
+	if err != nil {
+		return nil, err
+	}
+	resume := func(vm *VM, args []any) ([]any, error) { return resumeThread(vm, thread, args) }
+	return []any{Fn("coroutine.resume", resume)}, nil
 }
 
 func stdThreadToString(_ *VM, args []any) ([]any, error) {
@@ -127,3 +160,29 @@ func stdThreadToString(_ *VM, args []any) ([]any, error) {
 	}
 	return []any{ToString(args[0])}, nil
 }
+
+// stdThreadAsync wraps fn in a function that calls it asynchronously and returns
+// a future of its results. It is what async functions compile to.
+func stdThreadAsync(_ *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "coroutine.async", "function"); err != nil {
+		return nil, err
+	}
+	fn := args[0]
+	call := func(vm *VM, args []any) ([]any, error) {
+		future, err := vm.async(fn, args)
+		if err != nil {
+			return nil, err
+		}
+		return []any{future}, nil
+	}
+	return []any{Fn("coroutine.async", call)}, nil
+}
+
+// stdThreadAwait waits for a future and returns its results, any other value is
+// returned as is. It is what await expressions compile to.
+func stdThreadAwait(vm *VM, args []any) ([]any, error) {
+	if future, isFuture := firstValue(args).(*Future); isFuture {
+		return vm.await(future)
+	}
+	return args, nil
+}
@@ -1,13 +1,11 @@
 package runtime
 
 func createDebugLib() *Table {
-	return &Table{
-		hashtable: map[any]any{
-			"debug":     Fn("debug.debug", stdDebug),
-			"traceback": Fn("debug.traceback", stdDebugTraceback),
-			"getinfo":   Fn("debug.getinfo", stdDebugGetInfo),
-		},
-	}
+	return NewTable(nil, map[any]any{
+		"debug":     builtinFn("debug.debug", stdDebug),
+		"traceback": builtinFn("debug.traceback", stdDebugTraceback),
+		"getinfo":   builtinFn("debug.getinfo", stdDebugGetInfo),
+	})
 }
 
 func stdDebug(*VM, []any) ([]any, error) {
@@ -17,7 +15,7 @@ func stdDebug(*VM, []any) ([]any, error) {
 func stdDebugTraceback(vm *VM, _ []any) ([]any, error) {
 	tbl := NewTable(nil, nil)
 	for i := range vm.callDepth {
-		tbl.val = append(tbl.val, vm.callStack[i])
+		tbl.seti(i+1, ValueOf(vm.callStack[i]))
 	}
 	return []any{tbl}, nil
 }
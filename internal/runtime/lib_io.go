@@ -17,45 +17,41 @@ var (
 
 var fileMetatable *Table
 
-func createIOLib() *Table {
-	fileMetatable = &Table{
-		hashtable: map[any]any{
-			string(parse.MetaName):     "FILE*",
-			string(parse.MetaToString): Fn("file:__tostring", stdIOFileString),
-			string(parse.MetaClose):    Fn("file:__close", stdIOFileClose),
-			string(parse.MetaGC):       Fn("file:__gc", stdIOFileClose),
-			string(parse.MetaIndex): &Table{
-				hashtable: map[any]any{
-					"close":   Fn("file:close", stdIOFileClose),
-					"flush":   Fn("file:flush", stdIOFileFlush),
-					"read":    Fn("file:read", stdIOFileRead),
-					"write":   Fn("file:write", stdIOFileWrite),
-					"lines":   Fn("file:lines", stdIOFileLines),
-					"seek":    Fn("file:seek", stdIOFileSeek),
-					"setvbuf": Fn("file:setvbuf", stdIOFileSetvbuf),
-				},
-			},
-		},
-	}
+func init() {
+	fileMetatable = sharedMetatable(map[any]any{
+		string(parse.MetaName):     "FILE*",
+		string(parse.MetaToString): builtinFn("file:__tostring", stdIOFileString),
+		string(parse.MetaClose):    builtinFn("file:__close", stdIOFileClose),
+		string(parse.MetaGC):       builtinFn("file:__gc", stdIOFileClose),
+		string(parse.MetaIndex): NewTable(nil, map[any]any{
+			"close":   builtinFn("file:close", stdIOFileClose),
+			"flush":   builtinFn("file:flush", stdIOFileFlush),
+			"read":    builtinFn("file:read", stdIOFileRead),
+			"write":   builtinFn("file:write", stdIOFileWrite),
+			"lines":   builtinFn("file:lines", stdIOFileLines),
+			"seek":    builtinFn("file:seek", stdIOFileSeek),
+			"setvbuf": builtinFn("file:setvbuf", stdIOFileSetvbuf),
+		}),
+	})
+}
 
-	return &Table{
-		hashtable: map[any]any{
-			"stderr":  Stderr,
-			"stdin":   Stdin,
-			"stdout":  Stdout,
-			"input":   Fn("io.input", stdIOInput),
-			"output":  Fn("io.output", stdIOOutput),
-			"open":    Fn("io.open", stdIOOpen),
-			"close":   Fn("io.close", stdIOClose),
-			"flush":   Fn("io.flush", stdIOFlush),
-			"tmpfile": Fn("io.tmpfile", stdIOTmpfile),
-			"type":    Fn("io.type", stdIOType),
-			"read":    Fn("io.read", stdIORead),
-			"write":   Fn("io.write", stdIOWrite),
-			"lines":   Fn("io.lines", stdIOLines),
-			"popen":   Fn("io.popen", stdIOPOpen),
-		},
-	}
+func createIOLib() *Table {
+	return NewTable(nil, map[any]any{
+		"stderr":  Stderr,
+		"stdin":   Stdin,
+		"stdout":  Stdout,
+		"input":   builtinFn("io.input", stdIOInput),
+		"output":  builtinFn("io.output", stdIOOutput),
+		"open":    builtinFn("io.open", stdIOOpen),
+		"close":   builtinFn("io.close", stdIOClose),
+		"flush":   builtinFn("io.flush", stdIOFlush),
+		"tmpfile": builtinFn("io.tmpfile", stdIOTmpfile),
+		"type":    builtinFn("io.type", stdIOType),
+		"read":    builtinFn("io.read", stdIORead),
+		"write":   builtinFn("io.write", stdIOWrite),
+		"lines":   builtinFn("io.lines", stdIOLines),
+		"popen":   builtinFn("io.popen", stdIOPOpen),
+	})
 }
 
 func stdIOClose(_ *VM, args []any) ([]any, error) {
@@ -313,14 +309,14 @@ func stdIOLines(_ *VM, args []any) ([]any, error) {
 	if len(args) > 0 {
 		file = args[0].(*File)
 	}
-	return []any{Fn("io.lines.next", stdIOLinesNext), file, nil}, nil
+	return []any{builtinFn("io.lines.next", stdIOLinesNext), file, nil}, nil
 }
 
 func stdIOFileLines(_ *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "file:lines", "file"); err != nil {
 		return nil, err
 	}
-	return []any{Fn("file:lines.next", stdIOLinesNext), args[0].(*File), nil}, nil
+	return []any{builtinFn("file:lines.next", stdIOLinesNext), args[0].(*File), nil}, nil
 }
 
 func stdIOFileSeek(_ *VM, args []any) ([]any, error) {
@@ -0,0 +1,520 @@
+package runtime
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+type (
+	// eventLoop runs coroutines on the goroutine of the vm that runs it. A vm
+	// shares its loop with its coroutines. Threads spawned on the loop wait for
+	// timers and go operations by yielding, the loop resumes other threads until
+	// the goroutine doing the operation posts that it completed.
+	eventLoop struct {
+		mu     sync.Mutex
+		posted []loopEvent
+		wake   chan struct{}
+		// the fields below are only used on the goroutine of the vm.
+		ready []loopEvent
+		// waiting counts the events that timers and operations have yet to post
+		// and the mailboxes with a handler that are still open.
+		waiting int
+		running bool
+	}
+	// loopEvent is either a thread to resume with args, a timer that fired or a
+	// mailbox that was posted to. An empty event only wakes the loop.
+	loopEvent struct {
+		thread  *VM
+		timer   *Timer
+		mailbox *mailbox
+		args    []any
+	}
+	// AwaitFunc is an operation that a thread waits on with Await. It is run on
+	// its own goroutine so it must not use the vm, ctx is cancelled when the vm
+	// is.
+	AwaitFunc func(ctx context.Context) ([]any, error)
+	// awaitOp is what a thread yields to the loop to wait on an operation, or on a
+	// future, and awaitResult is what it is resumed with once it completes.
+	awaitOp struct {
+		fn     AwaitFunc
+		future *Future
+	}
+	awaitResult struct {
+		res []any
+		err error
+	}
+	// Timer calls a function on a new thread of the loop once its time has passed,
+	// and again every interval if it repeats, until it is cancelled.
+	Timer struct {
+		loop      *eventLoop
+		timer     *time.Timer
+		interval  time.Duration
+		fn        any
+		args      []any
+		repeat    bool
+		cancelled bool
+	}
+	// Listener accepts socket connections on the loop.
+	Listener struct {
+		listener net.Listener
+		closed   bool
+	}
+	sockFile struct{ net.Conn }
+)
+
+var (
+	timerMetatable    *Table
+	listenerMetatable *Table
+	// loopEpoch is where loop.time counts from.
+	loopEpoch = time.Now()
+	// awaitYield yields the awaitOp it is called with to the loop.
+	awaitYield = builtinFn("loop.await", stdThreadYield)
+)
+
+func init() {
+	timerMetatable = sharedMetatable(map[any]any{
+		string(parse.MetaName): "TIMER",
+		string(parse.MetaIndex): NewTable(nil, map[any]any{
+			"cancel": builtinFn("timer:cancel", stdLoopTimerCancel),
+		}),
+	})
+	listenerMetatable = sharedMetatable(map[any]any{
+		string(parse.MetaName):  "LISTENER",
+		string(parse.MetaClose): builtinFn("listener:close", stdLoopListenerClose),
+		string(parse.MetaIndex): NewTable(nil, map[any]any{
+			"accept": builtinFn("listener:accept", stdLoopListenerAccept),
+			"addr":   builtinFn("listener:addr", stdLoopListenerAddr),
+			"close":  builtinFn("listener:close", stdLoopListenerClose),
+		}),
+	})
+}
+
+func createLoopLib() *Table {
+	return NewTable(nil, map[any]any{
+		"run":     builtinFn("loop.run", stdLoopRun),
+		"spawn":   builtinFn("loop.spawn", stdLoopSpawn),
+		"sleep":   builtinFn("loop.sleep", stdLoopSleep),
+		"after":   builtinFn("loop.after", stdLoopAfter),
+		"every":   builtinFn("loop.every", stdLoopEvery),
+		"time":    builtinFn("loop.time", stdLoopTime),
+		"read":    builtinFn("loop.read", stdLoopRead),
+		"write":   builtinFn("loop.write", stdLoopWrite),
+		"connect": builtinFn("loop.connect", stdLoopConnect),
+		"listen":  builtinFn("loop.listen", stdLoopListen),
+	})
+}
+
+func newEventLoop() *eventLoop {
+	return &eventLoop{wake: make(chan struct{}, 1)}
+}
+
+func (t *Timer) String() string    { return fmt.Sprintf("timer: %p", t) }
+func (l *Listener) String() string { return fmt.Sprintf("listener: %p", l) }
+
+// post queues an event from any goroutine and wakes the loop. It never blocks.
+func (l *eventLoop) post(ev loopEvent) {
+	l.mu.Lock()
+	l.posted = append(l.posted, ev)
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// takePosted moves the events posted since it was last called to the ready
+// queue. A mailbox posts every message so it only stops being waited on once
+// it is closed.
+func (l *eventLoop) takePosted() {
+	l.mu.Lock()
+	posted := l.posted
+	l.posted = nil
+	l.mu.Unlock()
+	for _, ev := range posted {
+		if ev.mailbox == nil {
+			l.waiting--
+		}
+	}
+	l.ready = append(l.ready, posted...)
+}
+
+// spawn creates a thread that the loop will run fn on.
+func (l *eventLoop) spawn(vm *VM, fn any, args []any) (*VM, error) {
+	thread, err := vm.newThread(fn)
+	if err != nil {
+		return nil, err
+	}
+	thread.scheduled = true
+	l.ready = append(l.ready, loopEvent{thread: thread, args: args})
+	return thread, nil
+}
+
+// run resumes the threads on the loop until none are left to resume and no
+// timer or operation is pending, or until done returns true if it is set. An
+// error raised by any of the threads stops the loop and is returned.
+func (l *eventLoop) run(vm *VM, done func() bool) error {
+	if l.running {
+		return errors.New("loop is already running")
+	}
+	l.running = true
+	defer func() { l.running = false }()
+	for {
+		l.takePosted()
+		if done != nil && done() {
+			return nil
+		} else if len(l.ready) == 0 {
+			if l.waiting == 0 {
+				return nil
+			}
+			select {
+			case <-l.wake:
+			case <-vm.ctx.Done():
+				return errors.New("vm interrupted")
+			}
+			continue
+		}
+		ev := l.ready[0]
+		l.ready[0] = loopEvent{}
+		l.ready = l.ready[1:]
+		if err := l.dispatch(vm, ev); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *eventLoop) dispatch(vm *VM, ev loopEvent) error {
+	if t := ev.timer; t != nil {
+		if t.cancelled {
+			return nil
+		} else if t.repeat {
+			l.waiting++
+			t.timer.Reset(t.interval)
+		}
+		_, err := l.spawn(vm, t.fn, t.args)
+		return err
+	} else if ev.thread != nil {
+		return l.resume(vm, ev.thread, ev.args)
+	} else if ev.mailbox != nil {
+		return l.deliver(vm, ev.mailbox)
+	}
+	return nil
+}
+
+// resume resumes a thread of the loop and, if it yields, queues it again once
+// what it is waiting on completes.
+func (l *eventLoop) resume(vm, thread *VM, args []any) error {
+	res, err := resumeThread(vm, thread, args)
+	if err != nil {
+		return err
+	} else if thread.status != threadStateSuspended {
+		return nil
+	}
+	// a plain yield lets the other threads run before it is resumed again.
+	if op, isOp := firstValue(res).(*awaitOp); isOp {
+		l.start(vm, thread, op)
+	} else {
+		l.ready = append(l.ready, loopEvent{thread: thread})
+	}
+	return nil
+}
+
+// start runs the operation a thread is waiting on, or waits for the future, and
+// posts the thread back to the loop with the result.
+func (l *eventLoop) start(vm *VM, thread *VM, op *awaitOp) {
+	l.waiting++
+	done := func(res []any, err error) {
+		l.post(loopEvent{thread: thread, args: []any{&awaitResult{res: res, err: err}}})
+	}
+	if op.future != nil {
+		op.future.then(done)
+		return
+	}
+	go func() { done(op.fn(vm.ctx)) }()
+}
+
+// newTimer arms a timer that spawns fn after delay.
+func (l *eventLoop) newTimer(delay time.Duration, repeat bool, fn any, args []any) *Timer {
+	t := &Timer{loop: l, interval: delay, fn: fn, args: args, repeat: repeat}
+	l.waiting++
+	t.timer = time.AfterFunc(delay, func() { l.post(loopEvent{timer: t}) })
+	return t
+}
+
+// Await waits for op to complete and returns its results. When it is called
+// by a go function running on a thread of the event loop it yields so that the
+// loop can run other threads in the meantime, and like CallK, what it returns
+// must then be returned as is by the go function. Anywhere else it blocks
+// until op returns.
+func (vm *VM) Await(op AwaitFunc) ([]any, error) {
+	if !vm.canAwait() {
+		return op(vm.ctx)
+	}
+	return vm.CallK(awaitYield, []any{&awaitOp{fn: op}}, awaitContinue)
+}
+
+// canAwait reports if the go function that is running can yield to the loop.
+func (vm *VM) canAwait() bool {
+	// nny counts the go function itself.
+	return vm.scheduled && vm.yieldable && vm.nny <= 1
+}
+
+func awaitContinue(_ *VM, res []any, _ error) ([]any, error) {
+	result, isResult := firstValue(res).(*awaitResult)
+	if !isResult {
+		return nil, errors.New("await resumed outside of the event loop")
+	}
+	return result.res, result.err
+}
+
+func firstValue(vals []any) any {
+	if len(vals) == 0 {
+		return nil
+	}
+	return vals[0]
+}
+
+func durationOf(seconds any) time.Duration {
+	return time.Duration(toFloat(seconds) * float64(time.Second))
+}
+
+func stdLoopRun(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "loop.run", "~function"); err != nil {
+		return nil, err
+	}
+	if len(args) > 0 {
+		if _, err := vm.loop.spawn(vm, args[0], args[1:]); err != nil {
+			return nil, err
+		}
+	}
+	return []any{}, vm.loop.run(vm, nil)
+}
+
+func stdLoopSpawn(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "loop.spawn", "function"); err != nil {
+		return nil, err
+	}
+	thread, err := vm.loop.spawn(vm, args[0], args[1:])
+	if err != nil {
+		return nil, err
+	}
+	return []any{thread}, nil
+}
+
+func stdLoopSleep(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "loop.sleep", "number"); err != nil {
+		return nil, err
+	}
+	delay := durationOf(args[0])
+	return vm.Await(func(ctx context.Context) ([]any, error) {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return []any{}, nil
+		case <-ctx.Done():
+			return nil, errors.New("vm interrupted")
+		}
+	})
+}
+
+func stdLoopAfter(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "loop.after", "number", "function"); err != nil {
+		return nil, err
+	}
+	return []any{vm.loop.newTimer(max(durationOf(args[0]), 0), false, args[1], args[2:])}, nil
+}
+
+func stdLoopEvery(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "loop.every", "number", "function"); err != nil {
+		return nil, err
+	}
+	interval := durationOf(args[0])
+	if interval <= 0 {
+		return nil, argumentErr(1, "loop.every", errors.New("interval must be positive"))
+	}
+	return []any{vm.loop.newTimer(interval, true, args[1], args[2:])}, nil
+}
+
+func stdLoopTime(*VM, []any) ([]any, error) {
+	return []any{time.Since(loopEpoch).Seconds()}, nil
+}
+
+func stdLoopTimerCancel(_ *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "timer:cancel", "timer"); err != nil {
+		return nil, err
+	}
+	t := args[0].(*Timer)
+	if t.cancelled {
+		return []any{false}, nil
+	}
+	t.cancelled = true
+	// a timer that already fired has posted its event, which the loop drops.
+	if t.timer.Stop() {
+		t.loop.waiting--
+	}
+	return []any{true}, nil
+}
+
+// stdLoopRead reads from a file like file:read but without blocking the loop.
+// It returns nil at the end of the file rather than erroring.
+func stdLoopRead(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "loop.read", "file", "~string|number"); err != nil {
+		return nil, err
+	}
+	file := args[0].(*File)
+	formats := []any{"l"}
+	if len(args) > 1 {
+		formats = args[1:]
+	}
+	return vm.Await(func(ctx context.Context) ([]any, error) {
+		defer unblockOnDone(ctx, file.handle)()
+		res, err := file.Read(formats)
+		if ctx.Err() != nil {
+			return nil, errors.New("vm interrupted")
+		} else if errors.Is(err, io.EOF) {
+			return []any{nil}, nil
+		}
+		return res, err
+	})
+}
+
+func stdLoopWrite(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "loop.write", "file"); err != nil {
+		return nil, err
+	}
+	file := args[0].(*File)
+	// values are turned into strings on the vm since __tostring can call lua.
+	strParts := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		str, err := vm.toString(arg)
+		if err != nil {
+			return nil, err
+		}
+		strParts[i] = str
+	}
+	data := strings.Join(strParts, "")
+	return vm.Await(func(context.Context) ([]any, error) {
+		return []any{}, file.Write(data)
+	})
+}
+
+// stdLoopConnect opens a tcp connection, which is returned as a file that can
+// be read and written to with loop.read and loop.write.
+func stdLoopConnect(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "loop.connect", "string"); err != nil {
+		return nil, err
+	}
+	address := args[0].(string)
+	return vm.Await(func(ctx context.Context) ([]any, error) {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return []any{newSocketFile(conn)}, nil
+	})
+}
+
+func stdLoopListen(_ *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "loop.listen", "string"); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", args[0].(string))
+	if err != nil {
+		return nil, err
+	}
+	return []any{&Listener{listener: listener}}, nil
+}
+
+func stdLoopListenerAccept(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "listener:accept", "listener"); err != nil {
+		return nil, err
+	}
+	l := args[0].(*Listener)
+	if l.closed {
+		return nil, errors.New("listener closed")
+	}
+	return vm.Await(func(ctx context.Context) ([]any, error) {
+		defer unblockOnDone(ctx, l.listener)()
+		conn, err := l.listener.Accept()
+		if ctx.Err() != nil {
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return nil, errors.New("vm interrupted")
+		} else if err != nil {
+			return nil, err
+		}
+		return []any{newSocketFile(conn)}, nil
+	})
+}
+
+func stdLoopListenerAddr(_ *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "listener:addr", "listener"); err != nil {
+		return nil, err
+	}
+	return []any{args[0].(*Listener).listener.Addr().String()}, nil
+}
+
+func stdLoopListenerClose(_ *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "listener:close", "listener"); err != nil {
+		return nil, err
+	}
+	l := args[0].(*Listener)
+	if l.closed {
+		return []any{}, nil
+	}
+	l.closed = true
+	return []any{}, l.listener.Close()
+}
+
+// unblockOnDone interrupts a read or accept on handle that is blocked once ctx
+// is done by moving its deadline into the past. The returned function must be
+// called once the call returns, it clears the deadline again since handles like
+// stdin are shared with other vms. Handles without deadlines, like regular
+// files, do not block for long so they are left alone.
+func unblockOnDone(ctx context.Context, handle any) func() {
+	var setDeadline func(time.Time) error
+	switch h := handle.(type) {
+	case interface{ SetReadDeadline(time.Time) error }:
+		setDeadline = h.SetReadDeadline
+	case interface{ SetDeadline(time.Time) error }:
+		setDeadline = h.SetDeadline
+	default:
+		return func() {}
+	}
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(fired)
+		_ = setDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		if !stop() {
+			<-fired
+			_ = setDeadline(time.Time{})
+		}
+	}
+}
+
+func newSocketFile(conn net.Conn) *File {
+	return &File{
+		Path:   conn.RemoteAddr().String(),
+		handle: &sockFile{conn},
+		reader: bufio.NewReader(conn),
+	}
+}
+
+func (s *sockFile) ReadAt([]byte, int64) (int, error) { return 0, errors.New("cannot read socket at") }
+func (s *sockFile) Seek(int64, int) (int64, error)    { return 0, errors.New("cannot seek socket") }
+func (s *sockFile) Stat() (fs.FileInfo, error)        { return fs.FileInfo(nil), nil }
+func (s *sockFile) Sync() error                       { return nil }
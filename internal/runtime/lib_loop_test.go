@@ -0,0 +1,170 @@
+package runtime
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+func TestVM_Await(t *testing.T) {
+	t.Parallel()
+
+	run := func(t *testing.T, src string) []any {
+		t.Helper()
+		vm, err := New(context.Background(), nil)
+		require.NoError(t, err)
+		gate := make(chan string, 1)
+		require.NoError(t, vm.env.Set("open", Fn("open", func(_ *VM, args []any) ([]any, error) {
+			gate <- args[0].(string)
+			return []any{}, nil
+		})))
+		require.NoError(t, vm.env.Set("wait", Fn("wait", func(vm *VM, _ []any) ([]any, error) {
+			return vm.Await(func(ctx context.Context) ([]any, error) {
+				select {
+				case msg := <-gate:
+					return []any{msg}, nil
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			})
+		})))
+		fn, err := parse.Parse("test", strings.NewReader(src), parse.ModeText)
+		require.NoError(t, err)
+		result, err := vm.Eval(fn)
+		require.NoError(t, err)
+		return result
+	}
+
+	t.Run("yields to other threads on the loop", func(t *testing.T) {
+		t.Parallel()
+		result := run(t, `
+			local loop = require("loop")
+			local log = {}
+			loop.spawn(function() table.insert(log, "got " .. wait()) end)
+			loop.spawn(function()
+				table.insert(log, "opening")
+				open("msg")
+			end)
+			loop.run()
+			return table.concat(log, ",")
+		`)
+		assert.Equal(t, []any{"opening,got msg"}, result)
+	})
+
+	t.Run("blocks outside of the loop", func(t *testing.T) {
+		t.Parallel()
+		result := run(t, `
+			open("msg")
+			return wait()
+		`)
+		assert.Equal(t, []any{"msg"}, result)
+	})
+
+	t.Run("errors when resumed outside of the loop", func(t *testing.T) {
+		t.Parallel()
+		result := run(t, `
+			local loop = require("loop")
+			local thread = loop.spawn(wait)
+			local ok = coroutine.resume(thread)
+			return ok, coroutine.resume(thread, "not a result")
+		`)
+		require.Len(t, result, 3)
+		assert.Equal(t, []any{true, false}, result[:2])
+		assert.Contains(t, result[2], "await resumed outside of the event loop")
+	})
+}
+
+func TestLoop_CancelUnblocks(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	sock := newSocketFile(conn)
+	defer sock.Close()
+
+	run := func(t *testing.T, src string) error {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		vm, err := New(ctx, nil)
+		require.NoError(t, err)
+		require.NoError(t, vm.env.Set("sock", sock))
+		fn, err := parse.Parse("test", strings.NewReader(src), parse.ModeText)
+		require.NoError(t, err)
+		time.AfterFunc(10*time.Millisecond, cancel)
+		errs := make(chan error, 1)
+		go func() {
+			_, err := vm.Eval(fn)
+			errs <- err
+		}()
+		select {
+		case err := <-errs:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("cancelling the vm did not unblock it")
+			return nil
+		}
+	}
+
+	t.Run("pending read", func(t *testing.T) {
+		require.ErrorContains(t, run(t, `return require("loop").read(sock)`), "vm interrupted")
+		// the deadline is cleared so the socket can still be read.
+		_, err := client.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		res, err := sock.Read([]any{"l"})
+		require.NoError(t, err)
+		assert.Equal(t, []any{"hello"}, res)
+	})
+
+	t.Run("pending accept", func(t *testing.T) {
+		err := run(t, `return require("loop").listen("127.0.0.1:0"):accept()`)
+		require.ErrorContains(t, err, "vm interrupted")
+	})
+}
+
+func TestLoop_ConcurrentReadsAreSerialized(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	sock := newSocketFile(conn)
+	defer sock.Close()
+
+	_, err = client.Write([]byte("a\nb\nc\n"))
+	require.NoError(t, err)
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, vm.env.Set("sock", sock))
+	fn, err := parse.Parse("test", strings.NewReader(`
+		local loop = require("loop")
+		local lines = {}
+		loop.spawn(function() table.insert(lines, loop.read(sock)) end)
+		loop.spawn(function() table.insert(lines, loop.read(sock)) end)
+		loop.spawn(function() table.insert(lines, sock:read("l")) end)
+		loop.run()
+		table.sort(lines)
+		return table.concat(lines, ",")
+	`), parse.ModeText)
+	require.NoError(t, err)
+	result, err := vm.Eval(fn)
+	require.NoError(t, err)
+	assert.Equal(t, []any{"a,b,c"}, result)
+}
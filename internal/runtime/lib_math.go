@@ -9,42 +9,41 @@ import (
 var randSource = rand.New(rand.NewSource(time.Now().Unix()))
 
 func createMathLib() *Table {
-	return &Table{
-		hashtable: map[any]any{
-			"huge":       float64(math.MaxFloat64),
-			"maxinteger": int64(math.MaxInt64),
-			"mininteger": int64(math.MinInt64),
-			"pi":         float64(math.Pi),
-			"abs":        stdMathFn("abs", false, math.Abs),
-			"acos":       stdMathFn("acos", true, math.Acos),
-			"asin":       stdMathFn("asin", true, math.Asin),
-			"atan":       stdMathFn("atan", true, math.Atan),
-			"cos":        stdMathFn("cos", true, math.Cos),
-			"exp":        stdMathFn("exp", true, math.Exp),
-			"sin":        stdMathFn("sin", true, math.Sin),
-			"tan":        stdMathFn("tan", true, math.Tan),
-			"log":        stdMathFn("log", true, math.Log),
-			"sqrt":       stdMathFn("sqrt", true, math.Sqrt),
-			"ceil":       stdMathFn("ceil", false, math.Ceil),
-			"floor":      stdMathFn("floor", false, math.Floor),
-			"deg":        stdMathFn("deg", true, mathDeg),
-			"rad":        stdMathFn("rad", true, mathRad),
-			"fmod":       Fn("math.fmod", stdMathFmod),
-			"modf":       Fn("math.modf", stdMathModf),
-			"max":        Fn("math.max", stdMathMax),
-			"min":        Fn("math.min", stdMathMin),
-			"random":     Fn("math.random", stdMathRandom),
-			"randomseed": Fn("math.randomseed", stdMathRandomSeed),
-			"tointeger":  Fn("math.tointeger", stdMathToInteger),
-			"type":       Fn("math.type", stdMathType),
-			"ult":        Fn("math.ult", stdMathUlt),
-		},
-	}
+	return NewTable(nil, map[any]any{
+		"huge":       float64(math.MaxFloat64),
+		"maxinteger": int64(math.MaxInt64),
+		"mininteger": int64(math.MinInt64),
+		"pi":         float64(math.Pi),
+		"abs":        stdMathFn("abs", false, math.Abs),
+		"acos":       stdMathFn("acos", true, math.Acos),
+		"asin":       stdMathFn("asin", true, math.Asin),
+		"atan":       stdMathFn("atan", true, math.Atan),
+		"cos":        stdMathFn("cos", true, math.Cos),
+		"exp":        stdMathFn("exp", true, math.Exp),
+		"sin":        stdMathFn("sin", true, math.Sin),
+		"tan":        stdMathFn("tan", true, math.Tan),
+		"log":        stdMathFn("log", true, math.Log),
+		"sqrt":       stdMathFn("sqrt", true, math.Sqrt),
+		"ceil":       stdMathFn("ceil", false, math.Ceil),
+		"floor":      stdMathFn("floor", false, math.Floor),
+		"deg":        stdMathFn("deg", true, mathDeg),
+		"rad":        stdMathFn("rad", true, mathRad),
+		"fmod":       builtinFn("math.fmod", stdMathFmod),
+		"modf":       builtinFn("math.modf", stdMathModf),
+		"max":        builtinFn("math.max", stdMathMax),
+		"min":        builtinFn("math.min", stdMathMin),
+		"random":     builtinFn("math.random", stdMathRandom),
+		"randomseed": builtinFn("math.randomseed", stdMathRandomSeed),
+		"tointeger":  builtinFn("math.tointeger", stdMathToInteger),
+		"type":       builtinFn("math.type", stdMathType),
+		"ult":        builtinFn("math.ult", stdMathUlt),
+	})
 }
 
 func stdMathFn(name string, mustFloat bool, fn func(float64) float64) *GoFunc {
 	return &GoFunc{
-		name: "math." + name,
+		name:    "math." + name,
+		builtin: true,
 		val: func(_ *VM, args []any) ([]any, error) {
 			if err := assertArguments(args, "math."+name, "number"); err != nil {
 				return nil, err
@@ -22,21 +22,19 @@ func init() {
 }
 
 func createOSLib() *Table {
-	return &Table{
-		hashtable: map[any]any{
-			"clock":     Fn("os.clock", stdOSClock),
-			"execute":   Fn("os.execute", stdOSExecute),
-			"exit":      Fn("os.exit", stdOSExit),
-			"getenv":    Fn("os.getenv", stdOSGetenv),
-			"remove":    Fn("os.remove", stdOSRemove),
-			"rename":    Fn("os.rename", stdOSRename),
-			"setlocale": Fn("os.setlocale", stdOSSetlocale),
-			"tmpname":   Fn("os.tmpname", stdOSTmpname),
-			"time":      Fn("os.time", stdOSTime),
-			"date":      Fn("os.date", stdOSDate),
-			"difftime":  Fn("os.difftime", stdOSDifftime),
-		},
-	}
+	return NewTable(nil, map[any]any{
+		"clock":     builtinFn("os.clock", stdOSClock),
+		"execute":   builtinFn("os.execute", stdOSExecute),
+		"exit":      builtinFn("os.exit", stdOSExit),
+		"getenv":    builtinFn("os.getenv", stdOSGetenv),
+		"remove":    builtinFn("os.remove", stdOSRemove),
+		"rename":    builtinFn("os.rename", stdOSRename),
+		"setlocale": builtinFn("os.setlocale", stdOSSetlocale),
+		"tmpname":   builtinFn("os.tmpname", stdOSTmpname),
+		"time":      builtinFn("os.time", stdOSTime),
+		"date":      builtinFn("os.date", stdOSDate),
+		"difftime":  builtinFn("os.difftime", stdOSDifftime),
+	})
 }
 
 func stdOSClock(_ *VM, args []any) ([]any, error) {
@@ -160,20 +158,21 @@ func stdOSTime(_ *VM, args []any) ([]any, error) {
 	if len(args) == 0 {
 		return []any{float64(time.Now().Unix()) / 1000}, nil
 	}
-	timeTable := args[0].(*Table).hashtable
-	if timeTable["year"] == nil {
+	timeTable := args[0].(*Table)
+	field := func(name string) any { return timeTable.getStr(name).Any() }
+	if field("year") == nil {
 		return nil, errors.New("field 'year' missing in the time table")
-	} else if timeTable["month"] == nil {
+	} else if field("month") == nil {
 		return nil, errors.New("field 'month' missing in the time table")
-	} else if timeTable["day"] == nil {
+	} else if field("day") == nil {
 		return nil, errors.New("field 'day' missing in the time table")
 	}
-	year := toInt(timeTable["year"])
-	month := toInt(timeTable["month"])
-	day := toInt(timeTable["day"])
-	hour := toIntWithDefault(timeTable["hour"], 12)
-	minute := toIntWithDefault(timeTable["min"], 0)
-	sec := toIntWithDefault(timeTable["sec"], 0)
+	year := toInt(field("year"))
+	month := toInt(field("month"))
+	day := toInt(field("day"))
+	hour := toIntWithDefault(field("hour"), 12)
+	minute := toIntWithDefault(field("min"), 0)
+	sec := toIntWithDefault(field("sec"), 0)
 	t := time.Date(int(year), time.Month(month), int(day), int(hour), int(minute), int(sec), 0, time.Local)
 	return []any{float64(t.Unix()) / 1000}, nil
 }
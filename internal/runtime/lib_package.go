@@ -3,6 +3,7 @@ package runtime
 import (
 	"embed"
 	"fmt"
+	"io/fs"
 	"os"
 	"strings"
 
@@ -28,24 +29,24 @@ var (
 	builtinLib      string
 	pkgpathdefault  = []string{"./?.lua", "./?/init.lua"}
 	pkgBuiltinPaths = []string{"lib/?.lua", "lib/?/init.lua"}
-	pkgSearchers    = NewTable([]any{Fn("package.searchpath", stdPkgSearchPath)}, nil)
+	pkgSearchers    = NewTable([]any{builtinFn("package.searchpath", stdPkgSearchPath)}, nil)
 	searchPaths     = strings.Join(pkgpathdefault, pkgTemplateSeparator)
-	loadedPackages  = &Table{hashtable: map[any]any{}}
-	stdPackageLib   = &Table{
-		hashtable: map[any]any{
-			"config": strings.Join([]string{
-				pkgPathSeparator,
-				pkgTemplateSeparator,
-				pkgSubstitutionPoint,
-				pkgExecutableDirWin,
-				pkgIgnoreMark,
-			}, "\n"),
-			"loaded":     loadedPackages,
-			"path":       searchPaths,
-			"searchers":  pkgSearchers,
-			"searchpath": Fn("package.searchpath", stdPkgSearchPath),
-		},
-	}
+	loadedPackages  = NewTable(nil, map[any]any{})
+	preloadPackages = NewTable(nil, map[any]any{})
+	stdPackageLib   = NewTable(nil, map[any]any{
+		"config": strings.Join([]string{
+			pkgPathSeparator,
+			pkgTemplateSeparator,
+			pkgSubstitutionPoint,
+			pkgExecutableDirWin,
+			pkgIgnoreMark,
+		}, "\n"),
+		"loaded":     loadedPackages,
+		"path":       searchPaths,
+		"preload":    preloadPackages,
+		"searchers":  pkgSearchers,
+		"searchpath": builtinFn("package.searchpath", stdPkgSearchPath),
+	})
 )
 
 func stdRequire(vm *VM, args []any) ([]any, error) {
@@ -54,13 +55,26 @@ func stdRequire(vm *VM, args []any) ([]any, error) {
 	}
 
 	modName := args[0].(string)
-	moduleResolutionStrategies := []resolveStrategy{searchLibCache, searchStdLib, searchBuiltinLib, searchUserModules}
-	for _, strategy := range moduleResolutionStrategies {
+	var traceStart float64
+	if vm.tracer != nil {
+		traceStart = vm.tracer.now()
+	}
+	moduleResolutionStrategies := []resolveStrategy{
+		searchLibCache,
+		searchPreload,
+		searchStdLib,
+		searchBuiltinLib,
+		searchUserModules,
+	}
+	for i, strategy := range moduleResolutionStrategies {
 		found, lib, err := strategy(vm, modName)
 		if err != nil {
 			return nil, err
 		} else if found {
-			loadedPackages.hashtable[modName] = lib
+			if vm.tracer != nil {
+				vm.tracer.require(vm, modName, traceStart, i == 0)
+			}
+			vm.loaded.setStr(modName, ValueOf(lib))
 			return []any{lib}, nil
 		}
 	}
@@ -82,10 +96,23 @@ func newModuleNotFoundErr(modName string) error {
 	return fmt.Errorf("module %q not found:\n%v", modName, strings.Join(searchedPaths, "\n"))
 }
 
-func searchLibCache(_ *VM, modName string) (bool, any, error) {
-	loadedCache := loadedPackages.hashtable
-	lib, found := loadedCache[modName]
-	return found, lib, nil
+func searchLibCache(vm *VM, modName string) (bool, any, error) {
+	lib := vm.loaded.getStr(modName)
+	return !lib.isNil(), lib.Any(), nil
+}
+
+func searchPreload(vm *VM, modName string) (bool, any, error) {
+	loader := vm.preload.getStr(modName)
+	if loader.isNil() {
+		return false, nil, nil
+	}
+	res, err := vm.call(loader.Any(), []any{modName, ":preload:"})
+	if err != nil {
+		return false, nil, err
+	} else if len(res) > 0 && res[0] != nil {
+		return true, res[0], nil
+	}
+	return true, true, nil
 }
 
 func searchStdLib(_ *VM, modName string) (bool, any, error) {
@@ -98,6 +125,10 @@ func searchStdLib(_ *VM, modName string) (bool, any, error) {
 		"string":    createStringLib,
 		"table":     createTableLib,
 		"utf8":      createUtf8Lib,
+		"task":      createTaskLib,
+		"chan":      createChanLib,
+		"loop":      createLoopLib,
+		"worker":    createWorkerLib,
 	}
 	mod, found := std[modName]
 	if !found {
@@ -107,6 +138,21 @@ func searchStdLib(_ *VM, modName string) (bool, any, error) {
 	return true, lib, nil
 }
 
+// IsBuiltinModule returns true if the module is shipped with the runtime, either
+// as part of the standard library or as an embedded lua library, so requiring it
+// never needs to search the filesystem.
+func IsBuiltinModule(modName string) bool {
+	if found, _, _ := searchStdLib(nil, modName); found {
+		return true
+	}
+	for _, modPath := range generateBuiltinSearchPaths(modName) {
+		if _, err := fs.Stat(stdLib, modPath); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
 func generateBuiltinSearchPaths(modName string) []string {
 	searchedPaths := make([]string, len(pkgBuiltinPaths))
 	modName = strings.ReplaceAll(modName, ".", pkgPathSeparator)
@@ -138,9 +184,11 @@ func searchUserModules(vm *VM, modName string) (bool, any, error) {
 	}
 
 	var foundPath string
-	searchers := pkgSearchers.val
-	for _, search := range searchers {
-		if res, err := vm.call(search, []any{modName, dir}); err != nil {
+	for i := int64(1); ; i++ {
+		search := pkgSearchers.geti(i)
+		if search.isNil() {
+			break
+		} else if res, err := vm.call(search.Any(), []any{modName, dir}); err != nil {
 			return false, nil, err
 		} else if len(res) == 1 {
 			foundPath = res[0].(string)
@@ -151,7 +199,7 @@ func searchUserModules(vm *VM, modName string) (bool, any, error) {
 		return false, nil, nil
 	}
 
-	if fn, err := parse.File(foundPath, parse.ModeText); err != nil {
+	if fn, err := parse.File(foundPath, parse.ModeText|vm.optimize.Mode()); err != nil {
 		return false, nil, err
 	} else if res, err := vm.Eval(fn); err != nil {
 		return false, nil, err
@@ -13,52 +13,71 @@ import (
 	"github.com/tanema/luaf/internal/runtime/pattern"
 )
 
-var stringMetaTable *Table
-
 func createStringLib() *Table {
-	strLib := &Table{
-		hashtable: map[any]any{
-			"byte":     Fn("string.byte", stdStringByte),
-			"char":     Fn("string.char", stdStringChar),
-			"dump":     Fn("string.dump", stdStringDump),
-			"find":     Fn("string.find", stdStringFind),
-			"match":    Fn("string.match", stdStringMatch),
-			"gmatch":   Fn("string.gmatch", stdStringGMatch),
-			"gsub":     Fn("string.gsub", stdStringGSub),
-			"format":   Fn("string.format", stdStringFormat),
-			"len":      Fn("string.len", stdStringLen),
-			"lower":    Fn("string.lower", stdStringLower),
-			"rep":      Fn("string.rep", stdStringRep),
-			"reverse":  Fn("string.reverse", stdStringReverse),
-			"upper":    Fn("string.upper", stdStringUpper),
-			"sub":      Fn("string.sub", stdStringSub),
-			"pack":     Fn("string.pack", stdStringPack),
-			"packsize": Fn("string.packsize", stdStringPacksize),
-			"unpack":   Fn("string.unpack", stdStringUnpack),
-		},
-	}
-
-	// if the strings are convertable into numbers.
-	stringMetaTable = &Table{
-		hashtable: map[any]any{
-			string(parse.MetaName):  "STRING",
-			string(parse.MetaAdd):   strArith(parse.MetaAdd),
-			string(parse.MetaSub):   strArith(parse.MetaSub),
-			string(parse.MetaMul):   strArith(parse.MetaMul),
-			string(parse.MetaMod):   strArith(parse.MetaMod),
-			string(parse.MetaPow):   strArith(parse.MetaPow),
-			string(parse.MetaDiv):   strArith(parse.MetaDiv),
-			string(parse.MetaIDiv):  strArith(parse.MetaIDiv),
-			string(parse.MetaUNM):   strArith(parse.MetaUNM),
-			string(parse.MetaIndex): strLib,
-		},
-	}
+	strLib := NewTable(nil, map[any]any{
+		"byte":     builtinFn("string.byte", stdStringByte),
+		"char":     strAllocFn("string.char", stdStringChar),
+		"dump":     builtinFn("string.dump", stdStringDump),
+		"find":     builtinFn("string.find", stdStringFind),
+		"match":    builtinFn("string.match", stdStringMatch),
+		"gmatch":   builtinFn("string.gmatch", stdStringGMatch),
+		"gsub":     strAllocFn("string.gsub", stdStringGSub),
+		"format":   strAllocFn("string.format", stdStringFormat),
+		"len":      builtinFn("string.len", stdStringLen),
+		"lower":    strAllocFn("string.lower", stdStringLower),
+		"rep":      strAllocFn("string.rep", stdStringRep),
+		"reverse":  strAllocFn("string.reverse", stdStringReverse),
+		"upper":    strAllocFn("string.upper", stdStringUpper),
+		"sub":      strAllocFn("string.sub", stdStringSub),
+		"pack":     strAllocFn("string.pack", stdStringPack),
+		"packsize": builtinFn("string.packsize", stdStringPacksize),
+		"unpack":   builtinFn("string.unpack", stdStringUnpack),
+	})
 	return strLib
 }
 
+// newStringMetatable creates the metatable of strings for a vm, which indexes
+// the string library of its globals. Each vm has its own since, unlike the
+// other shared metatables, its string library can be changed by lua code.
+func newStringMetatable(strLib *Table) *Table {
+	// the arithmetic metamethods work if the strings are convertable into numbers.
+	return NewTable(nil, map[any]any{
+		string(parse.MetaName):  "STRING",
+		string(parse.MetaAdd):   strArith(parse.MetaAdd),
+		string(parse.MetaSub):   strArith(parse.MetaSub),
+		string(parse.MetaMul):   strArith(parse.MetaMul),
+		string(parse.MetaMod):   strArith(parse.MetaMod),
+		string(parse.MetaPow):   strArith(parse.MetaPow),
+		string(parse.MetaDiv):   strArith(parse.MetaDiv),
+		string(parse.MetaIDiv):  strArith(parse.MetaIDiv),
+		string(parse.MetaUNM):   strArith(parse.MetaUNM),
+		string(parse.MetaIndex): strLib,
+	})
+}
+
+// strAllocFn wraps string functions that build new strings so that the resulting
+// string is counted and the memory profiler can attribute it to the lua code
+// that called it.
+// Returning the source string unchanged is not counted as an allocation.
+func strAllocFn(name string, fn func(*VM, []any) ([]any, error)) *GoFunc {
+	return builtinFn(name, func(vm *VM, args []any) ([]any, error) {
+		res, err := fn(vm, args)
+		if err != nil || len(res) == 0 {
+			return res, err
+		}
+		if str, isStr := res[0].(string); isStr {
+			if len(args) == 0 || !isString(args[0]) || unsafe.StringData(args[0].(string)) != unsafe.StringData(str) {
+				vm.recordAlloc(allocString, int64(len(str)))
+			}
+		}
+		return res, err
+	})
+}
+
 func strArith(op parse.MetaMethod) *GoFunc {
 	return &GoFunc{
-		name: fmt.Sprintf("string:%s", op),
+		name:    fmt.Sprintf("string:%s", op),
+		builtin: true,
 		val: func(vm *VM, args []any) ([]any, error) {
 			var lval, rval any
 			if len(args) < 1 {
@@ -135,7 +154,7 @@ func stdStringDump(_ *VM, args []any) ([]any, error) {
 	var fn *parse.FnProto
 	switch cls := args[0].(type) {
 	case *Closure:
-		fn = cls.val
+		fn = cls.val.FnProto
 	default:
 		return nil, argumentErr(1, "string.dump", fmt.Errorf("unable to dump %T", args[0]))
 	}
@@ -431,12 +450,12 @@ func stdStringGSub(vm *VM, args []any) ([]any, error) {
 			if len(matches) > 1 {
 				key = matchValue(matches[1])
 			}
-			val, err := vm.index(tval, nil, key)
+			val, err := vm.index(tableValue(tval), nilValue, ValueOf(key))
 			if err != nil {
 				return nil, err
 			}
-			if val != nil && val != false {
-				resStr, err := gsubReplacementString(vm, val)
+			if val.truthy() {
+				resStr, err := gsubReplacementString(vm, val.Any())
 				if err != nil {
 					return nil, err
 				}
@@ -10,126 +10,23 @@ import (
 	"github.com/tanema/luaf/internal/parse"
 )
 
-type (
-	// Table is a container object in lua that acts both as an array and a map
-	// It is used duing runtime but cal also be changed in go code.
-	Table struct {
-		val       []any
-		hashtable map[any]any
-		metatable *Table
-		keyCache  []any
-	}
-)
-
 func createTableLib() *Table {
-	return &Table{
-		hashtable: map[any]any{
-			"create": Fn("table.create", stdTableCreate),
-			"concat": Fn("table.concat", stdTableConcat),
-			"keys":   Fn("table.keys", stdTableKeys),
-			"insert": Fn("table.insert", stdTableInsert),
-			"move":   Fn("table.move", stdTableMove),
-			"pack":   Fn("table.pack", stdTablePack),
-			"remove": Fn("table.remove", stdTableRemove),
-			"sort":   Fn("table.sort", stdTableSort),
-			"unpack": Fn("table.unpack", stdTableUnpack),
-		},
-	}
-}
-
-// NewTable will create a new table with default values contained in it. Since
-// lua tables act as both array and map, both can be passed in to set the values.
-func NewTable(arr []any, hash map[any]any) *Table {
-	if hash == nil {
-		hash = map[any]any{}
-	}
-	keycache := make([]any, 0, len(hash))
-	for key := range hash {
-		keycache = append(keycache, key)
-	}
-	return &Table{
-		val:       arr,
-		hashtable: hash,
-		keyCache:  keycache,
-	}
-}
-
-func newEmptyTable(nseq, nrec int64) *Table {
-	return &Table{
-		val:       make([]any, 0, nseq),
-		hashtable: make(map[any]any, nrec),
-		keyCache:  make([]any, 0, nrec),
-	}
-}
-
-func (t *Table) String() string {
-	return fmt.Sprintf("table: %p", t.val)
-}
-
-func newSizedTable(arraySize, tableSize int) *Table {
-	return &Table{
-		val:       make([]any, 0, arraySize),
-		hashtable: make(map[any]any, tableSize),
-	}
-}
-
-// Keys returns the map keys for the map storage used for pairs iteration.
-func (t *Table) Keys() []any { return t.keyCache }
-
-// Get will return the value for the key. If it is an int it will get it from the
-// array store, otherwise the map. Nil keys are not allowed.
-func (t *Table) Get(key any) (any, error) {
-	switch keyval := key.(type) {
-	case int64:
-		if i := keyval; i > 0 && int(i) <= len(t.val) {
-			return t.val[i-1], nil
-		} else if int(i) > len(t.val) {
-			return nil, nil
-		}
-	case nil:
-		return nil, errors.New("table index is nil")
-	}
-	val, ok := t.hashtable[toKey(key)]
-	if !ok {
-		return nil, nil
-	}
-	return val, nil
-}
-
-// Set will set a value at a given key. If the key is an int64, it will place it
-// in array-like storage. Otherwise it will be put in a map. Nil keys are not
-// allowed.
-func (t *Table) Set(key, val any) error {
-	switch keyval := key.(type) {
-	case int64:
-		if i := keyval - 1; i >= 0 {
-			ensureSize(&t.val, int(i))
-			t.val[i] = val
-			return nil
-		}
-	case nil:
-		return errors.New("table index is nil")
-	}
-	fmtKey := toKey(key)
-	_, exists := t.hashtable[fmtKey]
-	if !exists {
-		t.keyCache = append(t.keyCache, fmtKey)
-	}
-	if val == nil {
-		for i, kc := range t.keyCache {
-			if fmtKey == kc {
-				t.keyCache = t.keyCache[:i+copy(t.keyCache[i:], t.keyCache[i+1:])]
-				break
-			}
-		}
-		delete(t.hashtable, fmtKey)
-	} else {
-		t.hashtable[fmtKey] = val
-	}
-	return nil
+	return NewTable(nil, map[any]any{
+		"create":   builtinFn("table.create", stdTableCreate),
+		"concat":   builtinFn("table.concat", stdTableConcat),
+		"freeze":   builtinFn("table.freeze", stdTableFreeze),
+		"isfrozen": builtinFn("table.isfrozen", stdTableIsFrozen),
+		"keys":     builtinFn("table.keys", stdTableKeys),
+		"insert":   builtinFn("table.insert", stdTableInsert),
+		"move":     builtinFn("table.move", stdTableMove),
+		"pack":     builtinFn("table.pack", stdTablePack),
+		"remove":   builtinFn("table.remove", stdTableRemove),
+		"sort":     builtinFn("table.sort", stdTableSort),
+		"unpack":   builtinFn("table.unpack", stdTableUnpack),
+	})
 }
 
-func stdTableCreate(_ *VM, args []any) ([]any, error) {
+func stdTableCreate(vm *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "create", "number", "~number"); err != nil {
 		return nil, err
 	}
@@ -137,7 +34,7 @@ func stdTableCreate(_ *VM, args []any) ([]any, error) {
 	if len(args) > 1 {
 		nrec = toInt(args[1])
 	}
-	return []any{newEmptyTable(toInt(args[0]), nrec)}, nil
+	return []any{vm.newTable(toInt(args[0]), nrec)}, nil
 }
 
 func stdTableConcat(_ *VM, args []any) ([]any, error) {
@@ -146,7 +43,7 @@ func stdTableConcat(_ *VM, args []any) ([]any, error) {
 	}
 	tbl := args[0].(*Table)
 	sep := ""
-	i, j := int64(1), int64(len(tbl.val))
+	i, j := int64(1), tbl.length()
 	if len(args) > 1 {
 		sep = args[1].(string)
 	}
@@ -159,17 +56,34 @@ func stdTableConcat(_ *VM, args []any) ([]any, error) {
 
 	strParts := []string{}
 	for k := i; k <= j; k++ {
-		val, err := tbl.Get(k)
-		if err != nil {
-			return nil, err
-		} else if val == nil {
+		val := tbl.geti(k)
+		if val.isNil() {
 			return nil, fmt.Errorf("invalid value (nil) at index %v in table for 'concat'", k)
 		}
-		strParts = append(strParts, ToString(val))
+		strParts = append(strParts, ToString(val.Any()))
 	}
 	return []any{strings.Join(strParts, sep)}, nil
 }
 
+// stdTableFreeze freezes a table and everything reachable from it so that it can
+// be shared with tasks and workers rather than copied. It returns the table.
+func stdTableFreeze(_ *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "table.freeze", "table"); err != nil {
+		return nil, err
+	}
+	if err := args[0].(*Table).freeze(); err != nil {
+		return nil, argumentErr(1, "table.freeze", err)
+	}
+	return []any{args[0]}, nil
+}
+
+func stdTableIsFrozen(_ *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "table.isfrozen", "table"); err != nil {
+		return nil, err
+	}
+	return []any{args[0].(*Table).frozen}, nil
+}
+
 func stdTableKeys(_ *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "table.keys", "table"); err != nil {
 		return nil, err
@@ -183,25 +97,25 @@ func stdTableInsert(_ *VM, args []any) ([]any, error) {
 		return nil, err
 	}
 	tbl := args[0].(*Table)
+	if tbl.frozen {
+		return nil, errFrozenTable
+	}
+	end := tbl.length() + 1
 	if len(args) < 3 {
-		tbl.val = append(tbl.val, args[1])
+		tbl.seti(end, ValueOf(args[1]))
 		return []any{}, nil
 	} else if !isNumber(args[1]) {
 		return nil, argumentErr(2, "table.insert", errors.New("number expected, got string"))
 	}
 
-	i := int(toInt(args[1]))
-	val := args[2]
-	if i <= 0 || i > len(tbl.val)+1 {
+	pos := toInt(args[1])
+	if pos <= 0 || pos > end {
 		return nil, argumentErr(2, "table.insert", errors.New("position out of bounds"))
 	}
-
-	if i == len(tbl.val)+1 {
-		tbl.val = append(tbl.val, val)
-		return []any{}, nil
+	for i := end; i > pos; i-- {
+		tbl.seti(i, tbl.geti(i-1))
 	}
-
-	tbl.val = slices.Insert(tbl.val, i-1, val)
+	tbl.seti(pos, ValueOf(args[2]))
 	return []any{}, nil
 }
 
@@ -211,28 +125,33 @@ func stdTableMove(_ *VM, args []any) ([]any, error) {
 	}
 	tbl1 := args[0].(*Table)
 	tbl2 := tbl1
-	from := max(toInt(args[1])-1, 0)
-	end := min(toInt(args[2])-1, int64(len(tbl1.val))-1)
-	to := max(toInt(args[3])-1, 0)
+	from, end, to := toInt(args[1]), toInt(args[2]), toInt(args[3])
 	if len(args) > 4 {
 		tbl2 = args[4].(*Table)
 	}
-	count := end - from + 1
-
-	if end < from {
+	if tbl2.frozen {
+		return nil, errFrozenTable
+	} else if end < from {
 		return []any{tbl2}, nil
-	} else if to > math.MaxInt64-count+1 {
+	} else if from <= 0 && end >= math.MaxInt64+from {
+		return nil, argumentErr(3, "table.move", errors.New("too many elements to move"))
+	}
+	count := end - from + 1
+	if to > math.MaxInt64-count+1 {
 		return nil, argumentErr(4, "table.move", errors.New("destination wrap around"))
 	}
 
-	if need := to + count; need > int64(len(tbl2.val)) {
-		ensureSize(&tbl2.val, int(need)-1)
+	// table.move overwrites the destination range in place (like memmove) so
+	// when the ranges overlap it has to copy from the end.
+	if to > end || to <= from || tbl1 != tbl2 {
+		for i := range count {
+			tbl2.seti(to+i, tbl1.geti(from+i))
+		}
+	} else {
+		for i := count - 1; i >= 0; i-- {
+			tbl2.seti(to+i, tbl1.geti(from+i))
+		}
 	}
-
-	// table.move overwrites the destination range in place (like memmove); it does
-	// not insert/shift, so copy (which is overlap-safe for a shared backing array,
-	// same as memmove) is what's needed here, not slices.Insert.
-	copy(tbl2.val[to:to+count], tbl1.val[from:end+1])
 	return []any{tbl2}, nil
 }
 
@@ -241,20 +160,23 @@ func stdTableRemove(_ *VM, args []any) ([]any, error) {
 		return nil, err
 	}
 	tbl := args[0].(*Table)
-	i := len(tbl.val) - 1
-	if len(args) == 1 && len(tbl.val) == 0 {
-		return []any{nil}, nil
-	} else if len(args) > 1 {
-		i = int(toInt(args[1])) - 1
-		if i == len(tbl.val) {
-			return []any{nil}, nil
-		} else if i > len(tbl.val) || i < 0 {
+	if tbl.frozen {
+		return nil, errFrozenTable
+	}
+	size := tbl.length()
+	pos := size
+	if len(args) > 1 {
+		pos = toInt(args[1])
+		if pos != size && uint64(pos)-1 > uint64(size) {
 			return nil, argumentErr(2, "table.remove", errors.New("position out of bounds"))
 		}
 	}
-	value := tbl.val[i]
-	tbl.val = slices.Delete(tbl.val, i, i+1)
-	return []any{value}, nil
+	value := tbl.geti(pos)
+	for ; pos < size; pos++ {
+		tbl.seti(pos, tbl.geti(pos+1))
+	}
+	tbl.seti(pos, nilValue)
+	return []any{value.Any()}, nil
 }
 
 func stdTablePack(_ *VM, args []any) ([]any, error) {
@@ -266,42 +188,99 @@ func stdTableSort(vm *VM, args []any) ([]any, error) {
 		return nil, err
 	}
 	tbl := args[0].(*Table)
+	if tbl.frozen {
+		return nil, errFrozenTable
+	}
+	sorter := &tableSorter{tbl: tbl, vals: make([]Value, tbl.length()), width: 1}
 	if len(args) > 1 {
-		return []any{}, sortTableFunc(vm, args[1], tbl.val)
+		sorter.cmp = args[1]
+	}
+	for i := range sorter.vals {
+		sorter.vals[i] = tbl.geti(int64(i) + 1)
 	}
-	return []any{}, sortTableDefault(vm, tbl.val)
+	sorter.buf = make([]Value, len(sorter.vals))
+	return sorter.run(vm)
 }
 
-func sortTableFunc(vm *VM, fn any, tbl []any) error {
-	var err error
-	slices.SortFunc(tbl, func(l, r any) int {
-		if err != nil {
-			return 0
-		}
-		var res []any
-		res, err = vm.call(fn, []any{l, r})
-		if err == nil && len(res) > 0 {
-			if toBool(res[0]) {
-				return -1
+// tableSorter is a bottom up merge sort that keeps its progress so that it can
+// be continued after the order function yields.
+type tableSorter struct {
+	tbl       *Table
+	cmp       any
+	vals      []Value
+	buf       []Value
+	width     int
+	lo        int
+	merging   bool
+	i, j, k   int
+	less      bool // result of a comparison that yielded
+	hasResult bool
+}
+
+func (s *tableSorter) run(vm *VM) ([]any, error) {
+	n := len(s.vals)
+	for ; s.width < n; s.width, s.lo = s.width*2, 0 {
+		for ; s.lo < n-s.width; s.lo += 2 * s.width {
+			mid, hi := s.lo+s.width, min(s.lo+2*s.width, n)
+			if !s.merging {
+				s.i, s.j, s.k = s.lo, mid, s.lo
+				s.merging = true
 			}
-			return 1
+			for s.i < mid && s.j < hi {
+				less, err := s.compare(vm, s.vals[s.j], s.vals[s.i])
+				if err != nil {
+					return nil, err
+				}
+				if less {
+					s.buf[s.k] = s.vals[s.j]
+					s.j++
+				} else {
+					s.buf[s.k] = s.vals[s.i]
+					s.i++
+				}
+				s.k++
+			}
+			s.k += copy(s.buf[s.k:], s.vals[s.i:mid])
+			copy(s.buf[s.k:], s.vals[s.j:hi])
+			copy(s.vals[s.lo:hi], s.buf[s.lo:hi])
+			s.merging = false
 		}
-		return 0
-	})
-	return err
+	}
+	for i, val := range s.vals {
+		s.tbl.seti(int64(i)+1, val)
+	}
+	return []any{}, nil
 }
 
-func sortTableDefault(vm *VM, tbl []any) error {
-	var err error
-	slices.SortFunc(tbl, func(l, r any) int {
-		if err == nil {
-			var i int
-			i, err = compareVal(vm, parse.MetaLe, l, r)
-			return i
+// compare reports whether l sorts before r. Calls to the order function or a
+// __lt metamethod may yield, once they return sorting continues from resume.
+func (s *tableSorter) compare(vm *VM, l, r Value) (bool, error) {
+	if s.hasResult {
+		s.hasResult = false
+		return s.less, nil
+	}
+	fn := s.cmp
+	if fn == nil {
+		if (l.isNumber() && r.isNumber()) || (l.kind == kindString && r.kind == kindString) {
+			res, err := compareVal(vm, parse.MetaLt, l, r)
+			return res < 0, err
+		} else if fn = vm.findMetavalue(parse.MetaLt, l.Any()); fn == nil {
+			if fn = vm.findMetavalue(parse.MetaLt, r.Any()); fn == nil {
+				return false, compareErr(l.Any(), r.Any())
+			}
 		}
-		return 0
-	})
-	return err
+	}
+	res, err := vm.CallK(fn, []any{l.Any(), r.Any()}, s.resume)
+	if err != nil {
+		return false, err
+	}
+	return len(res) > 0 && toBool(res[0]), nil
+}
+
+func (s *tableSorter) resume(vm *VM, res []any, _ error) ([]any, error) {
+	s.less = len(res) > 0 && toBool(res[0])
+	s.hasResult = true
+	return s.run(vm)
 }
 
 func stdTableUnpack(_ *VM, args []any) ([]any, error) {
@@ -309,21 +288,23 @@ func stdTableUnpack(_ *VM, args []any) ([]any, error) {
 		return nil, err
 	}
 	tbl := args[0].(*Table)
-	i := 0
-	j := len(tbl.val)
+	i, j := int64(1), tbl.length()
 	if len(args) > 1 {
-		i = max(int(toInt(args[1]))-1, 0)
-	}
-	if i >= len(tbl.val) {
-		return []any{}, nil
+		i = toInt(args[1])
 	}
 	if len(args) > 2 {
-		j = min(int(toInt(args[2])), len(tbl.val))
+		j = toInt(args[2])
 	}
-	if j <= i {
+	if i > j {
 		return []any{}, nil
+	} else if uint64(j)-uint64(i) >= 1<<maxArrayBits {
+		return nil, errors.New("too many results to unpack")
+	}
+	out := make([]any, 0, j-i+1)
+	for k := i; k <= j; k++ {
+		out = append(out, tbl.geti(k).Any())
 	}
-	return tbl.val[i:j], nil
+	return out, nil
 }
 
 func argsToTableValues(clargs []string) ([]any, map[any]any) {
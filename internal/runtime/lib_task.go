@@ -0,0 +1,513 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+type (
+	// Task is a function running on its own goroutine in an isolated vm. The vm
+	// that spawned it and the task share nothing, the function, its arguments
+	// and its results are deep copied between them.
+	Task struct {
+		done   chan struct{}
+		res    []Value
+		errVal Value
+		err    error // what go code waiting on the task gets.
+		failed bool
+	}
+	// Channel passes values between tasks. Values are deep copied when they are
+	// sent so the sender and receiver never share a table or closure. Closing a
+	// channel closes an extra channel instead of the go channel so that a pending
+	// send errors rather than panics.
+	Channel struct {
+		ch     chan Value
+		closed chan struct{}
+		once   sync.Once
+	}
+	// valueCopier deep copies values from one vm to another. Tables and closures
+	// are copied keeping any sharing and cycles between them, references to the
+	// globals of the source become the globals of the destination. Strings,
+	// numbers, go functions, channels, tasks and frozen tables are shared as they
+	// are.
+	valueCopier struct {
+		vm   *VM // the destination vm, nil while the value is detached.
+		from *Table
+		to   *Table
+		seen map[any]any
+	}
+	selectCase struct {
+		arg    int
+		ch     *Channel
+		send   bool
+		closed bool
+	}
+)
+
+var (
+	taskMetatable    *Table
+	channelMetatable *Table
+	// detachedEnv stands in for the globals of whichever vm will receive a value
+	// while it is waiting in a channel or in the results of a task.
+	detachedEnv = newEmptyTable(0, 0)
+
+	errSendOnClosed = errors.New("send on closed channel")
+)
+
+// the metatables are created once rather than by the libs since task vms
+// require the libs on their own goroutines.
+func init() {
+	taskMetatable = sharedMetatable(map[any]any{
+		string(parse.MetaName): "TASK",
+		string(parse.MetaIndex): NewTable(nil, map[any]any{
+			"wait": builtinFn("task:wait", stdTaskWait),
+		}),
+	})
+	channelMetatable = sharedMetatable(map[any]any{
+		string(parse.MetaName):  "CHANNEL",
+		string(parse.MetaClose): builtinFn("channel:close", stdChanClose),
+		string(parse.MetaIndex): NewTable(nil, map[any]any{
+			"send":  builtinFn("channel:send", stdChanSend),
+			"recv":  builtinFn("channel:recv", stdChanRecv),
+			"close": builtinFn("channel:close", stdChanClose),
+		}),
+	})
+}
+
+func createTaskLib() *Table {
+	return NewTable(nil, map[any]any{
+		"spawn": builtinFn("task.spawn", stdTaskSpawn),
+		"wait":  builtinFn("task.wait", stdTaskWait),
+	})
+}
+
+func createChanLib() *Table {
+	return NewTable(nil, map[any]any{
+		"new":    builtinFn("chan.new", stdChanNew),
+		"select": builtinFn("chan.select", stdChanSelect),
+	})
+}
+
+func (t *Task) String() string    { return fmt.Sprintf("task: %p", t) }
+func (c *Channel) String() string { return fmt.Sprintf("channel: %p", c) }
+
+// newTaskVM creates the vm that a task runs in, with the settings of vm.
+func (vm *VM) newTaskVM() (*VM, error) {
+	task, err := newIsolatedVM(vm.ctx)
+	if err != nil {
+		return nil, err
+	}
+	task.maxCallDepth = vm.maxCallDepth
+	task.orderedPairs = vm.orderedPairs
+	task.optimize = vm.optimize
+	task.memprof = vm.memprof
+	return task, nil
+}
+
+// newIsolatedVM creates a vm that gets its own globals, copies of the standard
+// library tables and its own package.loaded so that nothing it changes is seen
+// by other goroutines.
+func newIsolatedVM(ctx context.Context) (*VM, error) {
+	env := createDefaultEnv(true)
+	loaded, preload := newEmptyTable(0, 0), newEmptyTable(0, 0)
+	for key, val, _ := env.next(nilValue); !key.isNil(); key, val, _ = env.next(key) {
+		if key.kind != kindString || val.kind != kindTable {
+			continue
+		}
+		lib := cloneTable(val.table())
+		if key.str() == "package" {
+			lib.setStr("loaded", tableValue(loaded))
+			lib.setStr("preload", tableValue(preload))
+		} else {
+			loaded.setStr(key.str(), tableValue(lib))
+		}
+		env.setStr(key.str(), tableValue(lib))
+	}
+	vm, err := New(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	vm.loaded = loaded
+	vm.preload = preload
+	return vm, nil
+}
+
+// cloneTable makes a shallow copy of a table.
+func cloneTable(src *Table) *Table {
+	tbl := newEmptyTable(int64(len(src.val)), int64(len(src.nodes)))
+	for key, val, _ := src.next(nilValue); !key.isNil(); key, val, _ = src.next(key) {
+		_ = tbl.set(key, val)
+	}
+	tbl.metatable = src.metatable
+	return tbl
+}
+
+// detach copies values out of the vm so that they can be attached to any other.
+func (vm *VM) detach(vals ...Value) ([]Value, error) {
+	c := &valueCopier{from: vm.env, to: detachedEnv, seen: map[any]any{}}
+	return c.copyAll(vals)
+}
+
+// attach copies detached values into the vm.
+func (vm *VM) attach(vals ...Value) ([]Value, error) {
+	c := &valueCopier{vm: vm, from: detachedEnv, to: vm.env, seen: map[any]any{}}
+	return c.copyAll(vals)
+}
+
+func (c *valueCopier) copyAll(vals []Value) ([]Value, error) {
+	res := make([]Value, len(vals))
+	for i, val := range vals {
+		cp, err := c.copy(val)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = cp
+	}
+	return res, nil
+}
+
+func (c *valueCopier) copy(val Value) (Value, error) {
+	switch ref := val.ref().(type) {
+	case *Table:
+		tbl, err := c.table(ref)
+		if err != nil {
+			return nilValue, err
+		}
+		return tableValue(tbl), nil
+	case *Closure:
+		cl, err := c.closure(ref)
+		if err != nil {
+			return nilValue, err
+		}
+		return ValueOf(cl), nil
+	case *GoFunc:
+		// like frozen tables, only builtin go functions are known not to hold lua
+		// values that the vms would then share.
+		if !ref.builtin {
+			return nilValue, errors.New("cannot copy a go function that is not builtin to another vm")
+		}
+	case *VM, *File, *Future, *Worker:
+		return nilValue, fmt.Errorf("cannot copy a %s to another vm", typeName(ref))
+	}
+	return val, nil
+}
+
+func (c *valueCopier) table(src *Table) (*Table, error) {
+	if src == c.from {
+		return c.to, nil
+	} else if src.frozen {
+		return src, nil
+	} else if cp, ok := c.seen[src]; ok {
+		return cp.(*Table), nil
+	}
+	tbl := newEmptyTable(int64(len(src.val)), int64(len(src.nodes)))
+	tbl.ordered = src.ordered
+	c.seen[src] = tbl
+	for i, val := range src.val {
+		cp, err := c.copy(load(val))
+		if err != nil {
+			return nil, err
+		}
+		tbl.seti(int64(i+1), cp)
+	}
+	for _, node := range src.nodes {
+		key, val := load(node.key), load(node.val)
+		if key.isNil() || val.isNil() {
+			continue
+		}
+		keyCp, err := c.copy(key)
+		if err != nil {
+			return nil, err
+		}
+		valCp, err := c.copy(val)
+		if err != nil {
+			return nil, err
+		}
+		if err := tbl.set(keyCp, valCp); err != nil {
+			return nil, err
+		}
+	}
+	// the metatable is set once the entries are copied so that a weak mode is
+	// applied to all of them.
+	if src.metatable != nil {
+		mt, err := c.table(src.metatable)
+		if err != nil {
+			return nil, err
+		}
+		tbl.setMetatable(mt)
+		if c.vm != nil && !mt.getStr(string(parse.MetaGC)).isNil() {
+			c.vm.gc.mark(tbl)
+		}
+	}
+	return tbl, nil
+}
+
+func (c *valueCopier) closure(src *Closure) (*Closure, error) {
+	if cp, ok := c.seen[src]; ok {
+		return cp.(*Closure), nil
+	}
+	// protos are never changed once loaded so they can be shared.
+	cl := &Closure{val: src.val, upvalues: make([]*upvalueBroker, len(src.upvalues))}
+	c.seen[src] = cl
+	for i, broker := range src.upvalues {
+		if cp, ok := c.seen[broker]; ok {
+			cl.upvalues[i] = cp.(*upvalueBroker)
+			continue
+		}
+		cp := &upvalueBroker{name: broker.name}
+		c.seen[broker] = cp
+		val, err := c.copy(broker.Get())
+		if err != nil {
+			return nil, err
+		}
+		cp.val = val
+		cl.upvalues[i] = cp
+	}
+	return cl, nil
+}
+
+func stdTaskSpawn(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "task.spawn", "function"); err != nil {
+		return nil, err
+	}
+	taskVM, err := vm.newTaskVM()
+	if err != nil {
+		return nil, err
+	}
+	c := &valueCopier{vm: taskVM, from: vm.env, to: taskVM.env, seen: map[any]any{}}
+	vals, err := c.copyAll(valuesOf(args))
+	if err != nil {
+		taskVM.cancel()
+		return nil, fmt.Errorf("task.spawn: %w", err)
+	}
+	task := &Task{done: make(chan struct{})}
+	go task.run(taskVM, vals[0].Any(), valuesToAny(vals[1:]))
+	return []any{task}, nil
+}
+
+// run calls the task function and keeps the detached results, or the error
+// value, for the vms waiting on it.
+func (t *Task) run(vm *VM, fn any, args []any) {
+	defer close(t.done)
+	defer vm.cancel()
+	res, err := vm.call(fn, args)
+	vm.runFinalizers(true)
+	if err == nil {
+		if t.res, err = vm.detach(valuesOf(res)...); err != nil {
+			err = fmt.Errorf("task results: %w", err)
+		}
+	}
+	if err != nil {
+		t.failed, t.err = true, err
+		errVal, detachErr := vm.detach(ValueOf(getErrVal(err)))
+		if detachErr != nil {
+			errVal = []Value{strValue(err.Error())}
+		}
+		t.errVal = errVal[0]
+	}
+}
+
+func stdTaskWait(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "task.wait", "task"); err != nil {
+		return nil, err
+	}
+	return args[0].(*Task).wait(vm)
+}
+
+// wait waits for the task to end and attaches its results, or its error, to vm.
+func (t *Task) wait(vm *VM) ([]any, error) {
+	select {
+	case <-t.done:
+	case <-vm.ctx.Done():
+		return nil, errors.New("vm interrupted")
+	}
+	if t.failed {
+		errVal, err := vm.attach(t.errVal)
+		if err != nil {
+			return nil, err
+		}
+		return nil, newUserErr(vm, 0, errVal[0].Any())
+	}
+	res, err := vm.attach(t.res...)
+	if err != nil {
+		return nil, err
+	}
+	return valuesToAny(res), nil
+}
+
+func stdChanNew(_ *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "chan.new", "~number"); err != nil {
+		return nil, err
+	}
+	var size int64
+	if len(args) > 0 {
+		size = toInt(args[0])
+	}
+	if size < 0 {
+		return nil, argumentErr(1, "chan.new", errors.New("size cannot be negative"))
+	}
+	return []any{&Channel{ch: make(chan Value, size), closed: make(chan struct{})}}, nil
+}
+
+func stdChanSend(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "channel:send", "channel", "~value"); err != nil {
+		return nil, err
+	}
+	ch := args[0].(*Channel)
+	var val any
+	if len(args) > 1 {
+		val = args[1]
+	}
+	detached, err := vm.detach(ValueOf(val))
+	if err != nil {
+		return nil, argumentErr(2, "channel:send", err)
+	}
+	if ch.isClosed() {
+		return nil, errSendOnClosed
+	}
+	select {
+	case ch.ch <- detached[0]:
+		return []any{}, nil
+	case <-ch.closed:
+		return nil, errSendOnClosed
+	case <-vm.ctx.Done():
+		return nil, errors.New("vm interrupted")
+	}
+}
+
+func stdChanRecv(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "channel:recv", "channel"); err != nil {
+		return nil, err
+	}
+	ch := args[0].(*Channel)
+	select {
+	case val := <-ch.ch:
+		return ch.received(vm, val)
+	case <-ch.closed:
+		return ch.drain(vm)
+	case <-vm.ctx.Done():
+		return nil, errors.New("vm interrupted")
+	}
+}
+
+func stdChanClose(_ *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "channel:close", "channel"); err != nil {
+		return nil, err
+	}
+	ch := args[0].(*Channel)
+	ch.once.Do(func() { close(ch.closed) })
+	return []any{}, nil
+}
+
+// isClosed is checked before sending since a send to a closed channel that
+// still has room could otherwise be chosen over erroring.
+func (c *Channel) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// received attaches a value received from the channel.
+func (c *Channel) received(vm *VM, val Value) ([]any, error) {
+	res, err := vm.attach(val)
+	if err != nil {
+		return nil, err
+	}
+	return []any{res[0].Any(), true}, nil
+}
+
+// drain receives the values still buffered in a closed channel before
+// reporting that it is closed.
+func (c *Channel) drain(vm *VM) ([]any, error) {
+	select {
+	case val := <-c.ch:
+		return c.received(vm, val)
+	default:
+		return []any{nil, false}, nil
+	}
+}
+
+// stdChanSelect waits on several channel operations and does whichever is ready
+// first. Each argument is a case, {recv = ch} receives, {send = ch, value = v}
+// sends and {default = true} is chosen if nothing else is ready. It returns the
+// position of the chosen case followed by the received value and if it was
+// received, like recv.
+func stdChanSelect(vm *VM, args []any) ([]any, error) {
+	if len(args) == 0 {
+		// with only the interrupt case select would block until the vm is cancelled.
+		return nil, argumentErr(1, "chan.select", errors.New("at least one case expected"))
+	}
+	hasDefault := false
+	cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(vm.ctx.Done())}}
+	meta := []selectCase{{}}
+	for i, arg := range args {
+		spec, isTable := arg.(*Table)
+		if !isTable {
+			return nil, argumentErr(i+1, "chan.select", fmt.Errorf("table expected, got %v", nameOfType(arg)))
+		}
+		if ch, isChan := spec.getStr("recv").Any().(*Channel); isChan {
+			cases = append(cases,
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch.ch)},
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch.closed)},
+			)
+			meta = append(meta, selectCase{arg: i + 1, ch: ch}, selectCase{arg: i + 1, ch: ch, closed: true})
+		} else if ch, isChan := spec.getStr("send").Any().(*Channel); isChan {
+			if ch.isClosed() {
+				return nil, errSendOnClosed
+			}
+			detached, err := vm.detach(spec.getStr("value"))
+			if err != nil {
+				return nil, argumentErr(i+1, "chan.select", err)
+			}
+			send := reflect.ValueOf(&detached[0]).Elem()
+			cases = append(cases,
+				reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(ch.ch), Send: send},
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch.closed)},
+			)
+			meta = append(meta,
+				selectCase{arg: i + 1, ch: ch, send: true},
+				selectCase{arg: i + 1, ch: ch, send: true, closed: true},
+			)
+		} else if spec.getStr("default").truthy() {
+			if hasDefault {
+				return nil, argumentErr(i+1, "chan.select", errors.New("multiple default cases"))
+			}
+			hasDefault = true
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+			meta = append(meta, selectCase{arg: i + 1})
+		} else {
+			return nil, argumentErr(i+1, "chan.select", errors.New("case must have a recv, send or default field"))
+		}
+	}
+	chosen, recv, _ := reflect.Select(cases)
+	selected := meta[chosen]
+	switch {
+	case chosen == 0:
+		return nil, errors.New("vm interrupted")
+	case selected.ch == nil, selected.send && !selected.closed:
+		return []any{int64(selected.arg)}, nil
+	case selected.send:
+		return nil, errSendOnClosed
+	}
+	var (
+		res []any
+		err error
+	)
+	if selected.closed {
+		res, err = selected.ch.drain(vm)
+	} else {
+		res, err = selected.ch.received(vm, recv.Interface().(Value))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]any{int64(selected.arg)}, res...), nil
+}
@@ -0,0 +1,60 @@
+package runtime
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+func TestValueCopier(t *testing.T) {
+	t.Parallel()
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	other, err := vm.newTaskVM()
+	require.NoError(t, err)
+
+	mt := NewTable(nil, map[any]any{"__mode": "k"})
+	tbl := NewTable([]any{int64(1), "two"}, map[any]any{"env": vm.env})
+	tbl.setStr("self", tableValue(tbl))
+	weak := NewTable(nil, nil)
+	weak.setMetatable(mt)
+	tbl.setStr("weak", tableValue(weak))
+
+	detached, err := vm.detach(tableValue(tbl))
+	require.NoError(t, err)
+	res, err := other.attach(detached...)
+	require.NoError(t, err)
+
+	cp := res[0].table()
+	assert.NotSame(t, tbl, cp)
+	assert.Same(t, cp, cp.getStr("self").table())
+	assert.Same(t, other.env, cp.getStr("env").table())
+	assert.Equal(t, []any{int64(1), "two"}, valuesToAny(cp.val))
+	assert.Equal(t, weakKeys, cp.getStr("weak").table().mode)
+
+	_, err = vm.detach(ValueOf(vm))
+	require.EqualError(t, err, "cannot copy a thread to another vm")
+
+	_, err = vm.detach(ValueOf(Fn("stateful", func(*VM, []any) ([]any, error) { return nil, nil })))
+	require.EqualError(t, err, "cannot copy a go function that is not builtin to another vm")
+	_, err = vm.detach(ValueOf(builtinFn("string.len", stdStringLen)))
+	require.NoError(t, err)
+}
+
+func TestNewIsolatedVM_OwnsStringMetatable(t *testing.T) {
+	t.Parallel()
+
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	isolated, err := newIsolatedVM(context.Background())
+	require.NoError(t, err)
+
+	// string methods are looked up in the string library of each vm's globals.
+	assert.NotSame(t, vm.stringMeta, isolated.stringMeta)
+	assert.Same(t, vm.env.getStr("string").table(), vm.stringMeta.getStr(string(parse.MetaIndex)).table())
+	assert.Same(t, isolated.env.getStr("string").table(), isolated.stringMeta.getStr(string(parse.MetaIndex)).table())
+}
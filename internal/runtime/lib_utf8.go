@@ -1,15 +1,13 @@
 package runtime
 
 func createUtf8Lib() *Table {
-	return &Table{
-		hashtable: map[any]any{
-			"char":        Fn("utf8.char", stdStringChar),
-			"charpattern": charPattern,
-			"codepoint":   Fn("utf8.codepoint", stdStringByte),
-			"len":         Fn("utf8.len", stdStringLen),
-			"codes":       Fn("utf8.codes", stdUtf8Codes),
-		},
-	}
+	return NewTable(nil, map[any]any{
+		"char":        builtinFn("utf8.char", stdStringChar),
+		"charpattern": charPattern,
+		"codepoint":   builtinFn("utf8.codepoint", stdStringByte),
+		"len":         builtinFn("utf8.len", stdStringLen),
+		"codes":       builtinFn("utf8.codes", stdUtf8Codes),
+	})
 }
 
 func stdCodesNext(_ *VM, args []any) ([]any, error) {
@@ -33,5 +31,5 @@ func stdUtf8Codes(_ *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "utf8.codes", "string"); err != nil {
 		return nil, err
 	}
-	return []any{Fn("utf8.codes.next", stdCodesNext), args[0], nil}, nil
+	return []any{builtinFn("utf8.codes.next", stdCodesNext), args[0], nil}, nil
 }
@@ -0,0 +1,337 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+type (
+	// Worker is a lua file running in its own vm on its own goroutine, like a
+	// task, that passes messages to and from whatever started it. Messages are
+	// deep copied like the values of tasks, except for frozen tables which are
+	// shared. A worker ends once its file returned and its event loop has nothing
+	// left to run, so a worker handling messages runs until it is closed.
+	Worker struct {
+		task     *Task
+		inbox    *mailbox // messages posted to the worker
+		outbox   *mailbox // messages that the worker posted
+		once     sync.Once
+		messages chan any
+	}
+	// mailbox queues the detached messages posted to a vm until its event loop
+	// calls the handler set with on_message with each of them. The outbox of a
+	// worker started by go code has no loop and is read with Messages instead.
+	mailbox struct {
+		mu     sync.Mutex
+		queue  []Value
+		closed bool
+		loop   *eventLoop
+		notify chan struct{}
+		// the fields below are only used on the goroutine of the loop.
+		handler   any
+		listening bool
+	}
+)
+
+var (
+	workerMetatable *Table
+	errWorkerClosed = errors.New("worker is closed")
+	errNotInWorker  = errors.New("not running in a worker")
+)
+
+func init() {
+	workerMetatable = sharedMetatable(map[any]any{
+		string(parse.MetaName):  "WORKER",
+		string(parse.MetaClose): builtinFn("worker:close", stdWorkerClose),
+		string(parse.MetaIndex): NewTable(nil, map[any]any{
+			"post":       builtinFn("worker:post", stdWorkerPost),
+			"on_message": builtinFn("worker:on_message", stdWorkerOnMessage),
+			"close":      builtinFn("worker:close", stdWorkerClose),
+			"wait":       builtinFn("worker:wait", stdWorkerWait),
+		}),
+	})
+}
+
+// createWorkerLib creates the worker library. new starts a worker, post and
+// on_message are used by the file running in a worker to talk to its parent.
+func createWorkerLib() *Table {
+	return NewTable(nil, map[any]any{
+		"new":        builtinFn("worker.new", stdWorkerNew),
+		"post":       builtinFn("worker.post", stdWorkerParentPost),
+		"on_message": builtinFn("worker.on_message", stdWorkerParentOnMessage),
+	})
+}
+
+// NewWorker starts a worker running the lua file at path with args. Go code posts
+// messages to it with Post and receives the ones it posts from Messages. The
+// worker is interrupted if ctx is cancelled.
+func NewWorker(ctx context.Context, path string, args ...any) (*Worker, error) {
+	fn, err := parse.File(path, parse.ModeText|parse.ModeBinary)
+	if err != nil {
+		return nil, err
+	}
+	vm, err := newIsolatedVM(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := vm.attach(valuesOf(args)...)
+	if err != nil {
+		vm.cancel()
+		return nil, err
+	}
+	return startWorker(vm, fn, vals, nil), nil
+}
+
+// startWorker runs fn in vm on a new goroutine. The messages that it posts are
+// delivered to loop.
+func startWorker(vm *VM, fn *parse.FnProto, args []Value, loop *eventLoop) *Worker {
+	w := &Worker{
+		task:   &Task{done: make(chan struct{})},
+		inbox:  newMailbox(vm.loop),
+		outbox: newMailbox(loop),
+	}
+	vm.worker = w
+	chunk := &Closure{val: newFnProto(fn), upvalues: loadedChunkUpvalues(fn, vm.env)}
+	main := Fn("worker", func(vm *VM, args []any) ([]any, error) {
+		res, err := vm.call(chunk, args)
+		if err != nil {
+			return nil, err
+		}
+		return res, vm.loop.run(vm, nil)
+	})
+	go func() {
+		defer w.outbox.close()
+		defer w.inbox.close()
+		w.task.run(vm, main, valuesToAny(args))
+	}()
+	return w
+}
+
+func (w *Worker) String() string { return fmt.Sprintf("worker: %p", w) }
+
+// Post sends a copy of msg to the worker.
+func (w *Worker) Post(msg any) error {
+	c := &valueCopier{to: detachedEnv, seen: map[any]any{}}
+	detached, err := c.copy(ValueOf(msg))
+	if err != nil {
+		return err
+	}
+	return w.inbox.send(detached)
+}
+
+// Messages returns the messages that the worker posts. The channel is closed
+// once the worker ended. It is only for workers started with NewWorker, the
+// messages of a worker started by lua go to its on_message handler.
+func (w *Worker) Messages() <-chan any {
+	w.once.Do(func() {
+		w.messages = make(chan any)
+		go w.outbox.forward(w.messages)
+	})
+	return w.messages
+}
+
+// Close stops the worker from receiving messages. It ends once it has handled
+// the ones that it was already posted.
+func (w *Worker) Close() { w.inbox.close() }
+
+// Wait waits for the worker to end and returns the results of its file.
+func (w *Worker) Wait() ([]any, error) {
+	<-w.task.done
+	if w.task.failed {
+		return nil, w.task.err
+	}
+	return valuesToAny(w.task.res), nil
+}
+
+func newMailbox(loop *eventLoop) *mailbox {
+	return &mailbox{loop: loop, notify: make(chan struct{}, 1)}
+}
+
+// send queues a detached message and wakes whoever receives it.
+func (m *mailbox) send(msg Value) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return errWorkerClosed
+	}
+	m.queue = append(m.queue, msg)
+	m.mu.Unlock()
+	m.signal()
+	return nil
+}
+
+func (m *mailbox) close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	m.mu.Unlock()
+	m.signal()
+}
+
+func (m *mailbox) signal() {
+	if m.loop != nil {
+		m.loop.post(loopEvent{mailbox: m})
+		return
+	}
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take empties the queue and reports if the mailbox was closed, in which case
+// nothing will be queued after what it returned.
+func (m *mailbox) take() ([]Value, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msgs := m.queue
+	m.queue = nil
+	return msgs, m.closed
+}
+
+// listen sets the function that the loop calls with each message. The loop
+// keeps running while the mailbox is open.
+func (m *mailbox) listen(handler any) {
+	m.handler = handler
+	m.mu.Lock()
+	pending, closed := len(m.queue) > 0, m.closed
+	m.mu.Unlock()
+	if !m.listening && !closed {
+		m.listening = true
+		m.loop.waiting++
+	}
+	if pending {
+		m.loop.ready = append(m.loop.ready, loopEvent{mailbox: m})
+	}
+}
+
+// deliver spawns the handler of the mailbox on the loop for each message that
+// was posted to it. Messages wait in the mailbox until there is a handler.
+func (l *eventLoop) deliver(vm *VM, m *mailbox) error {
+	if m.handler == nil {
+		return nil
+	}
+	msgs, closed := m.take()
+	for _, msg := range msgs {
+		vals, err := vm.attach(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := l.spawn(vm, m.handler, []any{vals[0].Any()}); err != nil {
+			return err
+		}
+	}
+	if closed && m.listening {
+		m.listening = false
+		l.waiting--
+	}
+	return nil
+}
+
+// forward sends the messages posted to the mailbox to ch until it is closed.
+func (m *mailbox) forward(ch chan<- any) {
+	defer close(ch)
+	for {
+		msgs, closed := m.take()
+		for _, msg := range msgs {
+			ch <- msg.Any()
+		}
+		if closed {
+			return
+		} else if len(msgs) == 0 {
+			<-m.notify
+		}
+	}
+}
+
+func stdWorkerNew(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "worker.new", "string"); err != nil {
+		return nil, err
+	}
+	fn, err := parse.File(args[0].(string), parse.ModeText|parse.ModeBinary|vm.optimize.Mode())
+	if err != nil {
+		return nil, err
+	}
+	workerVM, err := vm.newTaskVM()
+	if err != nil {
+		return nil, err
+	}
+	c := &valueCopier{vm: workerVM, from: vm.env, to: workerVM.env, seen: map[any]any{}}
+	vals, err := c.copyAll(valuesOf(args[1:]))
+	if err != nil {
+		workerVM.cancel()
+		return nil, fmt.Errorf("worker.new: %w", err)
+	}
+	return []any{startWorker(workerVM, fn, vals, vm.loop)}, nil
+}
+
+func stdWorkerPost(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "worker:post", "worker", "~value"); err != nil {
+		return nil, err
+	}
+	return postMessage(vm, "worker:post", args[0].(*Worker).inbox, args[1:])
+}
+
+func stdWorkerOnMessage(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "worker:on_message", "worker", "function"); err != nil {
+		return nil, err
+	}
+	w := args[0].(*Worker)
+	if w.outbox.loop != vm.loop {
+		return nil, errors.New("worker was not started by this vm")
+	}
+	w.outbox.listen(args[1])
+	return []any{}, nil
+}
+
+func stdWorkerClose(_ *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "worker:close", "worker"); err != nil {
+		return nil, err
+	}
+	args[0].(*Worker).Close()
+	return []any{}, nil
+}
+
+func stdWorkerWait(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "worker:wait", "worker"); err != nil {
+		return nil, err
+	}
+	return args[0].(*Worker).task.wait(vm)
+}
+
+func stdWorkerParentPost(vm *VM, args []any) ([]any, error) {
+	if vm.worker == nil {
+		return nil, errNotInWorker
+	}
+	return postMessage(vm, "worker.post", vm.worker.outbox, args)
+}
+
+func stdWorkerParentOnMessage(vm *VM, args []any) ([]any, error) {
+	if err := assertArguments(args, "worker.on_message", "function"); err != nil {
+		return nil, err
+	} else if vm.worker == nil {
+		return nil, errNotInWorker
+	}
+	vm.worker.inbox.listen(args[0])
+	return []any{}, nil
+}
+
+// postMessage sends a detached copy of the first of args, the message, to box.
+func postMessage(vm *VM, name string, box *mailbox, args []any) ([]any, error) {
+	var msg any
+	if len(args) > 0 {
+		msg = args[0]
+	}
+	detached, err := vm.detach(ValueOf(msg))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return []any{}, box.send(detached[0])
+}
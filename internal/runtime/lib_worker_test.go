@@ -0,0 +1,78 @@
+package runtime
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWorker(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "worker.lua")
+	require.NoError(t, os.WriteFile(path, []byte(`
+		local worker = require("worker")
+		local name = ...
+		worker.on_message(function(msg)
+			if msg.fail then error(msg.fail, 0) end
+			local total = 0
+			for _, val in ipairs(msg.values) do
+				total = total + val
+			end
+			worker.post({ total = total, values = msg.values })
+		end)
+		return name .. " done"
+	`), 0o600))
+
+	t.Run("posts and receives messages", func(t *testing.T) {
+		t.Parallel()
+		w, err := NewWorker(context.Background(), path, "go")
+		require.NoError(t, err)
+		require.NoError(t, w.Post(NewTable([]any{}, map[any]any{"values": NewTable([]any{int64(1), int64(2)}, nil)})))
+		w.Close()
+		var totals []any
+		for msg := range w.Messages() {
+			totals = append(totals, msg.(*Table).getStr("total").Any())
+		}
+		assert.Equal(t, []any{int64(3)}, totals)
+		res, err := w.Wait()
+		require.NoError(t, err)
+		assert.Equal(t, []any{"go done"}, res)
+		require.ErrorIs(t, w.Post("late"), errWorkerClosed)
+	})
+
+	t.Run("shares frozen tables", func(t *testing.T) {
+		t.Parallel()
+		values := NewTable([]any{int64(1), int64(2), int64(3)}, nil)
+		require.NoError(t, values.freeze())
+		var wg sync.WaitGroup
+		for range 4 {
+			w, err := NewWorker(context.Background(), path, "shared")
+			require.NoError(t, err)
+			require.NoError(t, w.Post(NewTable(nil, map[any]any{"values": values})))
+			w.Close()
+			wg.Go(func() {
+				for msg := range w.Messages() {
+					assert.Equal(t, int64(6), msg.(*Table).getStr("total").Any())
+					assert.Same(t, values, msg.(*Table).getStr("values").Any())
+				}
+			})
+		}
+		wg.Wait()
+	})
+
+	t.Run("returns the error of the worker", func(t *testing.T) {
+		t.Parallel()
+		w, err := NewWorker(context.Background(), path, "failing")
+		require.NoError(t, err)
+		require.NoError(t, w.Post(NewTable(nil, map[any]any{"fail": "worker failed"})))
+		_, err = w.Wait()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "worker failed")
+	})
+}
@@ -0,0 +1,218 @@
+package runtime
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/tanema/luaf/internal/runtime/pprof"
+)
+
+type (
+	allocKind string
+	// MemProfile records the allocations made by lua code and attributes them
+	// to the lua source line and call stack that caused them. It is opt in
+	// because collecting call stacks on every allocation is slow. The numbers
+	// are estimates of what the values hold, not exact go heap usage.
+	MemProfile struct {
+		lock    sync.Mutex
+		start   time.Time
+		samples map[string]*allocSample
+	}
+	allocSample struct {
+		kind    allocKind
+		stack   []pprof.Frame
+		objects int64
+		bytes   int64
+	}
+)
+
+const (
+	allocTable   allocKind = "table"
+	allocClosure allocKind = "closure"
+	allocString  allocKind = "string"
+
+	pointerSize = int64(unsafe.Sizeof(uintptr(0)))
+	valueSize   = int64(unsafe.Sizeof(Value{}))
+	tableSize   = int64(unsafe.Sizeof(Table{}))
+	closureSize = int64(unsafe.Sizeof(Closure{}))
+	brokerSize  = int64(unsafe.Sizeof(upvalueBroker{}))
+	// a hash slot is the node holding the key and value plus the map entry that
+	// indexes it.
+	hashSlot = int64(unsafe.Sizeof(tableNode{})) + valueSize + pointerSize
+)
+
+// EnableMemProfile starts recording allocations on this vm, and any coroutines
+// created from it after this call.
+func (vm *VM) EnableMemProfile() *MemProfile {
+	if vm.memprof == nil {
+		vm.memprof = &MemProfile{start: time.Now(), samples: map[string]*allocSample{}}
+	}
+	return vm.memprof
+}
+
+// MemProfile returns the running memory profile or nil if it was never enabled.
+func (vm *VM) MemProfile() *MemProfile { return vm.memprof }
+
+// recordAlloc adds an allocation of size bytes to the running memory count and,
+// if profiling, attributes it to the current call stack. The innermost lua
+// frame uses the line of the instruction currently executing.
+func (vm *VM) recordAlloc(kind allocKind, size int64) {
+	if size <= 0 {
+		return
+	}
+	vm.gc.allocated.Add(size)
+	if vm.memprof == nil {
+		return
+	}
+	stack := make([]pprof.Frame, 0, vm.callDepth+1)
+	for d := vm.callDepth; d >= 0; d-- {
+		info := vm.callStack[d]
+		frame := pprof.Frame{Function: info.name, Filename: info.filename}
+		if info.filename != coreCallstackFilename {
+			if d == vm.callDepth {
+				frame.Line = vm.allocLine
+			} else {
+				frame.Line = vm.callStack[d+1].Line
+			}
+		}
+		if frame.Function == "" {
+			frame.Function = "<anonymous>"
+		}
+		stack = append(stack, frame)
+	}
+	vm.memprof.add(kind, stack, size)
+}
+
+// tableSet is tbl.Set but records any growth of the table. This is how Table.Set
+// growth is counted without the table needing a reference to the vm.
+func (vm *VM) tableSet(tbl *Table, key, value Value) error {
+	before := tbl.footprint()
+	err := tbl.set(key, value)
+	vm.recordAlloc(allocTable, tbl.footprint()-before)
+	return err
+}
+
+func (t *Table) footprint() int64 {
+	return int64(cap(t.val))*valueSize + int64(cap(t.nodes))*hashSlot
+}
+
+func (p *MemProfile) add(kind allocKind, stack []pprof.Frame, size int64) {
+	var key strings.Builder
+	key.WriteString(string(kind))
+	for _, frame := range stack {
+		fmt.Fprintf(&key, "|%s:%s:%d", frame.Function, frame.Filename, frame.Line)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s, ok := p.samples[key.String()]
+	if !ok {
+		s = &allocSample{kind: kind, stack: stack}
+		p.samples[key.String()] = s
+	}
+	s.objects++
+	s.bytes += size
+}
+
+func (p *MemProfile) sortedSamples() []*allocSample {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	samples := make([]*allocSample, 0, len(p.samples))
+	for _, s := range p.samples {
+		samples = append(samples, s)
+	}
+	slices.SortFunc(samples, func(a, b *allocSample) int { return cmp.Compare(b.bytes, a.bytes) })
+	return samples
+}
+
+// WritePprof writes the profile as a gzipped pprof heap profile so that it can
+// be inspected with `go tool pprof`. Each sample is labeled with the kind of
+// value that was allocated so it can be filtered with -tagfocus.
+func (p *MemProfile) WritePprof(w io.Writer) error {
+	builder := pprof.NewBuilder(
+		p.start,
+		pprof.ValueType{Type: "alloc_objects", Unit: "count"},
+		pprof.ValueType{Type: "alloc_space", Unit: "bytes"},
+	)
+	builder.SetDuration(time.Since(p.start))
+	for _, s := range p.sortedSamples() {
+		builder.AddSample(s.stack, []int64{s.objects, s.bytes}, map[string]string{"kind": string(s.kind)})
+	}
+	return builder.Write(w)
+}
+
+// WriteTop writes a text report of the n source lines that allocated the most.
+// Allocations made inside of builtin functions are attributed to the lua line
+// that called them.
+func (p *MemProfile) WriteTop(w io.Writer, n int) error {
+	type site struct {
+		kind     allocKind
+		location string
+		objects  int64
+		bytes    int64
+	}
+	sites := map[string]*site{}
+	var totalBytes, totalObjects int64
+	for _, s := range p.sortedSamples() {
+		location := "<unknown>"
+		for _, frame := range s.stack {
+			if frame.Filename != coreCallstackFilename {
+				location = fmt.Sprintf("%s (%s:%d)", frame.Function, frame.Filename, frame.Line)
+				break
+			}
+		}
+		key := string(s.kind) + location
+		if _, ok := sites[key]; !ok {
+			sites[key] = &site{kind: s.kind, location: location}
+		}
+		sites[key].objects += s.objects
+		sites[key].bytes += s.bytes
+		totalBytes += s.bytes
+		totalObjects += s.objects
+	}
+	sorted := make([]*site, 0, len(sites))
+	for _, s := range sites {
+		sorted = append(sorted, s)
+	}
+	slices.SortFunc(sorted, func(a, b *site) int {
+		if c := cmp.Compare(b.bytes, a.bytes); c != 0 {
+			return c
+		}
+		return strings.Compare(a.location, b.location)
+	})
+	if n > 0 && len(sorted) > n {
+		sorted = sorted[:n]
+	}
+
+	if _, err := fmt.Fprintf(w, "lua allocations: %v objects, %v total\n", totalObjects, fmtBytes(totalBytes)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%10s %8s %7s  %-8s %s\n", "bytes", "objects", "bytes%", "kind", "location"); err != nil {
+		return err
+	}
+	for _, s := range sorted {
+		pct := float64(s.bytes) / float64(max(totalBytes, 1)) * 100
+		if _, err := fmt.Fprintf(
+			w, "%10s %8d %6.2f%%  %-8s %s\n", fmtBytes(s.bytes), s.objects, pct, s.kind, s.location,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fmtBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2fKB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
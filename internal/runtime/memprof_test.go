@@ -0,0 +1,57 @@
+package runtime
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+func TestMemProfile(t *testing.T) {
+	t.Parallel()
+
+	src := `local function mk(n)
+  local t = {}
+  for i = 1, n do
+    t[i] = { i = i }
+  end
+  return t
+end
+local parts = mk(50)
+local str = string.rep("ab", 100)
+local fn = function() return parts, str end
+`
+	fn, err := parse.Parse("alloc.lua", strings.NewReader(src), parse.ModeText)
+	require.NoError(t, err)
+
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Nil(t, vm.MemProfile())
+	profile := vm.EnableMemProfile()
+	_, err = vm.Eval(fn)
+	require.NoError(t, err)
+
+	var top bytes.Buffer
+	require.NoError(t, profile.WriteTop(&top, 10))
+	report := top.String()
+	assert.Contains(t, report, "table    mk (alloc.lua:4)")
+	assert.Contains(t, report, "table    mk (alloc.lua:2)")
+	assert.Contains(t, report, "string   main (alloc.lua:9)")
+	assert.Contains(t, report, "closure  main (alloc.lua:10)")
+
+	var buf bytes.Buffer
+	require.NoError(t, profile.WritePprof(&buf))
+	zr, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	data, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "alloc_space")
+	assert.Contains(t, string(data), "alloc.lua")
+}
@@ -0,0 +1,274 @@
+// Package pprof writes profiles in the gzipped protocol buffer format understood
+// by `go tool pprof`. It only implements the small subset of profile.proto that
+// the runtime needs to describe lua call stacks, so that there is no dependency
+// on the full pprof library:
+//
+//	https://github.com/google/pprof/blob/main/proto/profile.proto
+//
+// Every lua function is recorded as a pprof Function and every line within it
+// as a Location, so the usual pprof views (top, list, web, flame graphs) work
+// against lua source files.
+package pprof
+
+import (
+	"compress/gzip"
+	"io"
+	"time"
+)
+
+type (
+	// ValueType describes the kind and unit of a sample value, for instance
+	// "alloc_space" in "bytes".
+	ValueType struct {
+		Type string
+		Unit string
+	}
+	// Frame is a single entry in a call stack.
+	Frame struct {
+		Function string
+		Filename string
+		Line     int64
+	}
+	// Builder accumulates samples and serializes them as a pprof profile.
+	Builder struct {
+		sampleTypes []ValueType
+		samples     []sample
+		strings     []string
+		stringIdx   map[string]int64
+		functions   map[fnKey]uint64
+		locations   map[locKey]uint64
+		fnOrder     []fnKey
+		locOrder    []locKey
+		start       time.Time
+		duration    time.Duration
+	}
+	sample struct {
+		locations []uint64
+		values    []int64
+		labels    map[string]string
+	}
+	fnKey struct {
+		name     string
+		filename string
+	}
+	locKey struct {
+		fn   uint64
+		line int64
+	}
+)
+
+// protobuf field numbers from profile.proto.
+const (
+	profileSampleType  = 1
+	profileSample      = 2
+	profileLocation    = 4
+	profileFunction    = 5
+	profileStringTable = 6
+	profileTimeNanos   = 9
+	profileDuration    = 10
+	profileDefaultType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+	sampleLabel      = 3
+
+	labelKey = 1
+	labelStr = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID       = 1
+	functionName     = 2
+	functionFilename = 4
+
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// NewBuilder creates a builder whose samples will carry one value per sample type.
+func NewBuilder(start time.Time, sampleTypes ...ValueType) *Builder {
+	return &Builder{
+		sampleTypes: sampleTypes,
+		strings:     []string{""}, // string_table[0] must always be ""
+		stringIdx:   map[string]int64{"": 0},
+		functions:   map[fnKey]uint64{},
+		locations:   map[locKey]uint64{},
+		start:       start,
+	}
+}
+
+// SetDuration records how long the profile was collecting for.
+func (b *Builder) SetDuration(d time.Duration) { b.duration = d }
+
+// AddSample adds a sample. The stack is ordered from the innermost frame (where
+// the sample happened) outward, matching the pprof convention. Values must be
+// ordered the same as the sample types given to NewBuilder.
+func (b *Builder) AddSample(stack []Frame, values []int64, labels map[string]string) {
+	locs := make([]uint64, len(stack))
+	for i, frame := range stack {
+		locs[i] = b.location(frame)
+	}
+	b.samples = append(b.samples, sample{locations: locs, values: values, labels: labels})
+}
+
+// Write serializes the profile gzipped to the writer.
+func (b *Builder) Write(w io.Writer) error {
+	// strings must all be interned before the string table is written out.
+	for _, st := range b.sampleTypes {
+		b.str(st.Type)
+		b.str(st.Unit)
+	}
+	for _, s := range b.samples {
+		for key, val := range s.labels {
+			b.str(key)
+			b.str(val)
+		}
+	}
+
+	var buf encoder
+	for _, st := range b.sampleTypes {
+		var vt encoder
+		vt.int(valueTypeType, b.str(st.Type))
+		vt.int(valueTypeUnit, b.str(st.Unit))
+		buf.msg(profileSampleType, vt)
+	}
+	for _, s := range b.samples {
+		var enc encoder
+		enc.packedUint(sampleLocationID, s.locations)
+		enc.packedInt(sampleValue, s.values)
+		for key, val := range s.labels {
+			var label encoder
+			label.int(labelKey, b.str(key))
+			label.int(labelStr, b.str(val))
+			enc.msg(sampleLabel, label)
+		}
+		buf.msg(profileSample, enc)
+	}
+	for i, key := range b.locOrder {
+		var line encoder
+		line.uint(lineFunctionID, key.fn)
+		line.int(lineLine, key.line)
+		var loc encoder
+		loc.uint(locationID, uint64(i+1))
+		loc.msg(locationLine, line)
+		buf.msg(profileLocation, loc)
+	}
+	for i, key := range b.fnOrder {
+		var fn encoder
+		fn.uint(functionID, uint64(i+1))
+		fn.int(functionName, b.stringIdx[key.name])
+		fn.int(functionFilename, b.stringIdx[key.filename])
+		buf.msg(profileFunction, fn)
+	}
+	for _, str := range b.strings {
+		buf.bytes(profileStringTable, []byte(str))
+	}
+	buf.int(profileTimeNanos, b.start.UnixNano())
+	buf.int(profileDuration, b.duration.Nanoseconds())
+	if len(b.sampleTypes) > 0 {
+		buf.int(profileDefaultType, b.str(b.sampleTypes[len(b.sampleTypes)-1].Type))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(buf.data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (b *Builder) str(s string) int64 {
+	if idx, ok := b.stringIdx[s]; ok {
+		return idx
+	}
+	b.strings = append(b.strings, s)
+	b.stringIdx[s] = int64(len(b.strings) - 1)
+	return b.stringIdx[s]
+}
+
+func (b *Builder) function(name, filename string) uint64 {
+	key := fnKey{name: name, filename: filename}
+	if id, ok := b.functions[key]; ok {
+		return id
+	}
+	b.str(name)
+	b.str(filename)
+	b.fnOrder = append(b.fnOrder, key)
+	b.functions[key] = uint64(len(b.fnOrder))
+	return b.functions[key]
+}
+
+func (b *Builder) location(frame Frame) uint64 {
+	key := locKey{fn: b.function(frame.Function, frame.Filename), line: frame.Line}
+	if id, ok := b.locations[key]; ok {
+		return id
+	}
+	b.locOrder = append(b.locOrder, key)
+	b.locations[key] = uint64(len(b.locOrder))
+	return b.locations[key]
+}
+
+// encoder is a minimal protobuf wire format writer.
+type encoder struct {
+	data []byte
+}
+
+func (e *encoder) varint(x uint64) {
+	for x >= 0x80 {
+		e.data = append(e.data, byte(x)|0x80)
+		x >>= 7
+	}
+	e.data = append(e.data, byte(x))
+}
+
+func (e *encoder) key(field, wire int) {
+	e.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (e *encoder) uint(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	e.key(field, wireVarint)
+	e.varint(x)
+}
+
+func (e *encoder) int(field int, x int64) {
+	if x == 0 {
+		return
+	}
+	e.key(field, wireVarint)
+	e.varint(uint64(x))
+}
+
+func (e *encoder) bytes(field int, b []byte) {
+	e.key(field, wireBytes)
+	e.varint(uint64(len(b)))
+	e.data = append(e.data, b...)
+}
+
+func (e *encoder) msg(field int, m encoder) {
+	e.bytes(field, m.data)
+}
+
+func (e *encoder) packedUint(field int, xs []uint64) {
+	var packed encoder
+	for _, x := range xs {
+		packed.varint(x)
+	}
+	e.bytes(field, packed.data)
+}
+
+func (e *encoder) packedInt(field int, xs []int64) {
+	var packed encoder
+	for _, x := range xs {
+		packed.varint(uint64(x))
+	}
+	e.bytes(field, packed.data)
+}
@@ -16,11 +16,12 @@ import (
 // REPL will start an interactive repl parsing and running lua code.
 func (vm *VM) REPL() error {
 	fn := parse.NewEmptyFnProto("<repl>", nil)
-	ifn, err := vm.push(&Closure{val: fn})
+	proto := newFnProto(fn)
+	ifn, err := vm.push(&Closure{val: proto})
 	if err != nil {
 		return err
 	}
-	f := vm.newEnvFrame(fn, ifn+1, nil)
+	f := vm.newEnvFrame(proto, ifn+1, nil)
 	return vm.repl(f)
 }
 
@@ -54,7 +55,7 @@ func (vm *VM) repl(f *frame) error {
 			continue
 		}
 
-		replFn, err := parse.TryStat(buf.String(), f.fn)
+		replFn, err := parse.TryStat(buf.String(), f.fn.FnProto)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				rl.SetPrompt("...> ")
@@ -85,7 +86,8 @@ func (vm *VM) repl(f *frame) error {
 // upvalue brokers from ctx so that locals and upvalues of the calling scope are
 // accessible. This is the same broker construction the CLOSURE opcode uses.
 func (vm *VM) evalInContext(replFn *parse.FnProto, ctx *frame) ([]any, error) {
-	ifn, err := vm.push(&Closure{val: replFn})
+	proto := newFnProto(replFn)
+	ifn, err := vm.push(&Closure{val: proto})
 	if err != nil {
 		return nil, err
 	}
@@ -104,5 +106,5 @@ func (vm *VM) evalInContext(replFn *parse.FnProto, ctx *frame) ([]any, error) {
 			upvals[i] = ctx.upvals[idx.Index]
 		}
 	}
-	return vm.eval(vm.newFrame(replFn, ifn+1, 0, upvals, vm.vmargs...), true)
+	return vm.eval(vm.newFrame(proto, ifn+1, 0, upvals, vm.vmargs...), true)
 }
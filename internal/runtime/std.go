@@ -18,38 +18,39 @@ import (
 
 var (
 	// WarnEnabled is the flag that will toggle warn messages, it can be toggled with the Warn() function.
-	WarnEnabled  = false
+	WarnEnabled = false
+	// OrderedPairs makes tables created by new vms iterate in the order that their
+	// keys were first inserted. It can also be enabled per vm with EnableOrderedPairs.
+	OrderedPairs = false
 	libsLoaded   = false
 	libLoaderMux sync.Mutex
 	_ENVName     = "_ENV"
 )
 
 func createDefaultEnv(withLibs bool) *Table {
-	env := &Table{
-		hashtable: map[any]any{
-			"_LUAF_ENV":      true, // a variable to help check compatibility.
-			"HOST_OS":        runtime.GOOS,
-			"HOST_ARCH":      runtime.GOARCH,
-			"_VERSION":       conf.LUAVERSION,
-			"collectgarbage": Fn("collectgarbage", stdCollectgarbage),
-			"error":          Fn("error", stdError),
-			"getmetatable":   Fn("getmetatable", stdGetMetatable),
-			"load":           Fn("load", stdLoad),
-			"next":           Fn("next", stdNext),
-			"rawequal":       Fn("rawequal", stdRawEq),
-			"rawget":         Fn("rawget", stdRawGet),
-			"rawlen":         Fn("rawlen", stdRawLen),
-			"rawset":         Fn("rawset", stdRawSet),
-			"require":        Fn("require", stdRequire),
-			"setmetatable":   Fn("setmetatable", stdSetMetatable),
-			"tonumber":       Fn("tonumber", stdToNumber),
-			"tostring":       Fn("tostring", stdToString),
-			"type":           Fn("type", stdType),
-			"warn":           Fn("warn", stdWarn),
-			"xpcall":         Fn("xpcall", stdXPCall),
-			"package":        stdPackageLib,
-		},
-	}
+	env := NewTable(nil, map[any]any{
+		"_LUAF_ENV":      true, // a variable to help check compatibility.
+		"HOST_OS":        runtime.GOOS,
+		"HOST_ARCH":      runtime.GOARCH,
+		"_VERSION":       conf.LUAVERSION,
+		"collectgarbage": builtinFn("collectgarbage", stdCollectgarbage),
+		"error":          builtinFn("error", stdError),
+		"getmetatable":   builtinFn("getmetatable", stdGetMetatable),
+		"load":           builtinFn("load", stdLoad),
+		"next":           builtinFn("next", stdNext),
+		"rawequal":       builtinFn("rawequal", stdRawEq),
+		"rawget":         builtinFn("rawget", stdRawGet),
+		"rawlen":         builtinFn("rawlen", stdRawLen),
+		"rawset":         builtinFn("rawset", stdRawSet),
+		"require":        builtinFn("require", stdRequire),
+		"setmetatable":   builtinFn("setmetatable", stdSetMetatable),
+		"tonumber":       builtinFn("tonumber", stdToNumber),
+		"tostring":       builtinFn("tostring", stdToString),
+		"type":           builtinFn("type", stdType),
+		"warn":           builtinFn("warn", stdWarn),
+		"xpcall":         builtinFn("xpcall", stdXPCall),
+		"package":        stdPackageLib,
+	})
 	libLoaderMux.Lock()
 	if withLibs && !libsLoaded {
 		stdPkgFactories := map[string]func() *Table{
@@ -63,15 +64,15 @@ func createDefaultEnv(withLibs bool) *Table {
 			"utf8":      createUtf8Lib,
 		}
 		for name, fact := range stdPkgFactories {
-			lib := fact()
-			env.hashtable[name] = lib
-			loadedPackages.hashtable[name] = lib
+			lib := tableValue(fact())
+			env.setStr(name, lib)
+			loadedPackages.setStr(name, lib)
 		}
 		libsLoaded = true
 	} else if withLibs && libsLoaded {
 		stdPkgs := []string{"coroutine", "debug", "io", "math", "os", "string", "table", "utf8"}
 		for _, name := range stdPkgs {
-			env.hashtable[name] = loadedPackages.hashtable[name]
+			env.setStr(name, loadedPackages.getStr(name))
 		}
 	}
 	libLoaderMux.Unlock()
@@ -87,19 +88,26 @@ func stdCollectgarbage(vm *VM, args []any) ([]any, error) {
 		mode = args[0].(string)
 	}
 	switch mode {
-	case "collect", "step":
-		runtime.GC()
+	case "collect":
+		vm.collectGarbage()
+	case "step":
+		// every step is a full collection so it always finishes a cycle.
+		vm.collectGarbage()
+		return []any{true}, nil
 	case "stop":
-		vm.gcOff = true
+		vm.StopGC()
 	case "restart":
-		vm.gcOff = false
+		vm.RestartGC()
 	case "count":
-		var m runtime.MemStats
-		runtime.ReadMemStats(&m)
-		return []any{int64(m.TotalAlloc / 1024)}, nil
+		return []any{float64(vm.MemCount()) / 1024}, nil
 	case "isrunning":
-		return []any{!vm.gcOff}, nil
-	case "incremental", "generational":
+		return []any{!vm.gc.stopped}, nil
+	case gcModeIncremental, gcModeGenerational:
+		prev := vm.gc.mode
+		vm.gc.mode = mode
+		return []any{prev}, nil
+	default:
+		return nil, argumentErr(1, "collectgarbage", fmt.Errorf("invalid option '%s'", mode))
 	}
 	return []any{}, nil
 }
@@ -155,72 +163,54 @@ func stdType(_ *VM, args []any) ([]any, error) {
 	return []any{typeName(args[0])}, nil
 }
 
-func stdNext(vm *VM, args []any) ([]any, error) {
+func stdNext(_ *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "next", "table", "~value"); err != nil {
 		return nil, err
 	}
 
-	table := args[0].(*Table)
-	hashKeys := table.Keys()
-
-	allKeys := make([]any, 0, len(table.val)+len(hashKeys))
-	for i := 1; i <= len(table.val); i++ {
-		if table.val[i-1] != nil {
-			allKeys = append(allKeys, int64(i))
-		}
+	var key Value
+	if len(args) > 1 {
+		key = ValueOf(args[1])
 	}
-	allKeys = append(allKeys, hashKeys...)
-
-	if len(allKeys) == 0 {
+	nextKey, val, err := args[0].(*Table).next(key)
+	if err != nil {
+		return nil, err
+	} else if nextKey.isNil() {
 		return []any{nil}, nil
 	}
-
-	var toFind any
-	if len(args) > 1 {
-		toFind = args[1]
-	}
-	if toFind == nil {
-		key := allKeys[0]
-		val, _ := vm.index(table, nil, key)
-		return []any{key, val}, nil
-	}
-	for i, key := range allKeys {
-		if key == toKey(toFind) {
-			if i < len(allKeys)-1 {
-				tkey := allKeys[i+1]
-				val, _ := vm.index(table, nil, tkey)
-				return []any{tkey, val}, nil
-			}
-			break
-		}
-	}
-	return []any{nil}, nil
+	return []any{nextKey.Any(), val.Any()}, nil
 }
 
-func stdSetMetatable(_ *VM, args []any) ([]any, error) {
+func stdSetMetatable(vm *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "setmetatable", "table", "~table"); err != nil {
 		return nil, err
 	}
-	if method := findMetavalue(parse.MetaMeta, args[0]); method != nil {
+	if method := vm.findMetavalue(parse.MetaMeta, args[0]); method != nil {
 		return nil, errors.New("cannot set a metatable on a table with the __metatable metamethod defined")
 	}
 	table := args[0].(*Table)
+	if table.frozen {
+		return nil, errFrozenTable
+	}
+	var metatable *Table
 	if len(args) > 1 {
-		table.metatable = args[1].(*Table)
-	} else {
-		table.metatable = nil
+		metatable, _ = args[1].(*Table)
+	}
+	table.setMetatable(metatable)
+	if metatable != nil && !metatable.getStr(string(parse.MetaGC)).isNil() {
+		vm.gc.mark(table)
 	}
 	return []any{table}, nil
 }
 
-func stdGetMetatable(_ *VM, args []any) ([]any, error) {
+func stdGetMetatable(vm *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "getmetatable", "value"); err != nil {
 		return nil, err
 	}
-	if method := findMetavalue(parse.MetaMeta, args[0]); method != nil {
+	if method := vm.findMetavalue(parse.MetaMeta, args[0]); method != nil {
 		return []any{method}, nil
 	}
-	metatable := getMetatable(args[0])
+	metatable := vm.getMetatable(args[0])
 	if metatable == nil {
 		return []any{nil}, nil
 	}
@@ -269,12 +259,19 @@ func stdXPCall(vm *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "xpcall", "function|table", "function|table"); err != nil {
 		return nil, err
 	}
-	values, err := vm.call(args[0], args[2:])
-	if err != nil {
-		res, err := vm.call(args[1], []any{getErrVal(err)})
-		return append([]any{false}, res...), err
+	handler := args[1]
+	finish := func(vm *VM, res []any, err error) ([]any, error) {
+		if err != nil {
+			res, err := vm.call(handler, []any{getErrVal(err)})
+			return append([]any{false}, res...), err
+		}
+		return append([]any{true}, res...), nil
+	}
+	res, err := vm.PCallK(args[0], args[2:], finish)
+	if isYield(err) {
+		return nil, err
 	}
-	return append([]any{true}, values...), nil
+	return finish(vm, res, err)
 }
 
 func stdRawGet(_ *VM, args []any) ([]any, error) {
@@ -288,11 +285,11 @@ func stdRawGet(_ *VM, args []any) ([]any, error) {
 	return []any{res}, nil
 }
 
-func stdRawSet(_ *VM, args []any) ([]any, error) {
+func stdRawSet(vm *VM, args []any) ([]any, error) {
 	if err := assertArguments(args, "rawset", "table", "value", "value"); err != nil {
 		return nil, err
 	}
-	return []any{}, args[0].(*Table).Set(args[1], args[2])
+	return []any{}, vm.tableSet(args[0].(*Table), ValueOf(args[1]), ValueOf(args[2]))
 }
 
 func stdRawEq(_ *VM, args []any) ([]any, error) {
@@ -329,7 +326,7 @@ func stdRawLen(_ *VM, args []any) ([]any, error) {
 	case string:
 		return []any{int64(len(tval))}, nil
 	case *Table:
-		return []any{int64(len(tval.val))}, nil
+		return []any{tval.length()}, nil
 	}
 	return []any{}, nil
 }
@@ -381,12 +378,12 @@ func stdLoad(vm *VM, args []any) ([]any, error) {
 		env = args[3]
 	}
 
-	fn, err := parse.Parse(chunkname, strings.NewReader(src), mode)
+	fn, err := parse.Parse(chunkname, strings.NewReader(src), mode|vm.optimize.Mode())
 	var retVals []any
 	if err != nil {
 		retVals = []any{nil, err.Error()}
 	} else {
-		retVals = []any{&Closure{val: fn, upvalues: loadedChunkUpvalues(fn, env)}}
+		retVals = []any{&Closure{val: newFnProto(fn), upvalues: loadedChunkUpvalues(fn, env)}}
 	}
 	return retVals, nil
 }
@@ -395,7 +392,7 @@ func loadedChunkUpvalues(fn *parse.FnProto, env any) []*upvalueBroker {
 	upvalues := make([]*upvalueBroker, len(fn.UpIndexes))
 	for i, idx := range fn.UpIndexes {
 		if idx.Name == _ENVName {
-			upvalues[i] = &upvalueBroker{name: _ENVName, val: env}
+			upvalues[i] = &upvalueBroker{name: _ENVName, val: ValueOf(env)}
 		} else {
 			upvalues[i] = &upvalueBroker{name: idx.Name}
 		}
@@ -408,8 +405,14 @@ func assertArguments(args []any, methodName string, assertions ...string) error
 		optional := strings.HasPrefix(assertion, "~")
 		expectedTypes := strings.Split(strings.TrimPrefix(assertion, "~"), "|")
 		if i >= len(args) || (optional && args[i] == nil) {
-			if !optional {
-				return argumentErr(i+1, methodName, fmt.Errorf("%v expected", assertion))
+			if !optional && assertion == "value" {
+				return argumentErr(i+1, methodName, errors.New("value expected"))
+			} else if !optional {
+				return argumentErr(
+					i+1,
+					methodName,
+					fmt.Errorf("%v expected, got no value", displayTypeNames(expectedTypes)),
+				)
 			}
 			continue
 		} else if strings.TrimPrefix(assertion, "~") == "value" {
@@ -0,0 +1,548 @@
+package runtime
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+	"strings"
+	"unsafe"
+)
+
+type (
+	// Table is a container object in lua that acts both as an array and a map
+	// It is used duing runtime but cal also be changed in go code.
+	//
+	// Like the reference implementation it is split into an array part and a hash
+	// part. Every integer key from 1 up to the capacity of the array part lives in
+	// the array, the length of val is the last non-nil index in it. Everything else
+	// lives in nodes, which keeps insertion order, while hash maps the key to its
+	// slot in nodes. Removing a key only clears the slot value so that next can
+	// continue from a removed key during traversal. Removed slots are reclaimed
+	// when the hash part is full and the table is rehashed.
+	//
+	// Ordered tables iterate in the order that keys were first inserted. They
+	// only extend the array part while the hash part is empty, so integer keys
+	// set after any other key stay in the hash part and rehashing never moves
+	// them.
+	//
+	// Weak tables store collectable keys and values as weak references that read
+	// as nil once collected. Those slots are treated as removed and are dropped
+	// when the table is rehashed.
+	//
+	// Frozen tables cannot be changed. Since reading a table never changes it,
+	// they are shared between vms on different goroutines instead of copied.
+	Table struct {
+		val        []Value
+		hash       map[tableKey]int
+		nodes      []tableNode
+		metatable  *Table
+		ephemerons ephemerons
+		ordered    bool
+		frozen     bool
+		mode       weakMode
+	}
+	tableNode struct {
+		key Value
+		val Value
+	}
+	// tableKey is the comparable form of a key in the hash part. Strings compare
+	// by their bytes and boxed go values by the value they hold rather than by
+	// where they are kept.
+	tableKey struct {
+		ref  any
+		str  string
+		ptr  unsafe.Pointer
+		n    uint64
+		kind valueKind
+	}
+)
+
+var errFrozenTable = errors.New("attempt to modify a frozen table")
+
+// maxArrayBits limits the array part to 2^26 slots, any integer keys past that
+// will stay in the hash part.
+const maxArrayBits = 26
+
+// NewTable will create a new table with default values contained in it. Since
+// lua tables act as both array and map, both can be passed in to set the values.
+// The hash values are inserted in sorted key order so that iterating the table
+// is the same on every run.
+func NewTable(arr []any, hash map[any]any) *Table {
+	tbl := newEmptyTable(0, int64(len(hash)))
+	tbl.val = valuesOf(arr)
+	tbl.val = tbl.val[:tbl.border()]
+	keys := make([]Value, 0, len(hash))
+	for key := range hash {
+		keys = append(keys, ValueOf(key))
+	}
+	slices.SortFunc(keys, compareKeys)
+	for _, key := range keys {
+		_ = tbl.set(key, ValueOf(hash[key.Any()]))
+	}
+	return tbl
+}
+
+// compareKeys orders keys by kind and then by value for numbers and strings.
+// Other keys have no meaningful order and compare as equal.
+func compareKeys(l, r Value) int {
+	if l.kind != r.kind {
+		return cmp.Compare(l.kind, r.kind)
+	}
+	switch l.kind {
+	case kindInt:
+		return cmp.Compare(l.int(), r.int())
+	case kindFloat:
+		return cmp.Compare(l.float(), r.float())
+	case kindString:
+		return strings.Compare(l.str(), r.str())
+	case kindBool:
+		return cmp.Compare(l.n, r.n)
+	default:
+		return 0
+	}
+}
+
+// newEmptyTable creates a table with space preallocated for nseq sequence values
+// and nrec other values, these are the sizes that NEWTABLE and table.create pass.
+func newEmptyTable(nseq, nrec int64) *Table {
+	return &Table{
+		val:   make([]Value, 0, min(max(nseq, 0), 1<<maxArrayBits)),
+		hash:  make(map[tableKey]int, max(nrec, 0)),
+		nodes: make([]tableNode, 0, max(nrec, 0)),
+	}
+}
+
+func (t *Table) String() string {
+	return fmt.Sprintf("table: %p", t)
+}
+
+// Keys returns the keys stored in the hash part of the table in iteration order.
+func (t *Table) Keys() []any {
+	keys := make([]any, 0, len(t.nodes))
+	for _, node := range t.nodes {
+		if t.live(node) {
+			keys = append(keys, load(node.key).Any())
+		}
+	}
+	return keys
+}
+
+// Get will return the value for the key. If it is an int it will get it from the
+// array store, otherwise the map. Nil keys are not allowed.
+func (t *Table) Get(key any) (any, error) {
+	val, err := t.get(ValueOf(key))
+	return val.Any(), err
+}
+
+// Set will set a value at a given key. If the key is an int64, it will place it
+// in array-like storage. Otherwise it will be put in a map. Nil keys are not
+// allowed.
+func (t *Table) Set(key, val any) error {
+	return t.set(ValueOf(key), ValueOf(val))
+}
+
+// Len returns a border of the table, the same value as the # operator without
+// calling the __len metamethod.
+func (t *Table) Len() int64 { return t.length() }
+
+// normKey converts float keys with an integer value to integers so that t[1] and
+// t[1.0] refer to the same value.
+func normKey(key Value) Value {
+	if key.kind == kindFloat {
+		if i, ok := floatToIntExact(key.float()); ok {
+			return intValue(i)
+		}
+	}
+	return key
+}
+
+func (t *Table) get(key Value) (Value, error) {
+	switch key.kind {
+	case kindNil:
+		return nilValue, errors.New("table index is nil")
+	case kindInt:
+		return t.geti(key.int()), nil
+	case kindFloat:
+		if i, ok := floatToIntExact(key.float()); ok {
+			return t.geti(i), nil
+		}
+	}
+	return t.getHash(key), nil
+}
+
+// geti is the fast path for integer keys.
+func (t *Table) geti(i int64) Value {
+	if uint64(i-1) < uint64(len(t.val)) {
+		if t.mode&weakValues != 0 {
+			return load(t.val[i-1])
+		}
+		return t.val[i-1]
+	} else if !t.ordered && uint64(i-1) < uint64(cap(t.val)) {
+		return nilValue
+	}
+	return t.getHash(intValue(i))
+}
+
+// getStr is the fast path for string keys, mostly used for metamethod lookups.
+func (t *Table) getStr(key string) Value {
+	return t.getHash(strValue(key))
+}
+
+func (t *Table) getHash(key Value) Value {
+	if t.mode != 0 {
+		return t.getWeakHash(key)
+	} else if slot, ok := t.hash[key.key()]; ok {
+		return t.nodes[slot].val
+	}
+	return nilValue
+}
+
+func (t *Table) set(key, val Value) error {
+	if t.frozen {
+		return errFrozenTable
+	}
+	switch key.kind {
+	case kindNil:
+		return errors.New("table index is nil")
+	case kindInt:
+		t.seti(key.int(), val)
+		return nil
+	case kindFloat:
+		if i, ok := floatToIntExact(key.float()); ok {
+			t.seti(i, val)
+			return nil
+		} else if math.IsNaN(key.float()) {
+			return errors.New("table index is NaN")
+		}
+	}
+	t.setHash(key, val)
+	return nil
+}
+
+// seti is the fast path for integer keys.
+func (t *Table) seti(i int64, val Value) {
+	if t.mode&weakValues != 0 {
+		val = weaken(val)
+	}
+	switch {
+	case uint64(i-1) < uint64(len(t.val)):
+		t.setArray(i, val)
+	case t.ordered && (len(t.nodes) > 0 || i != int64(len(t.val))+1):
+		t.setHash(intValue(i), val)
+	case uint64(i-1) < uint64(cap(t.val)):
+		t.setArray(i, val)
+	case i == int64(cap(t.val))+1 && !val.isNil() && i <= 1<<maxArrayBits:
+		t.resizeArray(max(2*i-2, 4))
+		t.setArray(i, val)
+	default:
+		t.setHash(intValue(i), val)
+	}
+}
+
+// setStr is the fast path for string keys.
+func (t *Table) setStr(key string, val Value) {
+	t.setHash(strValue(key), val)
+}
+
+// setArray sets a value within the capacity of the array part, keeping the
+// length of val at the last non-nil value.
+func (t *Table) setArray(i int64, val Value) {
+	n := int64(len(t.val))
+	switch {
+	case i <= n:
+		t.val[i-1] = val
+		if i == n && val.isNil() {
+			for n > 0 && t.val[n-1].isNil() {
+				n--
+			}
+			t.val = t.val[:n]
+		}
+	case !val.isNil():
+		// everything past the length is always nil so only reslicing is needed.
+		t.val = t.val[:i]
+		t.val[i-1] = val
+	}
+}
+
+func (t *Table) setHash(key, val Value) {
+	if t.mode != 0 {
+		t.setWeakHash(key, val)
+		return
+	} else if slot, ok := t.hash[key.key()]; ok {
+		t.nodes[slot].val = val
+		return
+	} else if val.isNil() {
+		return
+	}
+	t.insertHash(key, val)
+}
+
+// insertHash adds a key that is not in the hash part yet.
+func (t *Table) insertHash(key, val Value) {
+	if t.hash == nil {
+		t.hash = map[tableKey]int{}
+	}
+	if len(t.nodes) == cap(t.nodes) {
+		t.rehash(key)
+		if !t.ordered && key.kind == kindInt && uint64(key.int()-1) < uint64(cap(t.val)) {
+			t.setArray(key.int(), val)
+			return
+		}
+	}
+	t.hash[key.key()] = len(t.nodes)
+	t.nodes = append(t.nodes, tableNode{key: key, val: val})
+}
+
+// rehash is called when the hash part is full. It will size the array part so
+// that more than half of it is in use, move any integer keys that now fit into
+// the array, and drop removed slots from the hash part. The key that is about
+// to be inserted is counted so that it can land in the array part.
+func (t *Table) rehash(newKey Value) {
+	if t.ordered {
+		t.compact()
+		return
+	}
+	var nums [maxArrayBits + 1]int64
+	total := countIntKeys(&nums, newKey)
+	for i, val := range t.val {
+		if !val.isNil() {
+			total += countIntKeys(&nums, intValue(int64(i+1)))
+		}
+	}
+	for _, node := range t.nodes {
+		if !node.val.isNil() {
+			total += countIntKeys(&nums, node.key)
+		}
+	}
+	if size := computeArraySize(&nums, total); size > int64(cap(t.val)) {
+		t.resizeArray(size)
+	}
+	t.compact()
+}
+
+// compact drops removed slots from the hash part, keeping the order of the
+// remaining ones, and leaves room for as many new keys as there are live ones.
+func (t *Table) compact() {
+	live := 0
+	for _, node := range t.nodes {
+		if t.live(node) {
+			live++
+		}
+	}
+	nodes := make([]tableNode, 0, max(2*live, 4))
+	clear(t.hash)
+	for _, node := range t.nodes {
+		if t.live(node) {
+			t.hash[node.key.key()] = len(nodes)
+			nodes = append(nodes, node)
+		}
+	}
+	t.nodes = nodes
+}
+
+// resizeArray grows the array part to size and moves any integer keys in the
+// hash part that now fit into it.
+func (t *Table) resizeArray(size int64) {
+	oldCap := int64(cap(t.val))
+	arr := make([]Value, len(t.val), size)
+	copy(arr, t.val)
+	t.val = arr
+	if len(t.hash) == 0 {
+		return
+	}
+	for i := oldCap + 1; i <= size; i++ {
+		key := intValue(i)
+		if slot, ok := t.hash[key.key()]; ok {
+			// the slot is left behind as a removed value so that a traversal that
+			// is currently on it can continue.
+			t.setArray(i, t.nodes[slot].val)
+			t.nodes[slot].val = nilValue
+		}
+	}
+}
+
+// ensureArray grows the array part so that it can hold at least size values
+// without needing to rehash.
+func (t *Table) ensureArray(size int64) {
+	if size > int64(cap(t.val)) && size <= 1<<maxArrayBits {
+		t.resizeArray(size)
+	}
+}
+
+// countIntKeys counts key into the power of 2 slice of the array it would fall
+// into if it is a candidate for the array part.
+func countIntKeys(nums *[maxArrayBits + 1]int64, key Value) int64 {
+	if key.kind != kindInt || key.int() < 1 || key.int() > 1<<maxArrayBits {
+		return 0
+	}
+	nums[bits.Len64(uint64(key.int()-1))]++
+	return 1
+}
+
+// computeArraySize finds the largest power of 2, n, where more than half of the
+// slots 1 to n would be in use.
+func computeArraySize(nums *[maxArrayBits + 1]int64, total int64) int64 {
+	var size, count int64
+	for i := range nums {
+		twotoi := int64(1) << i
+		if twotoi/2 >= total {
+			break
+		}
+		count += nums[i]
+		if count > twotoi/2 {
+			size = twotoi
+		}
+	}
+	return size
+}
+
+// length returns a border in the table, an index where t[n] is not nil and
+// t[n+1] is nil, or zero if t[1] is nil.
+func (t *Table) length() int64 {
+	if t.mode&weakValues != 0 {
+		t.trimArray()
+	}
+	n := int64(len(t.val))
+	if (!t.ordered && n < int64(cap(t.val))) || len(t.hash) == 0 || t.getHash(intValue(n+1)).isNil() {
+		return n
+	}
+	// the array is full and the border continues into the hash part, so find an
+	// upper bound that is nil and do a binary search between the two.
+	i, j := n+1, n+2
+	for !t.getHash(intValue(j)).isNil() {
+		i = j
+		if j > math.MaxInt64/2 {
+			// the table was built to be malicious so just do a linear search.
+			for k := int64(1); ; k++ {
+				if t.geti(k).isNil() {
+					return k - 1
+				}
+			}
+		}
+		j *= 2
+	}
+	for j-i > 1 {
+		m := i + (j-i)/2
+		if t.getHash(intValue(m)).isNil() {
+			j = m
+		} else {
+			i = m
+		}
+	}
+	return i
+}
+
+// trimArray drops collected values from the end of the array part of a table
+// with weak values so that its length is at the last live value.
+func (t *Table) trimArray() {
+	n := len(t.val)
+	for n > 0 && load(t.val[n-1]).isNil() {
+		n--
+		t.val[n] = nilValue
+	}
+	t.val = t.val[:n]
+}
+
+// border is only used when val has been filled directly, like when it is created,
+// to find the last non-nil value in the array.
+func (t *Table) border() int {
+	n := len(t.val)
+	for n > 0 && t.val[n-1].isNil() {
+		n--
+	}
+	return n
+}
+
+// next returns the key and value after key in traversal order, the array part
+// first and then the hash part. A nil key starts the traversal and a nil key is
+// returned at the end of it.
+func (t *Table) next(key Value) (Value, Value, error) {
+	key = normKey(key)
+	var i, slot int
+	keySlot, inHash := t.hash[t.hashKey(key).key()]
+	switch {
+	case key.isNil():
+	case key.kind == kindInt && uint64(key.int()-1) < uint64(cap(t.val)) && (!t.ordered || !inHash):
+		i = int(key.int())
+	case inHash:
+		i, slot = len(t.val), keySlot+1
+	default:
+		return nilValue, nilValue, errors.New("invalid key to 'next'")
+	}
+	for ; i < len(t.val); i++ {
+		if val := t.geti(int64(i + 1)); !val.isNil() {
+			return intValue(int64(i + 1)), val, nil
+		}
+	}
+	for ; slot < len(t.nodes); slot++ {
+		if node := t.nodes[slot]; t.live(node) {
+			return load(node.key), load(node.val), nil
+		}
+	}
+	return nilValue, nilValue, nil
+}
+
+// freeze makes the table, and every table reachable from it including their
+// metatables, read only. Frozen tables are shared between goroutines so they can
+// only hold values that are safe to share, which leaves out lua functions since
+// their upvalues can change, and go functions other than the builtin ones.
+// Nothing is frozen if any of the tables cannot be.
+func (t *Table) freeze() error {
+	tables := map[*Table]bool{}
+	if err := t.freezable(tables); err != nil {
+		return err
+	}
+	for tbl := range tables {
+		tbl.frozen = true
+	}
+	return nil
+}
+
+// sharedMetatable creates a metatable that every vm shares, like the one for
+// tasks. It is frozen since vms on other goroutines can reach it.
+func sharedMetatable(hash map[any]any) *Table {
+	tbl := NewTable(nil, hash)
+	if err := tbl.freeze(); err != nil {
+		panic(err)
+	}
+	return tbl
+}
+
+// freezable collects the tables that freezing t also freezes.
+func (t *Table) freezable(tables map[*Table]bool) error {
+	if t.frozen || tables[t] {
+		return nil
+	} else if t.mode != 0 {
+		return errors.New("cannot freeze a weak table")
+	}
+	tables[t] = true
+	for key, val, _ := t.next(nilValue); !key.isNil(); key, val, _ = t.next(key) {
+		for _, v := range [2]Value{key, val} {
+			switch ref := v.ref().(type) {
+			case *Table:
+				if err := ref.freezable(tables); err != nil {
+					return err
+				}
+			case *Closure:
+				return errors.New("cannot freeze a table holding a lua function")
+			case *GoFunc:
+				// go functions made at runtime, like coroutine.wrap, can hold lua values.
+				if !ref.builtin {
+					return errors.New("cannot freeze a table holding a go function that is not builtin")
+				}
+			case *Channel, *Task:
+			default:
+				if v.kind == kindOther {
+					return fmt.Errorf("cannot freeze a table holding a %s", typeName(ref))
+				}
+			}
+		}
+	}
+	if t.metatable != nil {
+		return t.metatable.freezable(tables)
+	}
+	return nil
+}
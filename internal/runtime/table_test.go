@@ -0,0 +1,174 @@
+package runtime
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+func TestTable_Rehash(t *testing.T) {
+	t.Parallel()
+
+	tbl := NewTable(nil, nil)
+	for i := int64(100); i > 0; i-- {
+		tbl.seti(i, intValue(i))
+	}
+	assert.Len(t, tbl.val, 100)
+	assert.Empty(t, tbl.Keys())
+	assert.Equal(t, int64(100), tbl.length())
+
+	tbl = NewTable(nil, nil)
+	tbl.seti(2, intValue(2))
+	tbl.setStr("x", boolValue(true))
+	assert.Empty(t, tbl.val)
+	tbl.seti(1, intValue(1))
+	assert.Equal(t, []Value{intValue(1), intValue(2)}, tbl.val)
+	assert.Equal(t, []any{"x"}, tbl.Keys())
+}
+
+func TestTable_Length(t *testing.T) {
+	t.Parallel()
+
+	tbl := NewTable([]any{int64(1), int64(2), int64(3), nil, nil}, nil)
+	assert.Equal(t, int64(3), tbl.length())
+	tbl.seti(3, nilValue)
+	assert.Equal(t, int64(2), tbl.length())
+	assert.Equal(t, int64(0), NewTable([]any{nil, nil}, nil).length())
+
+	tbl = newEmptyTable(10, 0)
+	for i := int64(1); i <= 10; i++ {
+		assert.Equal(t, i-1, tbl.length())
+		tbl.seti(tbl.length()+1, boolValue(true))
+	}
+}
+
+func TestTable_Next(t *testing.T) {
+	t.Parallel()
+
+	tbl := NewTable([]any{"a", "b"}, nil)
+	for _, key := range []string{"x", "y", "z"} {
+		tbl.setStr(key, strValue(key))
+	}
+	require.NoError(t, tbl.set(floatValue(1.5), boolValue(true)))
+
+	keys := []any{}
+	for key, _, err := tbl.next(nilValue); !key.isNil(); key, _, err = tbl.next(key) {
+		require.NoError(t, err)
+		keys = append(keys, key.Any())
+		// removing the current key during traversal is allowed
+		require.NoError(t, tbl.set(key, nilValue))
+	}
+	assert.Equal(t, []any{int64(1), int64(2), "x", "y", "z", 1.5}, keys)
+	key, _, err := tbl.next(nilValue)
+	require.NoError(t, err)
+	assert.True(t, key.isNil())
+
+	_, _, err = tbl.next(strValue("missing"))
+	require.EqualError(t, err, "invalid key to 'next'")
+}
+
+func TestTable_NormalizesKeys(t *testing.T) {
+	t.Parallel()
+
+	tbl := NewTable(nil, nil)
+	require.NoError(t, tbl.Set(1.0, "one"))
+	val, err := tbl.Get(int64(1))
+	require.NoError(t, err)
+	assert.Equal(t, "one", val)
+	require.EqualError(t, tbl.Set(nil, 1), "table index is nil")
+}
+
+func TestTable_Ordered(t *testing.T) {
+	t.Parallel()
+
+	src := `local t = {}
+t.b = 1
+t[1] = "one"
+t.a = 2
+t[2] = "two"
+t[3] = "three"
+local keys = {}
+for k in pairs(t) do
+  keys[#keys + 1] = k
+  t[k] = nil
+end
+return keys, #t`
+	fn, err := parse.Parse("ordered.lua", strings.NewReader(src), parse.ModeText)
+	require.NoError(t, err)
+
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	vm.EnableOrderedPairs()
+	res, err := vm.Eval(fn)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	assert.Equal(t, []any{"b", int64(1), "a", int64(2), int64(3)}, valuesToAny(res[0].(*Table).val))
+	assert.Equal(t, int64(0), res[1])
+}
+
+func TestTable_Weak(t *testing.T) {
+	t.Parallel()
+
+	keep := NewTable(nil, nil)
+	tbl := NewTable(nil, nil)
+	tbl.setMetatable(NewTable(nil, map[any]any{"__mode": "kv"}))
+	tbl.seti(1, tableValue(keep))
+	tbl.seti(2, tableValue(NewTable(nil, nil)))
+	require.NoError(t, tbl.set(tableValue(NewTable(nil, nil)), strValue("collected")))
+	require.NoError(t, tbl.set(tableValue(keep), strValue("kept")))
+	runtime.GC()
+
+	assert.Equal(t, int64(1), tbl.length())
+	assert.Equal(t, keep, tbl.geti(1).Any())
+	assert.Equal(t, []any{keep}, tbl.Keys())
+	val, err := tbl.get(tableValue(keep))
+	require.NoError(t, err)
+	assert.Equal(t, "kept", val.Any())
+
+	tbl.setMetatable(nil)
+	assert.Equal(t, weakMode(0), tbl.mode)
+	assert.Equal(t, []Value{tableValue(keep)}, tbl.val)
+	runtime.KeepAlive(keep)
+}
+
+func TestTable_SharedMetatablesAreFrozen(t *testing.T) {
+	t.Parallel()
+
+	shared := []*Table{
+		taskMetatable, channelMetatable, futureMetatable, workerMetatable, timerMetatable, listenerMetatable,
+		threadMetatable, fileMetatable,
+	}
+	for _, mt := range shared {
+		assert.True(t, mt.frozen)
+		require.ErrorIs(t, mt.set(strValue("__index"), nilValue), errFrozenTable)
+		index, ok := mt.getStr(string(parse.MetaIndex)).Any().(*Table)
+		require.True(t, ok)
+		assert.True(t, index.frozen)
+	}
+}
+
+func TestNewTable_SortsKeys(t *testing.T) {
+	t.Parallel()
+
+	tbl := NewTable(nil, map[any]any{"c": 1, "a": 2, "b": 3, int64(10): 4, 2.5: 5})
+	assert.Equal(t, []any{int64(10), 2.5, "a", "b", "c"}, tbl.Keys())
+}
+
+func TestTable_FreezeOnlySharesBuiltinGoFuncs(t *testing.T) {
+	t.Parallel()
+
+	builtin := NewTable(nil, map[any]any{"len": builtinFn("len", stdStringLen)})
+	require.NoError(t, builtin.freeze())
+	assert.True(t, builtin.frozen)
+
+	noop := func(*VM, []any) ([]any, error) { return nil, nil }
+	custom := NewTable(nil, map[any]any{"nested": NewTable(nil, map[any]any{"fn": Fn("fn", noop)})})
+	require.ErrorContains(t, custom.freeze(), "go function that is not builtin")
+	assert.False(t, custom.frozen)
+}
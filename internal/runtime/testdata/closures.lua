@@ -0,0 +1,23 @@
+-- compiled by Lua 5.4 into closures.luac to test loading real luac output.
+local function counter(start, ...)
+  local steps, count = { ... }, select("#", ...)
+  local total = start
+  return function(extra)
+    for _, step in ipairs(steps) do
+      total = total + step
+    end
+    return function(scale) return (total + (extra or 0)) * scale, count end
+  end
+end
+
+local function sum(...)
+  local acc = 0
+  for i = 1, select("#", ...) do
+    acc = acc + (select(i, ...))
+  end
+  return acc, ...
+end
+
+local step = counter(1, 2, 3)
+local result, count = step(4)(2)
+return result, count, sum(10, 20, 30)
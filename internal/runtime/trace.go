@@ -0,0 +1,159 @@
+package runtime
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+type (
+	// Tracer records execution events on a vm and writes them in the chrome
+	// trace event format so that they can be viewed in chrome://tracing or
+	// https://ui.perfetto.dev. Every coroutine is shown as its own thread, with
+	// flow arrows to show where execution switched between them.
+	Tracer struct {
+		lock     sync.Mutex
+		start    time.Time
+		events   []traceEvent
+		nextTID  int64
+		nextFlow int64
+	}
+	// traceEvent is a single entry in the trace, the fields are described in the
+	// chromium "Trace Event Format" document.
+	traceEvent struct {
+		Name  string         `json:"name"`
+		Cat   string         `json:"cat,omitempty"`
+		Phase string         `json:"ph"`
+		TS    float64        `json:"ts"`
+		Dur   float64        `json:"dur,omitempty"`
+		PID   int            `json:"pid"`
+		TID   int64          `json:"tid"`
+		ID    int64          `json:"id,omitempty"`
+		Bind  string         `json:"bp,omitempty"`
+		Scope string         `json:"s,omitempty"`
+		Args  map[string]any `json:"args,omitempty"`
+	}
+)
+
+const (
+	tracePID = 1
+
+	tracePhaseBegin    = "B"
+	tracePhaseEnd      = "E"
+	tracePhaseComplete = "X"
+	tracePhaseInstant  = "i"
+	tracePhaseMeta     = "M"
+	tracePhaseFlowOut  = "s"
+	tracePhaseFlowIn   = "f"
+)
+
+// EnableTrace starts recording execution events on this vm, and any coroutines
+// created from it after this call.
+func (vm *VM) EnableTrace() *Tracer {
+	if vm.tracer == nil {
+		vm.tracer = &Tracer{start: time.Now()}
+		vm.tracer.meta(0, "process_name", "luaf")
+		vm.traceTID = vm.tracer.newThread("main")
+	}
+	return vm.tracer
+}
+
+// Tracer returns the running tracer or nil if tracing was never enabled.
+func (vm *VM) Tracer() *Tracer { return vm.tracer }
+
+// WriteJSON writes all of the recorded events as a chrome trace event json object.
+func (t *Tracer) WriteJSON(w io.Writer) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return json.NewEncoder(w).Encode(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{TraceEvents: t.events, DisplayTimeUnit: "ms"})
+}
+
+func (t *Tracer) now() float64 {
+	return float64(time.Since(t.start).Nanoseconds()) / float64(time.Microsecond)
+}
+
+func (t *Tracer) add(evt traceEvent) {
+	evt.PID = tracePID
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.events = append(t.events, evt)
+}
+
+func (t *Tracer) meta(tid int64, name, value string) {
+	t.add(traceEvent{Name: name, Phase: tracePhaseMeta, TID: tid, Args: map[string]any{"name": value}})
+}
+
+func (t *Tracer) newThread(name string) int64 {
+	t.lock.Lock()
+	t.nextTID++
+	tid := t.nextTID
+	t.lock.Unlock()
+	t.meta(tid, "thread_name", name)
+	return tid
+}
+
+func (t *Tracer) enter(vm *VM, name, filename string, li parse.LineInfo) {
+	cat := "lua"
+	args := map[string]any{"file": filename, "line": li.Line}
+	if filename == coreCallstackFilename {
+		cat = "go"
+		args = nil
+	}
+	if name == "" {
+		name = "<anonymous>"
+	}
+	t.add(traceEvent{Name: name, Cat: cat, Phase: tracePhaseBegin, TS: t.now(), TID: vm.traceTID, Args: args})
+}
+
+func (t *Tracer) exit(vm *VM) {
+	t.add(traceEvent{Phase: tracePhaseEnd, TS: t.now(), TID: vm.traceTID})
+}
+
+func (t *Tracer) instant(vm *VM, name string, args map[string]any) {
+	t.add(traceEvent{
+		Name:  name,
+		Cat:   "coroutine",
+		Phase: tracePhaseInstant,
+		Scope: "t",
+		TS:    t.now(),
+		TID:   vm.traceTID,
+		Args:  args,
+	})
+}
+
+// switchThread records control moving from one thread to another as a flow
+// arrow between the two thread timelines.
+func (t *Tracer) switchThread(from, to *VM, name string) {
+	t.lock.Lock()
+	t.nextFlow++
+	id := t.nextFlow
+	t.lock.Unlock()
+	ts := t.now()
+	t.add(traceEvent{Name: name, Cat: "coroutine", Phase: tracePhaseFlowOut, TS: ts, TID: from.traceTID, ID: id})
+	t.instant(to, name, nil)
+	t.add(traceEvent{Name: name, Cat: "coroutine", Phase: tracePhaseFlowIn, Bind: "e", TS: ts, TID: to.traceTID, ID: id})
+}
+
+func (t *Tracer) create(parent, thread *VM, fnName string) {
+	thread.tracer = t
+	thread.traceTID = t.newThread("coroutine " + fnName)
+	t.instant(parent, "coroutine.create", map[string]any{"thread": thread.String()})
+}
+
+func (t *Tracer) require(vm *VM, modName string, start float64, cached bool) {
+	t.add(traceEvent{
+		Name:  "require " + modName,
+		Cat:   "require",
+		Phase: tracePhaseComplete,
+		TS:    start,
+		Dur:   t.now() - start,
+		TID:   vm.traceTID,
+		Args:  map[string]any{"cached": cached},
+	})
+}
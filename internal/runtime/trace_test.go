@@ -0,0 +1,69 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+func TestTrace(t *testing.T) {
+	t.Parallel()
+
+	src := `local function gen()
+  coroutine.yield(1)
+end
+local co = coroutine.create(gen)
+coroutine.resume(co)
+coroutine.resume(co)
+`
+	fn, err := parse.Parse("trace.lua", strings.NewReader(src), parse.ModeText)
+	require.NoError(t, err)
+
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Nil(t, vm.Tracer())
+	tracer := vm.EnableTrace()
+	_, err = vm.Eval(fn)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, tracer.WriteJSON(&buf))
+	var trace struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &trace))
+
+	depth := map[int64]int{}
+	phases := map[string][]string{}
+	for _, evt := range trace.TraceEvents {
+		switch evt.Phase {
+		case tracePhaseBegin:
+			depth[evt.TID]++
+		case tracePhaseEnd:
+			depth[evt.TID]--
+			assert.GreaterOrEqual(t, depth[evt.TID], 0)
+		}
+		if evt.Name != "" {
+			phases[evt.Name] = append(phases[evt.Name], evt.Phase)
+		}
+	}
+	assert.Equal(t, map[int64]int{1: 0, 2: 0}, depth)
+	assert.Equal(t, []string{tracePhaseMeta, tracePhaseMeta}, phases["thread_name"])
+	assert.Contains(t, phases["gen"], tracePhaseBegin)
+	assert.Contains(t, phases["coroutine.create"], tracePhaseInstant)
+	assert.Equal(t, []string{
+		tracePhaseBegin, tracePhaseFlowOut, tracePhaseInstant, tracePhaseFlowIn,
+		tracePhaseBegin, tracePhaseFlowOut, tracePhaseInstant, tracePhaseFlowIn,
+	}, phases["coroutine.resume"])
+	assert.Equal(t, []string{
+		tracePhaseBegin, tracePhaseFlowOut, tracePhaseInstant, tracePhaseFlowIn,
+	}, phases["coroutine.yield"])
+	assert.Equal(t, []string{tracePhaseFlowOut, tracePhaseInstant, tracePhaseFlowIn}, phases["coroutine.dead"])
+}
@@ -6,15 +6,15 @@ import (
 )
 
 type upvalueBroker struct {
-	val       any
+	val       Value
 	stackLock *sync.Mutex
-	stack     *[]any
+	stack     *[]Value
 	name      string
 	index     uint64
 	open      bool
 }
 
-func (vm *VM) newUpValueBroker(name string, val any, index uint64) *upvalueBroker {
+func (vm *VM) newUpValueBroker(name string, val Value, index uint64) *upvalueBroker {
 	return &upvalueBroker{
 		stackLock: &vm.stackLock,
 		stack:     &vm.Stack,
@@ -29,16 +29,17 @@ func (b *upvalueBroker) String() string {
 	return fmt.Sprintf("<-id: %v name: %v open: %v->", b.index, b.name, b.open)
 }
 
-func (b *upvalueBroker) Get() any {
+func (b *upvalueBroker) Get() Value {
 	if b.open {
 		b.stackLock.Lock()
-		defer b.stackLock.Unlock()
-		return (*b.stack)[b.index]
+		val := (*b.stack)[b.index]
+		b.stackLock.Unlock()
+		return val
 	}
 	return b.val
 }
 
-func (b *upvalueBroker) Set(val any) {
+func (b *upvalueBroker) Set(val Value) {
 	if b.open {
 		b.stackLock.Lock()
 		defer b.stackLock.Unlock()
@@ -1,26 +1,57 @@
 package runtime
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"math"
 	"regexp"
 	"strconv"
 	"strings"
+	"unsafe"
 
 	"github.com/tanema/luaf/internal/parse"
 )
 
 type (
+	valueKind uint8
+	// Value is a tagged lua value. It is what registers, tables, constants and
+	// upvalues hold. Numbers and booleans live in the 64 bit payload so that they
+	// never need to be boxed. Tables and functions keep their own pointer, strings
+	// point to a string header that is handed to go code as an any without being
+	// copied again, and only other go values and weak references point to a boxed
+	// any. The zero Value is nil.
+	Value struct {
+		ptr  unsafe.Pointer
+		n    uint64
+		kind valueKind
+	}
 	// GoFunc is a go func usable by the vm.
 	GoFunc struct {
 		val  func(*VM, []any) ([]any, error)
 		name string
+		// builtin functions of the standard library hold no state so frozen tables
+		// can share them between goroutines.
+		builtin bool
 	}
 	// Closure is a lua function encapsulated in the vm.
 	Closure struct {
-		val      *parse.FnProto
-		upvalues []*upvalueBroker
+		val        *fnProto
+		upvalues   []*upvalueBroker
+		ephemerons ephemerons
+	}
+	// eface is the layout of an any. It is used to hand out the string header of a
+	// string value as an any.
+	eface struct {
+		typ  unsafe.Pointer
+		data unsafe.Pointer
+	}
+	// fnProto is a parsed function prepared for the vm. Its constants are converted
+	// to values once when it is loaded so that loading a constant is only a copy.
+	fnProto struct {
+		*parse.FnProto
+		consts  []Value
+		fnTable []*fnProto
 	}
 )
 
@@ -32,9 +63,206 @@ const (
 	typeNameError    = "error"
 	typeNameFile     = "file"
 	typeNameThread   = "thread"
+	typeNameTask     = "task"
+	typeNameChannel  = "channel"
+	typeNameTimer    = "timer"
+	typeNameListener = "listener"
+	typeNameFuture   = "future"
+	typeNameWorker   = "worker"
 	typeNameNil      = "nil"
 )
 
+const (
+	kindNil valueKind = iota
+	kindBool
+	kindInt
+	kindFloat
+	kindString
+	kindTable
+	kindFunction
+	kindOther // errors, files, threads and anything else from go
+)
+
+// flags set in the payload of function and other reference values.
+const (
+	refGoFunc uint64 = 1 << iota // the function is a *GoFunc rather than a *Closure
+	refBoxed                     // ptr points to an any holding the go value
+)
+
+var (
+	nilValue = Value{}
+	// refTypes are the go types of the values that keep their own pointer, by
+	// kind and then if the function is a *GoFunc.
+	refTypes = [kindOther][2]unsafe.Pointer{
+		kindString:   {typeOf(""), typeOf("")},
+		kindTable:    {typeOf((*Table)(nil)), typeOf((*Table)(nil))},
+		kindFunction: {typeOf((*Closure)(nil)), typeOf((*GoFunc)(nil))},
+	}
+)
+
+func typeOf(val any) unsafe.Pointer { return (*eface)(unsafe.Pointer(&val)).typ }
+
+func intValue(i int64) Value     { return Value{kind: kindInt, n: uint64(i)} }
+func floatValue(f float64) Value { return Value{kind: kindFloat, n: math.Float64bits(f)} }
+func tableValue(t *Table) Value  { return Value{kind: kindTable, ptr: unsafe.Pointer(t)} }
+
+func strValue(s string) Value {
+	box := new(string)
+	*box = s
+	return Value{kind: kindString, ptr: unsafe.Pointer(box)}
+}
+
+// boxedValue keeps a go value that has no pointer of its own in the value, like
+// an error or a weak reference, as a value of kind.
+func boxedValue(kind valueKind, ref any) Value {
+	box := new(any)
+	*box = ref
+	return Value{kind: kind, ptr: unsafe.Pointer(box), n: refBoxed}
+}
+
+func boolValue(b bool) Value {
+	if b {
+		return Value{kind: kindBool, n: 1}
+	}
+	return Value{kind: kindBool}
+}
+
+// ValueOf converts a go value into a vm value. It is the inverse of Value.Any
+// and is how values cross from go code, like GoFunc results, into the vm.
+func ValueOf(in any) Value {
+	switch tin := in.(type) {
+	case nil:
+		return nilValue
+	case bool:
+		return boolValue(tin)
+	case int64:
+		return intValue(tin)
+	case float64:
+		return floatValue(tin)
+	case string:
+		// keep the string header that in already points to.
+		return Value{kind: kindString, ptr: (*eface)(unsafe.Pointer(&in)).data}
+	case *Table:
+		return tableValue(tin)
+	case *Closure:
+		return Value{kind: kindFunction, ptr: unsafe.Pointer(tin)}
+	case *GoFunc:
+		return Value{kind: kindFunction, ptr: unsafe.Pointer(tin), n: refGoFunc}
+	case Value:
+		return tin
+	default:
+		return boxedValue(kindOther, in)
+	}
+}
+
+// Any converts the value into a plain go value of nil, bool, int64, float64,
+// string, *Table, *Closure, *GoFunc or whatever go value it was created from.
+func (v Value) Any() any {
+	switch v.kind {
+	case kindNil:
+		return nil
+	case kindBool:
+		return v.n != 0
+	case kindInt:
+		return int64(v.n)
+	case kindFloat:
+		return math.Float64frombits(v.n)
+	default:
+		return v.ref()
+	}
+}
+
+// ref returns the go value of a string, table, function or other value, and nil
+// for the other kinds. Weak references are returned as they are stored.
+func (v Value) ref() any {
+	if v.boxed() {
+		return *(*any)(v.ptr)
+	}
+	var ref any
+	*(*eface)(unsafe.Pointer(&ref)) = eface{typ: refTypes[v.kind][v.n&refGoFunc], data: v.ptr}
+	return ref
+}
+
+// boxed reports if ptr points to an any rather than being the value itself.
+func (v Value) boxed() bool { return v.kind > kindString && v.n&refBoxed != 0 }
+
+// key returns the form of the value used to find it in the hash part of a table.
+func (v Value) key() tableKey {
+	switch {
+	case v.kind == kindString:
+		return tableKey{kind: kindString, str: v.str()}
+	case v.boxed():
+		return tableKey{kind: v.kind, ref: *(*any)(v.ptr)}
+	default:
+		return tableKey{kind: v.kind, ptr: v.ptr, n: v.n}
+	}
+}
+
+func (v Value) isNil() bool    { return v.kind == kindNil }
+func (v Value) isNumber() bool { return v.kind == kindInt || v.kind == kindFloat }
+func (v Value) truthy() bool   { return v.kind != kindNil && (v.kind != kindBool || v.n != 0) }
+func (v Value) int() int64     { return int64(v.n) }
+func (v Value) float() float64 { return math.Float64frombits(v.n) }
+func (v Value) str() string    { return *(*string)(v.ptr) }
+func (v Value) table() *Table  { return (*Table)(v.ptr) }
+
+func (v Value) toFloat() float64 {
+	switch v.kind {
+	case kindInt:
+		return float64(int64(v.n))
+	case kindFloat:
+		return math.Float64frombits(v.n)
+	default:
+		return math.NaN()
+	}
+}
+
+func (v Value) toIntExact() (int64, bool) {
+	switch v.kind {
+	case kindInt:
+		return int64(v.n), true
+	case kindFloat:
+		return floatToIntExact(v.float())
+	default:
+		return 0, false
+	}
+}
+
+func valuesToAny(vals []Value) []any {
+	out := make([]any, len(vals))
+	for i, val := range vals {
+		out[i] = val.Any()
+	}
+	return out
+}
+
+func valuesOf(vals []any) []Value {
+	out := make([]Value, len(vals))
+	for i, val := range vals {
+		out[i] = ValueOf(val)
+	}
+	return out
+}
+
+func newFnProto(fn *parse.FnProto) *fnProto {
+	proto := &fnProto{
+		FnProto: fn,
+		consts:  valuesOf(fn.Constants),
+		fnTable: make([]*fnProto, len(fn.FnTable)),
+	}
+	for i, child := range fn.FnTable {
+		proto.fnTable[i] = newFnProto(child)
+	}
+	return proto
+}
+
+func (fn *fnProto) konst(idx int64) Value {
+	if idx < 0 || int(idx) >= len(fn.consts) {
+		return nilValue
+	}
+	return fn.consts[idx]
+}
+
 func (fn *GoFunc) String() string {
 	return fmt.Sprintf("function:[%s()]", fn.name)
 }
@@ -62,6 +290,18 @@ func typeName(in any) string {
 		return typeNameFile
 	case *VM:
 		return typeNameThread
+	case *Task:
+		return typeNameTask
+	case *Channel:
+		return typeNameChannel
+	case *Timer:
+		return typeNameTimer
+	case *Listener:
+		return typeNameListener
+	case *Future:
+		return typeNameFuture
+	case *Worker:
+		return typeNameWorker
 	case nil:
 		return typeNameNil
 	default:
@@ -69,16 +309,28 @@ func typeName(in any) string {
 	}
 }
 
-func getMetatable(in any) *Table {
+func (vm *VM) getMetatable(in any) *Table {
 	switch tin := in.(type) {
 	case *Table:
 		return tin.metatable
 	case string:
-		return stringMetaTable
+		return vm.stringMeta
 	case *File:
 		return fileMetatable
 	case *VM:
 		return threadMetatable
+	case *Task:
+		return taskMetatable
+	case *Channel:
+		return channelMetatable
+	case *Timer:
+		return timerMetatable
+	case *Listener:
+		return listenerMetatable
+	case *Future:
+		return futureMetatable
+	case *Worker:
+		return workerMetatable
 	default:
 		return nil
 	}
@@ -86,7 +338,8 @@ func getMetatable(in any) *Table {
 
 func toBool(in any) bool {
 	switch tin := in.(type) {
-	case string, int64, float64, error, *Closure, *GoFunc, *Table, *File, *VM:
+	case string, int64, float64, error, *Closure, *GoFunc, *Table, *File, *VM, *Task, *Channel, *Timer, *Listener, *Future,
+		*Worker:
 		return true
 	case bool:
 		return tin
@@ -204,7 +457,7 @@ func ToString(val any) string {
 	case string:
 		return tin
 	case *Table:
-		return fmt.Sprintf("table: %p", tin.val)
+		return fmt.Sprintf("table: %p", tin)
 	case error:
 		return tin.Error()
 	case bool:
@@ -220,12 +473,12 @@ func ToString(val any) string {
 	}
 }
 
-func findMetavalue(op parse.MetaMethod, val any) any {
+func (vm *VM) findMetavalue(op parse.MetaMethod, val any) any {
 	if val == nil {
 		return nil
 	}
-	if mt := getMetatable(val); mt != nil && mt.hashtable[string(op)] != nil {
-		return mt.hashtable[string(op)]
+	if mt := vm.getMetatable(val); mt != nil {
+		return mt.getStr(string(op)).Any()
 	}
 	return nil
 }
@@ -239,54 +492,85 @@ func Fn(name string, fn func(*VM, []any) ([]any, error)) *GoFunc {
 	}
 }
 
+// builtinFn is Fn for the functions of the standard library that hold no state,
+// which unlike other go functions can be put in frozen tables.
+func builtinFn(name string, fn func(*VM, []any) ([]any, error)) *GoFunc {
+	return &GoFunc{
+		name:    name,
+		val:     fn,
+		builtin: true,
+	}
+}
+
 func arith(vm *VM, op parse.MetaMethod, lval, rval any) (any, error) {
-	if op == parse.MetaUNM {
-		if liva, lisInt := lval.(int64); lisInt {
-			return intArith(op, liva, 0), nil
-		} else if isNumber(lval) {
-			return floatArith(op, toFloat(lval), 0), nil
+	if op == parse.MetaUNM || op == parse.MetaBNot {
+		if val, ok, err := unaryArith(op, ValueOf(lval)); err != nil || ok {
+			return val.Any(), err
 		}
-	} else if op == parse.MetaBNot {
-		if isNumber(lval) {
-			ival, ok := toIntExact(lval)
-			if !ok {
-				return nil, errors.New("number has no integer representation")
-			}
-			return intArith(op, ival, 0), nil
+	} else if val, ok, err := numArith(op, ValueOf(lval), ValueOf(rval)); err != nil || ok {
+		return val.Any(), err
+	}
+	return vm.arithMetamethod(op, lval, rval)
+}
+
+// unaryArith performs a unary minus or bitwise not on a number. ok is false if
+// the value is not a number, which leaves the operation to metamethods.
+func unaryArith(op parse.MetaMethod, val Value) (Value, bool, error) {
+	switch {
+	case val.kind == kindInt:
+		return intValue(intArith(op, val.int(), 0)), true, nil
+	case val.kind != kindFloat:
+		return nilValue, false, nil
+	case op == parse.MetaUNM:
+		return floatValue(-val.float()), true, nil
+	}
+	ival, ok := val.toIntExact()
+	if !ok {
+		return nilValue, false, errors.New("number has no integer representation")
+	}
+	return intValue(intArith(op, ival, 0)), true, nil
+}
+
+// numArith performs a binary operation on two numbers. ok is false if either value
+// is not a number, or not an integer for bitwise operations, which leaves the
+// operation to metamethods. The only errors are divisions by zero.
+func numArith(op parse.MetaMethod, lval, rval Value) (Value, bool, error) {
+	if !lval.isNumber() || !rval.isNumber() {
+		return nilValue, false, nil
+	}
+	bothInts := lval.kind == kindInt && rval.kind == kindInt
+	switch op {
+	case parse.MetaBAnd, parse.MetaBOr, parse.MetaBXOr, parse.MetaShl, parse.MetaShr, parse.MetaSar:
+		liva, lok := lval.toIntExact()
+		riva, rok := rval.toIntExact()
+		if !lok || !rok {
+			return nilValue, false, nil
 		}
-	} else if isNumber(lval) && isNumber(rval) {
-		switch op {
-		case parse.MetaBAnd, parse.MetaBOr, parse.MetaBXOr, parse.MetaShl, parse.MetaShr, parse.MetaSar:
-			liva, lok := toIntExact(lval)
-			riva, rok := toIntExact(rval)
-			if !lok || !rok {
-				return nil, errors.New("number has no integer representation")
-			}
-			return intArith(op, liva, riva), nil
-		case parse.MetaDiv, parse.MetaPow:
-			return floatArith(op, toFloat(lval), toFloat(rval)), nil
-		case parse.MetaIDiv, parse.MetaMod:
-			liva, lisInt := lval.(int64)
-			riva, risInt := rval.(int64)
-			if lisInt && risInt {
-				if riva == 0 {
-					if op == parse.MetaIDiv {
-						return nil, errors.New("attempt to divide by zero")
-					}
-					return nil, errors.New("attempt to perform 'n%0'")
+		return intValue(intArith(op, liva, riva)), true, nil
+	case parse.MetaDiv, parse.MetaPow:
+		return floatValue(floatArith(op, lval.toFloat(), rval.toFloat())), true, nil
+	case parse.MetaIDiv, parse.MetaMod:
+		if bothInts {
+			if rval.int() == 0 {
+				if op == parse.MetaIDiv {
+					return nilValue, false, errors.New("attempt to divide by zero")
 				}
-				return intArith(op, liva, riva), nil
-			}
-			return floatArith(op, toFloat(lval), toFloat(rval)), nil
-		default:
-			liva, lisInt := lval.(int64)
-			riva, risInt := rval.(int64)
-			if lisInt && risInt {
-				return intArith(op, liva, riva), nil
+				return nilValue, false, errors.New("attempt to perform 'n%0'")
 			}
-			return floatArith(op, toFloat(lval), toFloat(rval)), nil
+			return intValue(intArith(op, lval.int(), rval.int())), true, nil
+		}
+		return floatValue(floatArith(op, lval.toFloat(), rval.toFloat())), true, nil
+	default:
+		if bothInts {
+			return intValue(intArith(op, lval.int(), rval.int())), true, nil
 		}
+		return floatValue(floatArith(op, lval.toFloat(), rval.toFloat())), true, nil
 	}
+}
+
+// arithMetamethod calls the metamethod for an operation that could not be done
+// on the values directly, or returns an error naming the type that was at fault.
+func (vm *VM) arithMetamethod(op parse.MetaMethod, lval, rval any) (any, error) {
 	if didDelegate, res, err := vm.delegateMetamethodBinop(op, lval, rval); err != nil {
 		return nil, err
 	} else if !didDelegate {
@@ -296,6 +580,9 @@ func arith(vm *VM, op parse.MetaMethod, lval, rval any) (any, error) {
 		}
 		switch op {
 		case parse.MetaBAnd, parse.MetaBOr, parse.MetaBXOr, parse.MetaShl, parse.MetaShr, parse.MetaSar, parse.MetaBNot:
+			if isNumber(bad) {
+				return nil, errors.New("number has no integer representation")
+			}
 			return nil, fmt.Errorf("attempt to perform bitwise operation on a %v value", nameOfType(bad))
 		default:
 			return nil, fmt.Errorf("attempt to perform arithmetic on a %v value", nameOfType(bad))
@@ -306,35 +593,27 @@ func arith(vm *VM, op parse.MetaMethod, lval, rval any) (any, error) {
 	return nil, errors.New("error object is a nil value")
 }
 
-func arithMetamethodOnly(vm *VM, op parse.MetaMethod, lval, rval any) (any, error) {
-	didDelegate, res, err := vm.delegateMetamethodBinop(op, lval, rval)
-	if err != nil {
-		return nil, err
-	} else if !didDelegate {
-		return nil, fmt.Errorf("attempt to perform arithmetic on a %v value", nameOfType(lval))
-	} else if len(res) > 0 {
-		return res[0], nil
-	}
-	return nil, nil
-}
-
 func toIntExact(val any) (int64, bool) {
 	switch tval := val.(type) {
 	case int64:
 		return tval, true
 	case float64:
-		if math.IsNaN(tval) || math.IsInf(tval, 0) || tval != math.Trunc(tval) {
-			return 0, false
-		}
-		if tval < -9223372036854775808.0 || tval >= 9223372036854775808.0 {
-			return 0, false
-		}
-		return int64(tval), true
+		return floatToIntExact(tval)
 	default:
 		return 0, false
 	}
 }
 
+func floatToIntExact(val float64) (int64, bool) {
+	if math.IsNaN(val) || math.IsInf(val, 0) || val != math.Trunc(val) {
+		return 0, false
+	}
+	if val < -9223372036854775808.0 || val >= 9223372036854775808.0 {
+		return 0, false
+	}
+	return int64(val), true
+}
+
 func nameOfType(val any) string {
 	var mt *Table
 	switch tval := val.(type) {
@@ -344,10 +623,22 @@ func nameOfType(val any) string {
 		mt = fileMetatable
 	case *VM:
 		mt = threadMetatable
+	case *Task:
+		mt = taskMetatable
+	case *Channel:
+		mt = channelMetatable
+	case *Timer:
+		mt = timerMetatable
+	case *Listener:
+		mt = listenerMetatable
+	case *Future:
+		mt = futureMetatable
+	case *Worker:
+		mt = workerMetatable
 	}
 	if mt != nil {
-		if name, ok := mt.hashtable[string(parse.MetaName)].(string); ok {
-			return name
+		if name := mt.getStr(string(parse.MetaName)); name.kind == kindString {
+			return name.str()
 		}
 	}
 	return typeName(val)
@@ -436,71 +727,62 @@ func floatArith(op parse.MetaMethod, lval, rval float64) float64 {
 	}
 }
 
-func eq(vm *VM, lVal, rVal any) (bool, error) {
-	switch tlval := lVal.(type) {
-	case string:
-		rstr, ok := rVal.(string)
-		if !ok {
-			return false, nil
-		}
-		return tlval == rstr, nil
-	case int64, float64:
-		return toFloat(lVal) == toFloat(rVal), nil
-	case bool:
-		rbool, ok := rVal.(bool)
-		if !ok {
-			return false, nil
-		}
-		return tlval == rbool, nil
-	case nil:
-		return rVal == nil, nil
-	case *Table:
-		rtble, ok := rVal.(*Table)
-		if !ok {
-			return false, nil
-		} else if lVal == rtble {
+func eq(vm *VM, lVal, rVal Value) (bool, error) {
+	if lVal.kind == kindInt && rVal.kind == kindInt {
+		return lVal.n == rVal.n, nil
+	} else if lVal.isNumber() {
+		return lVal.toFloat() == rVal.toFloat(), nil
+	} else if lVal.kind != rVal.kind {
+		return false, nil
+	}
+	switch lVal.kind {
+	case kindNil, kindBool:
+		return lVal.n == rVal.n, nil
+	case kindString:
+		return lVal.str() == rVal.str(), nil
+	case kindTable:
+		if lVal.ptr == rVal.ptr {
 			return true, nil
 		}
-		didDelegate, res, err := vm.delegateMetamethodBinop(parse.MetaEq, lVal, rtble)
+		didDelegate, res, err := vm.delegateMetamethodBinop(parse.MetaEq, lVal.Any(), rVal.Any())
 		if err != nil {
 			return false, err
 		} else if didDelegate && len(res) > 0 {
 			return toBool(res[0]), nil
 		}
 		return false, nil
-	case *Closure:
-		rcls, ok := rVal.(*Closure)
-		if !ok {
-			return false, nil
+	case kindFunction:
+		lcls, lok := lVal.ref().(*Closure)
+		rcls, rok := rVal.ref().(*Closure)
+		if lok && rok {
+			return lcls.val == rcls.val, nil
 		}
-		return tlval.val == rcls.val, nil
-	case *GoFunc:
-		rfn, ok := rVal.(*GoFunc)
-		if !ok {
-			return false, nil
-		}
-		return tlval == rfn, nil
+		return lVal.ptr == rVal.ptr, nil
 	default:
+		if thread, ok := lVal.ref().(*VM); ok {
+			return thread == rVal.ref(), nil
+		}
 		return false, nil
 	}
 }
 
-func compareVal(vm *VM, op parse.MetaMethod, lVal, rVal any) (int, error) {
-	if isNumber(lVal) && isNumber(rVal) {
-		vA, vB := toFloat(lVal), toFloat(rVal)
+func compareVal(vm *VM, op parse.MetaMethod, lVal, rVal Value) (int, error) {
+	if lVal.kind == kindInt && rVal.kind == kindInt {
+		return cmp.Compare(lVal.int(), rVal.int()), nil
+	} else if lVal.isNumber() && rVal.isNumber() {
+		vA, vB := lVal.toFloat(), rVal.toFloat()
 		if vA < vB {
 			return -1, nil
 		} else if vA > vB {
 			return 1, nil
 		}
 		return 0, nil
-	} else if isString(lVal) && isString(rVal) {
-		strA, strB := lVal.(string), rVal.(string)
-		return strings.Compare(strA, strB), nil
-	} else if didDelegate, res, err := vm.delegateMetamethodBinop(op, lVal, rVal); err != nil {
+	} else if lVal.kind == kindString && rVal.kind == kindString {
+		return strings.Compare(lVal.str(), rVal.str()), nil
+	} else if didDelegate, res, err := vm.delegateMetamethodBinop(op, lVal.Any(), rVal.Any()); err != nil {
 		return 0, err
 	} else if !didDelegate {
-		return 0, compareErr(lVal, rVal)
+		return 0, compareErr(lVal.Any(), rVal.Any())
 	} else if len(res) > 0 && toBool(res[0]) {
 		return -1, nil
 	}
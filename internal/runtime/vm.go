@@ -4,9 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/tanema/luaf/internal/bytecode"
 	"github.com/tanema/luaf/internal/conf"
@@ -16,14 +18,34 @@ import (
 type (
 	frame struct {
 		prev         *frame // parent frames
-		fn           *parse.FnProto
-		xargs        []any
+		fn           *fnProto
+		xargs        []Value
 		upvals       []*upvalueBroker // upvals passed to the scope
 		openBrokers  []*upvalueBroker // upvals created by the scope
 		tbcValues    []int64          // values that require closing
 		framePointer int64            // stack pointer to 0 of the running frame
 		pc           int64
+		cont         *continuation // set once a yield unwound the go call that started the frame
+		concatAt     int64         // register a CONCAT had reached when it called __concat
 	}
+	// continuation is how a call made from go is completed after a yield has
+	// unwound the go stack that made it. The first frame of the call is linked
+	// to the frame below it and when it returns the continuation finishes either
+	// the instruction that called a metamethod or the go function that made the
+	// call.
+	continuation struct {
+		k         Continuation
+		protected bool
+		fromGo    bool  // the call was made by a go function rather than an instruction
+		ifn       int64 // stack address of the go function
+		nret      int64 // results expected from the go function
+	}
+	// Continuation is called with the results of a call made with CallK, or the
+	// error of one made with PCallK, when it returns after the thread yielded
+	// from inside of it. What it returns is returned from the go function that
+	// made the call.
+	Continuation func(vm *VM, res []any, err error) ([]any, error)
+
 	callInfo struct {
 		parse.LineInfo
 		filename string
@@ -31,22 +53,66 @@ type (
 	}
 	// VM is the interpreter runtime that does everything in memory.
 	VM struct {
-		ctx        context.Context
-		cancel     func()
-		env        *Table
-		yieldFrame *frame
-		vmargs     []any
-		Stack      []any
+		ctx         context.Context
+		cancel      func()
+		interrupted *atomic.Bool
+		env         *Table
+		yieldFrame  *frame
+		vmargs      []Value
+		Stack       []Value
 
 		callDepth int64
 		callStack []callInfo
 		top       int64
 		stackLock sync.Mutex
-		gcOff     bool
-
+		// luaDepth is how many of the calls in callStack are lua frames, which is
+		// what is limited by maxCallDepth.
+		luaDepth     int64
+		maxCallDepth int64
+
+		// loaded and preload are package.loaded and package.preload, which every vm
+		// shares except for the isolated vms that tasks run in.
+		loaded  *Table
+		preload *Table
+
+		gc        *gcState
+		loop      *eventLoop
+		worker    *Worker // the worker that the vm runs, if it is one.
+		memprof   *MemProfile
+		allocLine int64
+		tracer    *Tracer
+		traceTID  int64
+
+		// coroutine state. body is the function a thread was created with and is
+		// cleared once it is first resumed. yieldTop and yieldNRet record where the
+		// values passed to the next resume are placed in the yielded frame.
 		yieldable bool
-		yielded   bool
 		status    threadstate
+		body      any
+		yieldTop  int64
+		yieldNRet int64
+		resumeErr error
+		// nny counts the go functions currently calling back into this thread
+		// without a continuation, a yield cannot unwind through them.
+		nny        int
+		ccallDepth int
+		// scheduled is set on the threads that the event loop runs, which wait on
+		// go operations by yielding to it.
+		scheduled bool
+		// boundary is the first frame of a go call that a yield is unwinding,
+		// waiting to be linked to the frame that made the call.
+		boundary *frame
+		// frames are the frames of lua calls that returned, kept to be reused by
+		// the next calls.
+		frames []*frame
+		// ephemerons are the values of weak keyed tables that the thread is a key in.
+		ephemerons ephemerons
+
+		// stringMeta is the metatable of strings, it is shared with coroutines.
+		stringMeta *Table
+
+		orderedPairs bool
+		optimize     parse.OptLevel // level that chunks loaded from text are optimized at
 	}
 	// InterruptKind distinguishes Interrupts to change the behaviour when an Interrupt
 	// was returned from a function call.
@@ -54,9 +120,10 @@ type (
 	// Interrupt is an error type that allows the VM to react to the kind. For instance
 	// debug, yield, or exit.
 	Interrupt struct {
-		kind InterruptKind
-		code int
-		flag bool
+		kind   InterruptKind
+		code   int
+		flag   bool
+		values []any
 	}
 
 	threadstate string
@@ -65,6 +132,7 @@ type (
 const (
 	threadStateRunning   threadstate = "running"
 	threadStateSuspended threadstate = "suspended"
+	threadStateNormal    threadstate = "normal"
 	threadStateDead      threadstate = "dead"
 )
 
@@ -79,6 +147,12 @@ const (
 	InterruptDebug
 )
 
+// returnProto is the code of a returnFrame.
+var returnProto = newFnProto(&parse.FnProto{
+	Filename:  coreCallstackFilename,
+	ByteCodes: []uint32{bytecode.IAB(bytecode.RETURN, 0, 0)},
+})
+
 var forNumMsgs = []string{
 	"bad 'for' initial value (number expected, got %v)",
 	"bad 'for' limit (number expected, got %v)",
@@ -89,7 +163,9 @@ func (interrupt *Interrupt) Error() string {
 	return fmt.Sprintf("VM interrupt %v", interrupt.kind)
 }
 
-var bytecodeToMetaMethod = map[bytecode.Op]parse.MetaMethod{
+// bytecodeToMetaMethod is indexed by opcode rather than being a map as it is
+// looked up on every arithmetic instruction.
+var bytecodeToMetaMethod = [math.MaxUint8 + 1]parse.MetaMethod{
 	bytecode.ADD:  parse.MetaAdd,
 	bytecode.SUB:  parse.MetaSub,
 	bytecode.MUL:  parse.MetaMul,
@@ -105,6 +181,20 @@ var bytecodeToMetaMethod = map[bytecode.Op]parse.MetaMethod{
 	bytecode.SAR:  parse.MetaSar,
 	bytecode.UNM:  parse.MetaUNM,
 	bytecode.BNOT: parse.MetaBNot,
+
+	bytecode.ADDI:  parse.MetaAdd,
+	bytecode.ADDK:  parse.MetaAdd,
+	bytecode.SUBK:  parse.MetaSub,
+	bytecode.MULK:  parse.MetaMul,
+	bytecode.DIVK:  parse.MetaDiv,
+	bytecode.MODK:  parse.MetaMod,
+	bytecode.POWK:  parse.MetaPow,
+	bytecode.IDIVK: parse.MetaIDiv,
+	bytecode.BANDK: parse.MetaBAnd,
+	bytecode.BORK:  parse.MetaBOr,
+	bytecode.BXORK: parse.MetaBXOr,
+	bytecode.SHLI:  parse.MetaShl,
+	bytecode.SHRI:  parse.MetaShr,
 }
 
 // New will create a new vm for evaluating. It will establish the initial stack,
@@ -112,22 +202,43 @@ var bytecodeToMetaMethod = map[bytecode.Op]parse.MetaMethod{
 // as the arg value in luaf.
 func New(ctx context.Context, env *Table, clargs ...string) (*VM, error) {
 	ctx, cancel := context.WithCancel(ctx)
+	interrupted := &atomic.Bool{}
 
 	if env == nil {
 		env = createDefaultEnv(true)
 	}
-	env.hashtable["_G"] = env
-	env.hashtable["arg"] = NewTable(argsToTableValues(clargs))
+	argTable := NewTable(argsToTableValues(clargs))
+	env.setStr("_G", tableValue(env))
+	env.setStr("arg", tableValue(argTable))
+	// string methods come from the string library of the globals so that the
+	// vm's changes to it are its own, an env without one still gets the builtins.
+	strLib, hasStrLib := env.getStr("string").Any().(*Table)
+	if !hasStrLib {
+		strLib = createStringLib()
+	}
 	newVM := &VM{
-		ctx:       ctx,
-		cancel:    cancel,
-		callDepth: -1,
-		callStack: make([]callInfo, 100),
-		Stack:     make([]any, conf.INITIALSTACKSIZE),
-		env:       env,
-		status:    threadStateRunning,
-		vmargs:    env.hashtable["arg"].(*Table).val,
+		ctx:         ctx,
+		cancel:      cancel,
+		interrupted: interrupted,
+		callDepth:   -1,
+		callStack:   make([]callInfo, 100),
+		Stack:       make([]Value, conf.INITIALSTACKSIZE),
+		env:         env,
+		loaded:      loadedPackages,
+		preload:     preloadPackages,
+		loop:        newEventLoop(),
+		status:      threadStateRunning,
+		vmargs:      argTable.val,
+
+		stringMeta: newStringMetatable(strLib),
+
+		maxCallDepth: conf.MAXCALLDEPTH,
+		orderedPairs: OrderedPairs,
 	}
+	newVM.gc = newGCState(newVM)
+	// checking ctx.Err() takes a lock so instead flag the interrupt once so that
+	// the eval loop only has to do an atomic load per instruction.
+	context.AfterFunc(ctx, func() { newVM.interrupted.Store(true) })
 
 	fn, err := parse.Parse("<builtin>", strings.NewReader(builtinLib), parse.ModeText)
 	if err != nil {
@@ -137,6 +248,7 @@ func New(ctx context.Context, env *Table, clargs ...string) (*VM, error) {
 		cancel()
 		return nil, err
 	}
+	newVM.gc.allocated.Store(newVM.MemStats().Total())
 
 	return newVM, nil
 }
@@ -145,57 +257,147 @@ func (vm *VM) String() string {
 	return fmt.Sprintf("thread %p", vm)
 }
 
-func (vm *VM) newYieldable(fn any) (*VM, error) {
-	if typeName(fn) != typeNameFunction {
+// EnableOrderedPairs makes tables created by this vm, and any coroutines created
+// from it after this call, iterate in the order that their keys were first
+// inserted instead of the array part first.
+func (vm *VM) EnableOrderedPairs() { vm.orderedPairs = true }
+
+// SetMaxCallDepth sets how many lua calls can be nested, tail calls excluded,
+// before erroring with a stack overflow. Coroutines created from the vm after
+// this call get the same limit.
+func (vm *VM) SetMaxCallDepth(depth int64) { vm.maxCallDepth = depth }
+
+// SetOptimizeLevel sets the level that the chunks the vm loads from text, with
+// require, load or worker.new, are optimized at. Coroutines and tasks created from
+// the vm after this call load chunks at the same level.
+func (vm *VM) SetOptimizeLevel(level parse.OptLevel) { vm.optimize = level }
+
+func (vm *VM) newTable(nseq, nrec int64) *Table {
+	tbl := newEmptyTable(nseq, nrec)
+	tbl.ordered = vm.orderedPairs
+	return tbl
+}
+
+// newThread creates a coroutine that will run fn. Threads are lightweight: they
+// only get their own stack and call chain, everything else including the
+// environment, context and profilers is shared with the vm that created them.
+func (vm *VM) newThread(fn any) (*VM, error) {
+	var name string
+	switch tfn := fn.(type) {
+	case *Closure:
+		name = tfn.val.Name
+	case *GoFunc:
+		name = tfn.name
+	default:
 		return nil, fmt.Errorf("cannot create a thread from a %s", typeName(fn))
 	}
-	newVM, err := New(vm.ctx, vm.env)
-	if err != nil {
-		return nil, err
+	thread := &VM{
+		ctx:          vm.ctx,
+		interrupted:  vm.interrupted,
+		gc:           vm.gc,
+		loop:         vm.loop,
+		worker:       vm.worker,
+		callDepth:    -1,
+		maxCallDepth: vm.maxCallDepth,
+		Stack:        make([]Value, conf.THREADSTACKSIZE),
+		env:          vm.env,
+		loaded:       vm.loaded,
+		preload:      vm.preload,
+		vmargs:       vm.vmargs,
+		memprof:      vm.memprof,
+		yieldable:    true,
+		status:       threadStateSuspended,
+		body:         fn,
+		orderedPairs: vm.orderedPairs,
+		stringMeta:   vm.stringMeta,
+		optimize:     vm.optimize,
 	}
-	newVM.yieldable = true
-	newVM.yielded = true
-	newVM.status = threadStateSuspended
-	f, err := newVM.callFrame(fn, []any{})
-	if err != nil {
-		return nil, err
+	if vm.tracer != nil {
+		vm.tracer.create(vm, thread, name)
 	}
-	newVM.yieldFrame = f
-	return newVM, newVM.pushCallstack(f.fn.Name, f.fn.Filename, f.fn.LineInfo)
+	return thread, nil
 }
 
 // Eval will take in the parsed fnproto returned from parse and evaluate it.
 func (vm *VM) Eval(fn *parse.FnProto) ([]any, error) {
+	proto := newFnProto(fn)
 	// push the fn because the vm always expects that the fn value is at framePointer-1
-	ifn, err := vm.push(&Closure{val: fn})
+	ifn, err := vm.push(&Closure{val: proto})
 	if err != nil {
 		return nil, err
 	}
-	res, err := vm.eval(vm.newEnvFrame(fn, ifn+1, vm.vmargs), true)
+	res, err := vm.eval(vm.newEnvFrame(proto, ifn+1, vm.vmargs), true)
 	return res, err
 }
 
 func (vm *VM) pushCallstack(name, filename string, li parse.LineInfo) error {
-	if vm.callDepth+1 >= conf.MAXCALLDEPTH {
-		return errors.New("stack overflow")
+	if filename != coreCallstackFilename {
+		if vm.luaDepth >= vm.maxCallDepth {
+			return errors.New("stack overflow")
+		}
+		vm.luaDepth++
 	}
 	ensureSize(&vm.callStack, int(vm.callDepth+1))
 	vm.callDepth++
 	vm.callStack[vm.callDepth].LineInfo = li
 	vm.callStack[vm.callDepth].name = name
 	vm.callStack[vm.callDepth].filename = filename
+	if vm.tracer != nil {
+		vm.tracer.enter(vm, name, filename, li)
+	}
 	return nil
 }
 
 func (vm *VM) popCallstack() {
+	if vm.tracer != nil && vm.callDepth >= 0 {
+		vm.tracer.exit(vm)
+	}
+	if vm.callDepth >= 0 && vm.callStack[vm.callDepth].filename != coreCallstackFilename {
+		vm.luaDepth--
+	}
 	vm.callDepth--
 }
 
-func (vm *VM) newEnvFrame(fn *parse.FnProto, fp int64, xargs []any) *frame {
-	return vm.newFrame(fn, fp, 0, []*upvalueBroker{{name: _ENVName, val: vm.env}}, xargs...)
+func (vm *VM) newEnvFrame(fn *fnProto, fp int64, xargs []Value) *frame {
+	if len(fn.UpIndexes) == 0 {
+		return vm.newFrame(fn, fp, 0, []*upvalueBroker{{name: _ENVName, val: tableValue(vm.env)}}, xargs...)
+	}
+	return vm.newFrame(fn, fp, 0, loadedChunkUpvalues(fn.FnProto, vm.env), xargs...)
+}
+
+// maxFreeFrames is how many returned frames a vm keeps to be reused.
+const maxFreeFrames = 256
+
+// reuseFrame returns a frame that returned if there is one, or a new frame.
+func (vm *VM) reuseFrame() *frame {
+	if n := len(vm.frames); n > 0 {
+		f := vm.frames[n-1]
+		vm.frames = vm.frames[:n-1]
+		return f
+	}
+	return &frame{}
+}
+
+// releaseFrame keeps a lua frame that returned to its caller to be reused. Frames
+// that continue a go call or have values to close may still be referred to and
+// are left to be collected.
+func (vm *VM) releaseFrame(f *frame) {
+	if f.cont != nil || len(f.tbcValues) > 0 || len(vm.frames) >= maxFreeFrames {
+		return
+	}
+	clear(f.openBrokers)
+	*f = frame{openBrokers: f.openBrokers[:0], tbcValues: f.tbcValues[:0]}
+	vm.frames = append(vm.frames, f)
+}
+
+// returnTo releases a lua frame that returned and gives the frame it returned to.
+func (vm *VM) returnTo(f *frame) *frame {
+	prev := f.prev
+	vm.releaseFrame(f)
+	return prev
 }
 
-func (vm *VM) newFrame(fn *parse.FnProto, fp, pc int64, upvals []*upvalueBroker, xargs ...any) *frame {
+func (vm *VM) newFrame(fn *fnProto, fp, pc int64, upvals []*upvalueBroker, xargs ...Value) *frame {
 	return &frame{
 		fn:           fn,
 		framePointer: fp,
@@ -205,44 +407,98 @@ func (vm *VM) newFrame(fn *parse.FnProto, fp, pc int64, upvals []*upvalueBroker,
 	}
 }
 
-func (vm *VM) resume(params []any) ([]any, error) {
-	if !vm.yielded {
-		return nil, errors.New("vm was not yielded and has no state to resume")
+// resume starts or continues a suspended thread. The values passed are the
+// arguments to the body on the first resume and the results of the yield
+// otherwise.
+func (vm *VM) resume(caller *VM, params []any) ([]any, error) {
+	switch vm.status {
+	case threadStateDead:
+		return nil, errors.New("cannot resume dead coroutine")
+	case threadStateRunning, threadStateNormal:
+		return nil, errors.New("cannot resume non-suspended coroutine")
 	}
-	vm.yielded = false
-	f := vm.yieldFrame
-	vm.yieldFrame = nil
-	if _, err := vm.push(params...); err != nil {
+	if caller.ccallDepth+1 >= conf.MAXCCALLDEPTH {
+		return nil, errors.New("C stack overflow")
+	}
+
+	var f *frame
+	var err error
+	start := vm.body != nil
+	if start {
+		f, err = vm.callFrame(vm.body, params)
+		vm.body = nil
+	} else if f = vm.yieldFrame; f == nil {
+		// the yield was a tail call from the body so the values passed to resume
+		// are what the body returns.
+		vm.status = threadStateDead
+		return params, nil
+	} else {
+		vm.yieldFrame = nil
+		vm.top = vm.yieldTop
+		if vm.yieldNRet > 0 && len(params) > int(vm.yieldNRet) {
+			params = params[:vm.yieldNRet]
+		} else if len(params) < int(vm.yieldNRet) {
+			params = ensureLenNil(params, int(vm.yieldNRet))
+		}
+		_, err = vm.push(params...)
+	}
+	if err != nil {
+		vm.status = threadStateDead
 		return nil, err
 	}
-	res, err := vm.eval(f, false)
+
+	vm.ccallDepth = caller.ccallDepth + 1
+	callerStatus := caller.status
+	caller.status = threadStateNormal
+	vm.status = threadStateRunning
+	res, err := vm.eval(f, start)
+	caller.status = callerStatus
 	if err != nil {
 		var intr *Interrupt
 		if errors.As(err, &intr) && intr.kind == InterruptYield {
-			return res, nil
+			vm.status = threadStateSuspended
+			return intr.values, nil
 		}
+		vm.status = threadStateDead
+		vm.resumeErr = err
 		return nil, err
 	}
+	vm.status = threadStateDead
 	return res, nil
 }
 
+// checkInterrupt is called between instructions when the interrupt flag is set,
+// either because the context was cancelled or tables are waiting for their __gc.
+func (vm *VM) checkInterrupt() error {
+	vm.interrupted.Store(false)
+	if vm.ctx.Err() != nil {
+		vm.interrupted.Store(true)
+		return errors.New("vm interrupted")
+	}
+	if !vm.gc.stopped {
+		vm.runFinalizers(false)
+	}
+	return nil
+}
+
 func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
+	if err := vm.ensureFrame(f); err != nil {
+		return nil, err
+	}
 	if pushFrame {
 		if err := vm.pushCallstack(f.fn.Name, f.fn.Filename, f.fn.LineInfo); err != nil {
 			return nil, err
 		}
 	}
-	vm.status = threadStateRunning
-
 	for {
-		if err := vm.ctx.Err(); err != nil { // cancelled context
-			vm.status = threadStateDead
-			return nil, errors.New("vm interrupted")
+		if vm.interrupted.Load() {
+			if err := vm.checkInterrupt(); err != nil {
+				return nil, err
+			}
 		}
 
 		var err error
 		if int64(len(f.fn.ByteCodes)) <= f.pc {
-			vm.status = threadStateDead
 			return nil, nil
 		}
 
@@ -252,28 +508,31 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 		if f.pc < int64(len(f.fn.LineTrace)) {
 			li = f.fn.LineTrace[f.pc]
 		}
+		if vm.memprof != nil {
+			vm.allocLine = li.Line
+		}
 		op := bytecode.GetOp(instruction)
 		switch op {
 		case bytecode.MOVE:
 			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), vm.get(f, bytecode.GetB(instruction), false))
 		case bytecode.LOADK:
-			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), f.fn.GetConst(bytecode.GetBx(instruction)))
+			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), f.fn.konst(bytecode.GetBx(instruction)))
 		case bytecode.LOADI:
-			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), bytecode.GetsBx(instruction))
+			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), intValue(bytecode.GetsBx(instruction)))
 		case bytecode.LOADF:
-			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), float64(bytecode.GetsBx(instruction)))
+			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), floatValue(float64(bytecode.GetsBx(instruction))))
 		case bytecode.LOADFALSE:
-			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), false)
+			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), boolValue(false))
 		case bytecode.LFALSESKIP:
-			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), false)
+			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), boolValue(false))
 			f.pc++
 		case bytecode.LOADTRUE:
-			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), true)
+			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), boolValue(true))
 		case bytecode.LOADNIL:
 			a := bytecode.GetA(instruction)
 			b := bytecode.GetBx(instruction)
 			for i := a; i <= a+b; i++ {
-				if err = vm.setStack(f.framePointer+i, nil); err != nil {
+				if err = vm.setStack(f.framePointer+i, nilValue); err != nil {
 					goto VM_ERROR
 				}
 			}
@@ -291,154 +550,174 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 				nvals = int(bytecode.GetAx(extraARg)) - 1
 			}
 
-			err = vm.setStack(dst, newSizedTable(nvals, nkeyed))
+			vm.recordAlloc(allocTable, tableSize+int64(nvals)*valueSize+int64(nkeyed)*hashSlot)
+			err = vm.setStack(dst, tableValue(vm.newTable(int64(nvals), int64(nkeyed))))
 		case bytecode.ADD, bytecode.SUB, bytecode.MUL, bytecode.DIV, bytecode.MOD, bytecode.POW, bytecode.IDIV,
-			bytecode.BAND, bytecode.BOR, bytecode.BXOR, bytecode.SHL, bytecode.SHR, bytecode.SAR, bytecode.UNM, bytecode.BNOT:
-			bReg, cReg := bytecode.GetB(instruction), bytecode.GetC(instruction)
-			bVal := vm.get(f, bReg, false)
-			cVal := vm.get(f, cReg, false)
-			var val any
-			if val, err = arith(vm, bytecodeToMetaMethod[op], bVal, cVal); err != nil {
-				err = vm.annotateArithErr(f, bytecodeToMetaMethod[op], bVal, bReg, cReg, err)
-				goto VM_ERROR
-			} else if err = vm.setStack(f.framePointer+bytecode.GetA(instruction), val); err != nil {
+			bytecode.BAND, bytecode.BOR, bytecode.BXOR, bytecode.SHL, bytecode.SHR, bytecode.SAR:
+			bVal := vm.get(f, bytecode.GetB(instruction), false)
+			cVal := vm.get(f, bytecode.GetC(instruction), false)
+			var val Value
+			var ok bool
+			if val, ok, err = numArith(bytecodeToMetaMethod[op], bVal, cVal); err != nil {
 				goto VM_ERROR
-			}
-		case bytecode.ADDI:
-			bReg := bytecode.GetB(instruction)
-			bVal := vm.get(f, bReg, false)
-			cVal := bytecode.GetsC(instruction)
-			if !isNumber(bVal) {
-				var val any
-				if val, err = arithMetamethodOnly(vm, parse.MetaAdd, bVal, cVal); err != nil {
-					err = vm.annotate(f, bReg, err)
-					goto VM_ERROR
-				}
+			} else if ok { // skip the MMBIN, otherwise it will call the metamethod
 				err = vm.setStack(f.framePointer+bytecode.GetA(instruction), val)
+				f.pc++
+			}
+		case bytecode.ADDI, bytecode.SHLI, bytecode.SHRI, bytecode.ADDK, bytecode.SUBK, bytecode.MULK, bytecode.MODK,
+			bytecode.POWK, bytecode.DIVK, bytecode.IDIVK, bytecode.BANDK, bytecode.BORK, bytecode.BXORK:
+			lVal := vm.get(f, bytecode.GetB(instruction), false)
+			var rVal Value
+			if op == bytecode.ADDI || op == bytecode.SHLI || op == bytecode.SHRI {
+				rVal = intValue(bytecode.GetsC(instruction))
 			} else {
-				err = vm.setStack(
-					f.framePointer+bytecode.GetA(instruction),
-					intArith(parse.MetaAdd, toInt(bVal), cVal),
-				)
+				rVal = f.fn.konst(bytecode.GetC(instruction))
+			}
+			if bytecode.GetK(instruction) {
+				lVal, rVal = rVal, lVal
 			}
-		case bytecode.ADDK:
+			var val Value
+			var ok bool
+			if val, ok, err = numArith(bytecodeToMetaMethod[op], lVal, rVal); err != nil {
+				goto VM_ERROR
+			} else if ok {
+				err = vm.setStack(f.framePointer+bytecode.GetA(instruction), val)
+				f.pc++
+			}
+		case bytecode.MMBIN, bytecode.MMBINI, bytecode.MMBINK:
+			lReg, rReg := bytecode.GetA(instruction), int64(-1)
+			lVal := vm.get(f, lReg, false)
+			var rVal Value
+			switch op {
+			case bytecode.MMBIN:
+				rReg = bytecode.GetB(instruction)
+				rVal = vm.get(f, rReg, false)
+			case bytecode.MMBINI:
+				rVal = intValue(bytecode.GetsB(instruction))
+			default:
+				rVal = f.fn.konst(bytecode.GetB(instruction))
+			}
+			if bytecode.GetK(instruction) {
+				lVal, rVal = rVal, lVal
+				lReg, rReg = rReg, lReg
+			}
+			var val any
+			metaOp := bytecodeToMetaMethod[bytecode.Op(bytecode.GetC(instruction))]
+			if val, err = vm.arithMetamethod(metaOp, lVal.Any(), rVal.Any()); err != nil {
+				err = vm.annotateArithErr(f, lVal, lReg, rReg, err)
+				goto VM_ERROR
+			}
+			err = vm.setStack(f.framePointer+bytecode.GetA(f.fn.ByteCodes[f.pc-1]), ValueOf(val))
+		case bytecode.UNM, bytecode.BNOT:
 			bReg := bytecode.GetB(instruction)
 			bVal := vm.get(f, bReg, false)
-			cVal := f.fn.GetConst(bytecode.GetC(instruction))
-			if !isNumber(bVal) {
-				var val any
-				if val, err = arithMetamethodOnly(vm, parse.MetaAdd, bVal, cVal); err != nil {
-					err = vm.annotate(f, bReg, err)
-					goto VM_ERROR
-				}
-				err = vm.setStack(f.framePointer+bytecode.GetA(instruction), val)
-			} else {
-				var val any
-				if val, err = arith(vm, parse.MetaAdd, bVal, cVal); err != nil {
-					err = vm.annotate(f, bReg, err)
-					goto VM_ERROR
-				}
-				err = vm.setStack(f.framePointer+bytecode.GetA(instruction), val)
+			metaOp := bytecodeToMetaMethod[op]
+			var val Value
+			var ok bool
+			if val, ok, err = unaryArith(metaOp, bVal); err == nil && !ok {
+				var res any
+				res, err = vm.arithMetamethod(metaOp, bVal.Any(), bVal.Any())
+				val = ValueOf(res)
+			}
+			if err != nil {
+				err = vm.annotate(f, bReg, err)
+				goto VM_ERROR
 			}
-		case bytecode.NOT:
-			val := !toBool(vm.get(f, bytecode.GetB(instruction), bytecode.GetK(instruction)))
 			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), val)
+		case bytecode.NOT:
+			val := !vm.get(f, bytecode.GetB(instruction), bytecode.GetK(instruction)).truthy()
+			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), boolValue(val))
 		case bytecode.CONCAT:
 			b := bytecode.GetB(instruction)
-			c := bytecode.GetC(instruction)
-			if c < b {
-				c = b + 1
-			}
-			result := vm.get(f, b, false)
-			for i := b + 1; i <= c; i++ {
-				next := vm.get(f, i, false)
-				aCoercable := isString(result) || isNumber(result)
-				bCoercable := isString(next) || isNumber(next)
-				var didDelegate bool
-				var res []any
-				if aCoercable && bCoercable {
-					result = ToString(result) + ToString(next)
-				} else if didDelegate, res, err = vm.delegateMetamethodBinop(parse.MetaConcat, result, next); err != nil {
-					goto VM_ERROR
-				} else if didDelegate && len(res) > 0 {
-					result = res[0]
-				} else {
-					bad := result
-					if aCoercable {
-						bad = next
-					}
-					err = fmt.Errorf("attempt to concatenate a %v value", nameOfType(bad))
-					goto VM_ERROR
-				}
-			}
-			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), result)
+			err = vm.concat(f, instruction, b+1, vm.get(f, b, false).Any())
 		case bytecode.TBC:
 			f.tbcValues = append(f.tbcValues, f.framePointer+bytecode.GetA(instruction))
 		case bytecode.JMP:
 			f.pc += bytecode.GetJump(instruction)
 		case bytecode.CLOSE:
 			vm.closeRange(f, bytecode.GetA(instruction))
-		case bytecode.EQ:
+		case bytecode.EQ, bytecode.EQK, bytecode.EQI:
 			expected := bytecode.GetA(instruction) != 0
 			lVal := vm.get(f, bytecode.GetB(instruction), false)
-			rVal := vm.get(f, bytecode.GetC(instruction), false)
+			var rVal Value
+			switch op {
+			case bytecode.EQK:
+				rVal = f.fn.konst(bytecode.GetC(instruction))
+			case bytecode.EQI:
+				rVal = intValue(bytecode.GetsC(instruction))
+			default:
+				rVal = vm.get(f, bytecode.GetC(instruction), false)
+			}
 			var isEq bool
 			if isEq, err = eq(vm, lVal, rVal); err != nil {
 				goto VM_ERROR
 			} else if isEq != expected {
 				f.pc++
 			}
-		case bytecode.LT:
+		case bytecode.LT, bytecode.LE, bytecode.LTI, bytecode.LEI:
 			expected := bytecode.GetA(instruction) != 0
 			bVal := vm.get(f, bytecode.GetB(instruction), false)
-			cVal := vm.get(f, bytecode.GetC(instruction), false)
-			var res int
-			if res, err = compareVal(vm, parse.MetaLt, bVal, cVal); err != nil {
-				goto VM_ERROR
-			} else if isMatch := res < 0; isMatch != expected {
-				f.pc++
+			var cVal Value
+			if op == bytecode.LTI || op == bytecode.LEI {
+				cVal = intValue(bytecode.GetsC(instruction))
+				if bytecode.GetK(instruction) {
+					bVal, cVal = cVal, bVal
+				}
+			} else {
+				cVal = vm.get(f, bytecode.GetC(instruction), false)
 			}
-		case bytecode.LE:
-			expected := bytecode.GetA(instruction) != 0
-			bVal := vm.get(f, bytecode.GetB(instruction), false)
-			cVal := vm.get(f, bytecode.GetC(instruction), false)
 			var res int
-			if res, err = compareVal(vm, parse.MetaLe, bVal, cVal); err != nil {
+			if op == bytecode.LT || op == bytecode.LTI {
+				if res, err = compareVal(vm, parse.MetaLt, bVal, cVal); err != nil {
+					goto VM_ERROR
+				} else if isMatch := res < 0; isMatch != expected {
+					f.pc++
+				}
+			} else if res, err = compareVal(vm, parse.MetaLe, bVal, cVal); err != nil {
 				goto VM_ERROR
 			} else if isMatch := res <= 0; isMatch != expected {
 				f.pc++
 			}
 		case bytecode.TEST:
 			expected := bytecode.GetB(instruction) != 0
-			actual := toBool(vm.get(f, bytecode.GetA(instruction), false))
+			actual := vm.get(f, bytecode.GetA(instruction), false).truthy()
 			if expected != actual {
 				f.pc++
 			}
+		case bytecode.TESTSET:
+			expected := bytecode.GetC(instruction) != 0
+			val := vm.get(f, bytecode.GetB(instruction), false)
+			if expected != val.truthy() {
+				f.pc++
+			} else {
+				err = vm.setStack(f.framePointer+bytecode.GetA(instruction), val)
+			}
 		case bytecode.LEN:
 			val := vm.get(f, bytecode.GetB(instruction), bytecode.GetK(instruction))
 			dst := f.framePointer + bytecode.GetA(instruction)
-			if isString(val) {
-				err = vm.setStack(dst, int64(len(val.(string))))
-			} else if tbl, isTbl := val.(*Table); isTbl {
-				if method := findMetavalue(parse.MetaLen, tbl); method != nil {
+			if val.kind == kindString {
+				err = vm.setStack(dst, intValue(int64(len(val.str()))))
+			} else if val.kind == kindTable {
+				tbl := val.table()
+				if method := vm.findMetavalue(parse.MetaLen, tbl); method != nil {
 					var res []any
 					res, err = vm.call(method, []any{tbl})
 					if err != nil {
 						goto VM_ERROR
 					} else if len(res) > 0 {
-						if err = vm.setStack(dst, res[0]); err != nil {
+						if err = vm.setStack(dst, ValueOf(res[0])); err != nil {
 							goto VM_ERROR
 						}
-					} else if err = vm.setStack(dst, nil); err != nil {
+					} else if err = vm.setStack(dst, nilValue); err != nil {
 						goto VM_ERROR
 					}
 				} else {
-					if err = vm.setStack(dst, int64(len(tbl.val))); err != nil {
+					if err = vm.setStack(dst, intValue(tbl.length())); err != nil {
 						goto VM_ERROR
 					}
 				}
 			} else {
-				err = fmt.Errorf("attempt to get length of a %v value", nameOfType(val))
+				err = fmt.Errorf("attempt to get length of a %v value", nameOfType(val.Any()))
 				goto VM_ERROR
 			}
 		case bytecode.GETTABLE:
@@ -446,28 +725,27 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 			keyK := bytecode.GetK(instruction)
 			tblReg := bytecode.GetB(instruction)
 			tbl := vm.get(f, tblReg, false)
-			var val any
-			if val, err = vm.index(tbl, nil, vm.get(f, keyIdx, keyK)); err != nil {
+			var val Value
+			if val, err = vm.index(tbl, nilValue, vm.get(f, keyIdx, keyK)); err != nil {
 				err = vm.annotate(f, tblReg, err)
 				goto VM_ERROR
 			} else if err = vm.setStack(f.framePointer+bytecode.GetA(instruction), val); err != nil {
 				goto VM_ERROR
 			}
-		case bytecode.GETI:
+		case bytecode.GETI, bytecode.GETFIELD:
 			tblReg := bytecode.GetB(instruction)
 			tbl := vm.get(f, tblReg, false)
-			var val any
-			if val, err = vm.index(tbl, nil, bytecode.GetC(instruction)); err != nil {
-				err = vm.annotate(f, tblReg, err)
-				goto VM_ERROR
-			} else if err = vm.setStack(f.framePointer+bytecode.GetA(instruction), val); err != nil {
-				goto VM_ERROR
+			key, val := intValue(bytecode.GetC(instruction)), nilValue
+			if op == bytecode.GETFIELD {
+				key = f.fn.konst(bytecode.GetC(instruction))
 			}
-		case bytecode.GETFIELD:
-			tblReg := bytecode.GetB(instruction)
-			tbl := vm.get(f, tblReg, false)
-			var val any
-			if val, err = vm.index(tbl, nil, f.fn.GetConst(bytecode.GetC(instruction))); err != nil {
+			// tables without a metatable can be read directly without looking up __index
+			if tbl.kind == kindTable && tbl.table().metatable == nil {
+				val, err = tbl.table().get(key)
+			} else {
+				val, err = vm.index(tbl, nilValue, key)
+			}
+			if err != nil {
 				err = vm.annotate(f, tblReg, err)
 				goto VM_ERROR
 			} else if err = vm.setStack(f.framePointer+bytecode.GetA(instruction), val); err != nil {
@@ -487,49 +765,40 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 				err = vm.annotate(f, tblReg, err)
 				goto VM_ERROR
 			}
-			vm.Stack[f.framePointer+keyIdx] = nil
+			vm.Stack[f.framePointer+keyIdx] = nilValue
 			if !konst {
-				vm.Stack[f.framePointer+valueIdx] = nil
+				vm.Stack[f.framePointer+valueIdx] = nilValue
 			}
-		case bytecode.SETI:
+		case bytecode.SETI, bytecode.SETFIELD:
 			tblReg := bytecode.GetA(instruction)
 			valueIdx := bytecode.GetC(instruction)
 			konst := bytecode.GetK(instruction)
-			err = vm.newIndex(
-				vm.get(f, tblReg, false),
-				bytecode.GetB(instruction),
-				vm.get(f, valueIdx, konst),
-			)
-			if err != nil {
-				err = vm.annotate(f, tblReg, err)
-				goto VM_ERROR
+			tbl := vm.get(f, tblReg, false)
+			key := intValue(bytecode.GetB(instruction))
+			if op == bytecode.SETFIELD {
+				key = f.fn.konst(bytecode.GetB(instruction))
 			}
-			if !konst {
-				vm.Stack[f.framePointer+valueIdx] = nil
+			// tables without a metatable can be written directly without looking up __newindex
+			if tbl.kind == kindTable && tbl.table().metatable == nil {
+				err = vm.tableSet(tbl.table(), key, vm.get(f, valueIdx, konst))
+			} else {
+				err = vm.newIndex(tbl, key, vm.get(f, valueIdx, konst))
 			}
-		case bytecode.SETFIELD:
-			tblReg := bytecode.GetA(instruction)
-			valueIdx := bytecode.GetC(instruction)
-			konst := bytecode.GetK(instruction)
-			err = vm.newIndex(
-				vm.get(f, tblReg, false),
-				f.fn.GetConst(bytecode.GetB(instruction)),
-				vm.get(f, valueIdx, konst),
-			)
 			if err != nil {
 				err = vm.annotate(f, tblReg, err)
 				goto VM_ERROR
 			}
 			if !konst {
-				vm.Stack[f.framePointer+valueIdx] = nil
+				vm.Stack[f.framePointer+valueIdx] = nilValue
 			}
 		case bytecode.SETLIST:
 			itbl := bytecode.GetA(instruction)
-			tbl, ok := vm.get(f, itbl, false).(*Table)
-			if !ok {
-				err = fmt.Errorf("attempt to index a %v value", nameOfType(vm.get(f, bytecode.GetA(instruction), false)))
+			tblVal := vm.get(f, itbl, false)
+			if tblVal.kind != kindTable {
+				err = fmt.Errorf("attempt to index a %v value", nameOfType(tblVal.Any()))
 				goto VM_ERROR
 			}
+			tbl := tblVal.table()
 			start := itbl + 1
 			nvals := (bytecode.GetvB(instruction) - 1)
 			if nvals < 0 {
@@ -545,9 +814,11 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 				}
 				index = int64(bytecode.GetAx(extraARg)) - 1
 			}
-			ensureSize(&tbl.val, int(index+nvals)-1)
+			arrCap := int64(cap(tbl.val))
+			tbl.ensureArray(index + nvals)
+			vm.recordAlloc(allocTable, (int64(cap(tbl.val))-arrCap)*valueSize)
 			for i := range nvals {
-				tbl.val[i+index] = vm.get(f, start+i, false)
+				tbl.seti(index+i+1, vm.get(f, start+i, false))
 			}
 			vm.top = f.framePointer + itbl + 1
 		case bytecode.GETUPVAL:
@@ -559,8 +830,13 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 			keyK := bytecode.GetK(instruction)
 			upIdx := bytecode.GetB(instruction)
 			tbl := f.upvals[upIdx].Get()
-			var val any
-			if val, err = vm.index(tbl, nil, vm.get(f, keyIdx, keyK)); err != nil {
+			key, val := vm.get(f, keyIdx, keyK), nilValue
+			if tbl.kind == kindTable && tbl.table().metatable == nil {
+				val, err = tbl.table().get(key)
+			} else {
+				val, err = vm.index(tbl, nilValue, key)
+			}
+			if err != nil {
 				err = vm.annotateUpvalue(f, upIdx, err)
 				goto VM_ERROR
 			} else if err = vm.setStack(f.framePointer+bytecode.GetA(instruction), val); err != nil {
@@ -582,8 +858,8 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 		case bytecode.SELF:
 			tblReg := bytecode.GetB(instruction)
 			tbl := vm.get(f, tblReg, false)
-			var fn any
-			if fn, err = vm.index(tbl, nil, f.fn.GetConst(bytecode.GetC(instruction))); err != nil {
+			var fn Value
+			if fn, err = vm.index(tbl, nilValue, f.fn.konst(bytecode.GetC(instruction))); err != nil {
 				err = vm.annotate(f, tblReg, err)
 				goto VM_ERROR
 			} else if err = vm.setStack(f.framePointer+bytecode.GetA(instruction), fn); err != nil {
@@ -602,11 +878,13 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 			rootTailCall := bytecode.GetOp(instruction) == bytecode.TAILCALL && f.prev == nil
 			if bytecode.GetOp(instruction) == bytecode.TAILCALL {
 				vm.popCallstack()
-				vm.closeUpvalues(f)
+				if err := vm.closeUpvalues(f, nil); err != nil {
+					_, _ = warn(vm, err)
+				}
 				copy(vm.Stack[f.framePointer-1:], vm.Stack[ifn:])
 				newTop := vm.top - (ifn - f.framePointer + 1)
 				for i := min(vm.top, int64(len(vm.Stack))-1); i > newTop; i-- {
-					vm.Stack[i] = nil
+					vm.Stack[i] = nilValue
 				}
 				vm.top = newTop
 				ifn = f.framePointer - 1
@@ -618,32 +896,33 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 			callChain := 0
 		RESOLVE_FN_LOOP:
 			for {
-				switch tval := fnVal.(type) {
-				case *Closure, *GoFunc:
+				switch fnVal.kind {
+				case kindFunction:
 					break RESOLVE_FN_LOOP
-				case *Table:
+				case kindTable:
+					tval := fnVal.table()
 					callChain++
 					if callChain > conf.MAXCALLCHAIN {
 						err = errors.New("'__call' chain too long; possible loop")
 						goto VM_ERROR
 					}
-					metaFn := findMetavalue(parse.MetaCall, tval)
+					metaFn := vm.findMetavalue(parse.MetaCall, tval)
 					if metaFn == nil {
 						err = vm.annotate(callerFrame, fnReg, fmt.Errorf("attempt to call a %s value", nameOfType(tval)))
 						goto VM_ERROR
 					}
-					fnVal = metaFn
 					for i := nargs; i >= 1; i-- {
 						if err = vm.setStack(ifn+i+1, vm.Stack[ifn+i]); err != nil {
 							goto VM_ERROR
 						}
 					}
-					if err = vm.setStack(ifn+1, tval); err != nil {
+					if err = vm.setStack(ifn+1, fnVal); err != nil {
 						goto VM_ERROR
 					}
+					fnVal = ValueOf(metaFn)
 					nargs++
 				default:
-					err = vm.annotate(callerFrame, fnReg, fmt.Errorf("attempt to call a %s value", nameOfType(fnVal)))
+					err = vm.annotate(callerFrame, fnReg, fmt.Errorf("attempt to call a %s value", nameOfType(fnVal.Any())))
 					goto VM_ERROR
 				}
 			}
@@ -654,26 +933,31 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 				vm.top = ifn + 1 + nargs
 			}
 
-			switch tfn := fnVal.(type) {
+			switch tfn := fnVal.ref().(type) {
 			case *Closure:
-				var xargs []any
+				var xargs []Value
 				if ifn+1+tfn.val.Arity < vm.top {
-					xargs = make([]any, max(vm.top-(ifn+tfn.val.Arity)-1, 0))
+					xargs = make([]Value, max(vm.top-(ifn+tfn.val.Arity)-1, 0))
 					copy(xargs, vm.Stack[ifn+1+tfn.val.Arity:vm.top])
 				}
-				f = &frame{
+				next := vm.reuseFrame()
+				*next = frame{
 					prev:         f,
 					fn:           tfn.val,
 					framePointer: ifn + 1,
 					pc:           -1, // because at the end of this instruction it will be incremented
 					xargs:        xargs,
 					upvals:       tfn.upvalues,
-					openBrokers:  []*upvalueBroker{},
-					tbcValues:    []int64{},
+					openBrokers:  next.openBrokers[:0],
+					tbcValues:    next.tbcValues[:0],
+				}
+				f = next
+				if err = vm.ensureFrame(f); err != nil {
+					goto VM_ERROR
 				}
 				if diff := f.fn.Arity - nargs; nargs > 0 && diff > 0 {
 					for i := nargs; i <= f.fn.Arity; i++ {
-						if err = vm.setStack(f.framePointer+i, nil); err != nil {
+						if err = vm.setStack(f.framePointer+i, nilValue); err != nil {
 							goto VM_ERROR
 						}
 					}
@@ -686,7 +970,9 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 					goto VM_ERROR
 				}
 				var retVals []any
+				vm.nny++
 				retVals, err = tfn.val(vm, vm.argsFromStack(ifn+1, nargs))
+				vm.nny--
 				if err != nil {
 					var inrp *Interrupt
 					if errors.As(err, &inrp) {
@@ -697,18 +983,22 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 							}
 							os.Exit(inrp.code)
 						case InterruptYield:
-							if !vm.yieldable {
-								err = errors.New("cannot yield from outside a coroutine")
+							if vm.boundary != nil {
+								// the go function made a call with a continuation that yielded
+								if f == nil {
+									if f, err = vm.returnFrame(ifn); err != nil {
+										goto VM_ERROR
+									}
+									ifn = f.framePointer
+								}
+								vm.linkBoundary(f, true, ifn, nret)
+								return nil, inrp
+							} else if err = vm.suspend(f, ifn, nret); err != nil {
 								goto VM_ERROR
 							}
-							f.pc++
-							vm.yieldFrame = f
-							vm.yielded = true
-							vm.status = threadStateSuspended
-							vm.popCallstack()
-							return retVals, inrp
+							return nil, inrp
 						case InterruptDebug:
-							replfn := parse.NewFnProtoFrom(f.fn)
+							replfn := newFnProto(parse.NewFnProtoFrom(f.fn.FnProto))
 							replframe := vm.newFrame(replfn, f.framePointer, 0, f.upvals, f.xargs...)
 							if err = vm.repl(replframe); err != nil {
 								goto VM_ERROR
@@ -716,6 +1006,10 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 						}
 					} else {
 						vm.popCallstack()
+						if rootTailCall {
+							// the tail call already popped the caller off of the call stack.
+							err = newRuntimeErrIn(vm, callerFrame.fn.Filename, li, err)
+						}
 						goto VM_ERROR
 					}
 				}
@@ -730,7 +1024,6 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 					goto VM_ERROR
 				}
 				if rootTailCall {
-					vm.status = threadStateDead
 					return retVals, nil
 				}
 			}
@@ -740,17 +1033,15 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 			if nret == -1 {
 				nret = vm.top - (f.framePointer + bytecode.GetA(instruction))
 			}
-			if f.prev == nil {
-				retVals := make([]any, nret)
-				copy(retVals, vm.Stack[addr:addr+nret])
-				for i, val := range retVals {
-					if val == nil {
-						retVals[i] = nil
-					}
-				}
+			if f.prev == nil || f.cont != nil {
+				retVals := valuesToAny(vm.Stack[addr : addr+nret])
 				vm.cleanup(f, f.framePointer-1)
-				vm.status = threadStateDead
-				return retVals, nil
+				if f.cont == nil {
+					return retVals, nil
+				} else if f, err = vm.finish(f, retVals, nil); err != nil {
+					goto VM_ERROR
+				}
+				break
 			}
 
 			copy(vm.Stack[f.framePointer-1:], vm.Stack[addr:addr+nret])
@@ -760,40 +1051,49 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 			// if we don't have enough values, insert nils to pad the amount out.
 			if retVals < nret {
 				for range nret - retVals {
-					if _, err = vm.push(nil); err != nil {
+					if _, err = vm.pushValue(nilValue); err != nil {
 						goto VM_ERROR
 					}
 				}
 			} else if nret == 0 {
-				if _, err = vm.push(nil); err != nil {
+				if _, err = vm.pushValue(nilValue); err != nil {
 					goto VM_ERROR
 				}
 			}
-			f = f.prev
+			f = vm.returnTo(f)
 		case bytecode.RETURN0:
 			vm.cleanup(f, f.framePointer-1)
-			if f.prev == nil {
-				vm.status = threadStateDead
+			if f.cont != nil {
+				if f, err = vm.finish(f, []any{}, nil); err != nil {
+					goto VM_ERROR
+				}
+				break
+			} else if f.prev == nil {
 				return []any{nil}, nil
 			}
-			_, err = vm.push(nil)
-			f = f.prev
+			_, err = vm.pushValue(nilValue)
+			f = vm.returnTo(f)
 		case bytecode.RETURN1:
 			addr := f.framePointer + bytecode.GetA(instruction)
 			returnVal := vm.Stack[addr]
 			vm.cleanup(f, f.framePointer-1)
-			if f.prev == nil {
-				vm.status = threadStateDead
-				return []any{returnVal}, nil
+			if f.cont != nil {
+				if f, err = vm.finish(f, []any{returnVal.Any()}, nil); err != nil {
+					goto VM_ERROR
+				}
+				break
+			} else if f.prev == nil {
+				return []any{returnVal.Any()}, nil
 			}
-			_, err = vm.push(returnVal)
-			f = f.prev
+			_, err = vm.pushValue(returnVal)
+			f = vm.returnTo(f)
 		case bytecode.VARARG:
 			vm.top = f.framePointer + bytecode.GetA(instruction)
-			_, err = vm.push(ensureLenNil(f.xargs, int(bytecode.GetB(instruction)-1))...)
+			_, err = vm.pushValue(ensureLenNil(f.xargs, int(bytecode.GetB(instruction)-1))...)
 		case bytecode.CLOSURE:
-			cls := f.fn.FnTable[bytecode.GetBx(instruction)]
+			cls := f.fn.fnTable[bytecode.GetBx(instruction)]
 			closureUpvals := make([]*upvalueBroker, len(cls.UpIndexes))
+			allocSize := closureSize + int64(len(closureUpvals))*pointerSize
 			for i, idx := range cls.UpIndexes {
 				if idx.FromStack {
 					if j, ok := search(f.openBrokers, uint64(f.framePointer)+uint64(idx.Index), findBroker); ok {
@@ -806,52 +1106,43 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 						)
 						f.openBrokers = append(f.openBrokers, newBroker)
 						closureUpvals[i] = newBroker
+						allocSize += brokerSize
 					}
 				} else {
 					closureUpvals[i] = f.upvals[idx.Index]
 				}
 			}
-			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), &Closure{val: cls, upvalues: closureUpvals})
+			vm.recordAlloc(allocClosure, allocSize)
+			err = vm.setStack(f.framePointer+bytecode.GetA(instruction), ValueOf(&Closure{val: cls, upvalues: closureUpvals}))
 		case bytecode.FORPREP:
 			ivar := bytecode.GetA(instruction)
-			hasFloat := false
 			for i := ivar; i <= ivar+2; i++ {
-				val := vm.get(f, i, false)
-				switch val.(type) {
-				case int64:
-				case float64:
-					hasFloat = true
-				default:
-					err = fmt.Errorf(forNumMsgs[i-ivar], nameOfType(val))
+				if val := vm.get(f, i, false); !val.isNumber() {
+					err = fmt.Errorf(forNumMsgs[i-ivar], nameOfType(val.Any()))
 					goto VM_ERROR
 				}
 			}
 
-			if hasFloat {
-				for i := ivar; i <= ivar+2; i++ {
-					if _, ok := vm.get(f, i, false).(int64); !ok {
-						fVal := toFloat(vm.get(f, i, false))
-						if err = vm.setStack(f.framePointer+i, fVal); err != nil {
-							goto VM_ERROR
-						}
-					}
-				}
-			}
-
-			if step := vm.get(f, ivar+2, false); toInt(step) == 0 {
+			i := vm.get(f, ivar, false)
+			limit := vm.get(f, ivar+1, false)
+			step := vm.get(f, ivar+2, false)
+			if step.toFloat() == 0 {
 				err = errors.New("0 step in numerical for")
 				goto VM_ERROR
 			}
 
-			i := vm.get(f, ivar, false)
-			step := vm.get(f, ivar+2, false)
-			if iVal, isInt := i.(int64); isInt {
-				stepVal := step.(int64)
-				err = vm.setStack(f.framePointer+ivar, iVal-stepVal)
+			// the loop is only done with integers if both the initial value and the
+			// step are integers, otherwise all three are converted to floats.
+			if i.kind == kindInt && step.kind == kindInt {
+				i = intValue(i.int() - step.int())
 			} else {
-				iVal := i.(float64)
-				stepVal := step.(float64)
-				err = vm.setStack(f.framePointer+ivar, iVal-stepVal)
+				limit, step = floatValue(limit.toFloat()), floatValue(step.toFloat())
+				i = floatValue(i.toFloat() - step.float())
+			}
+			for j, val := range [3]Value{i, limit, step} {
+				if err = vm.setStack(f.framePointer+ivar+int64(j), val); err != nil {
+					goto VM_ERROR
+				}
 			}
 
 			f.pc += bytecode.GetBx(instruction)
@@ -860,18 +1151,21 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 			i := vm.get(f, ivar, false)
 			limit := vm.get(f, ivar+1, false)
 			step := vm.get(f, ivar+2, false)
-			if iVal, isInt := i.(int64); isInt {
-				stepVal := step.(int64)
-				err = vm.setStack(f.framePointer+ivar, iVal+stepVal)
+			var check bool
+			if i.kind == kindInt {
+				next, stepVal := i.int()+step.int(), step.int()
+				i = intValue(next)
+				if limit.kind == kindInt {
+					check = (stepVal > 0 && next <= limit.int()) || (stepVal < 0 && next >= limit.int())
+				} else {
+					check = (stepVal > 0 && float64(next) <= limit.float()) || (stepVal < 0 && float64(next) >= limit.float())
+				}
 			} else {
-				iVal := i.(float64)
-				stepVal := step.(float64)
-				err = vm.setStack(f.framePointer+ivar, iVal+stepVal)
+				next, stepVal := i.float()+step.float(), step.float()
+				i = floatValue(next)
+				check = (stepVal > 0 && next <= limit.float()) || (stepVal < 0 && next >= limit.float())
 			}
-			i = vm.get(f, ivar, false)
-
-			check := (toFloat(step) > 0 && toFloat(i) <= toFloat(limit)) ||
-				(toFloat(step) < 0 && toFloat(i) >= toFloat(limit))
+			err = vm.setStack(f.framePointer+ivar, i)
 
 			if check {
 				f.pc -= bytecode.GetBx(instruction)
@@ -879,32 +1173,18 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 		case bytecode.TFORCALL:
 			idx := bytecode.GetA(instruction)
 			fn := vm.get(f, idx, false)
+			// the state and control values are passed in an array so that they stay
+			// on the go stack.
+			args := [2]any{vm.Stack[f.framePointer+idx+1].Any(), vm.Stack[f.framePointer+idx+2].Any()}
 			var values []any
-			values, err = vm.call(fn, vm.argsFromStack(f.framePointer+idx+1, 2))
-			if err != nil {
+			if values, err = vm.call(fn.Any(), args[:]); err != nil {
 				goto VM_ERROR
 			}
-			var ctrl any
-			if len(values) > 0 {
-				ctrl = values[0]
-			}
-			if err = vm.setStack(f.framePointer+idx+2, ctrl); err != nil {
-				goto VM_ERROR
-			}
-			// TODO set range instead of iteration
-			for i := range bytecode.GetsBx(instruction) {
-				var val any
-				if i < int64(len(values)) {
-					val = values[i]
-				}
-				if err = vm.setStack(f.framePointer+idx+i+3, val); err != nil {
-					goto VM_ERROR
-				}
-			}
+			err = vm.setForValues(f, instruction, values)
 		case bytecode.TFORLOOP:
 			idx := bytecode.GetA(instruction)
 			control := vm.get(f, idx+1, false)
-			if control != nil {
+			if !control.isNil() {
 				f.pc -= bytecode.GetBx(instruction)
 			}
 		default:
@@ -913,14 +1193,26 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 	VM_ERROR:
 		// centralized eval error handling for frame cleanup and everything
 		if err != nil {
+			if isYield(err) {
+				if vm.boundary != nil {
+					// a metamethod yielded, the instruction is finished once it returns.
+					vm.linkBoundary(f, false, 0, 0)
+				}
+				return nil, err
+			}
 			// format error before cleanup to capture callstack
 			err = newRuntimeErr(vm, li, err)
-			for f != nil {
+			for err != nil && f != nil {
 				vm.cleanup(f, f.framePointer-1)
-				f = f.prev
+				if f.cont == nil {
+					f = f.prev
+				} else if f, err = vm.finish(f, nil, err); isYield(err) {
+					return nil, err
+				}
+			}
+			if err != nil {
+				return nil, err
 			}
-			vm.status = threadStateDead
-			return nil, err
 		}
 
 		// next instruction
@@ -928,39 +1220,84 @@ func (vm *VM) eval(f *frame, pushFrame bool) ([]any, error) {
 	}
 }
 
-func (vm *VM) argsFromStack(offset, nargs int64) []any {
-	args := []any{}
-	if nargs < 0 {
-		nargs = vm.top - offset
+// concat concatenates result with the registers from start to the end of the
+// CONCAT instruction and stores it in the destination register.
+func (vm *VM) concat(f *frame, instruction uint32, start int64, result any) error {
+	b := bytecode.GetB(instruction)
+	c := bytecode.GetC(instruction)
+	if c < b {
+		c = b + 1
 	}
-	for _, val := range vm.Stack[offset : offset+nargs] {
-		if val != nil {
-			args = append(args, val)
+	for i := start; i <= c; i++ {
+		next := vm.get(f, i, false).Any()
+		aCoercable := isString(result) || isNumber(result)
+		bCoercable := isString(next) || isNumber(next)
+		if aCoercable && bCoercable {
+			result = ToString(result) + ToString(next)
+			continue
+		}
+		f.concatAt = i
+		if didDelegate, res, err := vm.delegateMetamethodBinop(parse.MetaConcat, result, next); err != nil {
+			return err
+		} else if didDelegate && len(res) > 0 {
+			result = res[0]
 		} else {
-			args = append(args, nil)
+			bad := result
+			if aCoercable {
+				bad = next
+			}
+			return fmt.Errorf("attempt to concatenate a %v value", nameOfType(bad))
 		}
 	}
-	if diff := int(nargs) - len(args); diff > 0 {
-		for range diff {
-			args = append(args, nil)
+	if str, isStr := result.(string); isStr && c > b {
+		vm.recordAlloc(allocString, int64(len(str)))
+	}
+	return vm.setStack(f.framePointer+bytecode.GetA(instruction), ValueOf(result))
+}
+
+// setForValues stores the values returned by the iterator of a generic for.
+func (vm *VM) setForValues(f *frame, instruction uint32, values []any) error {
+	idx := bytecode.GetA(instruction)
+	var ctrl Value
+	if len(values) > 0 {
+		ctrl = ValueOf(values[0])
+	}
+	if err := vm.setStack(f.framePointer+idx+2, ctrl); err != nil {
+		return err
+	}
+	// TODO set range instead of iteration
+	for i := range bytecode.GetsBx(instruction) {
+		var val Value
+		if i < int64(len(values)) {
+			val = ValueOf(values[i])
+		}
+		if err := vm.setStack(f.framePointer+idx+i+3, val); err != nil {
+			return err
 		}
 	}
-	return args
+	return nil
 }
 
-func (vm *VM) get(f *frame, id int64, isConst bool) any {
+func (vm *VM) argsFromStack(offset, nargs int64) []any {
+	if nargs < 0 {
+		nargs = vm.top - offset
+	}
+	return valuesToAny(vm.Stack[offset : offset+nargs])
+}
+
+func (vm *VM) get(f *frame, id int64, isConst bool) Value {
 	if isConst {
-		return f.fn.GetConst(id)
+		return f.fn.konst(id)
 	}
 
 	gID := f.framePointer + id
-	if gID >= vm.top || gID < 0 || vm.Stack[gID] == nil {
-		return nil
+	if gID >= vm.top || gID < 0 {
+		return nilValue
 	}
 	return vm.Stack[gID]
 }
 
-func (vm *VM) setStack(dst int64, val any) error {
+func (vm *VM) setStack(dst int64, val Value) error {
 	if dst < 0 {
 		return errors.New("cannot address negatively in the stack")
 	} else if err := vm.ensureStackSize(dst); err != nil {
@@ -973,106 +1310,117 @@ func (vm *VM) setStack(dst int64, val any) error {
 	return nil
 }
 
+// push converts go values and pushes them onto the top of the stack.
 func (vm *VM) push(vals ...any) (int64, error) {
-	if len(vals) == 0 {
-		return vm.top, nil
-	}
 	addr := vm.top
 	if err := vm.ensureStackSize(vm.top + int64(len(vals))); err != nil {
 		return -1, err
 	}
 	for _, val := range vals {
-		vm.Stack[vm.top] = val
+		vm.Stack[vm.top] = ValueOf(val)
 		vm.top++
 	}
 	return addr, nil
 }
 
+func (vm *VM) pushValue(vals ...Value) (int64, error) {
+	addr := vm.top
+	if err := vm.ensureStackSize(vm.top + int64(len(vals))); err != nil {
+		return -1, err
+	}
+	vm.top += int64(copy(vm.Stack[vm.top:], vals))
+	return addr, nil
+}
+
+// ensureFrame grows the stack to fit every register that a frame could use so
+// that instructions can index their registers directly.
+func (vm *VM) ensureFrame(f *frame) error {
+	return vm.ensureStackSize(f.framePointer + conf.MAXREGS)
+}
+
 func (vm *VM) ensureStackSize(index int64) error {
 	sliceLen := int64(len(vm.Stack))
 	if index < sliceLen {
 		return nil
 	}
-	growthAmount := (index - (sliceLen - 1)) * 2
+	growthAmount := max((index-(sliceLen-1))*2, sliceLen)
 	if growthAmount+sliceLen > conf.MAXSTACKSIZE {
 		growthAmount = conf.MAXSTACKSIZE - sliceLen
 	}
 	if growthAmount <= 0 {
 		return fmt.Errorf("stack overflow %v", index)
 	}
-	newSlice := make([]any, sliceLen+growthAmount)
+	newSlice := make([]Value, sliceLen+growthAmount)
 	copy(newSlice, vm.Stack)
 	vm.Stack = newSlice
 	return nil
 }
 
-func (vm *VM) index(source, table, key any) (any, error) {
-	if table == nil {
+func (vm *VM) index(source, table, key Value) (Value, error) {
+	if table.isNil() {
 		table = source
 	}
-	tbl, isTable := table.(*Table)
+	isTable := table.kind == kindTable
 	if isTable {
-		res, err := tbl.Get(key)
+		res, err := table.table().get(key)
 		if err != nil {
-			return nil, err
-		} else if res != nil {
+			return nilValue, err
+		} else if !res.isNil() {
 			return res, nil
 		}
 	}
-	metatable := getMetatable(table)
-	mIndex := string(parse.MetaIndex)
-	if metatable != nil && metatable.hashtable[mIndex] != nil {
-		switch metaVal := metatable.hashtable[mIndex].(type) {
-		case *GoFunc, *Closure:
-			if res, err := vm.call(metaVal, []any{source, key}); err != nil {
-				return nil, err
+	if metatable := vm.getMetatable(table.Any()); metatable != nil {
+		switch metaVal := metatable.getStr(string(parse.MetaIndex)); metaVal.kind {
+		case kindNil:
+		case kindFunction:
+			if res, err := vm.call(metaVal.Any(), []any{source.Any(), key.Any()}); err != nil {
+				return nilValue, err
 			} else if len(res) > 0 {
-				return res[0], nil
+				return ValueOf(res[0]), nil
 			}
-			return nil, nil
+			return nilValue, nil
 		default:
 			return vm.index(source, metaVal, key)
 		}
 	}
 	if isTable {
-		return nil, nil
+		return nilValue, nil
 	}
-	return nil, fmt.Errorf("attempt to index a %v value", nameOfType(table))
+	return nilValue, fmt.Errorf("attempt to index a %v value", nameOfType(table.Any()))
 }
 
-func (vm *VM) newIndex(table, key, value any) error {
-	tbl, isTbl := table.(*Table)
+func (vm *VM) newIndex(table, key, value Value) error {
+	isTbl := table.kind == kindTable
 	if isTbl {
-		res, err := tbl.Get(key)
+		res, err := table.table().get(key)
 		if err != nil {
 			return err
-		} else if res != nil {
-			return tbl.Set(key, value)
+		} else if !res.isNil() {
+			return vm.tableSet(table.table(), key, value)
 		}
 	}
-	metatable := getMetatable(table)
-	mNewIndex := string(parse.MetaNewIndex)
-	if metatable != nil && metatable.hashtable[mNewIndex] != nil {
-		switch metaVal := metatable.hashtable[mNewIndex].(type) {
-		case *GoFunc, *Closure:
-			_, err := vm.call(metaVal, []any{table, key})
+	if metatable := vm.getMetatable(table.Any()); metatable != nil {
+		switch metaVal := metatable.getStr(string(parse.MetaNewIndex)); metaVal.kind {
+		case kindNil:
+		case kindFunction:
+			_, err := vm.call(metaVal.Any(), []any{table.Any(), key.Any()})
 			return err
 		default:
 			return vm.newIndex(metaVal, key, value)
 		}
 	}
 	if isTbl {
-		return tbl.Set(key, value)
+		return vm.tableSet(table.table(), key, value)
 	}
-	return fmt.Errorf("attempt to index a %v value", nameOfType(table))
+	return fmt.Errorf("attempt to index a %v value", nameOfType(table.Any()))
 }
 
 func (vm *VM) delegateMetamethodBinop(op parse.MetaMethod, lval, rval any) (bool, []any, error) {
-	if method := findMetavalue(op, lval); method != nil {
+	if method := vm.findMetavalue(op, lval); method != nil {
 		ret, err := vm.call(method, []any{lval, rval})
 		return true, ret, annotateMetamethodErr(op, err)
-	} else if method := findMetavalue(op, rval); method != nil {
-		ret, err := vm.call(method, []any{rval, lval})
+	} else if method := vm.findMetavalue(op, rval); method != nil {
+		ret, err := vm.call(method, []any{lval, rval})
 		return true, ret, annotateMetamethodErr(op, err)
 	}
 	return false, nil, nil
@@ -1082,47 +1430,217 @@ func (vm *VM) callFrame(fn any, params []any) (*frame, error) {
 	switch tfn := fn.(type) {
 	case *Closure:
 		ifn, err := vm.push(append([]any{tfn}, params...)...)
+		var xargs []Value
+		if extra := int64(len(params)) - tfn.val.Arity; extra > 0 {
+			xargs = make([]Value, extra)
+			copy(xargs, vm.Stack[ifn+1+tfn.val.Arity:vm.top])
+		}
 		return &frame{
 			fn:           tfn.val,
 			framePointer: ifn + 1,
+			xargs:        xargs,
 			upvals:       tfn.upvalues,
 		}, err
 	default:
-		fn := &parse.FnProto{
+		fn := newFnProto(&parse.FnProto{
 			Filename: coreCallstackFilename,
 			LineInfo: parse.LineInfo{},
 			ByteCodes: []uint32{
 				bytecode.IABC(bytecode.CALL, 0, 0, 0, false),
 				bytecode.IAB(bytecode.RETURN, 0, 0),
 			},
-		}
+		})
 		ifn, err := vm.push(append([]any{fn, tfn}, params...)...)
 		return &frame{framePointer: ifn + 1, fn: fn}, err
 	}
 }
 
 func (vm *VM) call(fn any, params []any) ([]any, error) {
+	// lua calls do not recurse in go but calls made from go do, so they are
+	// limited separately.
+	if vm.ccallDepth+1 >= conf.MAXCCALLDEPTH {
+		return nil, errors.New("C stack overflow")
+	}
 	frame, err := vm.callFrame(fn, params)
 	if err != nil {
 		return nil, err
 	}
-	return vm.eval(frame, true)
+	vm.ccallDepth++
+	res, err := vm.eval(frame, true)
+	vm.ccallDepth--
+	if isYield(err) {
+		// the go stack that made this call is being unwound by a yield. The first
+		// frame of the call, a tail call may have replaced it, is left for the
+		// caller to link to the frame that made the call.
+		root := vm.yieldFrame
+		for root.prev != nil {
+			root = root.prev
+		}
+		root.cont = &continuation{}
+		vm.boundary = root
+	}
+	return res, err
+}
+
+// CallK calls fn from a go function like a regular call but allows fn to
+// yield. If it does, the yield is returned as the error, which the go function
+// must return as is, and once the thread is resumed and fn returns k is called
+// with its results to finish the go function.
+func (vm *VM) CallK(fn any, args []any, k Continuation) ([]any, error) {
+	return vm.callk(fn, args, k, false)
+}
+
+// PCallK is CallK in protected mode. Errors raised by fn are returned rather
+// than propagated and, after a yield, k is called with the error.
+func (vm *VM) PCallK(fn any, args []any, k Continuation) ([]any, error) {
+	return vm.callk(fn, args, k, true)
+}
+
+func (vm *VM) callk(fn any, args []any, k Continuation, protected bool) ([]any, error) {
+	// the go function making the call is not blocking yields anymore.
+	vm.nny--
+	res, err := vm.call(fn, args)
+	vm.nny++
+	if isYield(err) {
+		vm.boundary.cont.k = k
+		vm.boundary.cont.protected = protected
+	}
+	return res, err
+}
+
+// IsYield reports whether err is a yield unwinding the go stack, which a go
+// function has to return as is.
+func IsYield(err error) bool { return isYield(err) }
+
+func isYield(err error) bool {
+	var intr *Interrupt
+	return err != nil && errors.As(err, &intr) && intr.kind == InterruptYield
+}
+
+// suspend saves the state of the thread when f yields with a call at ifn.
+func (vm *VM) suspend(f *frame, ifn, nret int64) error {
+	vm.popCallstack()
+	if !vm.yieldable {
+		return errors.New("cannot yield from outside a coroutine")
+	} else if vm.nny > 0 {
+		return errors.New("attempt to yield across a C-call boundary")
+	} else if f == nil {
+		var err error
+		if f, err = vm.returnFrame(ifn); err != nil {
+			return err
+		}
+		ifn = f.framePointer
+	}
+	f.pc++
+	vm.yieldFrame = f
+	vm.yieldTop = ifn
+	vm.yieldNRet = nret
+	return nil
+}
+
+// returnFrame stands in for the frame at ifn that was replaced by a tail call to
+// a go function that yielded. Once the thread is resumed it returns the values
+// placed from its frame pointer, which is where the results of the call go.
+func (vm *VM) returnFrame(ifn int64) (*frame, error) {
+	return &frame{fn: returnProto, framePointer: ifn + 1, pc: -1}, vm.pushCallstack("", coreCallstackFilename, parse.LineInfo{})
+}
+
+// linkBoundary links the first frame of a go call that a yield is unwinding to
+// the frame f below it. fromGo is set when a go function called at ifn made the
+// call, otherwise the current instruction of f called a metamethod.
+func (vm *VM) linkBoundary(f *frame, fromGo bool, ifn, nret int64) {
+	b := vm.boundary
+	vm.boundary = nil
+	b.prev = f
+	b.cont.fromGo = fromGo
+	b.cont.ifn = ifn
+	b.cont.nret = nret
+}
+
+// finish completes the go call started by the frame b once it has returned res,
+// or failed with err, after the thread was resumed. It returns the frame to
+// continue from.
+func (vm *VM) finish(b *frame, res []any, err error) (*frame, error) {
+	f, cont := b.prev, b.cont
+	if !cont.fromGo {
+		if err != nil {
+			return f, err
+		}
+		return f, vm.finishOp(f, res)
+	}
+
+	if cont.k != nil && (err == nil || cont.protected) {
+		vm.nny++
+		res, err = cont.k(vm, res, err)
+		vm.nny--
+	}
+	if isYield(err) {
+		if vm.boundary != nil {
+			vm.linkBoundary(f, true, cont.ifn, cont.nret)
+		} else if serr := vm.suspend(f, cont.ifn, cont.nret); serr != nil {
+			return f, serr
+		}
+		return nil, err
+	}
+	vm.popCallstack()
+	if err != nil {
+		return f, err
+	}
+	vm.top = cont.ifn
+	if cont.nret > 0 && len(res) > int(cont.nret) {
+		res = res[:cont.nret]
+	} else if len(res) < int(cont.nret) {
+		res = ensureLenNil(res, int(cont.nret))
+	}
+	_, err = vm.push(res...)
+	return f, err
+}
+
+// finishOp completes the current instruction of f with the results of the
+// metamethod it called.
+func (vm *VM) finishOp(f *frame, res []any) error {
+	instruction := f.fn.ByteCodes[f.pc]
+	var val Value
+	if len(res) > 0 {
+		val = ValueOf(res[0])
+	}
+	switch bytecode.GetOp(instruction) {
+	case bytecode.MMBIN, bytecode.MMBINI, bytecode.MMBINK:
+		return vm.setStack(f.framePointer+bytecode.GetA(f.fn.ByteCodes[f.pc-1]), val)
+	case bytecode.SELF:
+		if err := vm.setStack(f.framePointer+bytecode.GetA(instruction)+1, vm.get(f, bytecode.GetB(instruction), false)); err != nil {
+			return err
+		}
+		return vm.setStack(f.framePointer+bytecode.GetA(instruction), val)
+	case bytecode.GETTABLE, bytecode.GETI, bytecode.GETFIELD, bytecode.GETTABUP,
+		bytecode.UNM, bytecode.BNOT, bytecode.LEN:
+		return vm.setStack(f.framePointer+bytecode.GetA(instruction), val)
+	case bytecode.EQ, bytecode.EQK, bytecode.EQI, bytecode.LT, bytecode.LE, bytecode.LTI, bytecode.LEI:
+		if val.truthy() != (bytecode.GetA(instruction) != 0) {
+			f.pc++
+		}
+	case bytecode.CONCAT:
+		return vm.concat(f, instruction, f.concatAt+1, val.Any())
+	case bytecode.TFORCALL:
+		return vm.setForValues(f, instruction, res)
+	}
+	return nil
 }
 
 func (vm *VM) toString(val any) (string, error) {
 	switch tin := val.(type) {
 	case *Table:
-		if mt := getMetatable(val); mt != nil {
-			if mt.hashtable[string(parse.MetaToString)] != nil {
-				res, err := vm.call(mt.hashtable[string(parse.MetaToString)], []any{val})
+		if mt := vm.getMetatable(val); mt != nil {
+			if method := mt.getStr(string(parse.MetaToString)); !method.isNil() {
+				res, err := vm.call(method.Any(), []any{val})
 				if err != nil {
 					return "", err
 				} else if len(res) == 0 || !isString(res[0]) {
 					return "", errors.New("'__tostring' must return a string")
 				}
 				return res[0].(string), nil
-			} else if name := mt.hashtable[string(parse.MetaName)]; name != nil {
-				return vm.toString(name)
+			} else if name := mt.getStr(string(parse.MetaName)); !name.isNil() {
+				return vm.toString(name.Any())
 			}
 		}
 
@@ -1137,41 +1655,56 @@ func (vm *VM) cleanShutdown(f *frame) {
 		vm.cleanup(f, f.framePointer-1)
 		f = f.prev
 	}
-	for i := range vm.Stack[:vm.top] {
-		vm.Stack[i] = nil
-	}
+	clear(vm.Stack[:vm.top])
 	vm.top = 0
 	_ = vm.Close()
 }
 
-// Close shuts down the vm cleanly and ensures all open files are closed.
+// Close shuts down the vm cleanly. It runs the __gc metamethods of every table
+// still marked for finalization and ensures all open files are closed.
 func (vm *VM) Close() error {
+	vm.runFinalizers(true)
 	_, err := stdIOClose(vm, nil)
 	return err
 }
 
-func (vm *VM) closeUpvalues(f *frame) {
+// closeUpvalues closes the open upvalues and to-be-closed variables of the frame.
+// Variables are closed in reverse order, each one is passed the pending error,
+// and an error raised while closing replaces it. The resulting error is returned.
+func (vm *VM) closeUpvalues(f *frame, closeErr error) error {
 	for _, broker := range f.openBrokers {
 		broker.Close()
 	}
-	for _, idx := range f.tbcValues {
-		val := vm.get(&frame{}, idx, false)
-		if method := findMetavalue(parse.MetaClose, val); method != nil {
-			if _, err := vm.call(method, []any{val}); err != nil {
-				_, _ = warn(vm, err)
-			}
-		} else {
+	for i := len(f.tbcValues) - 1; i >= 0; i-- {
+		val := vm.get(&frame{}, f.tbcValues[i], false).Any()
+		method := vm.findMetavalue(parse.MetaClose, val)
+		if method == nil {
 			_, _ = warn(vm, "__close not defined on closable table")
+			continue
+		}
+		var errVal any
+		if closeErr != nil {
+			errVal = getErrVal(closeErr)
+		}
+		// yielding from __close is not supported.
+		vm.nny++
+		_, err := vm.call(method, []any{val, errVal})
+		vm.nny--
+		if err != nil {
+			closeErr = err
 		}
 	}
+	return closeErr
 }
 
 func (vm *VM) cleanup(f *frame, newTop int64) {
 	vm.popCallstack()
-	vm.closeUpvalues(f)
+	if err := vm.closeUpvalues(f, nil); err != nil {
+		_, _ = warn(vm, err)
+	}
 
 	for i := min(vm.top, int64(len(vm.Stack))-1); i > newTop; i-- {
-		vm.Stack[i] = nil
+		vm.Stack[i] = nilValue
 	}
 
 	vm.top = newTop
@@ -1187,14 +1720,15 @@ func (vm *VM) closeRange(f *frame, newTop int64) {
 	vm.top = f.framePointer + newTop
 }
 
-func ensureLenNil(values []any, want int) []any {
+func ensureLenNil[T any](values []T, want int) []T {
 	if want <= 0 {
 		return values
 	} else if len(values) > want {
 		values = values[:want:want]
 	} else if len(values) < want {
+		var zero T
 		for range want - len(values) {
-			values = append(values, nil)
+			values = append(values, zero)
 		}
 	}
 	return values
@@ -1206,9 +1740,9 @@ func ensureSize[T any](slice *[]T, index int) {
 	if index < sliceLen {
 		return
 	}
-	newSlice := make([]T, index+1)
-	copy(newSlice, *slice)
-	*slice = newSlice
+	// append grows the capacity geometrically so deep call stacks are not copied
+	// on every new level.
+	*slice = append(*slice, make([]T, index+1-sliceLen)...)
 }
 
 // this is good for slices of non-simple datatypes.
@@ -1,10 +1,14 @@
 package runtime
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
 	"errors"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -69,15 +73,19 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 0, 1274),
 				bytecode.IAsBx(bytecode.LOADI, 1, 72),
 				bytecode.IABC(bytecode.ADD, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.ADD), false),
 				bytecode.IABx(bytecode.LOADK, 1, 0),
 				bytecode.IABx(bytecode.LOADK, 2, 1),
 				bytecode.IABC(bytecode.ADD, 1, 1, 2, false),
+				bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.ADD), false),
 				bytecode.IAsBx(bytecode.LOADI, 2, 42),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IABC(bytecode.ADD, 2, 2, 3, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.ADD), false),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IAsBx(bytecode.LOADI, 4, 99),
 				bytecode.IABC(bytecode.ADD, 3, 3, 4, false),
+				bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.ADD), false),
 				bytecode.IAB(bytecode.RETURN, 0, 5),
 			},
 			result: []any{int64(1346), float64(144), float64(74), float64(131)},
@@ -89,6 +97,7 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 0, 0),
 				bytecode.IAsBx(bytecode.LOADI, 1, 0),
 				bytecode.IABC(bytecode.ADD, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.ADD), false),
 			},
 			err: errors.New("cannot __add string and number"),
 		},
@@ -99,15 +108,19 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 0, 1274),
 				bytecode.IAsBx(bytecode.LOADI, 1, 72),
 				bytecode.IABC(bytecode.SUB, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.SUB), false),
 				bytecode.IABx(bytecode.LOADK, 1, 0),
 				bytecode.IABx(bytecode.LOADK, 2, 1),
 				bytecode.IABC(bytecode.SUB, 1, 1, 2, false),
+				bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.SUB), false),
 				bytecode.IAsBx(bytecode.LOADI, 2, 42),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IABC(bytecode.SUB, 2, 2, 3, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.SUB), false),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IAsBx(bytecode.LOADI, 4, 99),
 				bytecode.IABC(bytecode.SUB, 3, 3, 4, false),
+				bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.SUB), false),
 				bytecode.IAB(bytecode.RETURN, 0, 5),
 			},
 			result: []any{int64(1202), float64(-80), float64(10), float64(-67)},
@@ -119,6 +132,7 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 0, 0),
 				bytecode.IAsBx(bytecode.LOADI, 1, 0),
 				bytecode.IABC(bytecode.SUB, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.SUB), false),
 			},
 			err: errors.New("cannot __sub string and number"),
 		},
@@ -129,15 +143,19 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 0, 1274),
 				bytecode.IAsBx(bytecode.LOADI, 1, 72),
 				bytecode.IABC(bytecode.MUL, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.MUL), false),
 				bytecode.IABx(bytecode.LOADK, 1, 0),
 				bytecode.IABx(bytecode.LOADK, 2, 1),
 				bytecode.IABC(bytecode.MUL, 1, 1, 2, false),
+				bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.MUL), false),
 				bytecode.IAsBx(bytecode.LOADI, 2, 42),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IABC(bytecode.MUL, 2, 2, 3, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.MUL), false),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IAsBx(bytecode.LOADI, 4, 99),
 				bytecode.IABC(bytecode.MUL, 3, 3, 4, false),
+				bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.MUL), false),
 				bytecode.IAB(bytecode.RETURN, 0, 5),
 			},
 			result: []any{int64(91728), float64(3584), float64(1344), float64(3168)},
@@ -149,6 +167,7 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 0, 0),
 				bytecode.IAsBx(bytecode.LOADI, 1, 0),
 				bytecode.IABC(bytecode.MUL, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.MUL), false),
 			},
 			err: errors.New("cannot __mul string and number"),
 		},
@@ -159,15 +178,19 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 0, 1274),
 				bytecode.IAsBx(bytecode.LOADI, 1, 10),
 				bytecode.IABC(bytecode.DIV, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.DIV), false),
 				bytecode.IABx(bytecode.LOADK, 1, 0),
 				bytecode.IABx(bytecode.LOADK, 2, 1),
 				bytecode.IABC(bytecode.DIV, 1, 1, 2, false),
+				bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.DIV), false),
 				bytecode.IAsBx(bytecode.LOADI, 2, 42),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IABC(bytecode.DIV, 2, 2, 3, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.DIV), false),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.DIV, 3, 3, 4, false),
+				bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.DIV), false),
 				bytecode.IAB(bytecode.RETURN, 0, 5),
 			},
 			result: []any{float64(127.4), float64(3.5), float64(0.375), float64(112)},
@@ -179,6 +202,7 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 0, 0),
 				bytecode.IAsBx(bytecode.LOADI, 1, 0),
 				bytecode.IABC(bytecode.DIV, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.DIV), false),
 			},
 			err: errors.New("cannot __div string and number"),
 		},
@@ -189,15 +213,19 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 0, 1274),
 				bytecode.IAsBx(bytecode.LOADI, 1, 72),
 				bytecode.IABC(bytecode.MOD, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.MOD), false),
 				bytecode.IABx(bytecode.LOADK, 1, 0),
 				bytecode.IABx(bytecode.LOADK, 2, 1),
 				bytecode.IABC(bytecode.MOD, 1, 1, 2, false),
+				bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.MOD), false),
 				bytecode.IAsBx(bytecode.LOADI, 2, 42),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IABC(bytecode.MOD, 2, 2, 3, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.MOD), false),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.MOD, 3, 3, 4, false),
+				bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.MOD), false),
 				bytecode.IAB(bytecode.RETURN, 0, 5),
 			},
 			result: []any{int64(50), float64(16), float64(42), float64(0)},
@@ -209,6 +237,7 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 0, 0),
 				bytecode.IAsBx(bytecode.LOADI, 1, 0),
 				bytecode.IABC(bytecode.MOD, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.MOD), false),
 			},
 			err: errors.New("cannot __mod string and number"),
 		},
@@ -219,15 +248,19 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 0, 2),
 				bytecode.IAsBx(bytecode.LOADI, 1, 4),
 				bytecode.IABC(bytecode.POW, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.POW), false),
 				bytecode.IABx(bytecode.LOADK, 1, 0),
 				bytecode.IABx(bytecode.LOADK, 2, 1),
 				bytecode.IABC(bytecode.POW, 1, 1, 2, false),
+				bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.POW), false),
 				bytecode.IAsBx(bytecode.LOADI, 2, 2),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IABC(bytecode.POW, 2, 2, 3, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.POW), false),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.POW, 3, 3, 4, false),
+				bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.POW), false),
 				bytecode.IAB(bytecode.RETURN, 0, 5),
 			},
 			result: []any{float64(16), float64(8), float64(4), float64(2)},
@@ -239,6 +272,7 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 0, 0),
 				bytecode.IAsBx(bytecode.LOADI, 1, 0),
 				bytecode.IABC(bytecode.POW, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.POW), false),
 			},
 			err: errors.New("cannot __pow string and number"),
 		},
@@ -249,15 +283,19 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 0, 98),
 				bytecode.IAsBx(bytecode.LOADI, 1, 2),
 				bytecode.IABC(bytecode.IDIV, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.IDIV), false),
 				bytecode.IABx(bytecode.LOADK, 1, 0),
 				bytecode.IABx(bytecode.LOADK, 2, 1),
 				bytecode.IABC(bytecode.IDIV, 1, 1, 2, false),
+				bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.IDIV), false),
 				bytecode.IAsBx(bytecode.LOADI, 2, 42),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IABC(bytecode.IDIV, 2, 2, 3, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.IDIV), false),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.IDIV, 3, 3, 4, false),
+				bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.IDIV), false),
 				bytecode.IAB(bytecode.RETURN, 0, 5),
 			},
 			result: []any{int64(49), float64(3), float64(0), float64(112)},
@@ -269,6 +307,7 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 0, 0),
 				bytecode.IAsBx(bytecode.LOADI, 1, 0),
 				bytecode.IABC(bytecode.IDIV, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.IDIV), false),
 			},
 			err: errors.New("cannot __idiv string and number"),
 		},
@@ -279,15 +318,19 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 0, 2),
 				bytecode.IAsBx(bytecode.LOADI, 1, 4),
 				bytecode.IABC(bytecode.BAND, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.BAND), false),
 				bytecode.IABx(bytecode.LOADK, 1, 0),
 				bytecode.IABx(bytecode.LOADK, 2, 1),
 				bytecode.IABC(bytecode.BAND, 1, 1, 2, false),
+				bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.BAND), false),
 				bytecode.IAsBx(bytecode.LOADI, 2, 2),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IABC(bytecode.BAND, 2, 2, 3, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.BAND), false),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.BAND, 3, 3, 4, false),
+				bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.BAND), false),
 				bytecode.IAB(bytecode.RETURN, 0, 5),
 			},
 			result: []any{int64(0), int64(2), int64(2), int64(0)},
@@ -299,6 +342,7 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 0, 0),
 				bytecode.IAsBx(bytecode.LOADI, 1, 0),
 				bytecode.IABC(bytecode.BAND, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.BAND), false),
 			},
 			err: errors.New("attempt to perform bitwise operation on a string value"),
 		},
@@ -309,15 +353,19 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 0, 2),
 				bytecode.IAsBx(bytecode.LOADI, 1, 4),
 				bytecode.IABC(bytecode.BOR, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.BOR), false),
 				bytecode.IABx(bytecode.LOADK, 1, 0),
 				bytecode.IABx(bytecode.LOADK, 2, 1),
 				bytecode.IABC(bytecode.BOR, 1, 1, 2, false),
+				bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.BOR), false),
 				bytecode.IAsBx(bytecode.LOADI, 2, 2),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IABC(bytecode.BOR, 2, 2, 3, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.BOR), false),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.BOR, 3, 3, 4, false),
+				bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.BOR), false),
 				bytecode.IAB(bytecode.RETURN, 0, 5),
 			},
 			result: []any{int64(6), int64(3), int64(2), int64(3)},
@@ -329,6 +377,7 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 0, 0),
 				bytecode.IAsBx(bytecode.LOADI, 1, 0),
 				bytecode.IABC(bytecode.BOR, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.BOR), false),
 			},
 			err: errors.New("attempt to perform bitwise operation on a string value"),
 		},
@@ -339,15 +388,19 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 0, 2),
 				bytecode.IAsBx(bytecode.LOADI, 1, 4),
 				bytecode.IABC(bytecode.BXOR, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.BXOR), false),
 				bytecode.IABx(bytecode.LOADK, 1, 0),
 				bytecode.IABx(bytecode.LOADK, 2, 1),
 				bytecode.IABC(bytecode.BXOR, 1, 1, 2, false),
+				bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.BXOR), false),
 				bytecode.IAsBx(bytecode.LOADI, 2, 2),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IABC(bytecode.BXOR, 2, 2, 3, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.BXOR), false),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.BXOR, 3, 3, 4, false),
+				bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.BXOR), false),
 				bytecode.IAB(bytecode.RETURN, 0, 5),
 			},
 			result: []any{int64(6), int64(1), int64(0), int64(3)},
@@ -359,6 +412,7 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 0, 0),
 				bytecode.IAsBx(bytecode.LOADI, 1, 0),
 				bytecode.IABC(bytecode.BXOR, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.BXOR), false),
 			},
 			err: errors.New("attempt to perform bitwise operation on a string value"),
 		},
@@ -369,15 +423,19 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 0, 2),
 				bytecode.IAsBx(bytecode.LOADI, 1, 4),
 				bytecode.IABC(bytecode.SHL, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.SHL), false),
 				bytecode.IABx(bytecode.LOADK, 1, 0),
 				bytecode.IABx(bytecode.LOADK, 2, 1),
 				bytecode.IABC(bytecode.SHL, 1, 1, 2, false),
+				bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.SHL), false),
 				bytecode.IAsBx(bytecode.LOADI, 2, 2),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IABC(bytecode.SHL, 2, 2, 3, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.SHL), false),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.SHL, 3, 3, 4, false),
+				bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.SHL), false),
 				bytecode.IAB(bytecode.RETURN, 0, 5),
 			},
 			result: []any{int64(32), int64(16), int64(8), int64(4)},
@@ -389,6 +447,7 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 0, 0),
 				bytecode.IAsBx(bytecode.LOADI, 1, 0),
 				bytecode.IABC(bytecode.SHL, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.SHL), false),
 			},
 			err: errors.New("attempt to perform bitwise operation on a string value"),
 		},
@@ -399,15 +458,19 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 0, 100),
 				bytecode.IAsBx(bytecode.LOADI, 1, 1),
 				bytecode.IABC(bytecode.SHR, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.SHR), false),
 				bytecode.IABx(bytecode.LOADK, 1, 0),
 				bytecode.IABx(bytecode.LOADK, 2, 1),
 				bytecode.IABC(bytecode.SHR, 1, 1, 2, false),
+				bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.SHR), false),
 				bytecode.IAsBx(bytecode.LOADI, 2, 500),
 				bytecode.IABx(bytecode.LOADK, 3, 1),
 				bytecode.IABC(bytecode.SHR, 2, 2, 3, false),
+				bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.SHR), false),
 				bytecode.IABx(bytecode.LOADK, 3, 0),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.SHR, 3, 3, 4, false),
+				bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.SHR), false),
 				bytecode.IAB(bytecode.RETURN, 0, 5),
 			},
 			result: []any{int64(50), int64(50), int64(250), int64(50)},
@@ -419,9 +482,60 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 0, 0),
 				bytecode.IAsBx(bytecode.LOADI, 1, 0),
 				bytecode.IABC(bytecode.SHR, 0, 0, 1, false),
+				bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.SHR), false),
 			},
 			err: errors.New("attempt to perform bitwise operation on a string value"),
 		},
+		{
+			desc:      "ADDI SHLI and SHRI",
+			constants: []any{float64(1.5)},
+			code: []uint32{
+				bytecode.IABx(bytecode.LOADK, 0, 0),
+				bytecode.IABsC(bytecode.ADDI, 0, 0, 1, false),
+				bytecode.IAsBC(bytecode.MMBINI, 0, 1, uint8(bytecode.ADD), false),
+				bytecode.IAsBx(bytecode.LOADI, 1, 3),
+				bytecode.IABsC(bytecode.SHLI, 1, 1, 2, false),
+				bytecode.IAsBC(bytecode.MMBINI, 1, 2, uint8(bytecode.SHL), false),
+				bytecode.IAsBx(bytecode.LOADI, 2, 3),
+				bytecode.IABsC(bytecode.SHLI, 2, 2, 2, true),
+				bytecode.IAsBC(bytecode.MMBINI, 2, 2, uint8(bytecode.SHL), true),
+				bytecode.IAsBx(bytecode.LOADI, 3, 64),
+				bytecode.IABsC(bytecode.SHRI, 3, 3, -2, false),
+				bytecode.IAsBC(bytecode.MMBINI, 3, -2, uint8(bytecode.SHR), false),
+				bytecode.IAB(bytecode.RETURN, 0, 5),
+			},
+			result: []any{float64(2.5), int64(12), int64(16), int64(256)},
+		},
+		{
+			desc:      "K arithmetic",
+			constants: []any{int64(10), float64(4)},
+			code: []uint32{
+				bytecode.IAsBx(bytecode.LOADI, 0, 3),
+				bytecode.IABC(bytecode.SUBK, 0, 0, 0, false),
+				bytecode.IABC(bytecode.MMBINK, 0, 0, uint8(bytecode.SUB), false),
+				bytecode.IAsBx(bytecode.LOADI, 1, 3),
+				bytecode.IABC(bytecode.SUBK, 1, 1, 0, true),
+				bytecode.IABC(bytecode.MMBINK, 1, 0, uint8(bytecode.SUB), true),
+				bytecode.IAsBx(bytecode.LOADI, 2, 2),
+				bytecode.IABC(bytecode.DIVK, 2, 2, 1, true),
+				bytecode.IABC(bytecode.MMBINK, 2, 1, uint8(bytecode.DIV), true),
+				bytecode.IAsBx(bytecode.LOADI, 3, 6),
+				bytecode.IABC(bytecode.BANDK, 3, 3, 0, false),
+				bytecode.IABC(bytecode.MMBINK, 3, 0, uint8(bytecode.BAND), false),
+				bytecode.IAB(bytecode.RETURN, 0, 5),
+			},
+			result: []any{int64(-7), int64(7), float64(2), int64(2)},
+		},
+		{
+			desc:      "K arithmetic incompatible types",
+			constants: []any{int64(10)},
+			code: []uint32{
+				bytecode.IAB(bytecode.LOADTRUE, 0, 0),
+				bytecode.IABC(bytecode.MULK, 0, 0, 0, false),
+				bytecode.IABC(bytecode.MMBINK, 0, 0, uint8(bytecode.MUL), false),
+			},
+			err: errors.New("attempt to perform arithmetic on a boolean value"),
+		},
 		{
 			desc:      "UNM",
 			constants: []any{float64(200)},
@@ -677,6 +791,48 @@ func TestVM_Eval(t *testing.T) {
 			},
 			result: []any{false},
 		},
+		{
+			desc:      "EQK and EQI",
+			constants: []any{"hello"},
+			code: []uint32{
+				bytecode.IABx(bytecode.LOADK, 0, 0),
+				bytecode.IAsBx(bytecode.LOADI, 1, -3),
+				bytecode.IABC(bytecode.EQK, 0, 0, 0, false),
+				0xFFFFFFFF,
+				bytecode.IABsC(bytecode.EQI, 0, 1, -3, false),
+				0xFFFFFFFF,
+				bytecode.IAB(bytecode.RETURN, 0, 3),
+			},
+			result: []any{"hello", int64(-3)},
+		},
+		{
+			desc: "LTI and LEI",
+			code: []uint32{
+				bytecode.IAsBx(bytecode.LOADI, 0, 5),
+				bytecode.IABsC(bytecode.LTI, 1, 0, 5, false),
+				0xFFFFFFFF,
+				bytecode.IABsC(bytecode.LTI, 0, 0, 4, true),
+				0xFFFFFFFF,
+				bytecode.IABsC(bytecode.LEI, 0, 0, 5, false),
+				0xFFFFFFFF,
+				bytecode.IABsC(bytecode.LEI, 1, 0, 6, true),
+				0xFFFFFFFF,
+				bytecode.IAB(bytecode.RETURN, 0, 2),
+			},
+			result: []any{int64(5)},
+		},
+		{
+			desc: "TESTSET",
+			code: []uint32{
+				bytecode.IAsBx(bytecode.LOADI, 0, 5),
+				bytecode.IABx(bytecode.LOADNIL, 1, 0),
+				bytecode.IABC(bytecode.TESTSET, 2, 1, 1, false),
+				0xFFFFFFFF,
+				bytecode.IABC(bytecode.TESTSET, 2, 0, 1, false),
+				bytecode.IAB(bytecode.RETURN, 2, 2),
+			},
+			result: []any{int64(5)},
+		},
 		{
 			desc:      "LEN string",
 			constants: []any{"test string"},
@@ -715,7 +871,11 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABC(bytecode.SETTABLE, 0, 1, 1, true),
 				bytecode.IAB(bytecode.RETURN, 0, 2),
 			},
-			result: []any{&Table{val: []any{}, hashtable: map[any]any{"hello": "world"}, keyCache: []any{"hello"}}},
+			result: []any{&Table{
+				val:   []Value{},
+				hash:  map[tableKey]int{strValue("hello").key(): 0},
+				nodes: []tableNode{{key: strValue("hello"), val: strValue("world")}},
+			}},
 		},
 		{
 			desc:      "GETTABLE",
@@ -729,6 +889,38 @@ func TestVM_Eval(t *testing.T) {
 			},
 			result: []any{"world"},
 		},
+		{
+			desc:      "SETFIELD and GETFIELD",
+			constants: []any{"hello", "world"},
+			code: []uint32{
+				bytecode.IvABC(bytecode.NEWTABLE, 0, 0, 1, false),
+				bytecode.IABC(bytecode.SETFIELD, 0, 0, 1, true),
+				bytecode.IABC(bytecode.GETFIELD, 1, 0, 0, false),
+				bytecode.IAB(bytecode.RETURN, 1, 2),
+			},
+			result: []any{"world"},
+		},
+		{
+			desc:      "SETI and GETI",
+			constants: []any{"world"},
+			code: []uint32{
+				bytecode.IvABC(bytecode.NEWTABLE, 0, 1, 0, false),
+				bytecode.IABC(bytecode.SETI, 0, 1, 0, true),
+				bytecode.IABC(bytecode.GETI, 1, 0, 1, false),
+				bytecode.IABC(bytecode.GETI, 2, 0, 2, false),
+				bytecode.IAB(bytecode.RETURN, 1, 3),
+			},
+			result: []any{"world", nil},
+		},
+		{
+			desc:      "GETFIELD non table",
+			constants: []any{"hello"},
+			code: []uint32{
+				bytecode.IAsBx(bytecode.LOADI, 0, 1),
+				bytecode.IABC(bytecode.GETFIELD, 1, 0, 0, false),
+			},
+			err: errors.New("attempt to index a number value"),
+		},
 		{
 			desc: "SETLIST with defined count at zero position",
 			code: []uint32{
@@ -739,7 +931,11 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IvABC(bytecode.SETLIST, 0, 4, 1, false),
 				bytecode.IAB(bytecode.RETURN, 0, 2),
 			},
-			result: []any{&Table{val: []any{int64(20), int64(20), int64(20)}, hashtable: map[any]any{}}},
+			result: []any{&Table{
+				val:   []Value{intValue(20), intValue(20), intValue(20)},
+				hash:  map[tableKey]int{},
+				nodes: []tableNode{},
+			}},
 		},
 		{
 			desc: "SETLIST with defined count at c position",
@@ -751,7 +947,11 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IvABC(bytecode.SETLIST, 0, 4, 3, false),
 				bytecode.IAB(bytecode.RETURN, 0, 2),
 			},
-			result: []any{&Table{val: []any{nil, nil, int64(20), int64(20), int64(20)}, hashtable: map[any]any{}}},
+			result: []any{&Table{
+				val:   []Value{nilValue, nilValue, intValue(20), intValue(20), intValue(20)},
+				hash:  map[tableKey]int{},
+				nodes: []tableNode{},
+			}},
 		},
 		{
 			desc:      "RETURN all values",
@@ -835,10 +1035,11 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 1, 1),
 				bytecode.IAsBx(bytecode.LOADI, 2, 10),
 				bytecode.IAsBx(bytecode.LOADI, 3, 1),
-				bytecode.IABx(bytecode.FORPREP, 1, 2),
+				bytecode.IABx(bytecode.FORPREP, 1, 3),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.ADD, 0, 0, 4, false),
-				bytecode.IABx(bytecode.FORLOOP, 1, 3),
+				bytecode.IABC(bytecode.MMBIN, 0, 4, uint8(bytecode.ADD), false),
+				bytecode.IABx(bytecode.FORLOOP, 1, 4),
 				bytecode.IAB(bytecode.RETURN, 0, 2),
 			},
 			result: []any{int64(10)},
@@ -851,10 +1052,11 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABx(bytecode.LOADK, 1, 1), // 1.0
 				bytecode.IABx(bytecode.LOADK, 2, 2), // 10.0
 				bytecode.IABx(bytecode.LOADK, 3, 1), // 1.0
-				bytecode.IABx(bytecode.FORPREP, 1, 2),
+				bytecode.IABx(bytecode.FORPREP, 1, 3),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.ADD, 0, 0, 4, false),
-				bytecode.IABx(bytecode.FORLOOP, 1, 3),
+				bytecode.IABC(bytecode.MMBIN, 0, 4, uint8(bytecode.ADD), false),
+				bytecode.IABx(bytecode.FORLOOP, 1, 4),
 				bytecode.IAB(bytecode.RETURN, 0, 2),
 			},
 			result: []any{float64(10)},
@@ -866,10 +1068,11 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAsBx(bytecode.LOADI, 1, 1),
 				bytecode.IAsBx(bytecode.LOADI, 2, 10),
 				bytecode.IAsBx(bytecode.LOADI, 3, 0),
-				bytecode.IABx(bytecode.FORPREP, 1, 2),
+				bytecode.IABx(bytecode.FORPREP, 1, 3),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.ADD, 0, 0, 4, false),
-				bytecode.IABx(bytecode.FORLOOP, 1, 4),
+				bytecode.IABC(bytecode.MMBIN, 0, 4, uint8(bytecode.ADD), false),
+				bytecode.IABx(bytecode.FORLOOP, 1, 5),
 				bytecode.IAB(bytecode.RETURN, 0, 2),
 			},
 			err: errors.New("0 step in numerical for"),
@@ -881,10 +1084,11 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IAB(bytecode.LOADTRUE, 1, 0),
 				bytecode.IAsBx(bytecode.LOADI, 2, 10),
 				bytecode.IAsBx(bytecode.LOADI, 3, 0),
-				bytecode.IABx(bytecode.FORPREP, 1, 2),
+				bytecode.IABx(bytecode.FORPREP, 1, 3),
 				bytecode.IAsBx(bytecode.LOADI, 4, 1),
 				bytecode.IABC(bytecode.ADD, 0, 0, 4, false),
-				bytecode.IABx(bytecode.FORLOOP, 1, 3),
+				bytecode.IABC(bytecode.MMBIN, 0, 4, uint8(bytecode.ADD), false),
+				bytecode.IABx(bytecode.FORLOOP, 1, 4),
 				bytecode.IAB(bytecode.RETURN, 0, 2),
 			},
 			err: errors.New("bad 'for' initial value (number expected, got boolean)"),
@@ -903,13 +1107,14 @@ func TestVM_Eval(t *testing.T) {
 				bytecode.IABC(bytecode.GETTABUP, 2, 0, 0, true),
 				bytecode.IAB(bytecode.MOVE, 3, 0),
 				bytecode.IABC(bytecode.CALL, 2, 2, 4, false),
-				bytecode.Jump(4),
+				bytecode.Jump(5),
 				bytecode.IAB(bytecode.MOVE, 7, 1),
 				bytecode.IAB(bytecode.MOVE, 8, 6),
 				bytecode.IABC(bytecode.ADD, 7, 7, 8, false),
+				bytecode.IABC(bytecode.MMBIN, 7, 8, uint8(bytecode.ADD), false),
 				bytecode.IAB(bytecode.MOVE, 1, 7),
 				bytecode.IAsBx(bytecode.TFORCALL, 2, 2),
-				bytecode.IABx(bytecode.TFORLOOP, 3, 6),
+				bytecode.IABx(bytecode.TFORLOOP, 3, 7),
 				bytecode.IAB(bytecode.MOVE, 2, 1),
 				bytecode.IAB(bytecode.RETURN, 2, 2),
 			},
@@ -1002,8 +1207,9 @@ func TestVM_Eval(t *testing.T) {
 				},
 			}},
 			result: []any{&Table{
-				val:       []any{int64(1), int64(2), int64(3)},
-				hashtable: map[any]any{},
+				val:   []Value{intValue(1), intValue(2), intValue(3)},
+				hash:  map[tableKey]int{},
+				nodes: []tableNode{},
 			}},
 		},
 	}
@@ -1021,7 +1227,7 @@ func TestVM_Eval(t *testing.T) {
 			})
 			if tc.err == nil {
 				require.NoError(t, err)
-				assert.Equal(t, tc.result, value, "result value not equal")
+				assert.Equal(t, tableLayouts(tc.result), tableLayouts(value), "result value not equal")
 			} else {
 				require.ErrorContains(t, err, tc.err.Error())
 				require.Nil(t, value)
@@ -1030,6 +1236,32 @@ func TestVM_Eval(t *testing.T) {
 	}
 }
 
+// tableLayout is a table with its values converted to go values so that tables
+// can be compared without the pointers that string values hold.
+type tableLayout struct {
+	val   []any
+	hash  map[tableKey]int
+	nodes [][2]any
+}
+
+func tableLayouts(vals []any) []any {
+	if vals == nil {
+		return nil
+	}
+	out := make([]any, len(vals))
+	for i, val := range vals {
+		out[i] = val
+		if tbl, isTbl := val.(*Table); isTbl {
+			layout := tableLayout{val: valuesToAny(tbl.val), hash: tbl.hash, nodes: [][2]any{}}
+			for _, node := range tbl.nodes {
+				layout.nodes = append(layout.nodes, [2]any{node.key.Any(), node.val.Any()})
+			}
+			out[i] = layout
+		}
+	}
+	return out
+}
+
 func TestVM_call(t *testing.T) {
 	t.Parallel()
 	t.Run("Go Func call", func(t *testing.T) {
@@ -1055,24 +1287,28 @@ func TestVM_call(t *testing.T) {
 		t.Parallel()
 
 		fn := &Closure{
-			val: &parse.FnProto{
+			val: newFnProto(&parse.FnProto{
 				Constants: []any{float64(32), float64(112), "Don't touch me"},
 				ByteCodes: []uint32{
 					bytecode.IAsBx(bytecode.LOADI, 0, 1274),
 					bytecode.IAsBx(bytecode.LOADI, 1, 72),
 					bytecode.IABC(bytecode.ADD, 0, 0, 1, false),
+					bytecode.IABC(bytecode.MMBIN, 0, 1, uint8(bytecode.ADD), false),
 					bytecode.IABx(bytecode.LOADK, 1, 0),
 					bytecode.IABx(bytecode.LOADK, 2, 1),
 					bytecode.IABC(bytecode.ADD, 1, 1, 2, false),
+					bytecode.IABC(bytecode.MMBIN, 1, 2, uint8(bytecode.ADD), false),
 					bytecode.IAsBx(bytecode.LOADI, 2, 42),
 					bytecode.IABx(bytecode.LOADK, 3, 0),
 					bytecode.IABC(bytecode.ADD, 2, 2, 3, false),
+					bytecode.IABC(bytecode.MMBIN, 2, 3, uint8(bytecode.ADD), false),
 					bytecode.IABx(bytecode.LOADK, 3, 0),
 					bytecode.IAsBx(bytecode.LOADI, 4, 99),
 					bytecode.IABC(bytecode.ADD, 3, 3, 4, false),
+					bytecode.IABC(bytecode.MMBIN, 3, 4, uint8(bytecode.ADD), false),
 					bytecode.IAB(bytecode.RETURN, 0, 0),
 				},
-			},
+			}),
 		}
 
 		vm, err := New(context.Background(), nil)
@@ -1232,6 +1468,329 @@ func TestVM_ExplistWantExcess(t *testing.T) {
 	})
 }
 
+func TestVM_CallK(t *testing.T) {
+	t.Parallel()
+
+	run := func(t *testing.T, protected bool, src string) []any {
+		t.Helper()
+		vm, err := New(context.Background(), nil)
+		require.NoError(t, err)
+		require.NoError(t, vm.env.Set("twice", Fn("twice", func(vm *VM, args []any) ([]any, error) {
+			k := func(_ *VM, res []any, err error) ([]any, error) {
+				if err != nil {
+					return []any{"caught"}, nil
+				}
+				return []any{toInt(res[0]) * 2}, nil
+			}
+			call := vm.CallK
+			if protected {
+				call = vm.PCallK
+			}
+			res, err := call(args[0], args[1:], k)
+			if IsYield(err) {
+				return nil, err
+			}
+			return k(vm, res, err)
+		})))
+		fn, err := parse.Parse("test", strings.NewReader(src), parse.ModeText)
+		require.NoError(t, err)
+		result, err := vm.Eval(fn)
+		require.NoError(t, err)
+		return result
+	}
+
+	t.Run("continues after a yield", func(t *testing.T) {
+		t.Parallel()
+		result := run(t, false, `
+			local co = coroutine.wrap(function()
+				return twice(function(x) return coroutine.yield(x) + 1 end, 20)
+			end)
+			return co(), co(20)
+		`)
+		assert.Equal(t, []any{int64(20), int64(42)}, result)
+	})
+
+	t.Run("without yielding", func(t *testing.T) {
+		t.Parallel()
+		result := run(t, false, `return twice(function(x) return x end, 21)`)
+		assert.Equal(t, []any{int64(42)}, result)
+	})
+
+	t.Run("protected continuation gets the error", func(t *testing.T) {
+		t.Parallel()
+		result := run(t, true, `
+			local co = coroutine.wrap(function()
+				return twice(function() coroutine.yield("y"); error("boom") end)
+			end)
+			return co(), co()
+		`)
+		assert.Equal(t, []any{"y", "caught"}, result)
+	})
+}
+
+func TestVM_SetMaxCallDepth(t *testing.T) {
+	t.Parallel()
+	fn, err := parse.Parse("test", strings.NewReader(`
+		local function depth(n)
+			if n == 0 then return 0 end
+			return 1 + depth(n - 1)
+		end
+		return depth(...)
+	`), parse.ModeText)
+	require.NoError(t, err)
+
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	vm.SetMaxCallDepth(100)
+	closure := &Closure{val: newFnProto(fn), upvalues: loadedChunkUpvalues(fn, vm.env)}
+
+	res, err := vm.call(closure, []any{int64(90)})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(90)}, res)
+	assert.Equal(t, int64(0), vm.luaDepth)
+
+	_, err = vm.call(closure, []any{int64(100)})
+	require.ErrorContains(t, err, "stack overflow")
+	assert.Equal(t, int64(0), vm.luaDepth)
+}
+
+func TestVM_CancelInterruptsEval(t *testing.T) {
+	t.Parallel()
+	fn, err := parse.Parse("test", strings.NewReader(`while true do end`), parse.ModeText)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	vm, err := New(ctx, nil)
+	require.NoError(t, err)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = vm.Eval(fn)
+	require.ErrorContains(t, err, "vm interrupted")
+}
+
+func TestVM_SetOptimizeLevel(t *testing.T) {
+	t.Parallel()
+	fn, err := parse.Parse("test", strings.NewReader(`
+		return load("local a = 1 local b = a + 2 return b"), coroutine.wrap(function()
+			return load("local a = 1 local b = a + 2 return b")
+		end)()
+	`), parse.ModeText)
+	require.NoError(t, err)
+
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	vm.SetOptimizeLevel(parse.OptFull)
+	res, err := vm.Eval(fn)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	for _, loaded := range res {
+		assert.Len(t, loaded.(*Closure).val.ByteCodes, 2)
+	}
+}
+
+func TestVM_CloseRunsFinalizers(t *testing.T) {
+	t.Parallel()
+	fn, err := parse.Parse("test", strings.NewReader(`
+		local log = ...
+		local mt = {__gc = function(o) log[#log + 1] = o.name end}
+		keep = setmetatable({name = "a"}, mt)
+		local self = setmetatable({name = "b"}, mt)
+		self.self = self
+		return self
+	`), parse.ModeText)
+	require.NoError(t, err)
+
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	closure := &Closure{val: newFnProto(fn), upvalues: loadedChunkUpvalues(fn, vm.env)}
+	log := NewTable(nil, nil)
+	_, err = vm.call(closure, []any{log})
+	require.NoError(t, err)
+	// b refers to itself so collecting does not finalize it even once dropped.
+	clear(vm.Stack)
+	vm.collectGarbage()
+	assert.Empty(t, log.val)
+
+	require.NoError(t, vm.Close())
+	assert.Equal(t, []any{"b", "a"}, valuesToAny(log.val))
+	vm.gc.collect()
+	vm.runFinalizers(false)
+	assert.Len(t, log.val, 2)
+}
+
+func TestVM_MemStats(t *testing.T) {
+	t.Parallel()
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	before := vm.MemStats()
+	assert.Positive(t, before.Tables)
+	assert.Positive(t, before.Stack)
+
+	fn, err := parse.Parse("test", strings.NewReader(`
+		local str = string.rep("x", 4096)
+		big = {str, str, str}
+		for i = 4, 1000 do big[i] = {} end
+		fns = {}
+		for i = 1, 10 do fns[i] = function() return str end end
+	`), parse.ModeText)
+	require.NoError(t, err)
+	_, err = vm.Eval(fn)
+	require.NoError(t, err)
+
+	after := vm.MemStats()
+	assert.Greater(t, after.Tables-before.Tables, 1000*tableSize)
+	// the same string is only counted once.
+	assert.Less(t, after.Strings-before.Strings, int64(2*4096))
+	assert.GreaterOrEqual(t, after.Closures-before.Closures, 10*closureSize)
+	assert.Equal(t, after.Tables+after.Strings+after.Closures+after.Stack, after.Total())
+
+	require.NoError(t, vm.env.Set("big", nil))
+	assert.Less(t, vm.MemStats().Tables, after.Tables-1000*tableSize)
+}
+
+func TestVM_MemCount(t *testing.T) {
+	t.Parallel()
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	before := vm.MemCount()
+	assert.Equal(t, vm.MemStats().Total(), before)
+
+	fn, err := parse.Parse("test", strings.NewReader(`
+		big = {}
+		for i = 1, 1000 do big[i] = {} end
+		big = nil
+	`), parse.ModeText)
+	require.NoError(t, err)
+	_, err = vm.Eval(fn)
+	require.NoError(t, err)
+
+	// the tables are counted as they are allocated and still counted once dropped.
+	assert.Greater(t, vm.MemCount()-before, 1000*tableSize)
+	vm.collectGarbage()
+	assert.Equal(t, vm.MemStats().Total(), vm.MemCount())
+	assert.Less(t, vm.MemCount(), before+1000*tableSize)
+}
+
+func TestVM_StopGC(t *testing.T) {
+	t.Parallel()
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	fn, err := parse.Parse("test", strings.NewReader(`
+		finalized = 0
+		do setmetatable({}, {__gc = function() finalized = finalized + 1 end}) end
+	`), parse.ModeText)
+	require.NoError(t, err)
+	check, err := parse.Parse("check", strings.NewReader(`return finalized`), parse.ModeText)
+	require.NoError(t, err)
+
+	vm.StopGC()
+	_, err = vm.Eval(fn)
+	require.NoError(t, err)
+	clear(vm.Stack[vm.top:])
+	vm.gc.collect()
+	res, err := vm.Eval(check)
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(0)}, res)
+
+	vm.RestartGC()
+	res, err = vm.Eval(check)
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(1)}, res)
+}
+
+func TestVM_EvalLua54Chunk(t *testing.T) {
+	t.Parallel()
+	// Lua 5.4 chunk of:
+	//   local s = 0
+	//   for _, v in ipairs({1, 2, 3}) do s = s + v end
+	//   local x = false
+	//   return s, s == 6 and "yes" or false, x or "dflt"
+	chunk, err := hex.DecodeString(
+		"1b4c7561540019930d0a1a0a04080878560000000000000000000000287740018c406970616972732e6c756180800001" +
+			"0a9a510000000180ff7f8b00000013010003520000008101008001820080810201804e010300c4000205cb0001002200" +
+			"00062e000606cc000002cd000200800000003d008500b800008003810000380000800501000005020000c38104003800" +
+			"008083010100c60004018304876970616972730484796573048564666c74810100008080808081855f454e56",
+	)
+	require.NoError(t, err)
+	fn, err := parse.Parse("ipairs.luac", bytes.NewReader(chunk), parse.ModeBinary)
+	require.NoError(t, err)
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	result, err := vm.Eval(fn)
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(6), "yes", "dflt"}, result)
+}
+
+func TestVM_EvalLuac54Fixture(t *testing.T) {
+	t.Parallel()
+	// testdata/closures.luac is testdata/closures.lua compiled by Lua 5.4.6 with
+	// string.dump, which writes the same chunk as luac.
+	fn, err := parse.File("testdata/closures.luac", parse.ModeBinary)
+	require.NoError(t, err)
+	assert.Equal(t, "closures.lua", fn.Filename)
+	assert.True(t, fn.Varargs)
+	require.Len(t, fn.FnTable, 2)
+	counter := fn.FnTable[0]
+	assert.Equal(t, int64(1), counter.Arity)
+	assert.True(t, counter.Varargs)
+	require.Len(t, counter.FnTable, 1)
+	require.Len(t, counter.FnTable[0].FnTable, 1)
+	inner := counter.FnTable[0].FnTable[0]
+	assert.Equal(t, []string{"total", "extra", "count"}, upvalueNames(inner))
+
+	src, err := parse.File("testdata/closures.lua", parse.ModeText)
+	require.NoError(t, err)
+	vm, err := New(context.Background(), nil)
+	require.NoError(t, err)
+	expected, err := vm.Eval(src)
+	require.NoError(t, err)
+	result, err := vm.Eval(fn)
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(20), int64(2), int64(60), int64(10), int64(20), int64(30)}, result)
+	assert.Equal(t, expected, result)
+}
+
+// FuzzUndump checks that any chunk which passes verification can be run without
+// panicking the vm. Errors are fine, and the time limit stops chunks that loop.
+func FuzzUndump(f *testing.F) {
+	for _, src := range []string{
+		`local t = {} for i = 1, 3 do t[i] = i * 2 end return t[3], #t`,
+		`local function f(...) return select("#", ...), ... end return f(1, nil, 3)`,
+		`local a, b = 1, 2 local function g() a = a + b return a end return g(), g()`,
+		`local s = "" for k, v in pairs({x = 1, y = 2}) do s = s .. k .. v end return s`,
+		`local t = {1, 2, f(), ...} return table.unpack(t)`,
+		`local x <close> = nil local ok, err = pcall(error, {}) return ok, err, x`,
+		`return (function(...) return ... end)(1, 2, 3)`,
+	} {
+		fn, err := parse.Parse("fuzz", strings.NewReader(src), parse.ModeText)
+		require.NoError(f, err)
+		chunk, err := fn.Dump(false)
+		require.NoError(f, err)
+		f.Add(chunk)
+	}
+	chunk, err := os.ReadFile("testdata/closures.luac")
+	require.NoError(f, err)
+	f.Add(chunk)
+	f.Fuzz(func(t *testing.T, chunk []byte) {
+		fn, err := parse.Parse("fuzz", bytes.NewReader(chunk), parse.ModeBinary)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		vm, err := newIsolatedVM(ctx)
+		require.NoError(t, err)
+		_, _ = vm.Eval(fn)
+	})
+}
+
+func upvalueNames(fn *parse.FnProto) []string {
+	names := make([]string, len(fn.UpIndexes))
+	for i, idx := range fn.UpIndexes {
+		names[i] = idx.Name
+	}
+	return names
+}
+
 func TestEnsureSize(t *testing.T) {
 	t.Parallel()
 	a := []string{}
@@ -1240,3 +1799,40 @@ func TestEnsureSize(t *testing.T) {
 	assert.Len(t, a, 6)
 	a[5] = "did it"
 }
+
+func BenchmarkVM_Fib(b *testing.B) {
+	benchmarkEval(b, `
+		local function fib(n)
+			if n < 2 then return n end
+			return fib(n - 2) + fib(n - 1)
+		end
+		return fib(25)
+	`)
+}
+
+func BenchmarkVM_StringKeys(b *testing.B) {
+	benchmarkEval(b, `
+		local words = {}
+		for i = 1, 20000 do
+			words[i] = "w" .. (i % 100)
+		end
+		local counts = {}
+		for _, w in ipairs(words) do
+			counts[w] = (counts[w] or 0) + 1
+		end
+		return counts.w1
+	`)
+}
+
+func benchmarkEval(b *testing.B, src string) {
+	b.Helper()
+	fn, err := parse.Parse("bench", strings.NewReader(src), parse.ModeText)
+	require.NoError(b, err)
+	vm, err := New(context.Background(), nil)
+	require.NoError(b, err)
+	b.ReportAllocs()
+	for b.Loop() {
+		_, err := vm.Eval(fn)
+		require.NoError(b, err)
+	}
+}
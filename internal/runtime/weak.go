@@ -0,0 +1,217 @@
+package runtime
+
+import (
+	"strings"
+	"weak"
+
+	"github.com/tanema/luaf/internal/parse"
+)
+
+type (
+	// weakMode is what a table holds weakly, it is set from the __mode field of
+	// the metatable when it is set.
+	weakMode uint8
+	// weakRef is what a weak table stores in place of a collectable value so that
+	// the table does not keep it alive. value returns nil once it was collected.
+	weakRef interface{ value() any }
+	// weakPtr is comparable and stays equal for the same pointer even after it was
+	// collected, so it can be used as a key in the hash part.
+	weakPtr[T any] struct{ ptr weak.Pointer[T] }
+	// ephemeron is the value of an entry with a collectable key in a table with
+	// only weak keys. It is kept alive by the key rather than the table so, like
+	// in lua, a value that refers to its key does not keep the entry alive.
+	ephemeron struct{ val Value }
+	// ephemerons are the values of the weak keyed tables that a value is a key in.
+	ephemerons map[weak.Pointer[Table]]*ephemeron
+)
+
+const (
+	weakKeys weakMode = 1 << iota
+	weakValues
+)
+
+func (w weakPtr[T]) value() any {
+	if p := w.ptr.Value(); p != nil {
+		return p
+	}
+	return nil
+}
+
+func makeWeak[T any](p *T) weakRef { return weakPtr[T]{ptr: weak.Make(p)} }
+
+// weaken returns the weak form of collectable values and any other value as is.
+// Strings are values in lua so they are never removed from weak tables.
+func weaken(v Value) Value {
+	switch ref := v.ref().(type) {
+	case *Table:
+		return boxedValue(v.kind, makeWeak(ref))
+	case *Closure:
+		return boxedValue(v.kind, makeWeak(ref))
+	case *GoFunc:
+		return boxedValue(v.kind, makeWeak(ref))
+	case *VM:
+		return boxedValue(v.kind, makeWeak(ref))
+	case *File:
+		return boxedValue(v.kind, makeWeak(ref))
+	case *ephemeron:
+		return boxedValue(v.kind, makeWeak(ref))
+	}
+	return v
+}
+
+// load returns a value stored in a weak table as it was set, or nil if it was
+// collected.
+func load(v Value) Value {
+	if !v.boxed() {
+		return v
+	}
+	w, isWeak := v.ref().(weakRef)
+	if !isWeak {
+		return v
+	}
+	switch ref := w.value().(type) {
+	case nil:
+		return nilValue
+	case *ephemeron:
+		return ref.val
+	default:
+		return ValueOf(ref)
+	}
+}
+
+// ephemeronsOf returns where the ephemerons of a key are kept. Keys of other
+// types, and frozen tables which other goroutines may be reading, keep their
+// values alive in weak keyed tables for as long as they live.
+func ephemeronsOf(key Value) *ephemerons {
+	switch ref := key.ref().(type) {
+	case *Table:
+		if ref.frozen {
+			return nil
+		}
+		return &ref.ephemerons
+	case *Closure:
+		return &ref.ephemerons
+	case *VM:
+		return &ref.ephemerons
+	}
+	return nil
+}
+
+// purge drops the values of tables that were collected. It only does so when
+// the amount of ephemerons doubles so that adding them stays cheap.
+func (e ephemerons) purge() {
+	if n := len(e); n < 8 || n&(n-1) != 0 {
+		return
+	}
+	for tbl := range e {
+		if tbl.Value() == nil {
+			delete(e, tbl)
+		}
+	}
+}
+
+// setMetatable sets the metatable of the table, which makes the table weak if
+// the metatable has a __mode field. Like most implementations the mode is only
+// checked when the metatable is set.
+func (t *Table) setMetatable(mt *Table) {
+	t.metatable = mt
+	var mode weakMode
+	if mt != nil {
+		if val := mt.getStr(string(parse.MetaMode)); val.kind == kindString {
+			if strings.Contains(val.str(), "k") {
+				mode |= weakKeys
+			}
+			if strings.Contains(val.str(), "v") {
+				mode |= weakValues
+			}
+		}
+	}
+	if mode != t.mode {
+		t.setMode(mode)
+	}
+}
+
+// setMode sets all of the entries of the table again so that they are held as
+// the new mode requires.
+func (t *Table) setMode(mode weakMode) {
+	var keys, vals []Value
+	for key, val, _ := t.next(nilValue); !key.isNil(); key, val, _ = t.next(key) {
+		keys = append(keys, key)
+		vals = append(vals, val)
+	}
+	// removing the entries first drops any ephemerons the keys hold for the table.
+	for _, key := range keys {
+		_ = t.set(key, nilValue)
+	}
+	clear(t.val)
+	t.val = t.val[:0]
+	clear(t.hash)
+	clear(t.nodes)
+	t.nodes = t.nodes[:0]
+	t.mode = mode
+	for i, key := range keys {
+		_ = t.set(key, vals[i])
+	}
+}
+
+// hashKey returns the form that key has in the hash part of the table.
+func (t *Table) hashKey(key Value) Value {
+	if t.mode&weakKeys != 0 {
+		return weaken(key)
+	}
+	return key
+}
+
+// live reports if a slot in the hash part is in use, which for weak tables also
+// means that neither its key or value were collected.
+func (t *Table) live(node tableNode) bool {
+	if t.mode == 0 {
+		return !node.val.isNil()
+	}
+	return !load(node.key).isNil() && !load(node.val).isNil()
+}
+
+func (t *Table) getWeakHash(key Value) Value {
+	if slot, ok := t.hash[t.hashKey(key).key()]; ok {
+		return load(t.nodes[slot].val)
+	}
+	return nilValue
+}
+
+func (t *Table) setWeakHash(key, val Value) {
+	hkey := t.hashKey(key)
+	if slot, ok := t.hash[hkey.key()]; ok {
+		t.nodes[slot].val = t.weakVal(key, val)
+		return
+	} else if val.isNil() {
+		return
+	}
+	t.insertHash(hkey, t.weakVal(key, val))
+}
+
+// weakVal returns what is stored in the hash part for val at key.
+func (t *Table) weakVal(key, val Value) Value {
+	if t.mode&weakValues != 0 {
+		return weaken(val)
+	}
+	store := ephemeronsOf(key)
+	if store == nil {
+		return val
+	}
+	self := weak.Make(t)
+	if val.isNil() {
+		delete(*store, self)
+		return nilValue
+	}
+	eph, ok := (*store)[self]
+	if !ok {
+		if *store == nil {
+			*store = ephemerons{}
+		}
+		store.purge()
+		eph = &ephemeron{}
+		(*store)[self] = eph
+	}
+	eph.val = val
+	return boxedValue(kindOther, makeWeak(eph))
+}
@@ -554,4 +554,28 @@ function callTests.testLimitofMultiplReturns254()
   t.assert.SyntaxError(code .. ",10", "too many returns")
 end
 
+function callTests.testDeepRecursion()
+  local function depth(n)
+    if n == 0 then
+      return 0
+    end
+    return 1 + depth(n - 1)
+  end
+  t.assert.Eq(50000, depth(50000))
+  local function infinite(n)
+    return 1 + infinite(n)
+  end
+  t.assert.Error(function() infinite(1) end, "stack overflow")
+  local mt = {}
+  mt.__index = function(_, k) return setmetatable({}, mt)[k] end
+  t.assert.Error(function() return setmetatable({}, mt).x end, "C stack overflow")
+end
+
+function callTests.testIndexCallResult()
+  local function get(k)
+    return setmetatable({}, { __index = function(_, key) return key end })[k]
+  end
+  t.assert.Eq("x", get("x"))
+end
+
 return callTests
@@ -169,6 +169,35 @@ function constructTests.testGettingFunkyWithLoopVariables()
   t.assert.Nil(tbl[n + 1])
 end
 
+function constructTests.testNumericForMixedTypes()
+  local function collect(a, b, c)
+    local vals, types = {}, {}
+    for i = a, b, c do
+      vals[#vals + 1] = i
+      types[#types + 1] = math.type(i)
+    end
+    return vals, table.concat(types, ",")
+  end
+  -- integer start and step loop over integers even with a float limit
+  local vals, types = collect(1, 2.5, 1)
+  t.assert.Eq(vals, { 1, 2 })
+  t.assert.Eq(types, "integer,integer")
+  vals, types = collect(3, 1.5, -1)
+  t.assert.Eq(vals, { 3, 2 })
+  t.assert.Eq(types, "integer,integer")
+  vals = collect(1, 0.5, 1)
+  t.assert.Eq(#vals, 0)
+  -- a float start or step makes every value a float
+  vals, types = collect(1, 2, 0.5)
+  t.assert.Eq(vals, { 1.0, 1.5, 2.0 })
+  t.assert.Eq(types, "float,float,float")
+  vals, types = collect(1.0, 3, 1)
+  t.assert.Eq(vals, { 1.0, 2.0, 3.0 })
+  t.assert.Eq(types, "float,float,float")
+  t.assert.Error(function() collect(1, 2, 0.0) end, "0 step in numerical for")
+  t.assert.Error(function() collect(1, 2, 0) end, "0 step in numerical for")
+end
+
 function constructTests.testRepeatLoops()
   local function fn(b)
     local x = 1
@@ -390,6 +419,17 @@ function constructTests.testShortCircuit()
   _ENV.GLOB1 = nil
 end
 
+function constructTests.testLongFieldNames()
+  local tbl = { a_field_name_that_is_longer_than_a_short_string = 1 }
+  tbl.another_field_name_longer_than_a_short_string = 2
+  t.assert.Eq(1, tbl["a_field_name_that_is_longer_than_a_short_string"])
+  t.assert.Eq(2, tbl.another_field_name_longer_than_a_short_string)
+  function tbl:a_method_name_that_is_also_longer_than_a_short_string()
+    return self.a_field_name_that_is_longer_than_a_short_string
+  end
+  t.assert.Eq(1, tbl:a_method_name_that_is_also_longer_than_a_short_string())
+end
+
 function constructTests.testSyntaxErrors()
   t.assert.SyntaxError("for x do", "malformed for statement")
   t.assert.SyntaxError("x:call", "expected")
@@ -0,0 +1,175 @@
+local t = require("internal.runtime.lib.test")
+local coroutineTests = {}
+
+function coroutineTests.testResumeYield()
+  local co = coroutine.create(function(a, b, ...)
+    t.assert.Eq(2, select("#", ...))
+    local x, y = coroutine.yield(a + b)
+    return x * y
+  end)
+  t.assert.Eq("suspended", coroutine.status(co))
+  local ok, sum = coroutine.resume(co, 1, 2, 3, 4)
+  t.assert.True(ok)
+  t.assert.Eq(3, sum)
+  local ok2, prod = coroutine.resume(co, 5, 6)
+  t.assert.True(ok2)
+  t.assert.Eq(30, prod)
+  t.assert.Eq("dead", coroutine.status(co))
+  local ok3, err = coroutine.resume(co)
+  t.assert.False(ok3)
+  t.assert.Eq("cannot resume dead coroutine", err)
+end
+
+function coroutineTests.testRunningAndStatus()
+  local main, ismain = coroutine.running()
+  t.assert.True(ismain)
+  t.assert.False(coroutine.isyieldable())
+  local co
+  co = coroutine.create(function()
+    local running, isMainThread = coroutine.running()
+    t.assert.Eq(co, running)
+    t.assert.False(isMainThread)
+    t.assert.True(coroutine.isyieldable())
+    t.assert.Eq("running", coroutine.status(co))
+    t.assert.Eq("normal", coroutine.status(main))
+    t.assert.False(coroutine.resume(co))
+  end)
+  t.assert.True(coroutine.resume(co))
+end
+
+function coroutineTests.testErrors()
+  local co = coroutine.create(function() error({ code = 1 }) end)
+  local ok, err = coroutine.resume(co)
+  t.assert.False(ok)
+  t.assert.Eq(1, err.code)
+  t.assert.Eq("dead", coroutine.status(co))
+  local closeOk, closeErr = coroutine.close(co)
+  t.assert.False(closeOk)
+  t.assert.Eq(1, closeErr.code)
+end
+
+function coroutineTests.testClose()
+  local closed = false
+  local co = coroutine.create(function()
+    local _ <close> = setmetatable({}, { __close = function() closed = true end })
+    coroutine.yield()
+  end)
+  coroutine.resume(co)
+  t.assert.False(closed)
+  t.assert.True(coroutine.close(co))
+  t.assert.True(closed)
+  t.assert.Eq("dead", coroutine.status(co))
+  t.assert.True(coroutine.close(coroutine.create(print)))
+  t.assert.Error(function() coroutine.close(coroutine.running()) end, "cannot close a running coroutine")
+end
+
+function coroutineTests.testWrap()
+  local gen = coroutine.wrap(function()
+    for i = 1, 3 do
+      coroutine.yield(i)
+    end
+  end)
+  t.assert.Eq(1, gen())
+  t.assert.Eq(2, gen())
+  t.assert.Eq(3, gen())
+  gen()
+  t.assert.Error(gen, "cannot resume dead coroutine")
+end
+
+function coroutineTests.testYieldAcrossPcall()
+  local co = coroutine.wrap(function()
+    local ok, v = pcall(function() return coroutine.yield(1) + 1 end)
+    local ok2, err = pcall(function()
+      coroutine.yield(2)
+      error("after", 0)
+    end)
+    return ok, v, ok2, err
+  end)
+  t.assert.Eq(1, co())
+  t.assert.Eq(2, co(10))
+  local ok, v, ok2, err = co()
+  t.assert.True(ok)
+  t.assert.Eq(11, v)
+  t.assert.False(ok2)
+  t.assert.Eq("after", err)
+
+  co = coroutine.wrap(function()
+    return xpcall(function()
+      coroutine.yield("x")
+      error("boom", 0)
+    end, function(msg) return "handled " .. msg end)
+  end)
+  t.assert.Eq("x", co())
+  local xok, msg = co()
+  t.assert.False(xok)
+  t.assert.Eq("handled boom", msg)
+end
+
+function coroutineTests.testYieldAcrossMetamethods()
+  local mt = {
+    __index = function(_, k) return coroutine.yield("index") .. k end,
+    __add = function() return coroutine.yield("add") end,
+    __lt = function() return coroutine.yield("lt") end,
+    __len = function() return coroutine.yield("len") end,
+    __concat = function() return coroutine.yield("concat") end,
+  }
+  local obj = setmetatable({}, mt)
+  local co = coroutine.wrap(function()
+    local idx = obj.key
+    local sum = obj + 1
+    local less = obj < obj
+    local len = #obj + 1
+    local cat = obj .. "b"
+    return idx, sum, less, len, cat
+  end)
+  t.assert.Eq("index", co())
+  t.assert.Eq("add", co("the "))
+  t.assert.Eq("lt", co(42))
+  t.assert.Eq("len", co(false))
+  t.assert.Eq("concat", co(5))
+  local idx, sum, less, len, cat = co("a")
+  t.assert.Eq("the key", idx)
+  t.assert.Eq(42, sum)
+  t.assert.False(less)
+  t.assert.Eq(6, len)
+  t.assert.Eq("a", cat)
+end
+
+function coroutineTests.testYieldAcrossIteratorsAndSort()
+  local co = coroutine.wrap(function()
+    local sum = 0
+    for i in function(_, c)
+      c = (c or 0) + 1
+      if c <= 3 then
+        coroutine.yield(c)
+        return c
+      end
+    end do
+      sum = sum + i
+    end
+    local list = { 5, 3, 1, 4, 2 }
+    table.sort(list, function(a, b)
+      coroutine.yield("cmp")
+      return a < b
+    end)
+    return sum, table.concat(list, ",")
+  end)
+  t.assert.Eq(1, co())
+  t.assert.Eq(2, co())
+  t.assert.Eq(3, co())
+  local sum, list = co()
+  while sum == "cmp" do
+    sum, list = co()
+  end
+  t.assert.Eq(6, sum)
+  t.assert.Eq("1,2,3,4,5", list)
+end
+
+function coroutineTests.testYieldAcrossCBoundary()
+  local co = coroutine.wrap(function()
+    return string.gsub("a", "a", function() coroutine.yield() end)
+  end)
+  t.assert.Error(co, "attempt to yield across a C")
+end
+
+return coroutineTests
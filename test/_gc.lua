@@ -0,0 +1,219 @@
+local t = require("internal.runtime.lib.test")
+local gcTests = {}
+
+local function count(tbl)
+  local n = 0
+  for _ in pairs(tbl) do
+    n = n + 1
+  end
+  return n
+end
+
+function gcTests.testWeakKeys()
+  local keep = {}
+  local weak = setmetatable({}, { __mode = "k" })
+  weak[keep] = 1
+  weak[{}] = 2
+  weak[function() end] = 3
+  weak.str = {}
+  collectgarbage()
+  t.assert.Eq(2, count(weak))
+  t.assert.Eq(1, weak[keep])
+  t.assert.NotNil(weak.str)
+end
+
+function gcTests.testWeakValues()
+  local keep = {}
+  local weak = setmetatable({}, { __mode = "v" })
+  weak[1] = {}
+  weak[2] = keep
+  weak.x = {}
+  weak.s = "strings are not collected"
+  collectgarbage()
+  t.assert.Eq(2, count(weak))
+  t.assert.Nil(weak[1])
+  t.assert.Eq(keep, weak[2])
+  t.assert.Nil(weak.x)
+  t.assert.Eq("strings are not collected", weak.s)
+end
+
+function gcTests.testWeakKeysAndValues()
+  local keep = {}
+  local weak = setmetatable({}, { __mode = "kv" })
+  weak[{}] = keep
+  weak[keep] = {}
+  weak[1] = keep
+  collectgarbage()
+  t.assert.Eq(1, count(weak))
+  t.assert.Eq(keep, weak[1])
+end
+
+function gcTests.testEphemerons()
+  local weak = setmetatable({}, { __mode = "k" })
+  local keep = {}
+  weak[keep] = { keep }
+  do
+    local key = {}
+    weak[key] = { key }
+    local fn = function() end
+    weak[fn] = fn
+  end
+  collectgarbage()
+  t.assert.Eq(1, count(weak))
+  t.assert.Eq(keep, weak[keep][1])
+  weak[keep] = nil
+  t.assert.Eq(0, count(weak))
+end
+
+function gcTests.testModeSetAfterValues()
+  local tbl = { {}, {} }
+  tbl.x = {}
+  local keep = { 1 }
+  tbl.y = keep
+  setmetatable(tbl, { __mode = "v" })
+  collectgarbage()
+  t.assert.Eq(1, count(tbl))
+  t.assert.Eq(keep, tbl.y)
+  setmetatable(tbl, nil)
+  tbl.z = {}
+  collectgarbage()
+  t.assert.Eq(2, count(tbl))
+end
+
+function gcTests.testFinalizerOrder()
+  local log = {}
+  local mt = {
+    __gc = function(o)
+      log[#log + 1] = o.name
+    end,
+  }
+  do
+    setmetatable({ name = "a" }, mt)
+    setmetatable({ name = "b" }, mt)
+    setmetatable({ name = "c" }, mt)
+  end
+  local keep = setmetatable({ name = "keep" }, mt)
+  collectgarbage()
+  t.assert.Eq("c,b,a", table.concat(log, ","))
+  t.assert.Eq("keep", keep.name)
+end
+
+function gcTests.testFinalizerResurrection()
+  local saved
+  local calls = 0
+  do
+    setmetatable({ name = "zombie" }, {
+      __gc = function(o)
+        calls = calls + 1
+        saved = o
+      end,
+    })
+  end
+  collectgarbage()
+  t.assert.Eq(1, calls)
+  t.assert.Eq("zombie", saved.name)
+  saved = nil
+  collectgarbage()
+  t.assert.Eq(1, calls)
+end
+
+function gcTests.testFinalizerCycles()
+  local log = {}
+  local mt = {
+    __gc = function(o)
+      log[#log + 1] = o.name
+    end,
+  }
+  do
+    local cycle = setmetatable({ name = "cycle" }, mt)
+    cycle.self = { cycle }
+    local held = setmetatable({ name = "held" }, mt)
+    local a, b = { held = held }, {}
+    a.b, b.a = b, a
+    local back = setmetatable({ name = "back" }, mt)
+    back.parent = setmetatable({ back }, { __mode = "v" })
+  end
+  collectgarbage()
+  -- a table in a cycle is only finalized when the vm is closed, one that is only
+  -- referenced by a cycle, or refers back to itself weakly, is finalized.
+  t.assert.Eq("back,held", table.concat(log, ","))
+end
+
+function gcTests.testFinalizerAddedLater()
+  local called = false
+  local mt = {}
+  do
+    setmetatable({}, mt)
+  end
+  mt.__gc = function()
+    called = true
+  end
+  collectgarbage()
+  t.assert.False(called)
+end
+
+function gcTests.testFinalizerError()
+  local after = false
+  do
+    setmetatable({}, {
+      __gc = function()
+        error("boom")
+      end,
+    })
+    setmetatable({}, {
+      __gc = function()
+        after = true
+      end,
+    })
+  end
+  t.assert.NoError(function()
+    collectgarbage()
+  end)
+  t.assert.True(after)
+end
+
+function gcTests.testCount()
+  collectgarbage()
+  local before = collectgarbage("count")
+  t.assert.IsNumber(before)
+  local holder = { big = {} }
+  for i = 1, 10000 do
+    holder.big[i] = { i }
+  end
+  t.assert.Greater(collectgarbage("count"), before + 100)
+  holder.big = nil
+  -- dropped values are only uncounted once a collection runs
+  collectgarbage()
+  t.assert.Less(collectgarbage("count"), before + 100)
+end
+
+function gcTests.testControls()
+  t.assert.True(collectgarbage("isrunning"))
+  t.assert.True(collectgarbage("step"))
+  collectgarbage("stop")
+  t.assert.False(collectgarbage("isrunning"))
+  collectgarbage("restart")
+  t.assert.True(collectgarbage("isrunning"))
+  t.assert.Eq("incremental", collectgarbage("generational"))
+  t.assert.Eq("generational", collectgarbage("incremental"))
+  t.assert.Error(function()
+    collectgarbage("nope")
+  end, "invalid option 'nope'")
+end
+
+function gcTests.testStoppedCollect()
+  local called = false
+  collectgarbage("stop")
+  do
+    setmetatable({}, {
+      __gc = function()
+        called = true
+      end,
+    })
+  end
+  collectgarbage()
+  collectgarbage("restart")
+  t.assert.True(called)
+end
+
+return gcTests
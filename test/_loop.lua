@@ -0,0 +1,101 @@
+local loop = require("loop")
+local t = require("internal.runtime.lib.test")
+local loopTests = {}
+
+function loopTests.testSleepInterleaves()
+  local log = {}
+  loop.run(function()
+    loop.spawn(function()
+      loop.sleep(0.02)
+      table.insert(log, "slow")
+    end)
+    loop.spawn(function()
+      loop.sleep(0.01)
+      table.insert(log, "fast")
+    end)
+    table.insert(log, "first")
+  end)
+  t.assert.Eq("first,fast,slow", table.concat(log, ","))
+end
+
+function loopTests.testYieldRequeues()
+  local log = {}
+  loop.spawn(function()
+    table.insert(log, "a1")
+    coroutine.yield()
+    table.insert(log, "a2")
+  end)
+  loop.spawn(function() table.insert(log, "b") end)
+  loop.run()
+  t.assert.Eq("a1,b,a2", table.concat(log, ","))
+end
+
+function loopTests.testTimers()
+  local ticks, fired = 0, nil
+  loop.run(function()
+    local every
+    every = loop.every(0.005, function(step)
+      ticks = ticks + step
+      if ticks == 3 then every:cancel() end
+    end, 1)
+    loop.after(0.001, function(val) fired = val end, "after")
+    local never = loop.after(10, function() fired = "never" end)
+    t.assert.Eq("timer", type(never))
+    t.assert.True(never:cancel())
+    t.assert.False(never:cancel())
+  end)
+  t.assert.Eq(3, ticks)
+  t.assert.Eq("after", fired)
+  t.assert.Error(function() loop.every(0, print) end, "interval must be positive")
+end
+
+function loopTests.testTime()
+  local start = loop.time()
+  loop.sleep(0.01)
+  t.assert.True(loop.time() - start >= 0.01)
+end
+
+function loopTests.testErrors()
+  local ok, err = pcall(loop.run, function() error("failed", 0) end)
+  t.assert.False(ok)
+  t.assert.Eq("failed", err)
+  t.assert.Error(function() loop.run(function() loop.run() end) end, "loop is already running")
+end
+
+function loopTests.testFiles()
+  local file = io.tmpfile()
+  local line
+  loop.run(function()
+    loop.write(file, "hello ", 42, "\n")
+    file:seek("set", 0)
+    line = loop.read(file)
+  end)
+  t.assert.Eq("hello 42", line)
+  loop.run(function() line = loop.read(file) end)
+  t.assert.Nil(line)
+  file:close()
+
+  local pipe = io.popen("echo piped")
+  loop.run(function() line = loop.read(pipe) end)
+  t.assert.Eq("piped", line)
+end
+
+function loopTests.testSockets()
+  local listener <close> = loop.listen("127.0.0.1:0")
+  t.assert.Eq("listener", type(listener))
+  local reply
+  loop.run(function()
+    loop.spawn(function()
+      local conn = listener:accept()
+      loop.write(conn, "echo ", loop.read(conn), "\n")
+      conn:close()
+    end)
+    local conn = loop.connect(listener:addr())
+    loop.write(conn, "ping\n")
+    reply = loop.read(conn)
+    conn:close()
+  end)
+  t.assert.Eq("echo ping", reply)
+end
+
+return loopTests
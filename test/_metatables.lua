@@ -34,6 +34,27 @@ function metaTableTests.testMetaMethods()
   t.assert.True(didCall, "didCall")
 end
 
+function metaTableTests.testArithOperandOrder()
+  local mt = {
+    __sub = function(lval, rval) return { lval, rval } end,
+    __shl = function(lval, rval) return { lval, rval } end,
+    __lt = function(lval, rval) return lval == 1 and rval ~= 1 end,
+  }
+  local obj = setmetatable({}, mt)
+  local res = 1 - obj
+  t.assert.Eq(res[1], 1)
+  t.assert.Eq(res[2], obj)
+  res = obj - 1.5
+  t.assert.Eq(res[1], obj)
+  t.assert.Eq(res[2], 1.5)
+  res = 2 << obj
+  t.assert.Eq(res[1], 2)
+  t.assert.Eq(res[2], obj)
+  t.assert.True(1 < obj)
+  t.assert.Eq(1 - "7", -6)
+  t.assert.Eq("7" - 1, 6)
+end
+
 function metaTableTests.testFormatToString()
   local m = setmetatable({}, {
     __tostring = function() return "hello" end,
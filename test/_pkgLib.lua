@@ -14,6 +14,22 @@ function packageTests.testPackageAttributes()
   t.assert.Eq(type(package.path), "string")
   t.assert.Eq(type(package.loaded), "table")
   t.assert.Eq(type(package.config), "string")
+  t.assert.Eq(type(package.preload), "table")
+end
+
+function packageTests.testPreload()
+  local calls = {}
+  package.preload["test.preloaded"] = function(name, extra)
+    table.insert(calls, { name, extra })
+    return { loaded = true }
+  end
+  local mod = require("test.preloaded")
+  t.assert.True(mod.loaded)
+  t.assert.Eq(require("test.preloaded"), mod)
+  t.assert.Eq(#calls, 1)
+  t.assert.Eq(calls[1][1], "test.preloaded")
+  t.assert.Eq(calls[1][2], ":preload:")
+  package.preload["test.preloaded"] = nil
 end
 
 function packageTests.testChangePackagePath()
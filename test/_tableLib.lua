@@ -122,7 +122,8 @@ function tblTests.testTablePack()
 
   a = table.pack(nil, nil, nil, nil)
   t.assert.Nil(a[1])
-  t.assert.Len(a, 4)
+  t.assert.Eq(4, a.n)
+  t.assert.Len(a, 0)
 end
 
 function tblTests.testTableLen()
@@ -193,4 +194,34 @@ function tblTests.testTableUnpackExt()
   t.assert.Nil(next(d))
 end
 
+function tblTests.testTableFreeze()
+  local tbl = table.freeze({ 1, 2, name = "report", rows = { { id = 1 } } })
+  t.assert.True(table.isfrozen(tbl))
+  t.assert.True(table.isfrozen(tbl.rows[1]))
+  t.assert.Eq("report", tbl.name)
+  t.assert.Error(function() tbl.name = "other" end, "attempt to modify a frozen table")
+  t.assert.Error(function() tbl.rows[1].id = 2 end, "attempt to modify a frozen table")
+  t.assert.Error(function() rawset(tbl, 3, 3) end, "attempt to modify a frozen table")
+  t.assert.Error(function() table.insert(tbl, 3) end, "attempt to modify a frozen table")
+  t.assert.Error(function() table.remove(tbl) end, "attempt to modify a frozen table")
+  t.assert.Error(function() table.sort(tbl) end, "attempt to modify a frozen table")
+  t.assert.Error(function() setmetatable(tbl, {}) end, "attempt to modify a frozen table")
+  t.assert.Eq(table.move(tbl, 1, 2, 1, {})[2], 2)
+
+  local inner = {}
+  local withFn = { inner = inner, fn = function() end }
+  t.assert.Error(function() table.freeze(withFn) end, "cannot freeze a table holding a lua function")
+  t.assert.False(table.isfrozen(withFn))
+  t.assert.False(table.isfrozen(inner))
+  t.assert.Error(function() table.freeze(setmetatable({}, { __mode = "k" })) end, "cannot freeze a weak table")
+
+  -- builtin go functions are shared but ones made at runtime can hold lua values
+  t.assert.True(table.isfrozen(table.freeze({ upper = string.upper, max = math.max, len = string.len })))
+  local wrapped = { fn = coroutine.wrap(function() end) }
+  t.assert.Error(function() table.freeze(wrapped) end, "go function that is not builtin")
+  local async = { fn = coroutine["async"](function() end) }
+  t.assert.Error(function() table.freeze(async) end, "go function that is not builtin")
+  t.assert.Error(function() table.freeze({ string.gmatch("a", "a") }) end, "go function that is not builtin")
+end
+
 return tblTests
@@ -0,0 +1,158 @@
+local chan = require("chan")
+local t = require("internal.runtime.lib.test")
+local task = require("task")
+local taskTests = {}
+
+function taskTests.testSpawnAndWait()
+  local worker = task.spawn(function(a, b) return a + b, "done" end, 40, 2)
+  t.assert.Eq("task", type(worker))
+  local sum, msg = task.wait(worker)
+  t.assert.Eq(42, sum)
+  t.assert.Eq("done", msg)
+  t.assert.Eq(42, worker:wait())
+end
+
+function taskTests.testValuesAreCopied()
+  local shared = { n = 1, list = { 1, 2, 3 } }
+  local res = task.wait(task.spawn(function(tbl)
+    tbl.n = 2
+    table.insert(tbl.list, 4)
+    return tbl
+  end, shared))
+  t.assert.Eq(1, shared.n)
+  t.assert.Eq(3, #shared.list)
+  t.assert.Eq(2, res.n)
+  t.assert.Eq(4, #res.list)
+  t.assert.NotEq(shared, res)
+end
+
+function taskTests.testCyclesAndClosures()
+  local count = 0
+  local function inc()
+    count = count + 1
+    return count
+  end
+  local tbl = { fn = inc }
+  tbl.self = tbl
+  local res, n = task.wait(task.spawn(function(obj)
+    obj.fn()
+    return obj, obj.fn()
+  end, tbl))
+  t.assert.Eq(res, res.self)
+  t.assert.Eq(2, n)
+  t.assert.Eq(0, count)
+end
+
+function taskTests.testGlobalsAreIsolated()
+  ISOLATED = 1
+  local global, lib, method = task.wait(task.spawn(function()
+    ISOLATED = 2
+    string.isolated = true
+    function string.shout(s) return s:upper() .. "!" end
+    return ISOLATED, string.isolated, ("hi"):shout()
+  end))
+  t.assert.Eq(2, global)
+  t.assert.True(lib)
+  t.assert.Eq("HI!", method)
+  t.assert.Eq(1, ISOLATED)
+  t.assert.Nil(string.isolated)
+  t.assert.Nil(("hi").shout)
+  ISOLATED = nil
+end
+
+function taskTests.testErrors()
+  local ok, err = pcall(task.wait, task.spawn(function() error("failed", 0) end))
+  t.assert.False(ok)
+  t.assert.Eq("failed", err)
+  ok, err = pcall(task.wait, task.spawn(function() error({ code = 7 }) end))
+  t.assert.False(ok)
+  t.assert.Eq(7, err.code)
+  local co = coroutine.create(print)
+  t.assert.Error(function() task.spawn(print, co) end, "cannot copy a thread to another vm")
+  local wrapped = coroutine.wrap(function() end)
+  t.assert.Error(function() task.spawn(wrapped) end, "cannot copy a go function that is not builtin")
+  local ch = chan.new(1)
+  t.assert.Error(function() ch:send(string.gmatch("a", "a")) end, "cannot copy a go function that is not builtin")
+  ch:send(string.upper)
+  t.assert.Eq(string.upper, ch:recv())
+end
+
+function taskTests.testChannels()
+  local ch = chan.new(2)
+  t.assert.Eq("channel", type(ch))
+  ch:send("a")
+  ch:send({ "b" })
+  t.assert.Eq("a", ch:recv())
+  t.assert.Eq("b", ch:recv()[1])
+  ch:send(1)
+  ch:close()
+  ch:close()
+  local val, ok = ch:recv()
+  t.assert.Eq(1, val)
+  t.assert.True(ok)
+  val, ok = ch:recv()
+  t.assert.Nil(val)
+  t.assert.False(ok)
+  t.assert.Error(function() ch:send(2) end, "send on closed channel")
+end
+
+function taskTests.testFanOut()
+  local jobs, results = chan.new(4), chan.new()
+  local workers = {}
+  for i = 1, 4 do
+    workers[i] = task.spawn(function(input, output)
+      local done = 0
+      for job in
+        function() return (input:recv()) end
+      do
+        output:send(job * job)
+        done = done + 1
+      end
+      return done
+    end, jobs, results)
+  end
+  task.spawn(function(input)
+    for i = 1, 20 do
+      input:send(i)
+    end
+    input:close()
+  end, jobs)
+  local sum = 0
+  for _ = 1, 20 do
+    sum = sum + results:recv()
+  end
+  local done = 0
+  for _, worker in ipairs(workers) do
+    done = done + task.wait(worker)
+  end
+  t.assert.Eq(2870, sum)
+  t.assert.Eq(20, done)
+end
+
+function taskTests.testSelect()
+  local a, b = chan.new(1), chan.new(1)
+  t.assert.Eq(3, chan.select({ recv = a }, { recv = b }, { default = true }))
+  t.assert.Eq(1, chan.select({ send = b, value = "x" }))
+  local idx, val, ok = chan.select({ recv = a }, { recv = b })
+  t.assert.Eq(2, idx)
+  t.assert.Eq("x", val)
+  t.assert.True(ok)
+  a:close()
+  idx, val, ok = chan.select({ recv = a })
+  t.assert.Eq(1, idx)
+  t.assert.Nil(val)
+  t.assert.False(ok)
+  t.assert.Error(function() chan.select({ send = a, value = 1 }) end, "send on closed channel")
+  t.assert.Error(function() chan.select({}) end, "case must have a recv, send or default field")
+  t.assert.Error(function() chan.select() end, "at least one case expected")
+  t.assert.Error(function() chan.select({ default = true }, { default = true }) end, "multiple default cases")
+end
+
+function taskTests.testSharedMetatablesAreFrozen()
+  local worker = task.spawn(function() return 1 end)
+  t.assert.Error(function() getmetatable(worker).__index.wait = nil end, "attempt to modify a frozen table")
+  t.assert.Error(function() getmetatable(chan.new()).__name = "mine" end, "attempt to modify a frozen table")
+  t.assert.Eq(1, worker:wait())
+end
+
+return taskTests
@@ -0,0 +1,47 @@
+local loop = require("loop")
+local t = require("internal.runtime.lib.test")
+local worker = require("worker")
+local workerTests = {}
+
+function workerTests.testPostAndOnMessage()
+  local w = worker.new("test/misc/worker.lua", "summer")
+  t.assert.Eq("worker", type(w))
+  local totals = {}
+  w:on_message(function(msg) totals[msg.id] = msg.total end)
+  for id = 1, 4 do
+    w:post({ id = id, values = { id, id * 2, id * 3 } })
+  end
+  w:close()
+  loop.run()
+  t.assert.Eq({ 6, 12, 18, 24 }, totals)
+  t.assert.Eq("summer done", w:wait())
+  t.assert.Error(function() w:post({}) end, "worker is closed")
+end
+
+function workerTests.testMessagesAreCopied()
+  local values = { 1, 2, 3 }
+  local frozen = table.freeze({ 4, 5, 6 })
+  local replies = {}
+  local w <close> = worker.new("test/misc/worker.lua", "copier")
+  w:on_message(function(msg) replies[msg.id] = msg.values end)
+  w:post({ id = 1, values = values })
+  w:post({ id = 2, values = frozen })
+  w:close()
+  loop.run()
+  t.assert.Eq(values, replies[1])
+  t.assert.False(values == replies[1])
+  t.assert.True(frozen == replies[2])
+end
+
+function workerTests.testErrors()
+  local w = worker.new("test/misc/worker.lua", "failer")
+  w:on_message(function() end)
+  w:post({ fail = "report failed" })
+  loop.run()
+  t.assert.Error(function() w:wait() end, "report failed")
+  t.assert.Error(function() worker.post("msg") end, "not running in a worker")
+  t.assert.Error(function() worker.new("test/misc/missing.lua") end, "no such file")
+  t.assert.Error(function() worker.new("test/misc/worker.lua", print, io.stdout) end, "cannot copy a file")
+end
+
+return workerTests
@@ -0,0 +1,94 @@
+local loop = require("loop")
+local t = require("test")
+local asyncTests = {}
+
+function asyncTests.testAsyncFunctionReturnsFuture()
+  async function add(a, b) return a + b end
+  local future = add(40, 2)
+  t.assert.Eq("future", type(future))
+  t.assert.Eq("resolved", future:status())
+  t.assert.Eq(42, await future)
+  add = nil
+end
+
+function asyncTests.testAwaitWaitsForTheLoop()
+  local async function slow(val)
+    loop.sleep(0.01)
+    return val, "done"
+  end
+  local future = slow(1)
+  t.assert.Eq("pending", future:status())
+  local val, msg = await future
+  t.assert.Eq(1, val)
+  t.assert.Eq("done", msg)
+  t.assert.Eq("resolved", future:status())
+end
+
+function asyncTests.testAsyncFunctionsInterleave()
+  local log = {}
+  local async function step(name, delay)
+    loop.sleep(delay)
+    table.insert(log, name)
+    return name
+  end
+  loop.run(function()
+    local slow, fast = step("slow", 0.02), step("fast", 0.01)
+    table.insert(log, "started")
+    t.assert.Eq("slow", await slow)
+    t.assert.Eq("fast", await fast)
+  end)
+  t.assert.Eq(log, { "started", "fast", "slow" })
+end
+
+function asyncTests.testAwaitChains()
+  local async function double(x) return x * 2 end
+  local async function quad(x) return await double(await double(x)) end
+  t.assert.Eq(12, await quad(3))
+  t.assert.Eq(13, await quad(3) + 1)
+end
+
+function asyncTests.testAwaitPlainValues()
+  t.assert.Eq(7, await 7)
+  t.assert.Nil(await nil)
+end
+
+function asyncTests.testAsyncErrors()
+  local async function fail() error({ code = 7 }) end
+  local future = fail()
+  t.assert.Eq("rejected", future:status())
+  local ok, err = pcall(function() return await future end)
+  t.assert.False(ok)
+  t.assert.Eq(7, err.code)
+end
+
+function asyncTests.testAsyncMethodsAndExpressions()
+  local obj = { n = 2 }
+  async function obj:scale(...)
+    local sum = 0
+    for _, v in ipairs({ ... }) do
+      sum = sum + v
+    end
+    return sum * self.n
+  end
+  t.assert.Eq(12, await obj:scale(1, 2, 3))
+  local anon = async function(x) return -x end
+  t.assert.Eq(-1, await anon(1))
+end
+
+function asyncTests.testAwaitIgnoresLocalCoroutine()
+  local coroutine = {}
+  local async function one() return 1 end
+  t.assert.Eq(1, await one())
+  t.assert.Eq(0, #coroutine)
+end
+
+function asyncTests.testAsyncAndAwaitAreStillNames()
+  local obj = { async = 1, await = 2 }
+  t.assert.Eq(3, obj.async + obj.await)
+  local async, await = coroutine.async, coroutine.await
+  local future = async(function() return 4 end)()
+  t.assert.Eq(4, await(future))
+  t.assert.Eq(4, await future)
+end
+
+return asyncTests
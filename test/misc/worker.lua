@@ -0,0 +1,15 @@
+-- worker.lua is started by the worker tests. It sums the values it is posted
+-- and posts the totals back.
+local worker = require("worker")
+local name = ...
+
+worker.on_message(function(msg)
+  if msg.fail then error(msg.fail, 0) end
+  local total = 0
+  for _, val in ipairs(msg.values) do
+    total = total + val
+  end
+  worker.post({ id = msg.id, total = total, values = msg.values })
+end)
+
+return name .. " done"